@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/vrok/have/have"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A language server, speaking the Language Server Protocol over stdin and
+// stdout. Open documents are kept in memory, and every request loads their
+// package from scratch.
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	fpl *FilesystemPkgLocator
+	// Contents of open documents, by Have file names (see have.File).
+	docs map[string]string
+	// Files that diagnostics were published for the last time.
+	published map[string]bool
+	shutdown  bool
+}
+
+func newLspServer(in io.Reader, out io.Writer, fpl *FilesystemPkgLocator) *lspServer {
+	return &lspServer{
+		in:        bufio.NewReader(in),
+		out:       out,
+		fpl:       fpl,
+		docs:      map[string]string{},
+		published: map[string]bool{},
+	}
+}
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   lspError         `json:"error"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+const (
+	lspMethodNotFound = -32601
+	lspInternalError  = -32603
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	Position       lspPosition `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+// Serves requests until the client sends `exit`. Returns the exit code.
+func (s *lspServer) serve() int {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+		s.handle(msg)
+	}
+}
+
+func (s *lspServer) read() (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[len("Content-Length:"):]))
+			if err != nil {
+				return nil, fmt.Errorf("Wrong header: %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("Content-Length header missing")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	msg := &lspMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, fmt.Errorf("Wrong message: %s", err)
+	}
+	return msg, nil
+}
+
+func (s *lspServer) write(msg interface{}) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) respond(id *json.RawMessage, result interface{}) {
+	s.write(&lspResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *lspServer) respondError(id *json.RawMessage, code int, message string) {
+	s.write(&lspErrorResponse{JSONRPC: "2.0", ID: id, Error: lspError{Code: code, Message: message}})
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	s.write(&lspNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *lspServer) handle(msg *lspMessage) {
+	// Bugs in the compiler shouldn't take the whole server down.
+	defer func() {
+		if r := recover(); r != nil && msg.ID != nil {
+			s.respondError(msg.ID, lspInternalError, fmt.Sprintf("Internal error: %v", r))
+		}
+	}()
+
+	params := &lspDocumentParams{}
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params, params)
+	}
+	name := s.fileName(params.TextDocument.URI)
+
+	switch msg.Method {
+	case "initialize":
+		s.respond(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    1, // Full contents are sent on every change
+					"save":      true,
+				},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+			},
+			"serverInfo": map[string]string{"name": "have"},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.respond(msg.ID, nil)
+	case "textDocument/didOpen":
+		if name != "" {
+			s.docs[name] = params.TextDocument.Text
+			s.publishDiagnostics(name)
+		}
+	case "textDocument/didChange":
+		if name != "" && len(params.ContentChanges) > 0 {
+			s.docs[name] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		}
+	case "textDocument/didSave":
+		if name != "" {
+			s.publishDiagnostics(name)
+		}
+	case "textDocument/didClose":
+		delete(s.docs, name)
+	case "textDocument/hover":
+		s.respond(msg.ID, s.hover(name, params.Position))
+	case "textDocument/definition":
+		s.respond(msg.ID, s.definition(name, params.Position))
+	case "textDocument/completion":
+		s.respond(msg.ID, s.completion(name, params.Position))
+	default:
+		// Notifications that aren't supported are ignored.
+		if msg.ID != nil {
+			s.respondError(msg.ID, lspMethodNotFound, "Method not supported: "+msg.Method)
+		}
+	}
+}
+
+// Converts a document URI to the name of a Have file. Returns an empty string
+// for documents that aren't Have files that the server's locator can find.
+func (s *lspServer) fileName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" || !strings.HasSuffix(u.Path, ".hav") {
+		return ""
+	}
+	name, ok := s.fpl.fileName(filepath.FromSlash(u.Path))
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+func (s *lspServer) fileURI(name string) string {
+	fpath := s.fpl.sourcePath(name)
+	if abs, err := filepath.Abs(fpath); err == nil {
+		fpath = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(fpath)}
+	return u.String()
+}
+
+// Loads the package of a file (with its tests), using contents of open documents
+// instead of the files on disk. The code argument, if not empty, is used for the file.
+func (s *lspServer) load(name, code string) (*have.PkgManager, []error) {
+	docs := s.docs
+	if code != "" {
+		docs = map[string]string{name: code}
+		for n, c := range s.docs {
+			if n != name {
+				docs[n] = c
+			}
+		}
+	}
+
+	locator := &docsLocator{fpl: s.fpl, docs: docs}
+	manager := have.NewPkgManager(locator)
+	manager.GoVersion = goVersion("", s.fpl)
+	_, errs := manager.LoadWithTests(path.Dir(name))
+	return manager, errs
+}
+
+func (s *lspServer) publishDiagnostics(name string) {
+	manager, errs := s.load(name, "")
+
+	diags := map[string][]*lspDiagnostic{}
+	if files, err := (&docsLocator{fpl: s.fpl, docs: s.docs}).Locate(path.Dir(name)); err == nil {
+		for _, f := range files {
+			diags[f.Name] = []*lspDiagnostic{}
+		}
+	}
+	for _, err := range errs {
+		d := have.NewDiagnostic(manager.Fset, err)
+		file := d.File
+		if file == "" || file == have.BuiltinsFileName {
+			file, d.Line, d.Column, d.EndLine, d.EndColumn = name, 1, 1, 1, 1
+		}
+		start, end := lspPosition{d.Line - 1, d.Column - 1}, lspPosition{d.EndLine - 1, d.EndColumn - 1}
+		if d.EndLine == 0 {
+			// End of the code isn't known.
+			end = start
+		}
+		diags[file] = append(diags[file], &lspDiagnostic{
+			Range:    lspRange{Start: start, End: end},
+			Severity: 1, // Error
+			Code:     d.Code,
+			Source:   "have",
+			Message:  d.Message,
+		})
+	}
+
+	// Diagnostics published before, and not reported any more have to be cleared.
+	for file := range s.published {
+		if _, ok := diags[file]; !ok {
+			diags[file] = []*lspDiagnostic{}
+		}
+	}
+	s.published = map[string]bool{}
+	for file, list := range diags {
+		if len(list) > 0 {
+			s.published[file] = true
+		}
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         s.fileURI(file),
+			"diagnostics": list,
+		})
+	}
+}
+
+// Returns the identifier at a position of a document, together with
+// the package manager it was loaded with.
+func (s *lspServer) identAt(name string, pos lspPosition) (*have.IdentInfo, *have.PkgManager) {
+	if name == "" {
+		return nil, nil
+	}
+	manager, _ := s.load(name, "")
+	f := manager.File(name)
+	if f == nil {
+		return nil, nil
+	}
+	return f.IdentAt(f.Pos(pos.Line+1, pos.Character+1)), manager
+}
+
+func (s *lspServer) hover(name string, pos lspPosition) interface{} {
+	info, _ := s.identAt(name, pos)
+	if info == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "plaintext", "value": info.String()},
+	}
+}
+
+func (s *lspServer) definition(name string, pos lspPosition) interface{} {
+	info, manager := s.identAt(name, pos)
+	if info == nil || !info.DeclPos.IsValid() {
+		return nil
+	}
+	decl := manager.Fset.Position(info.DeclPos)
+	if decl.Filename == have.BuiltinsFileName {
+		return nil
+	}
+	start := lspPosition{decl.Line - 1, decl.Column - 1}
+	return &lspLocation{URI: s.fileURI(decl.Filename), Range: lspRange{start, start}}
+}
+
+// Completes names of members after a dot. The code written after the dot is
+// cut, so that the rest can be parsed.
+func (s *lspServer) completion(name string, pos lspPosition) []*lspCompletionItem {
+	items := []*lspCompletionItem{}
+	code, ok := s.docs[name]
+	if !ok {
+		return items
+	}
+
+	lines := strings.Split(code, "\n")
+	if pos.Line >= len(lines) {
+		return items
+	}
+	line := []rune(lines[pos.Line])
+	if pos.Character > len(line) {
+		pos.Character = len(line)
+	}
+	dot := pos.Character
+	for dot > 0 && (unicode.IsLetter(line[dot-1]) || unicode.IsDigit(line[dot-1]) || line[dot-1] == '_') {
+		dot--
+	}
+	if dot == 0 || line[dot-1] != '.' {
+		return items
+	}
+	prefix := string(line[dot:pos.Character])
+	dot--
+
+	lines[pos.Line] = string(line[:dot]) + string(line[pos.Character:])
+	manager, _ := s.load(name, strings.Join(lines, "\n"))
+	f := manager.File(name)
+	if f == nil {
+		return items
+	}
+
+	for _, member := range f.MembersOf(f.Pos(pos.Line+1, dot+1)) {
+		if !strings.HasPrefix(member.Name, prefix) {
+			continue
+		}
+		items = append(items, &lspCompletionItem{
+			Label:  member.Name,
+			Kind:   lspCompletionKind(member),
+			Detail: member.String(),
+		})
+	}
+	return items
+}
+
+// Kinds of completion items, as defined by the protocol.
+func lspCompletionKind(info *have.IdentInfo) int {
+	const (
+		method   = 2
+		function = 3
+		field    = 5
+		variable = 6
+		module   = 9
+		constant = 21
+		typ      = 22
+	)
+
+	switch info.Object.(type) {
+	case nil:
+		if info.IsMethod() {
+			return method
+		}
+		return field
+	case *have.Variable:
+		if strings.HasPrefix(info.String(), "func ") {
+			return function
+		}
+		return variable
+	case *have.Constant:
+		return constant
+	case *have.TypeDecl, *have.GenericStruct:
+		return typ
+	case *have.ImportStmt:
+		return module
+	}
+	return function
+}
+
+// Implements PkgLocator, returns contents of documents open in the editor
+// instead of files saved on disk.
+type docsLocator struct {
+	fpl  *FilesystemPkgLocator
+	docs map[string]string
+}
+
+func (dl *docsLocator) Locate(relativePath string) ([]*have.File, error) {
+	files, err := dl.fpl.Locate(relativePath)
+
+	found := map[string]bool{}
+	for i, f := range files {
+		if code, ok := dl.docs[f.Name]; ok {
+			files[i] = have.NewFile(f.Name, code)
+		}
+		found[f.Name] = true
+	}
+	// Documents that haven't been saved yet.
+	for name, code := range dl.docs {
+		if path.Dir(name) == relativePath && !found[name] {
+			files = append(files, have.NewFile(name, code))
+			err = nil
+		}
+	}
+	return files, err
+}
+
+func lsp(args []string) {
+	_, fpl := paths()
+	os.Exit(newLspServer(os.Stdin, os.Stdout, fpl).serve())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func lspRequest(buf *bytes.Buffer, id int, method string, params interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id > 0 {
+		msg["id"] = id
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+type lspTestMessage struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *lspError       `json:"error"`
+}
+
+func lspReadAll(t *testing.T, out io.Reader) []*lspTestMessage {
+	var result []*lspTestMessage
+	r := bufio.NewReader(out)
+	for {
+		header, err := r.ReadString('\n')
+		if err == io.EOF {
+			return result
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "Content-Length:")))
+		if err != nil {
+			t.Fatalf("Wrong header: %q", header)
+		}
+		r.ReadString('\n')
+		body := make([]byte, length)
+		io.ReadFull(r, body)
+
+		msg := &lspTestMessage{}
+		if err := json.Unmarshal(body, msg); err != nil {
+			t.Fatalf("Wrong message: %s", body)
+		}
+		result = append(result, msg)
+	}
+}
+
+func TestLsp(t *testing.T) {
+	srcpath, _ := filepath.Abs(path.Join("test_data", "lsp", "input"))
+	uri := "file://" + filepath.ToSlash(filepath.Join(srcpath, "shapes", "shapes.hav"))
+	code, err := ioutil.ReadFile(filepath.Join(srcpath, "shapes", "shapes.hav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := strings.Replace(string(code), "return r\n", "return r.Depth\n", 1)
+	completed := strings.Replace(string(code), "return r\n", "return r.\n", 1)
+	doc := map[string]interface{}{"uri": uri}
+	at := func(line, character int) map[string]interface{} {
+		return map[string]interface{}{"textDocument": doc, "position": map[string]int{"line": line, "character": character}}
+	}
+
+	in := &bytes.Buffer{}
+	lspRequest(in, 1, "initialize", map[string]interface{}{})
+	lspRequest(in, 0, "initialized", map[string]interface{}{})
+	lspRequest(in, 0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "have", "version": 1, "text": broken},
+	})
+	lspRequest(in, 0, "textDocument/didChange", map[string]interface{}{
+		"textDocument": doc, "contentChanges": []map[string]string{{"text": string(code)}},
+	})
+	lspRequest(in, 0, "textDocument/didSave", map[string]interface{}{"textDocument": doc})
+	lspRequest(in, 2, "textDocument/hover", at(11, 8))
+	lspRequest(in, 3, "textDocument/definition", at(11, 8))
+	lspRequest(in, 4, "textDocument/hover", at(7, 15))
+	lspRequest(in, 0, "textDocument/didChange", map[string]interface{}{
+		"textDocument": doc, "contentChanges": []map[string]string{{"text": completed}},
+	})
+	lspRequest(in, 6, "textDocument/completion", at(11, 10))
+	lspRequest(in, 7, "textDocument/unknown", map[string]interface{}{})
+	lspRequest(in, 8, "shutdown", nil)
+	lspRequest(in, 0, "exit", nil)
+
+	out := &bytes.Buffer{}
+	if code := newLspServer(in, out, NewFilesystemPkgLocator(srcpath)).serve(); code != 0 {
+		t.Errorf("Wrong exit code: %d", code)
+	}
+
+	results := map[int]string{}
+	var diagnostics []string
+	for _, msg := range lspReadAll(t, out) {
+		switch {
+		case msg.Method == "textDocument/publishDiagnostics":
+			diagnostics = append(diagnostics, string(msg.Params))
+		case msg.Error != nil:
+			results[msg.ID] = fmt.Sprintf("error %d", msg.Error.Code)
+		default:
+			results[msg.ID] = string(msg.Result)
+		}
+	}
+
+	if !strings.Contains(results[1], `"hoverProvider":true`) {
+		t.Errorf("Wrong capabilities: %s", results[1])
+	}
+	wantDiags := []string{
+		`{"diagnostics":[{"range":{"start":{"line":11,"character":10},"end":{"line":11,"character":15}},"severity":1,` +
+			`"code":"no-member","source":"have","message":"No such member: Depth"}],"uri":"` + uri + `"}`,
+		`{"diagnostics":[],"uri":"` + uri + `"}`,
+	}
+	if strings.Join(diagnostics, "\n") != strings.Join(wantDiags, "\n") {
+		t.Errorf("Wrong diagnostics, got:\n%s\nwant:\n%s", strings.Join(diagnostics, "\n"), strings.Join(wantDiags, "\n"))
+	}
+
+	want := map[int]string{
+		2: `{"contents":{"kind":"plaintext","value":"var r Rect"}}`,
+		3: `{"range":{"start":{"line":10,"character":5},"end":{"line":10,"character":5}},"uri":"` + uri + `"}`,
+		4: `{"contents":{"kind":"plaintext","value":"field Width int"}}`,
+		6: `[{"detail":"func Area() int","kind":2,"label":"Area"},` +
+			`{"detail":"field Height int","kind":5,"label":"Height"},` +
+			`{"detail":"field Width int","kind":5,"label":"Width"}]`,
+		7: "error -32601",
+		8: "null",
+	}
+	for id, res := range want {
+		if got := normalizeJSON(results[id]); got != normalizeJSON(res) {
+			t.Errorf("Wrong result #%d, got:\n%s\nwant:\n%s", id, results[id], res)
+		}
+	}
+}
+
+// Sorts keys of JSON objects, so that results can be compared as strings.
+func normalizeJSON(s string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
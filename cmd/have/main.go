@@ -1,28 +1,94 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/vrok/have/have"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
-	"syscall"
 )
 
-// Implements PkgLocator
+// Implements PkgLocator. Packages are looked for in srcpath (e.g. $GOPATH/src),
+// or in a Go module if it's set.
 type FilesystemPkgLocator struct {
-	gopath string
+	srcpath string
+	module  *goModule
+}
+
+func NewFilesystemPkgLocator(srcpath string) *FilesystemPkgLocator {
+	return &FilesystemPkgLocator{srcpath: srcpath}
+}
+
+// Creates a locator of packages in a Go module, import paths are resolved
+// relative to the module path.
+func newModulePkgLocator(module *goModule) *FilesystemPkgLocator {
+	return &FilesystemPkgLocator{module: module}
+}
+
+// Directory of a package, false if the package can't be found by the locator
+// (in modules, only packages of the module itself can).
+func (gpl *FilesystemPkgLocator) pkgDir(relativePath string) (string, bool) {
+	if gpl.module != nil {
+		return gpl.module.pkgDir(relativePath)
+	}
+	return path.Join(gpl.srcpath, relativePath), true
+}
+
+// Path of a file, given its name like in have.File (its package's path and its base name).
+func (gpl *FilesystemPkgLocator) sourcePath(name string) string {
+	dir, ok := gpl.pkgDir(path.Dir(name))
+	if !ok {
+		return name
+	}
+	return filepath.Join(dir, path.Base(name))
+}
+
+// Path of a file relative to the working directory, like users refer to it.
+func (gpl *FilesystemPkgLocator) workingPath(name string) string {
+	src, err := filepath.Abs(gpl.sourcePath(name))
+	if err != nil {
+		return name
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return src
+	}
+	if rel, err := filepath.Rel(wd, src); err == nil {
+		return rel
+	}
+	return src
 }
 
-func NewFilesystemPkgLocator(gopath string) *FilesystemPkgLocator {
-	return &FilesystemPkgLocator{gopath: gopath}
+// Reverse of sourcePath, returns false for files the locator can't find.
+func (gpl *FilesystemPkgLocator) fileName(fpath string) (string, bool) {
+	root, prefix := gpl.srcpath, ""
+	if gpl.module != nil {
+		root, prefix = gpl.module.dir, gpl.module.path
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return path.Join(prefix, filepath.ToSlash(rel)), true
 }
 
 func (gpl *FilesystemPkgLocator) Locate(relativePath string) ([]*have.File, error) {
-	var fullPkgPath = path.Join(gpl.gopath, relativePath)
+	var fullPkgPath, ok = gpl.pkgDir(relativePath)
+	if !ok {
+		// Not a Have package, maybe a Go one.
+		return nil, nil
+	}
 	var flist, err = ioutil.ReadDir(fullPkgPath)
 	if err != nil {
 		return nil, err
@@ -47,22 +113,126 @@ func (gpl *FilesystemPkgLocator) Locate(relativePath string) ([]*have.File, erro
 	return files, nil
 }
 
-func paths() (gopath, srcpath string) {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		fmt.Fprintf(os.Stderr, "GOPATH not set")
-		os.Exit(1)
+// Tells if stderr is a terminal, so that errors can be printed in colour.
+func colourStderr() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
 	}
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
 
-	srcpath = os.Getenv("HAVESRCPATH")
-	if srcpath == "" {
-		srcpath = path.Join(gopath, "src")
+// Options common for commands compiling Have code.
+type compileOpts struct {
+	json bool
+	// Version of Go to generate code for, see have.PkgManager.GoVersion.
+	goVersion string
+}
+
+// Creates a flag set filling opts, commands can add their own flags to it.
+func compileFlags(cmd string, opts *compileOpts) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.BoolVar(&opts.json, "json", false, "print errors as JSON objects, one per line")
+	flags.StringVar(&opts.goVersion, "go", "", "version of Go to generate code for (e.g. 1.18, "+
+		"which allows Go generics), the one from go.mod by default")
+	return flags
+}
+
+func parseCompileOpts(cmd string, args []string) (*compileOpts, []string) {
+	opts := &compileOpts{}
+	flags := compileFlags(cmd, opts)
+	flags.Parse(args)
+	return opts, flags.Args()
+}
+
+func printErrors(manager *have.PkgManager, fpl *FilesystemPkgLocator, errs []error, opts *compileOpts) {
+	if fpl.module == nil {
+		printSourceErrors(manager.Fset, manager.Source, errs, opts)
+		return
+	}
+
+	// Files of modules are named by import paths, errors refer to them by their
+	// paths instead (positions are the same, only names of files differ).
+	fset, names := token.NewFileSet(), map[string]string{}
+	manager.Fset.Iterate(func(f *token.File) bool {
+		name := fpl.workingPath(f.Name())
+		names[name] = f.Name()
+		fset.AddFile(name, f.Base(), f.Size()).SetLines(f.Lines())
+		return true
+	})
+	printSourceErrors(fset, func(name string) string { return manager.Source(names[name]) }, errs, opts)
+}
+
+// Like printErrors, for errors in code that isn't loaded by a PkgManager.
+func printSourceErrors(fset *token.FileSet, source func(filename string) string, errs []error, opts *compileOpts) {
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		for _, err := range errs {
+			enc.Encode(have.NewDiagnostic(fset, err))
+		}
+		return
 	}
 
-	return
+	colour := colourStderr()
+	for _, err := range errs {
+		if compErr, ok := err.(*have.CompileError); ok {
+			fmt.Fprintf(os.Stderr, "%s\n", compErr.Report(fset, source, colour))
+		} else {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		}
+	}
+}
+
+// Names Have source files in //line directives of a Go file written to goFile.
+// Relative paths are resolved by Go tools against the Go file's directory.
+func relativeSources(fpl *FilesystemPkgLocator, goFile string) func(name string) string {
+	return func(name string) string {
+		src, err := filepath.Abs(fpl.sourcePath(name))
+		if err != nil {
+			return fpl.sourcePath(name)
+		}
+		dir, err := filepath.Abs(filepath.Dir(goFile))
+		if err != nil {
+			return src
+		}
+		if rel, err := filepath.Rel(dir, src); err == nil {
+			return filepath.ToSlash(rel)
+		}
+		return src
+	}
 }
 
+// Names Have source files in //line directives with absolute paths, for Go
+// files written to temporary directories. Files of the main package are named
+// as given on the command line, the rest are found by the locator.
+func absoluteSources(fpl *FilesystemPkgLocator, mainFiles []string) func(name string) string {
+	return func(name string) string {
+		full := fpl.sourcePath(name)
+		for _, f := range mainFiles {
+			if f == name {
+				full = name
+			}
+		}
+		if abs, err := filepath.Abs(full); err == nil {
+			return abs
+		}
+		return full
+	}
+}
+
+// Translates packages to Go. By default Go files are written next to Have files
+// in modules, and to $GOPATH/src outside of them.
 func trans(args []string) {
+	opts := &compileOpts{}
+	flags := compileFlags("trans", opts)
+	outDir := flags.String("o", "", "directory to write Go files to, with the same layout as the module "+
+		"(or used instead of GOPATH outside of modules)")
+	flags.Parse(args)
+	args = flags.Args()
+
 	var pkgs, files []string
 	for _, arg := range args {
 		if strings.HasSuffix(arg, ".hav") {
@@ -72,24 +242,16 @@ func trans(args []string) {
 		}
 	}
 
-	var gopath, srcpath = paths()
-
-	var locator = NewFilesystemPkgLocator(srcpath)
+	var gopath, locator = paths()
 
 	manager := have.NewPkgManager(locator)
+	manager.GoVersion = goVersion(opts.goVersion, locator)
 
 	for _, pkgName := range pkgs {
 		pkg, errs := manager.Load(pkgName)
 
-		for _, err := range errs {
-			if compErr, ok := err.(*have.CompileError); ok {
-				fmt.Fprintf(os.Stderr, "ERROR: %s\n", compErr.PrettyString(manager.Fset))
-			} else {
-				fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-			}
-		}
-
 		if len(errs) > 0 {
+			printErrors(manager, locator, errs, opts)
 			os.Exit(1)
 		}
 
@@ -97,22 +259,60 @@ func trans(args []string) {
 			if f.Name == have.BuiltinsFileName {
 				continue
 			}
-			var output = f.GenerateCode()
+			var fullFname = transFileName(gopath, *outDir, locator, f)
+			var output = f.GenerateCodeWithLines(relativeSources(locator, fullFname))
 
-			var fullFname = path.Join(gopath, "src", f.Name+".go")
-			if strings.HasSuffix(f.Name, ".hav") {
-				fullFname = path.Join(gopath, "src", f.Name[0:len(f.Name)-len("hav")]+"go")
+			if err := writeGoFile(fullFname, output); err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
 			}
+		}
+	}
+}
 
-			os.MkdirAll(path.Dir(fullFname), 0744)
+// Path of the Go file generated from a Have file, in the workspace rooted at gopath.
+func goFileName(gopath string, f *have.File) string {
+	return path.Join(gopath, "src", goName(f.Name))
+}
 
-			var err = ioutil.WriteFile(fullFname, []byte(output), 0644)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing file %s: %s", fullFname, err)
-				os.Exit(1)
-			}
+// Name of the Go file generated from a Have file with the given name.
+func goName(name string) string {
+	if strings.HasSuffix(name, ".hav") {
+		return name[0:len(name)-len("hav")] + "go"
+	}
+	return name + ".go"
+}
+
+// Path of the Go file that trans generates from a Have file. In modules it's
+// written next to the Have file, or to outDir (in the same place relative to
+// it as the Have file to the module directory). Outside of modules outDir is
+// used instead of GOPATH.
+func transFileName(gopath, outDir string, fpl *FilesystemPkgLocator, f *have.File) string {
+	if fpl.module == nil {
+		if outDir != "" {
+			gopath = outDir
 		}
+		return goFileName(gopath, f)
+	}
+
+	fname := fpl.sourcePath(goName(f.Name))
+	if outDir == "" {
+		return fname
+	}
+	rel, err := filepath.Rel(fpl.module.dir, fname)
+	if err != nil {
+		return fname
 	}
+	return filepath.Join(outDir, rel)
+}
+
+func writeGoFile(fname, code string) error {
+	os.MkdirAll(path.Dir(fname), 0744)
+
+	if err := ioutil.WriteFile(fname, []byte(code), 0644); err != nil {
+		return fmt.Errorf("Error writing file %s: %s", fname, err)
+	}
+	return nil
 }
 
 // Implements PkgLocator
@@ -145,6 +345,8 @@ func (rl *RunLocator) Locate(relativePath string) ([]*have.File, error) {
 }
 
 func run(args []string) {
+	opts, args := parseCompileOpts("run", args)
+
 	if len(args) == 0 {
 		fmt.Fprintf(os.Stderr, "No source files specified\n")
 		os.Exit(1)
@@ -156,61 +358,365 @@ func run(args []string) {
 		}
 	}
 
-	var _, srcpath = paths()
+	var gopath, fpl = paths()
 
-	var locator, err = NewRunLocator(NewFilesystemPkgLocator(srcpath), args)
+	var locator, err = NewRunLocator(fpl, args)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating temporary dir: %s", err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
 	manager := have.NewPkgManager(locator)
+	manager.GoVersion = goVersion(opts.goVersion, fpl)
 
-	pkg, errs := manager.Load("main")
+	if _, errs := manager.Load("main"); len(errs) > 0 {
+		printErrors(manager, fpl, errs, opts)
+		os.Exit(1)
+	}
 
-	for _, err := range errs {
-		if compErr, ok := err.(*have.CompileError); ok {
-			fmt.Fprintf(os.Stderr, "ERROR: %s\n", compErr.PrettyString(manager.Fset))
-		} else {
-			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		}
+	workDir, err := ioutil.TempDir("", "hav")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating temporary dir: %s", err)
+		os.Exit(1)
 	}
 
-	if len(errs) > 0 {
+	cmd, err := goCommand(manager, gopath, fpl, workDir, args, "run")
+	if err != nil {
+		os.RemoveAll(workDir)
+		fmt.Fprintf(os.Stderr, "%s", err)
 		os.Exit(1)
 	}
+	// The program is interactive, its streams aren't captured.
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	os.RemoveAll(workDir)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running go: %s", err)
+		os.Exit(1)
+	}
+}
 
-	tmpDir, err := ioutil.TempDir("", "hav")
+// Translates a package and the Have packages it imports into a temporary
+// workspace and builds it with `go build`. Errors reported by Go refer to
+// Have files, thanks to //line directives.
+func build(args []string) {
+	opts := &compileOpts{}
+	flags := compileFlags("build", opts)
+	out := flags.String("o", "", "output file, named after the package by default")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Expected exactly one package to build\n")
+		os.Exit(1)
+	}
+	pkgName := flags.Arg(0)
+
+	var gopath, fpl = paths()
+
+	manager := have.NewPkgManager(fpl)
+	manager.GoVersion = goVersion(opts.goVersion, fpl)
+
+	if _, errs := manager.Load(pkgName); len(errs) > 0 {
+		printErrors(manager, fpl, errs, opts)
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		*out = path.Base(pkgName)
+	}
+	// Go commands for modules are run in the module directory.
+	if abs, err := filepath.Abs(*out); err == nil {
+		*out = abs
+	}
+
+	os.Exit(runGo(manager, gopath, fpl, os.Stderr, "build", "-o", *out, pkgName))
+}
+
+// Writes Go code of all the Have packages loaded by the manager into
+// a temporary workspace and runs a Go command there, returning its exit code.
+// Output of the command goes to out.
+func runGo(manager *have.PkgManager, gopath string, fpl *FilesystemPkgLocator, out io.Writer, args ...string) int {
+	workDir, err := ioutil.TempDir("", "havbuild")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating temporary dir: %s", err)
-		os.Exit(1)
+		return 1
 	}
-	defer os.RemoveAll(tmpDir)
+	defer os.RemoveAll(workDir)
 
+	cmd, err := goCommand(manager, gopath, fpl, workDir, nil, args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s", err)
+		return 1
+	}
+	output, err := cmd.CombinedOutput()
+	out.Write(goOutputPaths(workDir, output))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// Writes Go code of all the Have packages loaded by the manager into workDir
+// and prepares a Go command using it. Go files of the main package made of
+// mainFiles (see RunLocator) are appended to the arguments.
+func goCommand(manager *have.PkgManager, gopath string, fpl *FilesystemPkgLocator, workDir string, mainFiles []string, args ...string) (*exec.Cmd, error) {
+	if fpl.module != nil {
+		return goModuleCommand(manager, fpl, workDir, mainFiles, args...)
+	}
+
+	for _, pkg := range manager.Packages() {
+		for _, f := range pkg.Files {
+			if f.Name == have.BuiltinsFileName {
+				continue
+			}
+			fname := goFileName(workDir, f)
+			if isMainFile(mainFiles, f) {
+				// Kept apart from packages, in the same directory.
+				fname = path.Join(workDir, "main", goName(f.Name))
+				args = append(args, fname)
+			}
+			output := f.GenerateCodeWithLines(absoluteSources(fpl, mainFiles))
+			if err := writeGoFile(fname, output); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cmd := exec.Command("go", args...)
+	// Go packages can still be imported from the original GOPATH.
+	cmd.Env = append(os.Environ(),
+		"GOPATH="+workDir+string(filepath.ListSeparator)+gopath,
+		"GO111MODULE=off")
+	return cmd, nil
+}
+
+// Like goCommand, for packages of a Go module. The Go command is run in the
+// module directory, with generated files added next to Have files by an overlay
+// (see `go help build`), so that the module itself isn't modified.
+func goModuleCommand(manager *have.PkgManager, fpl *FilesystemPkgLocator, workDir string, mainFiles []string, args ...string) (*exec.Cmd, error) {
+	overlay := map[string]string{}
 	var goFiles []string
+	for _, pkg := range manager.Packages() {
+		for _, f := range pkg.Files {
+			if f.Name == have.BuiltinsFileName {
+				continue
+			}
+			output := f.GenerateCodeWithLines(absoluteSources(fpl, mainFiles))
+			fname := path.Join(workDir, fmt.Sprintf("%d.go", len(overlay)))
+			if err := writeGoFile(fname, output); err != nil {
+				return nil, err
+			}
+			source := fpl.sourcePath(goName(f.Name))
+			if isMainFile(mainFiles, f) {
+				// Relative to the working directory, not the module one.
+				source, _ = filepath.Abs(goName(f.Name))
+				goFiles = append(goFiles, source)
+			}
+			overlay[source] = fname
+		}
+	}
 
-	for _, f := range pkg.Files {
-		if f.Name == have.BuiltinsFileName {
-			continue
+	overlayFile := path.Join(workDir, "overlay.json")
+	data, _ := json.Marshal(map[string]interface{}{"Replace": overlay})
+	if err := writeGoFile(overlayFile, string(data)); err != nil {
+		return nil, err
+	}
+
+	args = append(append([]string{args[0], "-overlay", overlayFile}, args[1:]...), goFiles...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = fpl.module.dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on")
+	return cmd, nil
+}
+
+func isMainFile(mainFiles []string, f *have.File) bool {
+	for _, name := range mainFiles {
+		if name == f.Name {
+			return true
 		}
-		var output = f.GenerateCode()
+	}
+	return false
+}
 
-		outputPath := path.Join(tmpDir, f.Name+".go")
-		ioutil.WriteFile(outputPath, []byte(output), 0600)
-		goFiles = append(goFiles, outputPath)
+// Runs tests of a package, written in its _test.hav files, with `go test`.
+// Failures are reported at lines of Have code.
+func test(args []string) {
+	opts := &compileOpts{}
+	flags := compileFlags("test", opts)
+	run := flags.String("run", "", "run only tests matching the regular expression")
+	verbose := flags.Bool("v", false, "print names of tests as they are run")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Expected exactly one package to test\n")
+		os.Exit(1)
 	}
+	pkgName := flags.Arg(0)
 
-	binary, err := exec.LookPath("go")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't find go binary: %s", err)
+	var gopath, fpl = paths()
+
+	manager := have.NewPkgManager(fpl)
+	manager.GoVersion = goVersion(opts.goVersion, fpl)
+
+	if _, errs := manager.LoadWithTests(pkgName); len(errs) > 0 {
+		printErrors(manager, fpl, errs, opts)
 		os.Exit(1)
 	}
 
-	env := os.Environ()
+	goArgs := []string{"test"}
+	if *run != "" {
+		goArgs = append(goArgs, "-run", *run)
+	}
+	if *verbose {
+		goArgs = append(goArgs, "-v")
+	}
+	os.Exit(runGo(manager, gopath, fpl, os.Stdout, append(goArgs, pkgName)...))
+}
+
+// Makes paths in Go tools' output refer to the user's files: the ones from the
+// working directory become relative, and the temporary workspace is cut out.
+func goOutputPaths(workDir string, output []byte) []byte {
+	replacements := []string{workDir + "/src/", ""}
+	if wd, err := os.Getwd(); err == nil {
+		replacements = append(replacements, wd+"/", "")
+	}
+	return []byte(strings.NewReplacer(replacements...).Replace(string(output)))
+}
+
+// Reprints Have files in the canonical style. Arguments can be files or
+// directories (searched recursively), with no arguments stdin is formatted.
+func format(args []string) {
+	// Nothing is compiled, errors are only the syntax ones.
+	opts := &compileOpts{}
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	list := flags.Bool("l", false, "list files whose formatting differs from the canonical one")
+	diff := flags.Bool("d", false, "print diffs instead of formatted code")
+	write := flags.Bool("w", false, "write the result to the source files instead of stdout")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		code, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading stdin: %s\n", err)
+			os.Exit(1)
+		}
+		fset := token.NewFileSet()
+		result, errs := have.Format(fset, "<stdin>", string(code))
+		if len(errs) > 0 {
+			printSourceErrors(fset, func(string) string { return string(code) }, errs, opts)
+			os.Exit(1)
+		}
+		os.Stdout.WriteString(result)
+		return
+	}
+
+	var files []string
+	for _, arg := range flags.Args() {
+		err := filepath.Walk(arg, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files given explicitly are formatted whatever their names are.
+			if !info.IsDir() && (fname == arg || strings.HasSuffix(fname, ".hav")) {
+				files = append(files, fname)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	failed := false
+	for _, fname := range files {
+		code, err := ioutil.ReadFile(fname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", fname, err)
+			failed = true
+			continue
+		}
+
+		fset := token.NewFileSet()
+		result, errs := have.Format(fset, fname, string(code))
+		if len(errs) > 0 {
+			printSourceErrors(fset, func(string) string { return string(code) }, errs, opts)
+			failed = true
+			continue
+		}
+
+		changed := result != string(code)
+		if *list && changed {
+			fmt.Println(fname)
+		}
+		if *write && changed {
+			if err := ioutil.WriteFile(fname, []byte(result), 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", fname, err)
+				failed = true
+			}
+		}
+		if *diff && changed {
+			out, err := diffCode(fname, code, []byte(result))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error computing diff for %s: %s\n", fname, err)
+				failed = true
+			}
+			os.Stdout.Write(out)
+		}
+		if !*list && !*write && !*diff {
+			os.Stdout.WriteString(result)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
 
-	err = syscall.Exec(binary, append([]string{"go", "run"}, goFiles...), env)
+// Returns a unified diff of two versions of a file, computed by the diff tool.
+func diffCode(fname string, a, b []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "havfmt")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error execing go binary: %s", err)
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	aName, bName := filepath.Join(dir, "a.hav"), filepath.Join(dir, "b.hav")
+	if err := ioutil.WriteFile(aName, a, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(bName, b, 0600); err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command("diff", "-u", "-L", fname+".orig", "-L", fname, aName, bName).Output()
+	if len(out) > 0 {
+		// Exit code 1 just means that there are differences.
+		return out, nil
+	}
+	return out, err
+}
+
+// Only checks packages for errors, doesn't write any files.
+func check(args []string) {
+	opts, pkgs := parseCompileOpts("check", args)
+
+	var _, fpl = paths()
+
+	manager := have.NewPkgManager(fpl)
+	manager.GoVersion = goVersion(opts.goVersion, fpl)
+
+	failed := false
+	for _, pkgName := range pkgs {
+		if _, errs := manager.Load(pkgName); len(errs) > 0 {
+			printErrors(manager, fpl, errs, opts)
+			failed = true
+		}
+	}
+
+	if failed {
 		os.Exit(1)
 	}
 }
@@ -230,6 +736,18 @@ func main() {
 		trans(args[1:])
 	case "run":
 		run(args[1:])
+	case "build":
+		build(args[1:])
+	case "test":
+		test(args[1:])
+	case "fmt":
+		format(args[1:])
+	case "check":
+		check(args[1:])
+	case "lsp":
+		lsp(args[1:])
+	case "repl":
+		repl(args[1:])
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +10,7 @@ import (
 	"os/exec"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -82,12 +85,16 @@ func compareDirs(src, model string) (errs []error) {
 	return
 }
 
-func TestTrans(t *testing.T) {
+// Tests run the 'have' command, it's built once for all of them.
+func TestMain(m *testing.M) {
 	output, err := exec.Command("go", "build", ".").CombinedOutput()
 	if err != nil {
 		panic(errors.New("Can't compile 'have' command: " + string(output)))
 	}
+	os.Exit(m.Run())
+}
 
+func TestTrans(t *testing.T) {
 	cases := []struct {
 		name string
 		args []string
@@ -141,3 +148,197 @@ func TestTrans(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckJSON(t *testing.T) {
+	testCaseDir := path.Join(currentPkgFullPath(), "test_data", "broken")
+
+	cmd := exec.Command("./have", "check", "-json", "broken")
+	cmd.Env = append(cmd.Env,
+		"GOPATH="+path.Join(testCaseDir, "output"),
+		"HAVESRCPATH="+path.Join(testCaseDir, "input"))
+
+	output, err := cmd.Output()
+	if err == nil {
+		t.Fatalf("Checking a broken package should fail")
+	}
+
+	want := []map[string]interface{}{
+		{"file": "broken/broken.hav", "line": 4.0, "column": 14.0,
+			"severity": "error", "code": "invalid-literal", "message": "Can't use this literal for type int"},
+		{"file": "broken/broken.hav", "line": 5.0, "column": 10.0, "endLine": 5.0, "endColumn": 11.0,
+			"severity": "error", "code": "unknown-identifier", "message": "Unknown identifier: z"},
+	}
+
+	var got []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(output))
+	for dec.More() {
+		var diag map[string]interface{}
+		if err := dec.Decode(&diag); err != nil {
+			t.Fatalf("Invalid JSON in the output: %s\n%s", err, output)
+		}
+		got = append(got, diag)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong diagnostics, want:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "havtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+
+	buildCmd := func(testCase string, args ...string) *exec.Cmd {
+		cmd := exec.Command("./have", append([]string{"build"}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"HAVESRCPATH="+path.Join(currentPkgFullPath(), "test_data", testCase, "input"))
+		return cmd
+	}
+
+	binary := path.Join(outDir, "hello")
+	output, err := buildCmd("scattered_world", "-o", binary, "hello").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Build failed: %s\n%s", err, output)
+	}
+	output, err = exec.Command(binary).CombinedOutput()
+	if err != nil || string(output) != "Hello, world!\n" {
+		t.Errorf("Wrong output of the built binary: %q (%v)", output, err)
+	}
+
+	// Errors found by Go are reported at Have lines.
+	output, err = buildCmd("go_error", "-o", path.Join(outDir, "goerr"), "goerr").CombinedOutput()
+	if err == nil {
+		t.Fatalf("Building a package with an unused variable should fail")
+	}
+	if !bytes.Contains(output, []byte("goerr/main.hav:4:")) {
+		t.Errorf("Go error not mapped to Have code:\n%s", output)
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	cmd := exec.Command("./have", "test", "-v", "calc")
+	cmd.Env = append(os.Environ(),
+		"HAVESRCPATH="+path.Join(currentPkgFullPath(), "test_data", "testing", "input"))
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("One of the tests should fail:\n%s", output)
+	}
+
+	for _, want := range []string{
+		"--- PASS: TestAdd ",
+		"--- FAIL: TestAddBroken ",
+		"calc_test.hav:11: 2 + 2 isn't 5",
+	} {
+		if !bytes.Contains(output, []byte(want)) {
+			t.Errorf("Output doesn't contain %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestFmt(t *testing.T) {
+	input := path.Join("test_data", "fmt", "input")
+
+	output, err := exec.Command("./have", "fmt", "-l", input).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Listing failed: %s\n%s", err, output)
+	}
+	if want := path.Join(input, "messy.hav") + "\n"; string(output) != want {
+		t.Errorf("Wrong list of unformatted files, want %q, got %q", want, output)
+	}
+
+	output, err = exec.Command("./have", "fmt", "-d", path.Join(input, "messy.hav")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Diffing failed: %s\n%s", err, output)
+	}
+	for _, want := range []string{"-package   main\n", "+package main\n", "+\tvar s = S{x: 1}\n"} {
+		if !bytes.Contains(output, []byte(want)) {
+			t.Errorf("Diff doesn't contain %q:\n%s", want, output)
+		}
+	}
+	// Flags of commands that compile code aren't accepted.
+	if output, err = exec.Command("./have", "fmt", "-json", input).CombinedOutput(); err == nil {
+		t.Errorf("Flag -json accepted by fmt:\n%s", output)
+	}
+}
+
+func TestModules(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "havtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+
+	// Packages are found in the module containing the working directory, GOPATH isn't needed.
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "GOPATH=") && !strings.HasPrefix(v, "HAVESRCPATH=") {
+			env = append(env, v)
+		}
+	}
+	moduleCmd := func(dir string, args ...string) *exec.Cmd {
+		cmd := exec.Command(path.Join(currentPkgFullPath(), "have"), args...)
+		cmd.Dir = path.Join(currentPkgFullPath(), "test_data", "modules", "input", dir)
+		cmd.Env = env
+		return cmd
+	}
+
+	binary := path.Join(outDir, "app")
+	output, err := moduleCmd("app", "build", "-o", binary, "example.com/shapes/app").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Build failed: %s\n%s", err, output)
+	}
+	output, err = exec.Command(binary).CombinedOutput()
+	if err != nil || string(output) != "6\n" {
+		t.Errorf("Wrong output of the built binary: %q (%v)", output, err)
+	}
+
+	// Files passed to run are relative to the working directory, anywhere in the module.
+	for _, c := range []struct{ dir, file string }{{"app", "main.hav"}, {"", "app/main.hav"}} {
+		output, err = moduleCmd(c.dir, "run", c.file).CombinedOutput()
+		if err != nil || string(output) != "6\n" {
+			t.Errorf("Wrong output of run %s in %q: %q (%v)", c.file, c.dir, output, err)
+		}
+	}
+
+	output, err = moduleCmd("", "test", "-v", "example.com/shapes/geo").CombinedOutput()
+	if err != nil || !bytes.Contains(output, []byte("--- PASS: TestArea ")) {
+		t.Errorf("Tests failed: %s\n%s", err, output)
+	}
+
+	output, err = moduleCmd("geo", "trans", "-o", outDir, "example.com/shapes/geo").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Translation failed: %s\n%s", err, output)
+	}
+	if _, err := os.Stat(path.Join(outDir, "geo", "geo.go")); err != nil {
+		t.Errorf("Go file not written to the output tree: %s", err)
+	}
+
+	// Errors refer to files by their paths relative to the working directory,
+	// not by import paths.
+	output, err = moduleCmd("", "check", "example.com/shapes/broken").CombinedOutput()
+	if err == nil || !bytes.HasPrefix(output, []byte("broken/broken.hav:4:9: Unknown identifier: z\n\treturn z\n")) {
+		t.Errorf("Wrong errors of check: %s\n%s", err, output)
+	}
+	output, err = moduleCmd("app", "check", "-json", "example.com/shapes/broken").Output()
+	if err == nil || !bytes.Contains(output, []byte(`"file":"../broken/broken.hav","line":4,"column":9,`)) {
+		t.Errorf("Wrong JSON errors of check: %s\n%s", err, output)
+	}
+}
+
+func TestModDirective(t *testing.T) {
+	cases := []struct {
+		gomod, name, value string
+	}{
+		{"module example.com/a\n\ngo 1.16\n", "module", "example.com/a"},
+		{"// comment\nmodule \"example.com/b\" // comment\n", "module", "example.com/b"},
+		{"go 1.16\n", "module", ""},
+		{"module example.com/a\n\ngo 1.16\n", "go", "1.16"},
+	}
+	for _, c := range cases {
+		if got := modDirective([]byte(c.gomod), c.name); got != c.value {
+			t.Errorf("Wrong %s directive of %q: got %q, want %q", c.name, c.gomod, got, c.value)
+		}
+	}
+}
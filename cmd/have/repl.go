@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/vrok/have/have"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Base name of the package of programs built of REPL entries.
+const replPkg = "haverepl"
+
+// An interactive session. Every entry is checked and run as a part of a program
+// made of the declarations accepted so far. Imports and declarations of types
+// go to the top level, the rest (functions too, so that they can use variables
+// declared earlier) goes to main(). Expressions are evaluated, their values
+// and types are printed, and then they're forgotten.
+//
+// Go programs can't be extended while they run, so each entry is run by a new
+// one. Other statements than declarations are run once, and they don't affect
+// later entries, e.g. values assigned to variables are lost. Initializers of
+// variables are run again by every program, with their side effects.
+type replSession struct {
+	gopath string
+	fpl    *FilesystemPkgLocator
+	out    io.Writer
+	// Import path of the program, in modules it has to be a part of the module.
+	pkg string
+
+	imports, decls, stmts []string
+}
+
+func newReplSession(gopath string, fpl *FilesystemPkgLocator, out io.Writer) *replSession {
+	pkg := replPkg
+	if fpl.module != nil {
+		pkg = fpl.module.path + "/" + replPkg
+	}
+	return &replSession{gopath: gopath, fpl: fpl, out: out, pkg: pkg}
+}
+
+// Name of the file of the program.
+func (s *replSession) file() string {
+	return s.pkg + "/repl.hav"
+}
+
+// Implements PkgLocator, provides the program built of REPL entries.
+type replLocator struct {
+	fpl       *FilesystemPkgLocator
+	pkg, code string
+}
+
+func (rl *replLocator) Locate(relativePath string) ([]*have.File, error) {
+	if relativePath == rl.pkg {
+		return []*have.File{have.NewFile(rl.pkg+"/repl.hav", rl.code)}, nil
+	}
+	return rl.fpl.Locate(relativePath)
+}
+
+var (
+	replImportRegexp  = regexp.MustCompile(`^import\s+"([^"]*)"(\s+as\s+(\w+))?\s*$`)
+	replGenericRegexp = regexp.MustCompile(`^func\s+\w+\s*\[`)
+)
+
+// Builds a program of the accepted entries, with tail added at the end of main.
+// Returns the program and the number of the line where tail starts. Earlier
+// declarations in main are run again, so the program prints a zero byte before
+// tail, and only the output after it is shown.
+func (s *replSession) program(tail ...string) (string, int) {
+	lines := []string{"package main", `import "fmt" as __repl_fmt`}
+
+	// Go doesn't allow unused imports.
+	code := strings.Join(append(append(append([]string{}, s.decls...), s.stmts...), tail...), "\n")
+	for _, imp := range s.imports {
+		m := replImportRegexp.FindStringSubmatch(imp)
+		name := m[3]
+		if name == "" {
+			name = m[1][strings.LastIndex(m[1], "/")+1:]
+		}
+		if regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\.`).MatchString(code) {
+			lines = append(lines, imp)
+		}
+	}
+	for _, decl := range s.decls {
+		lines = append(lines, strings.Split(decl, "\n")...)
+	}
+
+	lines = append(lines, "func main():")
+	for _, stmt := range s.stmts {
+		lines = append(lines, indentLines(stmt)...)
+	}
+	lines = append(lines, `	__repl_fmt.Print("\x00")`)
+	start := len(lines) + 1
+	for _, t := range tail {
+		lines = append(lines, indentLines(t)...)
+	}
+	return strings.Join(lines, "\n") + "\n", start
+}
+
+func indentLines(code string) []string {
+	lines := strings.Split(code, "\n")
+	for i := range lines {
+		lines[i] = "\t" + lines[i]
+	}
+	return lines
+}
+
+func (s *replSession) load(code string) (*have.PkgManager, []error) {
+	manager := have.NewPkgManager(&replLocator{fpl: s.fpl, pkg: s.pkg, code: code})
+	manager.GoVersion = goVersion("", s.fpl)
+	_, errs := manager.Load(s.pkg)
+	return manager, errs
+}
+
+// Names of variables, constants and functions declared by an entry.
+func replDeclared(entry string) []string {
+	f := have.NewFile("entry.hav", "package main\n"+entry)
+	have.NewPackage("main", f)
+	f.Parse()
+	return f.Decls()
+}
+
+// Checks an entry and runs it. If everything goes fine, the entry is kept.
+func (s *replSession) eval(entry string) {
+	first := strings.Fields(entry)[0]
+
+	switch {
+	case first == "import":
+		m := replImportRegexp.FindStringSubmatch(entry)
+		if m == nil {
+			fmt.Fprintf(s.out, "Expected an import of one package\n")
+			return
+		}
+		manager := have.NewPkgManager(s.fpl)
+		if _, errs := manager.Load(m[1]); len(errs) > 0 {
+			s.printErrors(manager, errs, 0, false)
+			return
+		}
+		s.imports = append(s.imports, entry)
+	case first == "struct" || first == "interface" || first == "type" || replGenericRegexp.MatchString(entry):
+		s.decls = append(s.decls, entry)
+		code, _ := s.program()
+		if manager, errs := s.load(code); len(errs) > 0 {
+			// Main starts right after the declarations.
+			main := strings.Index(code, "\nfunc main():\n")
+			s.printErrors(manager, errs, strings.Count(code[:main], "\n")+1-strings.Count(entry, "\n"), false)
+			s.decls = s.decls[:len(s.decls)-1]
+		}
+	case first == "var" || first == "const" || first == "func":
+		stmt := entry
+		for _, name := range replDeclared(entry) {
+			stmt += "\n_ = " + name
+		}
+		if ok, _ := s.run("", stmt); ok {
+			s.stmts = append(s.stmts, stmt)
+		}
+	default:
+		if !strings.Contains(entry, "\n") && s.evalExpr(entry) {
+			return
+		}
+		// Not kept, so that its side effects happen once.
+		s.run("", entry)
+	}
+}
+
+// Prints the value and the type of an expression. Returns false if the entry
+// isn't an expression (or it has no value).
+func (s *replSession) evalExpr(entry string) bool {
+	// Expressions are assigned to a variable, so that their types are known.
+	code, start := s.program("var __repl_value = "+entry, "__repl_fmt.Print(__repl_value)")
+	manager, errs := s.load(code)
+	if len(errs) > 0 {
+		return false
+	}
+	f := manager.File(s.file())
+	info := f.IdentAt(f.Pos(start+1, len("\t__repl_fmt.Print(")+1))
+	if info == nil || info.Type == nil {
+		return false
+	}
+
+	values := []string{"__repl_value"}
+	if tuple, ok := info.Type.(*have.TupleType); ok {
+		values = nil
+		for i := range tuple.Members {
+			values = append(values, fmt.Sprintf("__repl_value%d", i))
+		}
+	}
+	format := strings.TrimSpace(strings.Repeat("%v ", len(values)))
+	_, built := s.run(" ("+info.Type.String()+")\n",
+		fmt.Sprintf("var %s = %s", strings.Join(values, ", "), entry),
+		fmt.Sprintf("__repl_fmt.Printf(\"%s\", %s)", format, strings.Join(values, ", ")))
+	// Some calls pass the checks, but they have no values in Go (e.g. print).
+	return built
+}
+
+// Runs the program with tail added to main. Text in suffix is written after
+// the program's output. Returns false if the code can't be compiled or fails,
+// and whether the Go program was built. Errors of Go builds aren't printed.
+func (s *replSession) run(suffix string, tail ...string) (ok, built bool) {
+	code, start := s.program(tail...)
+	manager, errs := s.load(code)
+	if len(errs) > 0 {
+		s.printErrors(manager, errs, start, true)
+		return false, false
+	}
+
+	output := &bytes.Buffer{}
+	exitCode := runGo(manager, s.gopath, s.fpl, output, "run", s.pkg)
+	out := output.String()
+	i := strings.LastIndex(out, "\x00")
+	if i < 0 {
+		return false, false
+	}
+	fmt.Fprint(s.out, out[i+1:])
+	if exitCode != 0 {
+		return false, true
+	}
+	fmt.Fprint(s.out, suffix)
+	return true, true
+}
+
+// Prints errors, with positions relative to the entry starting at the given
+// line of the program (if it's 0, just messages are printed). Entries put
+// in main are indented.
+func (s *replSession) printErrors(manager *have.PkgManager, errs []error, start int, indented bool) {
+	for _, err := range errs {
+		d := have.NewDiagnostic(manager.Fset, err)
+		if start == 0 || d.File != s.file() || d.Line < start {
+			fmt.Fprintf(s.out, "%s\n", d.Message)
+			continue
+		}
+		column := d.Column
+		if indented {
+			column--
+		}
+		fmt.Fprintf(s.out, "%d:%d: %s\n", d.Line-start+1, column, d.Message)
+	}
+}
+
+// Reads entries: single lines, or blocks started by lines ending with
+// a colon, and ended by empty lines.
+func (s *replSession) serve(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	var entry []string
+	fmt.Fprint(s.out, ">>> ")
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		switch {
+		case len(entry) == 0 && strings.TrimSpace(line) == "":
+		case len(entry) == 0 && !strings.HasSuffix(line, ":"):
+			s.eval(line)
+		case len(entry) > 0 && line == "":
+			s.eval(strings.Join(entry, "\n"))
+			entry = nil
+		default:
+			entry = append(entry, line)
+		}
+
+		if len(entry) > 0 {
+			fmt.Fprint(s.out, "... ")
+		} else {
+			fmt.Fprint(s.out, ">>> ")
+		}
+	}
+	if len(entry) > 0 {
+		s.eval(strings.Join(entry, "\n"))
+	}
+	fmt.Fprintln(s.out)
+}
+
+func repl(args []string) {
+	gopath, fpl := paths()
+	newReplSession(gopath, fpl, os.Stdout).serve(os.Stdin)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRepl(t *testing.T) {
+	srcpath, err := ioutil.TempDir("", "have-repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcpath)
+
+	in := `var x = 5
+x * 2
+import "strings"
+strings.ToUpper("abc")
+struct Point:
+	X int
+
+func double() int:
+	return x * 2
+
+import "fmt"
+fmt.Println("once")
+double()
+x = 7
+x
+var p = Point{X: double()}
+p
+p.X + y
+func two() (int, string):
+	return 1, "a"
+
+two()
+`
+	out := &bytes.Buffer{}
+	newReplSession(os.Getenv("GOPATH"), NewFilesystemPkgLocator(srcpath), out).serve(strings.NewReader(in))
+
+	want := []string{
+		"10 (int)",
+		"ABC (string)",
+		"once",
+		"5 <nil> ((int, error))",
+		"10 (int)",
+		// Statements other than declarations are run once, their effects are lost.
+		"5 (int)",
+		"{10} (Point)",
+		"1:7: Unknown identifier: y",
+		"1 a ((int, string))",
+	}
+	var got []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(strings.Replace(strings.Replace(line, ">>> ", "", -1), "... ", "", -1))
+		if line != "" {
+			got = append(got, line)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Wrong output, got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+//line ../../../input/hello/hello_world.hav:3
 func main() {
+//line ../../../input/hello/hello_world.hav:4
 	print("Hello, world!\n")
 }
@@ -1,7 +1,11 @@
 package main
 
+//line ../../../input/hello/hello_world.hav:3
 func main() {
+//line ../../../input/hello/hello_world.hav:4
 	print("Hello, ")
+//line ../../../input/hello/hello_world.hav:5
 	print(who())
+//line ../../../input/hello/hello_world.hav:6
 	print("!\n")
 }
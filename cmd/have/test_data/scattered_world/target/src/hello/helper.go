@@ -1,5 +1,7 @@
 package main
 
+//line ../../../input/hello/helper.hav:3
 func who() (string) {
+//line ../../../input/hello/helper.hav:4
 	return "world"
 }
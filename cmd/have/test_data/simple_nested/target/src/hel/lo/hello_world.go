@@ -1,5 +1,7 @@
 package main
 
+//line ../../../../input/hel/lo/hello_world.hav:3
 func main() {
+//line ../../../../input/hel/lo/hello_world.hav:4
 	print("Hello, world!\n")
 }
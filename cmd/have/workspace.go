@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Go module containing Have code.
+type goModule struct {
+	// Module path, as declared in go.mod.
+	path string
+	// Directory of go.mod.
+	dir string
+	// Go version declared in go.mod, empty if there's none.
+	goVersion string
+}
+
+// Finds the module that a directory belongs to, looking for go.mod in the
+// directory and its parents. Returns nil if there's no go.mod.
+func findModule(dir string) (*goModule, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		gomod := filepath.Join(dir, "go.mod")
+		data, err := ioutil.ReadFile(gomod)
+		if err == nil {
+			modPath := modDirective(data, "module")
+			if modPath == "" {
+				return nil, fmt.Errorf("No module path declared in %s", gomod)
+			}
+			return &goModule{path: modPath, dir: dir, goVersion: modDirective(data, "go")}, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error reading %s: %s", gomod, err)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Returns the argument of a directive of a go.mod file (like the path of
+// the module directive), or an empty string if there's no such directive.
+func modDirective(gomod []byte, name string) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != name {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(fields[1]); err == nil {
+			return unquoted
+		}
+		return fields[1]
+	}
+	return ""
+}
+
+// Directory of a package of the module, false if the import path is outside it.
+func (m *goModule) pkgDir(importPath string) (string, bool) {
+	if importPath == m.path {
+		return m.dir, true
+	}
+	if !strings.HasPrefix(importPath, m.path+"/") {
+		return "", false
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(importPath[len(m.path)+1:])), true
+}
+
+// Go version to generate code for: the one given by a flag, or the one
+// declared in go.mod in modules.
+func goVersion(flagValue string, fpl *FilesystemPkgLocator) string {
+	if flagValue == "" && fpl.module != nil {
+		return fpl.module.goVersion
+	}
+	return flagValue
+}
+
+// Tells where Have packages are. Unless HAVESRCPATH is set, they're looked for
+// in the Go module containing the working directory. Outside of modules, import
+// paths are relative to HAVESRCPATH or $GOPATH/src, and GOPATH has to be set.
+func paths() (gopath string, fpl *FilesystemPkgLocator) {
+	gopath = os.Getenv("GOPATH")
+	srcpath := os.Getenv("HAVESRCPATH")
+
+	if srcpath == "" {
+		module, err := findModule(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if module != nil {
+			return gopath, newModulePkgLocator(module)
+		}
+	}
+
+	if gopath == "" {
+		fmt.Fprintf(os.Stderr, "GOPATH not set")
+		os.Exit(1)
+	}
+	if srcpath == "" {
+		srcpath = path.Join(gopath, "src")
+	}
+	return gopath, NewFilesystemPkgLocator(srcpath)
+}
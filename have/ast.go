@@ -24,7 +24,28 @@ type Stmt interface {
 
 type stmt struct {
 	expr
-	label *Object
+	label    *Object
+	comments *Comments
+}
+
+func (s *stmt) Comments() *Comments     { return s.comments }
+func (s *stmt) setComments(c *Comments) { s.comments = c }
+
+// A `#` comment.
+type Comment struct {
+	// Text following the `#`.
+	Text string
+	Pos  gotoken.Pos
+	// False for comments following code in the same line.
+	FullLine bool
+}
+
+// Comments attached to a statement or a declaration.
+type Comments struct {
+	// Full-line comments right above the node, indented like it.
+	Doc []*Comment
+	// Comment at the end of the node's first line.
+	Trailing *Comment
 }
 
 type declStmt interface {
@@ -57,6 +78,12 @@ type TopLevelStmt struct {
 	// This stores either CustomTypes or GenericStruct
 	unboundTypes  map[string][]DeclaredType
 	unboundIdents map[string][]*Ident
+	// Where the unbound types are used
+	unboundTypesPos map[DeclaredType]gotoken.Pos
+	// Arrays declared with constant expressions as sizes
+	unresolvedArrays []*ArrayType
+	// Types captured by patterns of `when` branches
+	captured []*GenericParamTypeDecl
 }
 
 // List of top-level symbols used within this statement.
@@ -96,13 +123,19 @@ func (s *TopLevelStmt) Decls() []string {
 		result = append(result, stmt.Name())
 	case *GenericStruct:
 		result = append(result, stmt.Name())
-	case *ImportStmt, *AssignStmt, *SendStmt, *SwitchStmt, *ExprStmt, *IfStmt, *ForStmt, *ForRangeStmt, *BranchStmt, *LabelStmt:
+	case *ConstStmt:
+		for _, spec := range stmt.Specs {
+			for _, c := range spec.Consts {
+				result = append(result, c.name)
+			}
+		}
+	case *ImportStmt, *AssignStmt, *SendStmt, *GoStmt, *DeferStmt, *SwitchStmt, *SelectStmt, *ExprStmt, *IfStmt, *ForStmt, *ForRangeStmt, *BranchStmt, *LabelStmt,
+		*PassStmt, *ReturnStmt, *WhenStmt:
 	case declStmt:
 		// TODO: Tests are leaking, add an interface to prevent this
 		result = stmt.Decls()
-	default:
-		panic(fmt.Errorf("todo %#v", s.Stmt))
 	}
+	// Other statements don't declare anything.
 	return result
 }
 
@@ -115,6 +148,7 @@ const (
 	OBJECT_LABEL
 	OBJECT_GENERIC
 	OBJECT_GENERIC_TYPE
+	OBJECT_CONST
 )
 
 // This serves a similar purpose to Go's types.Object
@@ -129,11 +163,28 @@ type Variable struct {
 	Type Type
 
 	init Expr
+	pos  gotoken.Pos // Where it's declared, NoPos if it's not known (e.g. for Go objects).
 }
 
 func (o *Variable) Name() string           { return o.name }
 func (o *Variable) ObjectType() ObjectType { return OBJECT_VAR }
 
+// Implements Object
+type Constant struct {
+	name string
+	Type Type // Nil for untyped constants
+
+	init Expr
+	iota int
+	pos  gotoken.Pos // Like in Variable
+
+	value      *constValue // Computed lazily, see Eval
+	evaluating bool        // Used to detect cycles
+}
+
+func (o *Constant) Name() string           { return o.name }
+func (o *Constant) ObjectType() ObjectType { return OBJECT_CONST }
+
 // implements Object and Stmt
 type LabelStmt struct {
 	stmt
@@ -164,6 +215,11 @@ type WhenBranch struct {
 	Predicates []*WhenPredicate
 	Code       *CodeBlock
 	True       bool
+
+	// Types captured by patterns of the predicates, that are opaque in the code
+	// of the branch. When an instantiation of a generic is parsed, they're
+	// usually known and substituted instead, like params of the generic.
+	Captures []*GenericParamTypeDecl
 }
 
 type WhenPredicateKind int
@@ -174,9 +230,16 @@ const (
 	WHEN_KIND_DEFAULT
 )
 
+// Target of `is` can be a pattern, like `map[K]_` or `*[_]_`, matching types
+// of a given shape. `_` matches any type (or array size), and names that aren't
+// builtin types, types of the package or params of the generic capture the
+// matched types, which can be used in the code of the branch.
+// Types match the target only if they're identical to it, or, with `is ~`,
+// if their underlying types are.
 type WhenPredicate struct {
-	Kind   WhenPredicateKind
-	Target Type
+	Kind       WhenPredicateKind
+	Target     Type
+	Underlying bool
 }
 
 func TokenToWhenPred(t *Token) WhenPredicateKind {
@@ -217,11 +280,33 @@ func (o *TypeDecl) Type() Type {
 type GenericParamTypeDecl struct {
 	stmt
 	name string
+	// Nil if the param can be any type.
+	constraint *GenericConstraint
+
+	// Set if values of the param are compared or used as map keys, so
+	// the param needs the comparable constraint in Go generics.
+	comparable bool
+	// Set for types captured by patterns in `when` branches.
+	captured bool
 }
 
 func (g *GenericParamTypeDecl) Name() string           { return g.name }
 func (g *GenericParamTypeDecl) ObjectType() ObjectType { return OBJECT_GENERIC_TYPE }
 
+// Constraint of a generic param, declared like `T implements Stringer`
+// or `K is comparable`.
+type GenericConstraint struct {
+	// Interface that types have to implement, nil for `is comparable`.
+	Iface Type
+}
+
+func (c *GenericConstraint) String() string {
+	if c.Iface == nil {
+		return "is comparable"
+	}
+	return "implements " + c.Iface.String()
+}
+
 var builtinTypeNames []string = []string{"bool", "byte", "complex128", "complex64", "error", "float32",
 	"float64", "int", "int16", "int32", "int64", "int8", "rune",
 	"string", "uint", "uint16", "uint32", "uint64", "uint8", "uintptr"}
@@ -268,6 +353,18 @@ type SendStmt struct {
 	Lhs, Rhs Expr
 }
 
+// implements Stmt
+type GoStmt struct {
+	stmt
+	Call *FuncCallExpr
+}
+
+// implements Stmt
+type DeferStmt struct {
+	stmt
+	Call *FuncCallExpr
+}
+
 // implements Stmt
 type StructStmt struct {
 	stmt
@@ -305,6 +402,22 @@ type VarStmt struct {
 	IsFuncStmt bool
 }
 
+// Single line of a constant declaration.
+type ConstSpec struct {
+	Consts []*Constant
+	Type   Type
+	Inits  []Expr
+	// True when the type and values are repeated from the previous spec.
+	Implicit bool
+}
+
+// implements Stmt
+type ConstStmt struct {
+	stmt
+	Specs []*ConstSpec
+	Block bool // Declared with the `const:` block syntax
+}
+
 // Chain of variable declarations. Sample uses:
 // 	- multi-element variable declaration
 // 	- function arguments definition
@@ -376,6 +489,27 @@ type SwitchStmt struct {
 	Branches []*SwitchBranch
 }
 
+// implements Stmt
+type SelectBranch struct {
+	stmt
+
+	// Communication clause of the branch, one of:
+	//   - SendStmt, for `case ch <- v:`
+	//   - ExprStmt with a receive expression, for `case <-ch:`
+	//   - AssignStmt with a receive expression, for `case x = <-ch:`
+	//   - VarStmt with a receive expression, for `case var x = <-ch:`
+	//   - `nil` for `default`
+	Comm Stmt
+	Code *CodeBlock
+}
+
+// implements Stmt
+type SelectStmt struct {
+	stmt
+
+	Branches []*SelectBranch
+}
+
 // implements Stmt
 type ForStmt struct {
 	stmt
@@ -450,14 +584,20 @@ type Generic interface {
 	// Token file containing the definition of the generic and offset where
 	// the definition starts in the file.
 	Location() (tfile *gotoken.File, offset int)
+	// Tells whether the generic is emitted as a Go generic.
+	nativeInfo() *nativeGeneric
+	// Declarations of the params, with their constraints.
+	paramDeclList() []*GenericParamTypeDecl
 }
 
 // Implements Stmt and Type.
 // It is a pseudo-type, can't be directly used in a program.
 type GenericStruct struct {
 	stmt
-	params []string
-	struc  *StructType
+	params     []string
+	paramDecls []*GenericParamTypeDecl
+	struc      *StructType
+	native     nativeGeneric
 
 	// TODO: Use token.Pos
 	code    []rune
@@ -471,6 +611,8 @@ func (gs *GenericStruct) Name() string                  { return gs.struc.Name }
 func (gs *GenericStruct) Signature() (string, []string) { return gs.struc.Name, gs.params }
 func (gs *GenericStruct) ObjectType() ObjectType        { return OBJECT_GENERIC }
 func (gs *GenericStruct) Instantiate(tc *TypesContext, params ...Type) (Object, string, []error) {
+	defErr := gs.checkDefinition(tc)
+
 	// First, check if we've already been here and it's cached.
 	instKey := NewInstKey(gs, params)
 	i, ok := tc.instantiations[instKey]
@@ -486,6 +628,10 @@ func (gs *GenericStruct) Instantiate(tc *TypesContext, params ...Type) (Object,
 	tc.instantiations[instKey] = r
 	errs := r.ParseAndCheck()
 	if len(errs) > 0 {
+		if defErr != nil {
+			// Caused by the errors of the definition, which are reported instead.
+			tc.usedFailed = true
+		}
 		return nil, "", errs
 	}
 	return r.Object, "sliwka", nil
@@ -493,12 +639,19 @@ func (gs *GenericStruct) Instantiate(tc *TypesContext, params ...Type) (Object,
 func (gs *GenericStruct) Code() []rune                   { return gs.code }
 func (gs *GenericStruct) Imports() Imports               { return gs.imports }
 func (gs *GenericStruct) Location() (*gotoken.File, int) { return gs.tfile, gs.offset }
+func (gs *GenericStruct) nativeInfo() *nativeGeneric     { return &gs.native }
+
+func (gs *GenericStruct) paramDeclList() []*GenericParamTypeDecl {
+	return gs.paramDecls
+}
 
 // Implements Stmt, Object
 type GenericFunc struct {
 	stmt
-	params []string
-	Func   *FuncDecl
+	params     []string
+	paramDecls []*GenericParamTypeDecl
+	Func       *FuncDecl
+	native     nativeGeneric
 
 	// TODO: Use token.Pos
 	code    []rune
@@ -512,6 +665,8 @@ func (gf *GenericFunc) Name() string                  { return gf.Func.name }
 func (gf *GenericFunc) Signature() (string, []string) { return gf.Func.name, gf.params }
 func (gf *GenericFunc) ObjectType() ObjectType        { return OBJECT_GENERIC }
 func (gf *GenericFunc) Instantiate(tc *TypesContext, params ...Type) (Object, string, []error) {
+	defErr := gf.checkDefinition(tc)
+
 	// First, check if we've already been here and it's cached.
 	instKey := NewInstKey(gf, params)
 	i, ok := tc.instantiations[instKey]
@@ -528,6 +683,10 @@ func (gf *GenericFunc) Instantiate(tc *TypesContext, params ...Type) (Object, st
 	tc.instantiations[instKey] = r
 	errs := r.ParseAndCheck()
 	if len(errs) > 0 {
+		if defErr != nil {
+			// Caused by the errors of the definition, which are reported instead.
+			tc.usedFailed = true
+		}
 		return nil, "", errs
 	}
 	return r.Object, r.getGoName(), nil
@@ -535,16 +694,24 @@ func (gf *GenericFunc) Instantiate(tc *TypesContext, params ...Type) (Object, st
 func (gf *GenericFunc) Code() []rune                   { return gf.code }
 func (gf *GenericFunc) Imports() Imports               { return gf.imports }
 func (gf *GenericFunc) Location() (*gotoken.File, int) { return gf.tfile, gf.offset }
+func (gf *GenericFunc) nativeInfo() *nativeGeneric     { return &gf.native }
+
+func (gf *GenericFunc) paramDeclList() []*GenericParamTypeDecl {
+	return gf.paramDecls
+}
 
-// Implements Type
+// Implements Type. Without a concrete type, it's an opaque type used when
+// checking the definition of a generic (see checkNative).
 type GenericParamType struct {
 	Name     string
 	Concrete Type
+
+	decl *GenericParamTypeDecl
 }
 
 func (t *GenericParamType) Known() bool {
 	if t.Concrete == nil {
-		return false
+		return true
 	}
 	return t.Concrete.Known()
 }
@@ -557,8 +724,13 @@ func (t *GenericParamType) String() string {
 
 //func (t *GenericType) Kind() Kind                             { return t.Concrete.Kind() }
 func (t *GenericParamType) Kind() Kind                             { return KIND_GENERIC_PARAM }
-func (t *GenericParamType) ZeroValue() string                      { return t.Concrete.ZeroValue() }
 func (t *GenericParamType) MapSubtypes(callback func(t Type) bool) {}
+func (t *GenericParamType) ZeroValue() string {
+	if t.Concrete == nil {
+		return "*new(" + t.Name + ")"
+	}
+	return t.Concrete.ZeroValue()
+}
 
 type GenericType struct {
 	// Base name of the type. Doesn't include package name for external types.
@@ -792,13 +964,23 @@ func IsTypeNumeric(t Type) bool {
 }
 
 type ArrayType struct {
+	// -1 in patterns of `when` branches, for arrays of any size.
 	Size int
 	Of   Type
+
+	// Non-nil when the size is given by a constant expression. Size is set
+	// to its value once it's evaluated.
+	SizeExpr Expr
 }
 
-func (t *ArrayType) Known() bool    { return t.Of.Known() }
-func (t *ArrayType) String() string { return fmt.Sprintf("[%d]%s", t.Size, t.Of.String()) }
-func (t *ArrayType) Kind() Kind     { return KIND_ARRAY }
+func (t *ArrayType) Known() bool { return t.Of.Known() }
+func (t *ArrayType) String() string {
+	if t.Size < 0 {
+		return "[_]" + t.Of.String()
+	}
+	return fmt.Sprintf("[%d]%s", t.Size, t.Of.String())
+}
+func (t *ArrayType) Kind() Kind { return KIND_ARRAY }
 func (t *ArrayType) ZeroValue() string {
 	b := bytes.Buffer{}
 	b.WriteString(fmt.Sprintf("%s{", t))
@@ -838,6 +1020,8 @@ func (t *MapType) MapSubtypes(callback func(t Type) bool) {
 
 type FuncType struct {
 	Args, Results []Type
+	// If true, the last element of Args is a slice of variadic arguments.
+	Variadic bool
 }
 
 func (t *FuncType) Known() bool {
@@ -862,7 +1046,11 @@ func (t *FuncType) Header() string {
 	out := &bytes.Buffer{}
 	out.WriteString("(")
 	for c, a := range t.Args {
-		out.WriteString(a.String())
+		if t.Variadic && c == len(t.Args)-1 {
+			out.WriteString("..." + a.(*SliceType).Of.String())
+		} else {
+			out.WriteString(a.String())
+		}
 		if (c + 1) < len(t.Args) {
 			out.WriteString(", ")
 		}
@@ -1010,6 +1198,10 @@ func (t *StructType) Kind() Kind        { return KIND_STRUCT }
 func (t *StructType) ZeroValue() string { return fmt.Sprintf("%s{}", t) }
 func (t *StructType) MapSubtypes(callback func(t Type) bool) {
 	for _, k := range t.Keys {
+		if _, ok := t.Members[k]; !ok {
+			// Not a plain member, but a method
+			continue
+		}
 		mapSubtype(t.Members[k], callback)
 	}
 }
@@ -1064,7 +1256,17 @@ func (t *CustomType) RootType() Type {
 	}
 	return current
 }
-func (t *CustomType) ZeroValue() string { return t.RootType().ZeroValue() }
+func (t *CustomType) ZeroValue() string {
+	if t.Package != nil && t.Package.pkg != nil && t.Package.pkg.IsGo() {
+		// Types from Go packages can have unexported members, so their
+		// zero values can't be spelled out.
+		switch t.RootType().Kind() {
+		case KIND_STRUCT, KIND_ARRAY:
+			return t.String() + "{}"
+		}
+	}
+	return t.RootType().ZeroValue()
+}
 func (t *CustomType) MapSubtypes(callback func(t Type) bool) {
 	if t.Decl != nil {
 		mapSubtype(t.Decl.AliasedType, callback)
@@ -1212,6 +1414,8 @@ type FuncCallExpr struct {
 
 	Left Expr
 	Args []Expr
+	// True if the last argument is followed by `...`
+	Spread bool
 
 	// nil unless Left refers to a function
 	fn *FuncDecl
@@ -1237,6 +1441,21 @@ type FuncDecl struct {
 	GenericParamVals []Type
 
 	compilerMacros []*compilerMacro
+
+	comments *Comments
+}
+
+func (fd *FuncDecl) Comments() *Comments     { return fd.comments }
+func (fd *FuncDecl) setComments(c *Comments) { fd.comments = c }
+
+// Tells if any of the compiler macros in the function was activated.
+func (fd *FuncDecl) macroActive() bool {
+	for _, cm := range fd.compilerMacros {
+		if cm.Active {
+			return true
+		}
+	}
+	return false
 }
 
 // implements PrimaryExpr
@@ -0,0 +1,554 @@
+package have
+
+import (
+	"go/constant"
+	gotoken "go/token"
+	"math"
+)
+
+// Value of a constant expression, computed at compile time.
+type constValue struct {
+	Value constant.Value
+	// Type of a typed constant, or the default type of an untyped one.
+	Type    Type
+	Untyped bool
+}
+
+// Returned by evalConst for expressions that aren't constant at all
+// (as opposed to invalid constant expressions).
+type notConstError struct {
+	ex Expr
+}
+
+func (e *notConstError) Error() string {
+	return "Expression is not constant"
+}
+
+func isNotConst(err error) bool {
+	_, ok := err.(*notConstError)
+	return ok
+}
+
+// The predeclared `iota` identifier, available only in constant declarations.
+var iotaConst = &Constant{name: "iota"}
+
+// Evaluates a constant expression. The iota argument is the value of `iota`
+// for the constant declaration the expression comes from.
+// Works on the AST only, so it can be used before type checking (after
+// identifiers are bound to their objects).
+func evalConst(ex Expr, iota int) (*constValue, error) {
+	switch e := ex.(type) {
+	case *BasicLit:
+		return evalBasicLit(e)
+	case *Ident:
+		if e.object == iotaConst {
+			return &constValue{
+				Value:   constant.MakeInt64(int64(iota)),
+				Type:    &SimpleType{ID: SIMPLE_TYPE_INT},
+				Untyped: true,
+			}, nil
+		}
+		if c, ok := e.object.(*Constant); ok {
+			return c.Eval()
+		}
+	case *DotSelector:
+		if ident, ok := e.Left.(*Ident); ok && ident.object != nil && ident.object.ObjectType() == OBJECT_PACKAGE {
+			member := ident.object.(*ImportStmt).pkg.GetObject(e.Right.name)
+			if c, ok := member.(*Constant); ok {
+				return c.Eval()
+			}
+		}
+	case *UnaryOp:
+		return evalConstUnaryOp(e, iota)
+	case *BinaryOp:
+		return evalConstBinaryOp(e, iota)
+	case *FuncCallExpr:
+		typ, err := ExprToTypeName(nil, e.Left)
+		if err != nil || typ == nil || len(e.Args) != 1 {
+			break
+		}
+		arg, err := evalConst(e.Args[0], iota)
+		if err != nil {
+			return nil, err
+		}
+		return convertConst(e, arg, typ)
+	}
+	return nil, &notConstError{ex}
+}
+
+func evalBasicLit(lit *BasicLit) (*constValue, error) {
+	var kind gotoken.Token
+	switch lit.token.Type {
+	case TOKEN_TRUE, TOKEN_FALSE:
+		return &constValue{
+			Value:   constant.MakeBool(lit.token.Type == TOKEN_TRUE),
+			Type:    &SimpleType{ID: SIMPLE_TYPE_BOOL},
+			Untyped: true,
+		}, nil
+	case TOKEN_INT:
+		kind = gotoken.INT
+	case TOKEN_FLOAT:
+		kind = gotoken.FLOAT
+	case TOKEN_IMAG:
+		kind = gotoken.IMAG
+	case TOKEN_RUNE:
+		kind = gotoken.CHAR
+	case TOKEN_STR:
+		kind = gotoken.STRING
+	default:
+		return nil, &notConstError{lit}
+	}
+
+	val := constant.MakeFromLiteral(lit.token.Value.(string), kind, 0)
+	if val.Kind() == constant.Unknown {
+		return nil, ExprErrorf(lit, CodeInvalidLiteral, "Invalid literal %s", lit.token.Value)
+	}
+	_, typ := lit.GuessType(nil)
+	return &constValue{Value: val, Type: typ, Untyped: true}, nil
+}
+
+func evalConstUnaryOp(ex *UnaryOp, iota int) (*constValue, error) {
+	var op gotoken.Token
+	switch ex.op.Type {
+	case TOKEN_PLUS:
+		op = gotoken.ADD
+	case TOKEN_MINUS:
+		op = gotoken.SUB
+	default:
+		return nil, &notConstError{ex}
+	}
+
+	right, err := evalConst(ex.Right, iota)
+	if err != nil {
+		return nil, err
+	}
+	if !IsTypeNumeric(constRootType(right)) {
+		return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s not defined for %s", ex.op.Value, right.Type)
+	}
+
+	result := &constValue{
+		Value:   constant.UnaryOp(op, right.Value, 0),
+		Type:    right.Type,
+		Untyped: right.Untyped,
+	}
+	return result, checkConstOverflow(ex, result)
+}
+
+var constBinaryOps = map[TokenType]gotoken.Token{
+	TOKEN_PLUS:    gotoken.ADD,
+	TOKEN_MINUS:   gotoken.SUB,
+	TOKEN_MUL:     gotoken.MUL,
+	TOKEN_DIV:     gotoken.QUO,
+	TOKEN_PERCENT: gotoken.REM,
+	TOKEN_AMP:     gotoken.AND,
+	TOKEN_PIPE:    gotoken.OR,
+	TOKEN_SHL:     gotoken.SHL,
+	TOKEN_SHR:     gotoken.SHR,
+	TOKEN_AND:     gotoken.LAND,
+	TOKEN_OR:      gotoken.LOR,
+	TOKEN_EQUALS:  gotoken.EQL,
+	TOKEN_NEQUALS: gotoken.NEQ,
+	TOKEN_LT:      gotoken.LSS,
+	TOKEN_GT:      gotoken.GTR,
+	TOKEN_EQ_LT:   gotoken.LEQ,
+	TOKEN_EQ_GT:   gotoken.GEQ,
+}
+
+// Shifting by more than that is surely a mistake.
+const maxConstShift = 1 << 12
+
+func evalConstBinaryOp(ex *BinaryOp, iota int) (*constValue, error) {
+	op, ok := constBinaryOps[ex.op.Type]
+	if !ok {
+		return nil, &notConstError{ex}
+	}
+
+	left, err := evalConst(ex.Left, iota)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalConst(ex.Right, iota)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == gotoken.SHL || op == gotoken.SHR {
+		return evalConstShift(ex, op, left, right)
+	}
+
+	// Bring both operands to a common type.
+	switch {
+	case !left.Untyped && !right.Untyped:
+		if left.Type.String() != right.Type.String() {
+			return nil, ExprErrorf(ex, CodeMismatchedTypes, "Mismatched types %s and %s", left.Type, right.Type)
+		}
+	case !left.Untyped:
+		if right, err = convertConst(ex.Right, right, left.Type); err != nil {
+			return nil, err
+		}
+	case !right.Untyped:
+		if left, err = convertConst(ex.Left, left, right.Type); err != nil {
+			return nil, err
+		}
+	default:
+		// Untyped operands can still be of different kinds, e.g. bool and int.
+		if left.Value.Kind() != right.Value.Kind() && !(isConstNumeric(left.Value) && isConstNumeric(right.Value)) {
+			return nil, ExprErrorf(ex, CodeMismatchedTypes, "Mismatched types %s and %s", left.Type, right.Type)
+		}
+		if constKindRank(right.Type) > constKindRank(left.Type) {
+			left = &constValue{Value: left.Value, Type: right.Type, Untyped: true}
+		}
+	}
+
+	root := constRootType(left)
+
+	switch {
+	case ex.op.IsCompOp():
+		if ex.op.IsOrderOp() && !(IsTypeNumeric(root) || IsTypeString(root)) || IsTypeComplexType(root) && ex.op.IsOrderOp() {
+			return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s not defined for %s", ex.op.Value, left.Type)
+		}
+		return &constValue{
+			Value:   constant.MakeBool(constant.Compare(left.Value, op, right.Value)),
+			Type:    &SimpleType{ID: SIMPLE_TYPE_BOOL},
+			Untyped: true,
+		}, nil
+	case op == gotoken.LAND || op == gotoken.LOR:
+		if !IsTypeBool(root) {
+			return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s not defined for %s", ex.op.Value, left.Type)
+		}
+	case IsTypeString(root):
+		if op != gotoken.ADD {
+			return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s not defined for %s", ex.op.Value, left.Type)
+		}
+	case IsTypeNumeric(root):
+		intOnly := op == gotoken.REM || op == gotoken.AND || op == gotoken.OR
+		if intOnly && (constant.ToInt(left.Value).Kind() != constant.Int ||
+			constant.ToInt(right.Value).Kind() != constant.Int) {
+			return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s requires integer operands", ex.op.Value)
+		}
+		if op == gotoken.QUO || op == gotoken.REM {
+			if constant.Sign(right.Value) == 0 {
+				return nil, ExprErrorf(ex, CodeDivisionByZero, "Division by zero")
+			}
+			if op == gotoken.QUO && left.Value.Kind() == constant.Int && right.Value.Kind() == constant.Int {
+				// Integer division, as opposed to the exact one.
+				op = gotoken.QUO_ASSIGN
+			}
+		}
+		if intOnly {
+			left.Value, right.Value = constant.ToInt(left.Value), constant.ToInt(right.Value)
+		}
+	default:
+		return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s not defined for %s", ex.op.Value, left.Type)
+	}
+
+	result := &constValue{
+		Value:   constant.BinaryOp(left.Value, op, right.Value),
+		Type:    left.Type,
+		Untyped: left.Untyped,
+	}
+	return result, checkConstOverflow(ex, result)
+}
+
+func evalConstShift(ex *BinaryOp, op gotoken.Token, left, right *constValue) (*constValue, error) {
+	count := constant.ToInt(right.Value)
+	if count.Kind() != constant.Int || !right.Untyped && !IsTypeIntKind(constRootType(right)) {
+		return nil, ExprErrorf(ex.Right, CodeInvalidShift, "Shift count must be an integer")
+	}
+	s, ok := constant.Uint64Val(count)
+	if !ok || constant.Sign(count) < 0 {
+		return nil, ExprErrorf(ex.Right, CodeInvalidShift, "Invalid shift count %s", count)
+	}
+	if s > maxConstShift {
+		return nil, ExprErrorf(ex.Right, CodeInvalidShift, "Shift count %d too large", s)
+	}
+
+	val := constant.ToInt(left.Value)
+	if val.Kind() != constant.Int || !left.Untyped && !IsTypeIntKind(constRootType(left)) {
+		return nil, ExprErrorf(ex.Left, CodeInvalidShift, "Only integers can be shifted")
+	}
+
+	typ := left.Type
+	if left.Untyped {
+		// Shifted untyped constants are always integers.
+		typ = &SimpleType{ID: SIMPLE_TYPE_INT}
+	}
+
+	result := &constValue{
+		Value:   constant.Shift(val, op, uint(s)),
+		Type:    typ,
+		Untyped: left.Untyped,
+	}
+	return result, checkConstOverflow(ex, result)
+}
+
+// Untyped constants of different kinds are converted to the "bigger" kind
+// when used together, e.g. 1 + 2.0 is an untyped float.
+func constKindRank(t Type) int {
+	switch {
+	case IsTypeComplexType(t):
+		return 3
+	case IsTypeFloatKind(t):
+		return 2
+	case IsTypeSimple(t, SIMPLE_TYPE_RUNE):
+		return 1
+	}
+	return 0
+}
+
+// Root type of a constant's type (UnknownType if it isn't bound yet).
+func constRootType(v *constValue) Type {
+	if custom, ok := v.Type.(*CustomType); ok && custom.Decl == nil {
+		return &UnknownType{}
+	}
+	return RootType(v.Type)
+}
+
+func checkConstOverflow(ex Expr, v *constValue) error {
+	if v.Untyped {
+		return nil
+	}
+	root, ok := constRootType(v).(*SimpleType)
+	if !ok {
+		return nil
+	}
+	if _, ok := representConst(v.Value, root); !ok {
+		return ExprErrorf(ex, CodeConstantOverflow, "Constant %s overflows %s", v.Value, v.Type)
+	}
+	return nil
+}
+
+// Converts a constant value to a given type (explicitly, or implicitly when
+// an untyped constant is used as a typed one).
+func convertConst(ex Expr, v *constValue, typ Type) (*constValue, error) {
+	result := &constValue{Value: v.Value, Type: typ}
+	root := constRootType(result)
+	if root.Kind() == KIND_UNKNOWN {
+		// Type not known yet, nothing to check.
+		return result, nil
+	}
+
+	simple, ok := root.(*SimpleType)
+	if !ok {
+		return nil, &notConstError{ex}
+	}
+
+	val, ok := representConst(v.Value, simple)
+	if !ok {
+		return nil, constMismatchError(ex, v.Value, simple, typ)
+	}
+	result.Value = val
+	return result, nil
+}
+
+func isConstNumeric(v constant.Value) bool {
+	switch v.Kind() {
+	case constant.Int, constant.Float, constant.Complex:
+		return true
+	}
+	return false
+}
+
+var constIntRanges = map[SimpleTypeID][2]int64{
+	SIMPLE_TYPE_INT8:  {math.MinInt8, math.MaxInt8},
+	SIMPLE_TYPE_INT16: {math.MinInt16, math.MaxInt16},
+	SIMPLE_TYPE_INT32: {math.MinInt32, math.MaxInt32},
+	SIMPLE_TYPE_RUNE:  {math.MinInt32, math.MaxInt32},
+	SIMPLE_TYPE_INT64: {math.MinInt64, math.MaxInt64},
+	SIMPLE_TYPE_INT:   {math.MinInt64, math.MaxInt64},
+}
+
+var constUintRanges = map[SimpleTypeID]uint64{
+	SIMPLE_TYPE_UINT8:   math.MaxUint8,
+	SIMPLE_TYPE_BYTE:    math.MaxUint8,
+	SIMPLE_TYPE_UINT16:  math.MaxUint16,
+	SIMPLE_TYPE_UINT32:  math.MaxUint32,
+	SIMPLE_TYPE_UINT64:  math.MaxUint64,
+	SIMPLE_TYPE_UINT:    math.MaxUint64,
+	SIMPLE_TYPE_UINTPTR: math.MaxUint64,
+}
+
+// Tells if a constant value can be represented by a value of the given type,
+// and returns it converted to the type's representation (e.g. 2.0 becomes
+// an integer for integer types).
+func representConst(v constant.Value, typ *SimpleType) (constant.Value, bool) {
+	if r, ok := constIntRanges[typ.ID]; ok {
+		i := constant.ToInt(v)
+		if i.Kind() != constant.Int {
+			return nil, false
+		}
+		return i, constant.Compare(i, gotoken.GEQ, constant.MakeInt64(r[0])) &&
+			constant.Compare(i, gotoken.LEQ, constant.MakeInt64(r[1]))
+	}
+	if max, ok := constUintRanges[typ.ID]; ok {
+		i := constant.ToInt(v)
+		if i.Kind() != constant.Int {
+			return nil, false
+		}
+		return i, constant.Sign(i) >= 0 && constant.Compare(i, gotoken.LEQ, constant.MakeUint64(max))
+	}
+
+	switch typ.ID {
+	case SIMPLE_TYPE_FLOAT32, SIMPLE_TYPE_FLOAT64:
+		f := constant.ToFloat(v)
+		if f.Kind() != constant.Float {
+			return nil, false
+		}
+		return f, fitsFloat(f, typ.ID)
+	case SIMPLE_TYPE_COMPLEX64, SIMPLE_TYPE_COMPLEX128:
+		c := constant.ToComplex(v)
+		if c.Kind() != constant.Complex {
+			return nil, false
+		}
+		partID := SIMPLE_TYPE_FLOAT64
+		if typ.ID == SIMPLE_TYPE_COMPLEX64 {
+			partID = SIMPLE_TYPE_FLOAT32
+		}
+		return c, fitsFloat(constant.Real(c), partID) && fitsFloat(constant.Imag(c), partID)
+	case SIMPLE_TYPE_STRING:
+		return v, v.Kind() == constant.String
+	case SIMPLE_TYPE_BOOL:
+		return v, v.Kind() == constant.Bool
+	}
+	return nil, false
+}
+
+func fitsFloat(v constant.Value, id SimpleTypeID) bool {
+	if id == SIMPLE_TYPE_FLOAT32 {
+		f, _ := constant.Float32Val(v)
+		return !math.IsInf(float64(f), 0)
+	}
+	f, _ := constant.Float64Val(v)
+	return !math.IsInf(f, 0)
+}
+
+// Checks if the constant can be used as a value of the given type.
+func constFits(ex Expr, v *constValue, typ Type) error {
+	root, ok := RootType(typ).(*SimpleType)
+	if !ok {
+		return ExprErrorf(ex, CodeInvalidConstant, "Can't use constant %s for type %s", v.Value, typ)
+	}
+	if _, ok := representConst(v.Value, root); !ok {
+		return constMismatchError(ex, v.Value, root, typ)
+	}
+	return nil
+}
+
+// Explains why a constant value can't be represented by a type.
+func constMismatchError(ex Expr, v constant.Value, root *SimpleType, typ Type) error {
+	switch {
+	case !isConstNumeric(v) || !IsTypeNumeric(root):
+		return ExprErrorf(ex, CodeInvalidConstant, "Can't use constant %s for type %s", v, typ)
+	case (IsTypeIntKind(root) || IsTypeSimple(root, SIMPLE_TYPE_RUNE)) && constant.ToInt(v).Kind() != constant.Int:
+		return ExprErrorf(ex, CodeConstantOverflow, "Constant %s truncated to %s", v, typ)
+	}
+	return ExprErrorf(ex, CodeConstantOverflow, "Constant %s overflows %s", v, typ)
+}
+
+// Checks if a value of a constant expression fits in typ (e.g. 300 is too
+// much for int8). Does nothing for expressions that aren't constant, and for
+// operands of untyped constant expressions (see applyOperatorType).
+func (tc *TypesContext) checkConstExpr(ex Expr, typ Type) error {
+	if tc.constOperands || RootType(typ).Kind() != KIND_SIMPLE {
+		return nil
+	}
+	val, err := evalConst(ex, 0)
+	if err != nil {
+		if isNotConst(err) {
+			return nil
+		}
+		return err
+	}
+	if !val.Untyped {
+		// Typed operands were checked on their own.
+		return nil
+	}
+	return constFits(ex, val, typ)
+}
+
+// Applies typ to operands of an operator. Like in Go, untyped constant
+// expressions are evaluated exactly, and only their values have to fit in typ,
+// e.g. `300 / 100` is a fine int8, even though 300 isn't.
+func (tc *TypesContext) applyOperatorType(ex Expr, typ Type, operands ...TypedExpr) error {
+	val, err := evalConst(ex, 0)
+	whole := err == nil && val.Untyped && !tc.constOperands && RootType(typ).Kind() == KIND_SIMPLE
+	if whole {
+		tc.constOperands = true
+	}
+	err = nil
+	for _, operand := range operands {
+		if err = operand.ApplyType(tc, typ); err != nil {
+			break
+		}
+	}
+	if !whole {
+		return firstErr(err, tc.checkConstExpr(ex, typ))
+	}
+	tc.constOperands = false
+	return firstErr(err, constFits(ex, val, typ))
+}
+
+// Computes value of the constant (only once, the result is cached).
+func (c *Constant) Eval() (*constValue, error) {
+	if c.value != nil {
+		return c.value, nil
+	}
+	if c.evaluating {
+		return nil, posErrorf(c.pos, CodeDependencyLoop, "Constant %s is defined in terms of itself", c.name)
+	}
+	if c.init == nil {
+		return nil, posErrorf(c.pos, CodeNotConstant, "Constant %s has no value", c.name)
+	}
+
+	c.evaluating = true
+	defer func() { c.evaluating = false }()
+
+	v, err := evalConst(c.init, c.iota)
+	if err != nil {
+		if isNotConst(err) {
+			return nil, ExprErrorf(c.init, CodeNotConstant, "Value of constant %s is not constant", c.name)
+		}
+		return nil, err
+	}
+
+	if c.Type != nil {
+		if !v.Untyped && v.Type.String() != c.Type.String() {
+			return nil, ExprErrorf(c.init, CodeInvalidConstant, "Can't use %s constant as %s", v.Type, c.Type)
+		}
+		v, err = convertConst(c.init, v, c.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.value = v
+	return v, nil
+}
+
+// Resolves sizes of arrays declared with constant expressions.
+func resolveArraySizes(arrays []*ArrayType) (errors []error) {
+	for _, arr := range arrays {
+		v, err := evalConst(arr.SizeExpr, 0)
+		if err != nil {
+			if isNotConst(err) {
+				err = ExprErrorf(arr.SizeExpr, CodeInvalidArraySize, "Array size must be a constant")
+			} else if isUnplaced(err) {
+				err = exprError(arr.SizeExpr, err)
+			}
+			errors = append(errors, err)
+			continue
+		}
+		size, ok := representConst(v.Value, &SimpleType{ID: SIMPLE_TYPE_INT})
+		if !ok || !v.Untyped && !IsTypeIntKind(constRootType(v)) {
+			errors = append(errors, ExprErrorf(arr.SizeExpr, CodeInvalidArraySize, "Array size must be an integer"))
+			continue
+		}
+		n, _ := constant.Int64Val(size)
+		if n < 0 {
+			errors = append(errors, ExprErrorf(arr.SizeExpr, CodeInvalidArraySize, "Array size can't be negative"))
+			continue
+		}
+		arr.Size = int(n)
+	}
+	return
+}
@@ -1,26 +1,201 @@
 package have
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 import gotoken "go/token"
 
 type CompileError struct {
 	Message string
 	Pos     gotoken.Pos
+	// End of the erroneous code, if known (NoPos otherwise).
+	End gotoken.Pos
+	// Kind of the error, for tools.
+	Code ErrorCode
+	// Instantiations of generics that led to the error, innermost first.
+	Trace []TraceFrame
 }
 
-func CompileErrorf(token *Token, message string, args ...interface{}) *CompileError {
-	return &CompileError{
+// A generic instantiated with concrete params, e.g. `List[int]`, and the place
+// where the instantiation was needed.
+type TraceFrame struct {
+	Name string
+	Pos  gotoken.Pos
+}
+
+// Stable identifier of a kind of errors, e.g. "unknown-identifier". Messages
+// of errors can change, their codes don't.
+type ErrorCode string
+
+const (
+	CodeSyntax                  ErrorCode = "syntax"                    // Code that can't be parsed
+	CodeMisplaced               ErrorCode = "misplaced"                 // Statement or declaration not allowed where it is
+	CodeInternal                ErrorCode = "internal"                  // Bug of the compiler
+	CodeImport                  ErrorCode = "import"                    // Package that can't be imported
+	CodePackageClause           ErrorCode = "package-clause"            // Files of different packages in one directory
+	CodeRedeclared              ErrorCode = "redeclared"                // Name declared twice
+	CodeDependencyLoop          ErrorCode = "dependency-loop"           // Declarations that depend on each other
+	CodeUnknownIdentifier       ErrorCode = "unknown-identifier"        // Name that isn't declared
+	CodeUnknownType             ErrorCode = "unknown-type"              // Type name that isn't declared
+	CodeNoMember                ErrorCode = "no-member"                 // Selector of a member that doesn't exist
+	CodeNotAType                ErrorCode = "not-a-type"                // Value used as a type
+	CodeNotAValue               ErrorCode = "not-a-value"               // Type or generic used as a value
+	CodeNotAFunction            ErrorCode = "not-a-function"            // Call of something that isn't a function
+	CodeNotAPointer             ErrorCode = "not-a-pointer"             // Dereference of a value that isn't a pointer
+	CodeNotAssignable           ErrorCode = "not-assignable"            // Value of a type that can't be used for another type
+	CodeUnassignable            ErrorCode = "unassignable"              // Assignment to something that isn't a variable
+	CodeAssignmentMismatch      ErrorCode = "assignment-mismatch"       // Different numbers of assigned values and variables
+	CodeWrongArgumentCount      ErrorCode = "wrong-argument-count"      // Too many or too few arguments
+	CodeWrongResultCount        ErrorCode = "wrong-result-count"        // Too many or too few returned values
+	CodeInvalidArgument         ErrorCode = "invalid-argument"          // Argument that a builtin can't be used with
+	CodeInvalidVariadic         ErrorCode = "invalid-variadic"          // Misuse of `...`
+	CodeInvalidLiteral          ErrorCode = "invalid-literal"           // Literal that doesn't match its type
+	CodeInvalidConversion       ErrorCode = "invalid-conversion"        // Conversion between types that don't allow it
+	CodeInvalidTypeAssertion    ErrorCode = "invalid-type-assertion"    // Type assertion that can't succeed
+	CodeInvalidOperator         ErrorCode = "invalid-operator"          // Operator used with operands of wrong types
+	CodeInvalidShift            ErrorCode = "invalid-shift"             // Shift by a wrong count, or of a non-integer
+	CodeInvalidIndex            ErrorCode = "invalid-index"             // Index or slice expression that can't be used
+	CodeInvalidChannelOperation ErrorCode = "invalid-channel-operation" // Send or receive that can't be done
+	CodeInvalidSwitch           ErrorCode = "invalid-switch"            // Malformed clauses of a switch
+	CodeInvalidPattern          ErrorCode = "invalid-pattern"           // Type pattern that can't match anything
+	CodeInvalidNil              ErrorCode = "invalid-nil"               // Nil used for a type that can't be nil
+	CodeMismatchedTypes         ErrorCode = "mismatched-types"          // Operands of different types
+	CodeNotComparable           ErrorCode = "not-comparable"            // Values that can't be compared or ordered
+	CodeNotIterable             ErrorCode = "not-iterable"              // Range over a type that doesn't allow it
+	CodeCantInfer               ErrorCode = "cant-infer"                // Types that can't be inferred
+	CodeUnsatisfiedConstraint   ErrorCode = "unsatisfied-constraint"    // Param of a generic not allowed by its constraint
+	CodeUnusedExpression        ErrorCode = "unused-expression"         // Expression used as a statement, without effects
+	CodeNotConstant             ErrorCode = "not-constant"              // Value that has to be a constant, but isn't
+	CodeInvalidConstant         ErrorCode = "invalid-constant"          // Constant used for a type that can't hold it
+	CodeInvalidConstantType     ErrorCode = "invalid-constant-type"     // Constant declared with a non-basic type
+	CodeConstantOverflow        ErrorCode = "constant-overflow"         // Constant value that doesn't fit in its type
+	CodeDivisionByZero          ErrorCode = "division-by-zero"          // Constant division by zero
+	CodeInvalidArraySize        ErrorCode = "invalid-array-size"        // Array size that isn't a non-negative integer constant
+	CodeInvalidTestSignature    ErrorCode = "invalid-test-signature"    // Test function with a wrong signature
+)
+
+func CompileErrorf(token *Token, code ErrorCode, message string, args ...interface{}) *CompileError {
+	err := &CompileError{
 		Message: fmt.Sprintf(message, args...),
 		Pos:     token.Pos,
+		Code:    code,
 	}
+	if token.Type == TOKEN_WORD {
+		err.End = token.Pos + gotoken.Pos(len([]rune(token.Value.(string))))
+	}
+	return err
 }
 
-func ExprErrorf(expr Expr, message string, args ...interface{}) *CompileError {
+func ExprErrorf(expr Expr, code ErrorCode, message string, args ...interface{}) *CompileError {
 	return &CompileError{
 		Message: fmt.Sprintf(message, args...),
 		Pos:     expr.Pos(),
+		End:     exprEnd(expr),
+		Code:    code,
+	}
+}
+
+// Returns end of an expression if it's easy to tell, NoPos otherwise.
+func exprEnd(expr Expr) gotoken.Pos {
+	if ident, ok := expr.(*Ident); ok {
+		return ident.Pos() + gotoken.Pos(len([]rune(ident.name)))
+	}
+	return gotoken.NoPos
+}
+
+// For errors that aren't related to a single token or expression,
+// e.g. declarations in other files.
+func posErrorf(pos gotoken.Pos, code ErrorCode, message string, args ...interface{}) *CompileError {
+	return &CompileError{
+		Message: fmt.Sprintf(message, args...),
+		Pos:     pos,
+		Code:    code,
+	}
+}
+
+// Creates an error in places that don't know where the problem is,
+// the position is attached later with exprError or placeErrors.
+func unplacedErrorf(code ErrorCode, message string, args ...interface{}) *CompileError {
+	return posErrorf(gotoken.NoPos, code, message, args...)
+}
+
+// Creates an error at the position of an expression, keeping the message
+// and the code of the original error.
+func exprError(expr Expr, err error) *CompileError {
+	return moveError(err, expr.Pos(), exprEnd(expr))
+}
+
+// Creates an error at the given position, keeping the message and the code
+// of the original error. Errors other than CompileErrors come from loading
+// packages (e.g. from package locators).
+func moveError(err error, pos, end gotoken.Pos) *CompileError {
+	result := &CompileError{
+		Message: err.Error(),
+		Pos:     pos,
+		End:     end,
+		Code:    CodeImport,
+	}
+	if ce, ok := err.(*CompileError); ok {
+		result.Code = ce.Code
+	}
+	return result
+}
+
+// Attaches the position of an expression to the errors that don't have any,
+// including plain errors, e.g. the ones coming from package locators.
+func placeErrors(expr Expr, errs []error) []error {
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		if _, ok := err.(*CompileError); !ok || isUnplaced(err) {
+			err = exprError(expr, err)
+		}
+		result[i] = err
 	}
+	return result
+}
+
+// Like placeErrors, for positions that don't belong to any expression.
+func placeErrorsAt(pos gotoken.Pos, errs []error) []error {
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		if _, ok := err.(*CompileError); !ok || isUnplaced(err) {
+			err = moveError(err, pos, gotoken.NoPos)
+		}
+		result[i] = err
+	}
+	return result
+}
+
+// Errors found in code of a generic instantiated with params at pos get
+// the instantiation added to their traces. The rest is left to placeErrors.
+func traceErrors(g Generic, params []Type, pos gotoken.Pos, errs []error) []error {
+	name, _ := g.Signature()
+	args := make([]string, len(params))
+	for i, p := range params {
+		args[i] = p.String()
+	}
+	frame := TraceFrame{Name: name + "[" + strings.Join(args, ", ") + "]", Pos: pos}
+
+	var result []error
+	for _, err := range errs {
+		for _, err := range flattenErrors(err) {
+			if ce, ok := err.(*CompileError); ok && !isUnplaced(ce) {
+				traced := *ce
+				traced.Trace = append(append([]TraceFrame{}, ce.Trace...), frame)
+				err = &traced
+			}
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// Tells if err was created with unplacedErrorf and still has no position.
+func isUnplaced(err error) bool {
+	ce, ok := err.(*CompileError)
+	return ok && !ce.Pos.IsValid()
 }
 
 func (ce *CompileError) Error() string {
@@ -28,6 +203,155 @@ func (ce *CompileError) Error() string {
 }
 
 func (ce *CompileError) PrettyString(fset *gotoken.FileSet) string {
+	if !ce.Pos.IsValid() {
+		return ce.Message
+	}
+	position := fset.Position(ce.Pos)
+	return fmt.Sprintf("%s:%d:%d: %s", position.Filename, position.Line, position.Column, ce.Message) +
+		ce.traceString(fset)
+}
+
+// Describes the trace of the error, e.g. "in List[int] instantiated at a.hav:12,
+// from b.hav:40", in a separate line. Empty if there's no trace.
+func (ce *CompileError) traceString(fset *gotoken.FileSet) string {
+	if len(ce.Trace) == 0 {
+		return ""
+	}
+	places := make([]string, len(ce.Trace))
+	for i, frame := range ce.Trace {
+		position := fset.Position(frame.Pos)
+		places[i] = fmt.Sprintf("%s:%d", position.Filename, position.Line)
+	}
+	return fmt.Sprintf("\n\tin %s instantiated at %s", ce.Trace[0].Name, strings.Join(places, ", from "))
+}
+
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[1;31m"
+	ansiGreen = "\x1b[1;32m"
+	ansiReset = "\x1b[0m"
+)
+
+// Like PrettyString, but also quotes the line of code the error refers to,
+// with a caret under the exact position. `source` returns code of files by
+// their names. When `colour` is true, ANSI escape codes are used.
+func (ce *CompileError) Report(fset *gotoken.FileSet, source func(filename string) string, colour bool) string {
+	if !ce.Pos.IsValid() {
+		return ce.Message
+	}
 	position := fset.Position(ce.Pos)
-	return fmt.Sprintf("%s:%d: %s", position.Filename, position.Line, ce.Message)
+	paint := func(code, s string) string {
+		if !colour {
+			return s
+		}
+		return code + s + ansiReset
+	}
+
+	result := fmt.Sprintf("%s %s", paint(ansiBold, fmt.Sprintf("%s:%d:%d:", position.Filename, position.Line, position.Column)),
+		paint(ansiRed, strings.TrimSpace(ce.Message)))
+
+	lines := strings.Split(source(position.Filename), "\n")
+	if position.Line < 1 || position.Line > len(lines) {
+		return result + ce.traceString(fset)
+	}
+	line := []rune(strings.TrimRight(lines[position.Line-1], "\r"))
+
+	// Tabs are kept, so that the caret is aligned no matter how wide they are.
+	caret := []rune{}
+	for i := 0; i < position.Column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+
+	return fmt.Sprintf("%s\n%s\n%s%s", result, string(line), string(caret), paint(ansiGreen, "^")) +
+		ce.traceString(fset)
+}
+
+// Returns position of a CompileError, or NoPos for other errors.
+func errorPos(err error) gotoken.Pos {
+	if ce, ok := err.(*CompileError); ok {
+		return ce.Pos
+	}
+	return gotoken.NoPos
+}
+
+// Many errors passed where only one fits, e.g. all the errors found in a function body.
+type ErrorList []error
+
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, err := range el {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Flattens an error into a slice, unpacking ErrorLists.
+func flattenErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if el, ok := err.(ErrorList); ok {
+		var result []error
+		for _, e := range el {
+			result = append(result, flattenErrors(e)...)
+		}
+		return result
+	}
+	return []error{err}
+}
+
+// Packs errors into a single error: nil if there are none, the error itself
+// if there's just one, and an ErrorList otherwise.
+func errorList(errs []error) error {
+	var flat []error
+	for _, err := range errs {
+		flat = append(flat, flattenErrors(err)...)
+	}
+	switch len(flat) {
+	case 0:
+		return nil
+	case 1:
+		return flat[0]
+	}
+	return ErrorList(flat)
+}
+
+// An error in a form suitable for tools (e.g. editor plugins) that read
+// compiler output as JSON.
+type Diagnostic struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// End of the erroneous code, zeros (and left out in JSON) if it isn't known.
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+	Severity  string `json:"severity"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// Errors other than CompileErrors have no position nor code.
+func NewDiagnostic(fset *gotoken.FileSet, err error) *Diagnostic {
+	d := &Diagnostic{Severity: "error", Message: strings.TrimSpace(err.Error())}
+
+	ce, ok := err.(*CompileError)
+	if !ok {
+		return d
+	}
+	d.Code = string(ce.Code)
+	if !ce.Pos.IsValid() {
+		return d
+	}
+
+	start := fset.Position(ce.Pos)
+	d.File, d.Line, d.Column = start.Filename, start.Line, start.Column
+	if ce.End.IsValid() {
+		end := fset.Position(ce.End)
+		d.EndLine, d.EndColumn = end.Line, end.Column
+	}
+	return d
 }
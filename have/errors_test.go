@@ -2,6 +2,9 @@ package have
 
 import (
 	"fmt"
+	gotoken "go/token"
+	gotypes "go/types"
+	"strings"
 	"testing"
 )
 
@@ -41,26 +44,26 @@ func TestErrors(t *testing.T) {
 			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
 func main():
 	var x int = "aaa"
-`}}, []string{"a.hav:3: Can't use this literal for type int"},
+`}}, []string{"a.hav:3:14: Can't use this literal for type int"},
 		},
 
 		{
 			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
-~`}}, []string{"a.hav:2: Unexpected token (expected a primary expression): TOKEN_UNEXP_CHAR"},
+$`}}, []string{"a.hav:2:1: Unexpected token (expected a primary expression): TOKEN_UNEXP_CHAR"},
 		},
 
 		{
 			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
 func main():
 	somethingUnknown()
-`}}, []string{"a.hav:3: Unknown identifier: somethingUnknown"},
+`}}, []string{"a.hav:3:2: Unknown identifier: somethingUnknown"},
 		},
 
 		{
 			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
 func main():
 	somethingUnknown[int]()
-`}}, []string{"a.hav:3: Unknown identifier: somethingUnknown"},
+`}}, []string{"a.hav:3:2: Unknown identifier: somethingUnknown"},
 		},
 	}
 
@@ -68,3 +71,775 @@ func main():
 		testErrors(t, c.files, c.errors)
 	}
 }
+
+func TestErrorsMultiple(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var x int = "aaa"
+	var y string = 1
+func g():
+	var z bool = 2
+var w int = "bbb"
+`}}, []string{
+				"a.hav:3:14: Can't use this literal for type int",
+				"a.hav:4:17: Can't use this literal for type string",
+				"a.hav:6:15: Can't use this literal for type bool",
+				"a.hav:7:13: Can't use this literal for type int",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct A:
+	func f():
+		var x int = "aaa"
+	func g():
+		var y int = "bbb"
+`}}, []string{
+				"a.hav:4:15: Can't use this literal for type int",
+				"a.hav:6:15: Can't use this literal for type int",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f(a int):
+	if a > 0:
+		var x int = "aaa"
+	else:
+		var y int = "bbb"
+`}}, []string{
+				"a.hav:4:15: Can't use this literal for type int",
+				"a.hav:6:15: Can't use this literal for type int",
+			},
+		},
+
+		// Errors caused by using variables whose declarations failed aren't reported.
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var x = 1 + "a"
+	var y = x + 1
+	var z int = y
+	var w string = 1
+`}}, []string{
+				"a.hav:3:12: Too little information to infer types",
+				"a.hav:6:17: Can't use this literal for type string",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+var x = 1 + "a"
+var y = x
+func f():
+	var z int = y
+`}}, []string{
+				"a.hav:2:11: Too little information to infer types",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+func TestErrorsSyntaxRecovery(t *testing.T) {
+	testErrors(t, []fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f(a ...int, b int):
+	pass
+func g():
+	const c int
+	if true:
+		const d
+	else:
+		pass
+	var x int = 1
+func h() ...int:
+	pass
+func k():
+	pass
+`}}, []string{
+		"a.hav:2:16: Only the last parameter can be variadic",
+		"a.hav:5:13: Missing value in constant declaration",
+		"a.hav:7:9: Missing value in constant declaration",
+		"a.hav:11:10: Expected `:`",
+	})
+
+	// Errors found at the ends of lines.
+	testErrors(t, []fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var x = 3 +
+	var y = 3 3
+	var z = 3 )
+	if 1 ==:
+		pass
+	var b = 1 +
+	var c int = 2 +
+	var d = 2 )
+var e = 3 3
+var g = 3 +
+func h():
+	pass
+`}}, []string{
+		fmt.Sprintf("a.hav:3:13: Unexpected token (expected a primary expression): %s", TOKEN_INDENT),
+		fmt.Sprintf("a.hav:4:12: Unexpected token after a statement: %s", TOKEN_INT),
+		fmt.Sprintf("a.hav:5:12: Unexpected token after a statement: %s", TOKEN_RPARENTH),
+		fmt.Sprintf("a.hav:6:5: Couldn't parse the condition expression: Unexpected token (expected a primary expression): %s", TOKEN_COLON),
+		fmt.Sprintf("a.hav:8:13: Unexpected token (expected a primary expression): %s", TOKEN_INDENT),
+		fmt.Sprintf("a.hav:9:17: Unexpected token (expected a primary expression): %s", TOKEN_INDENT),
+		fmt.Sprintf("a.hav:10:12: Unexpected token after a statement: %s", TOKEN_RPARENTH),
+		fmt.Sprintf("a.hav:11:11: Unexpected token after a statement: %s", TOKEN_INT),
+		fmt.Sprintf("a.hav:12:12: Unexpected token (expected a primary expression): %s", TOKEN_INDENT),
+	})
+}
+
+func TestErrorsPackageLevel(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var x Foo
+`}}, []string{"a.hav:3:8: Unknown type Foo"},
+		},
+
+		{
+			[]fakeLocatorFile{
+				fakeLocatorFile{"a", "a.hav", `package a
+var x int
+`},
+				fakeLocatorFile{"a", "b.hav", `package a
+var y int
+var x string
+`}}, []string{"b.hav:3:1: Redeclared x in the same package, previous declaration at a.hav:2:1"},
+		},
+
+		{
+			[]fakeLocatorFile{
+				fakeLocatorFile{"a", "a.hav", `package a
+`},
+				fakeLocatorFile{"a", "b.hav", `package b
+`}}, []string{"b.hav:1:9: Different packages in one dir: a and b"},
+		},
+
+		{
+			[]fakeLocatorFile{
+				fakeLocatorFile{"a", "a.hav", `package a
+import "b"
+`},
+				fakeLocatorFile{"b", "b.hav", `package b
+import "a"
+`}}, []string{
+				"a.hav:2:8: Import cycle (a -> b -> a): a imports b",
+				"b.hav:2:8: Import cycle (a -> b -> a): b imports a",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+import "nope"
+`}}, []string{"a.hav:2:8: Package nope can't be found"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func g[T](x T) T:
+	return x
+func f():
+	var x = g[int, int](1)
+`}}, []string{"a.hav:5:11: Wrong number of generic args: 2, not 1"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+interface Shape:
+	func Area() int
+func total[T implements Shape](s []T) int:
+	return 0
+func f():
+	var x = total([]int{1})
+	var y = total[string](nil)
+`}}, []string{
+				"a.hav:7:15: int doesn't satisfy the constraint `T implements Shape`",
+				"a.hav:8:15: string doesn't satisfy the constraint `T implements Shape`",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct Set[K is comparable]:
+	m map[K]bool
+var s Set[[]int]
+`}}, []string{"a.hav:4:7: []int doesn't satisfy the constraint `K is comparable`"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func g[T implements int](x T):
+	pass
+`}}, []string{"a.hav:2:8: Not an interface: int"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+var a = b
+var b = a
+`}}, []string{
+				"a.hav:2:1: Dependency loop: a depends on b",
+				"a.hav:3:1: Dependency loop: b depends on a",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+var x = nil
+func f():
+	var y = nil
+`}}, []string{
+				"a.hav:2:9: Too little information to infer types",
+				"a.hav:4:10: Too little information to infer types",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+const:
+	a = b
+	b = a
+`}}, []string{"a.hav:3:2: Constant a is defined in terms of itself"},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+// Definitions of generics are checked even if they're never instantiated.
+// Errors that depend on params are reported by instantiations.
+func TestErrorsGenericDefinitions(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](x T) T:
+	var y int = "a"
+	return x + unknown()
+struct S[T]:
+	v T
+	func get() T:
+		var z string = 1
+		return self.v + 1
+`}}, []string{
+				"a.hav:3:14: Can't use this literal for type int",
+				"a.hav:4:13: Unknown identifier: unknown",
+				"a.hav:8:18: Can't use this literal for type string",
+				"a.hav:9:19: Can't use this literal for type T (code for specific types of params has to be in `when` branches)",
+			},
+		},
+
+		// Opaque params allow only what their constraints and `when` branches do.
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](x T) int:
+	return x.y
+func g[T](x T) T:
+	return x + 1
+struct S[T]:
+	x T
+	func h():
+		self.x.foo()
+interface Namer:
+	func name() string
+func n[T implements Namer](x T) string:
+	return x.name()
+func m[T](x T) T:
+	when T
+	is int:
+		return x + 1
+	default:
+		return x
+func o[T](a, b T) bool:
+	var c = a + b
+	var d = -a
+	a += b
+	var e = float64(a)
+	return a < b
+`}}, []string{
+				"a.hav:3:9: Dot selector used for type T (code for specific types of params has to be in `when` branches)",
+				"a.hav:5:13: Can't use this literal for type T (code for specific types of params has to be in `when` branches)",
+				"a.hav:9:7: Dot selector used for type T (code for specific types of params has to be in `when` branches)",
+				"a.hav:21:12: Operator + can't be used with values of T (code for specific types of params has to be in `when` branches)",
+				"a.hav:22:10: Operator - can't be used with values of T (code for specific types of params has to be in `when` branches)",
+				"a.hav:23:4: Operator += can't be used with values of T (code for specific types of params has to be in `when` branches)",
+				"a.hav:24:17: Impossible conversion from T to float64 (code for specific types of params has to be in `when` branches)",
+				"a.hav:25:11: Operands of types T and T can't be ordered (code for specific types of params has to be in `when` branches)",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](x T) string:
+	when T
+	is int:
+		return notThere
+	implements interface: pass:
+		var s string = x
+		return s
+	default:
+		return 1
+`}}, []string{
+				"a.hav:5:10: Unknown identifier: notThere",
+				"a.hav:10:10: Can't use this literal for type string",
+			},
+		},
+
+		// Instantiations of generics whose definitions failed don't report the same errors.
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](x T) T:
+	var y int = "a"
+	return x
+func g():
+	var x = f(1)
+`}}, []string{"a.hav:3:14: Can't use this literal for type int"},
+		},
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](x T) int:
+	when T
+	is []E:
+		return len(x)
+	default:
+		return len(x)
+func g():
+	when []int
+	is []E:
+		pass
+var n = f(1)
+`}}, []string{
+				"a.hav:7:13: Invalid argument for len: int\n\tin f[int] instantiated at a.hav:12",
+				"a.hav:10:2: Types can be captured only from params of generics",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+// Errors in code of generics tell which instantiations led to them.
+func TestErrorsInstantiationTrace(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{
+				fakeLocatorFile{"a", "a.hav", `package a
+func inc[T](x T) T:
+	when T
+	is string:
+		return x + "+"
+	default:
+		return x + 1
+func twice[T](x T) T:
+	return inc(inc(x))
+`},
+				fakeLocatorFile{"a", "b.hav", `package a
+func g():
+	var s = twice(true)
+`}}, []string{
+				"a.hav:7:14: Can't use this literal for type bool\n\tin inc[bool] instantiated at a.hav:9, from b.hav:3",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct Pair[K, V]:
+	k K
+	v V
+	func key() int:
+		when K
+		is string:
+			return len(self.k)
+		default:
+			return self.k
+struct List[T]:
+	items []T
+	func first() int:
+		return self.items[0].key()
+var l List[Pair[bool, int]]
+`}}, []string{
+				"a.hav:10:15: Types int and bool are not assignable\n\tin Pair[bool, int] instantiated at a.hav:15",
+				"a.hav:14:20: Dot selector used for type T" + opaqueParamsHint,
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct Box[T]:
+	v T
+	func next() T:
+		return inc(self.v)
+func inc[T](x T) T:
+	when T
+	is string:
+		return x + "+"
+	default:
+		return x + 1
+var b Box[bool]
+`}}, []string{
+				"a.hav:11:14: Can't use this literal for type bool\n\tin inc[bool] instantiated at a.hav:5, from a.hav:12",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+// Errors found when declarations are bound and ordered don't hide type errors
+// of the statements that don't use the broken declarations.
+func TestErrorsBeforeTypeChecking(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct S:
+	a Unknown
+func f(s S) int:
+	return s.b
+func g() int:
+	return "b"
+var x int = "a"
+var y = x + f(S{})
+`}}, []string{
+				"a.hav:3:4: Unknown type Unknown",
+				"a.hav:7:9: Can't use this literal for type int",
+				"a.hav:8:13: Can't use this literal for type int",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+var a = b
+var b = a
+var c = a + 1
+var d int = "d"
+struct T:
+	x [len(e)]int
+var e = "e"
+`}}, []string{
+				"a.hav:2:1: Dependency loop: a depends on b",
+				"a.hav:3:1: Dependency loop: b depends on a",
+				"a.hav:5:13: Can't use this literal for type int",
+				"a.hav:7:8: Array size must be a constant",
+			},
+		},
+
+		{
+			[]fakeLocatorFile{
+				fakeLocatorFile{"a", "a.hav", `package a
+var x int
+func f() int:
+	return x + "x"
+`},
+				fakeLocatorFile{"a", "b.hav", `package a
+var x, y = "x", 1
+var z string = y
+`}}, []string{
+				"a.hav:4:13: Can't use this literal for type int",
+				"b.hav:2:1: Redeclared x in the same package, previous declaration at a.hav:2:1",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+// Odd code used to crash the compiler.
+func TestErrorsNoPanic(t *testing.T) {
+	var cases = []struct {
+		files  []fakeLocatorFile
+		errors []string
+	}{
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var x = /1
+`}}, []string{"a.hav:3:10: Operator / can't be used as a unary operator"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f():
+	var c chan int
+	var x, y, z = <-c
+`}}, []string{"a.hav:4:16: Assignment mismatch: 3 variables but 2 values"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct S[T]:
+	x T
+func f():
+	var s S[int, int]
+`}}, []string{"a.hav:5:8: Wrong number of generic args: 2, not 1"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct S[T]:
+	x T
+func f():
+	var s S[T]
+`}}, []string{"a.hav:5:10: Unknown type T"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+var x int
+var y x
+`}}, []string{"a.hav:3:7: x is not a type"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f(a int, ] int):
+	pass
+`}}, []string{"a.hav:2:15: Expected a parameter name"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+func f[T](g func(T)) T:
+	pass
+var g func(int) int
+var x = f(g)
+`}}, []string{"a.hav:5:10: Generic function and the parameter have incomptible types (func(T) and func(int) int)"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+const A = true + 1
+`}}, []string{"a.hav:2:16: Mismatched types bool and int"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+for var y range y:
+	pass
+`}}, []string{"a.hav:2:17: Couldn't determine the type"},
+		},
+
+		{
+			[]fakeLocatorFile{fakeLocatorFile{"a", "a.hav", `package a
+struct S:
+	i int
+	func String() string:
+		return "s"
+func f():
+	var s S
+	var n = len(s)
+`}}, []string{"a.hav:8:13: Invalid argument for len: S"},
+		},
+	}
+
+	for _, c := range cases {
+		testErrors(t, c.files, c.errors)
+	}
+}
+
+type panickingImporter struct{}
+
+func (panickingImporter) Import(path string) (*gotypes.Package, error) {
+	panic("something went wrong")
+}
+
+func TestInternalError(t *testing.T) {
+	manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", `package a
+import "b"
+`}))
+	manager.GoImporter = panickingImporter{}
+
+	_, errs := manager.Load("a")
+	if len(errs) != 1 {
+		t.Fatalf("Wrong number of errors, want 1, got %d", len(errs))
+	}
+	if got, want := errs[0].(*CompileError).PrettyString(manager.Fset),
+		"a.hav:2:8: Internal compiler error: something went wrong"; got != want {
+		t.Errorf("Wrong error, want:\n\t%s\ngot:\n\t%s", want, got)
+	}
+}
+
+// Imports packages with a constant whose value is missing, which the compiler
+// doesn't expect.
+type brokenImporter struct{}
+
+func (brokenImporter) Import(path string) (*gotypes.Package, error) {
+	pkg := gotypes.NewPackage(path, path)
+	pkg.Scope().Insert(gotypes.NewConst(gotoken.NoPos, pkg, "C", gotypes.Typ[gotypes.UntypedInt], nil))
+	pkg.MarkComplete()
+	return pkg, nil
+}
+
+// Internal errors are reported at the innermost statement being checked.
+func TestInternalErrorPos(t *testing.T) {
+	cases := []struct{ code, want string }{
+		{`package a
+import "b"
+type T [b.C + 1]int
+`, "a.hav:3:1"},
+		{`package a
+import "b"
+func f[T](x T) T:
+	var y int8 = b.C
+	return x
+func g():
+	var x = f(1)
+`, "a.hav:4:2"},
+		{`package a
+import "b"
+struct S[T]:
+	x T
+	func m():
+		if true:
+			var y int8 = b.C
+var s S[int]
+`, "a.hav:7:4"},
+	}
+	for _, c := range cases {
+		manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", c.code}))
+		manager.GoImporter = brokenImporter{}
+
+		_, errs := manager.Load("a")
+		if len(errs) != 1 {
+			t.Errorf("Wrong number of errors, want 1, got %d", len(errs))
+			continue
+		}
+		got := errs[0].(*CompileError).PrettyString(manager.Fset)
+		if want := c.want + ": Internal compiler error: "; !strings.HasPrefix(got, want) {
+			t.Errorf("Wrong error, want:\n\t%s...\ngot:\n\t%s", want, got)
+		}
+	}
+}
+
+func TestErrorReport(t *testing.T) {
+	manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", `package a
+func main():
+	var x int = "aaa"
+`}))
+
+	_, errs := manager.Load("a")
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	compErr := errs[0].(*CompileError)
+
+	want := "a.hav:3:14: Can't use this literal for type int\n" +
+		"\tvar x int = \"aaa\"\n" +
+		"\t            ^"
+	if got := compErr.Report(manager.Fset, manager.Source, false); got != want {
+		t.Errorf("Wrong report, want:\n%s\ngot:\n%s", want, got)
+	}
+
+	want = "\x1b[1ma.hav:3:14:\x1b[0m \x1b[1;31mCan't use this literal for type int\x1b[0m\n" +
+		"\tvar x int = \"aaa\"\n" +
+		"\t            \x1b[1;32m^\x1b[0m"
+	if got := compErr.Report(manager.Fset, manager.Source, true); got != want {
+		t.Errorf("Wrong coloured report, want:\n%q\ngot:\n%q", want, got)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	cases := []struct {
+		code string
+		want ErrorCode
+	}{
+		{`var x = 1 +`, CodeSyntax},
+		{`var x = y`, CodeUnknownIdentifier},
+		{`var x int = "aaa"`, CodeInvalidLiteral},
+		{`var x int8 = 300`, CodeConstantOverflow},
+		{`import "b"`, CodeImport},
+		// Codes are kept when errors of instantiations are placed where they're used.
+		{`var x = len(1)`, CodeInvalidArgument},
+		{`func f[T](x T) int:
+	return x
+var x = f("a")`, CodeNotAssignable},
+	}
+	for _, c := range cases {
+		manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", "package a\n" + c.code + "\n"}))
+		_, errs := manager.Load("a")
+		if len(errs) != 1 {
+			t.Errorf("Expected one error for %q, got %v", c.code, errs)
+			continue
+		}
+		if code := errs[0].(*CompileError).Code; code != c.want {
+			t.Errorf("Wrong code of %q, want %s, got %s", errs[0], c.want, code)
+		}
+	}
+}
+
+func TestDiagnostic(t *testing.T) {
+	manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", `package a
+func main():
+	var x = y
+`}))
+
+	_, errs := manager.Load("a")
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+
+	want := Diagnostic{
+		File:      "a.hav",
+		Line:      3,
+		Column:    10,
+		EndLine:   3,
+		EndColumn: 11,
+		Severity:  "error",
+		Code:      "unknown-identifier",
+		Message:   "Unknown identifier: y",
+	}
+	if got := NewDiagnostic(manager.Fset, errs[0]); *got != want {
+		t.Errorf("Wrong diagnostic, want %+v, got %+v", want, *got)
+	}
+
+	// The end is known only for identifiers.
+	manager = NewPkgManager(newFakeLocator(fakeLocatorFile{"a", "a.hav", `package a
+var x int = "aaa"
+`}))
+	_, errs = manager.Load("a")
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	want = Diagnostic{
+		File:     "a.hav",
+		Line:     2,
+		Column:   13,
+		Severity: "error",
+		Code:     "invalid-literal",
+		Message:  "Can't use this literal for type int",
+	}
+	if got := NewDiagnostic(manager.Fset, errs[0]); *got != want {
+		t.Errorf("Wrong diagnostic, want %+v, got %+v", want, *got)
+	}
+}
@@ -1,6 +1,13 @@
 package have
 
-import gotoken "go/token"
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	gotoken "go/token"
+)
 
 type PkgLocator interface {
 	Locate(pkgPath string) ([]*File, error)
@@ -9,12 +16,18 @@ type PkgLocator interface {
 type File struct {
 	Name, Code, Pkg string
 	size            int
+	// Position of the package name in the package clause.
+	pkgPos gotoken.Pos
+	// Comments attached to the package clause.
+	doc *Comments
 
 	statements []*TopLevelStmt
 	objects    map[string]Object
 	tfile      *gotoken.File
+	fset       *gotoken.FileSet
 	parser     *Parser
 	tc         *TypesContext
+	manager    *PkgManager
 }
 
 func NewFile(name, code string) *File {
@@ -24,26 +37,54 @@ func NewFile(name, code string) *File {
 		objects: make(map[string]Object)}
 }
 
+// Tells if it's a test file. Test files are loaded only for the package
+// being tested, see PkgManager.LoadWithTests.
+func (f *File) IsTest() bool {
+	return strings.HasSuffix(f.Name, "_test.hav")
+}
+
 func (f *File) Parse() []error {
+	return f.parse(nil)
+}
+
+// Parses the file, pkgTypes are names of types declared in its package, if
+// they're known (see Parser.pkgTypes).
+func (f *File) parse(pkgTypes map[string]bool) []error {
 	f.parser = NewParser(NewLexer([]rune(f.Code), f.tfile, 0))
+	f.parser.pkgTypes = pkgTypes
 	err := f.parser.ParseFile(f)
-	if err != nil {
-		return []error{err}
-	}
+	// Even with syntax errors, statements that were parsed are available.
 	f.objects = f.parser.topLevelDecls
-	return nil
+	return flattenErrors(err)
 }
 
-func (f *File) Typecheck() []error {
+// Tells if patterns in the parsed file captured types with any of the names.
+func (f *File) capturesAny(names map[string]bool) bool {
 	for _, stmt := range f.statements {
-		typedStmt := stmt.Stmt.(ExprToProcess)
-		if err := typedStmt.NegotiateTypes(f.tc); err != nil {
-			return []error{err}
+		for _, decl := range stmt.captured {
+			if names[decl.name] {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		//f.statements = append(f.statements, stmt)
+// Names declared by top-level statements of a parsed file, in the order of declaration.
+func (f *File) Decls() []string {
+	var result []string
+	for _, stmt := range f.statements {
+		result = append(result, stmt.Decls()...)
 	}
-	return nil
+	return result
+}
+
+func (f *File) Typecheck() []error {
+	var errors []error
+	for _, stmt := range f.statements {
+		errors = append(errors, flattenErrors(f.tc.negotiateStmt(stmt.Stmt))...)
+	}
+	return errors
 }
 
 func (f *File) ParseAndCheck() []error {
@@ -64,3 +105,58 @@ func (f *File) GenerateCode() string {
 	f.Generate(f.tc, cc)
 	return cc.ReadAll()
 }
+
+// Like GenerateCode, but the result has //line directives, so that Go tools (compiler,
+// stack traces, debuggers) refer to the Have code. The path function gets names of Have
+// files and returns their paths, relative to the directory of the generated file or absolute.
+func (f *File) GenerateCodeWithLines(path func(name string) string) string {
+	cc := &CodeChunk{lineDirectives: func(pos gotoken.Pos) string {
+		position := f.fset.Position(pos)
+		return fmt.Sprintf("//line %s:%d\n", path(position.Filename), position.Line)
+	}}
+	f.Generate(f.tc, cc)
+	return cc.ReadAll()
+}
+
+// Like in Go, names of test functions start with Test, followed by something
+// that isn't a lowercase letter. TestMain is special, it's not a test.
+func isTestFuncName(name string) bool {
+	if !strings.HasPrefix(name, "Test") || name == "TestMain" {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(name[len("Test"):])
+	return !unicode.IsLower(r)
+}
+
+// Checks if the function can be run by `go test`, i.e. it's a func(*testing.T).
+func isTestFuncType(typ *FuncType) bool {
+	if len(typ.Args) != 1 || len(typ.Results) != 0 {
+		return false
+	}
+	ptr, ok := typ.Args[0].(*PointerType)
+	if !ok {
+		return false
+	}
+	custom, ok := ptr.To.(*CustomType)
+	return ok && custom.Name == "T" && custom.Package != nil && custom.Package.path == "testing"
+}
+
+// Makes sure that test functions in a test file have the right signatures,
+// otherwise `go test` would complain about the generated code.
+func (f *File) checkTestFuncs() (errors []error) {
+	for _, stmt := range f.statements {
+		vars, ok := stmt.Stmt.(*VarStmt)
+		if !ok {
+			continue
+		}
+		vars.Vars.eachPair(func(v *Variable, init Expr) {
+			fd, ok := init.(*FuncDecl)
+			if !ok || !isTestFuncName(v.name) || isTestFuncType(fd.typ) {
+				return
+			}
+			errors = append(errors, ExprErrorf(fd, CodeInvalidTestSignature, "Test function %s should have signature func(t *testing.T)",
+				v.name))
+		})
+	}
+	return
+}
@@ -0,0 +1,332 @@
+package have
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	gotoken "go/token"
+)
+
+// A token of the code being formatted, with its text as written in the code.
+type fmtToken struct {
+	typ    TokenType
+	text   string
+	offset int
+	// Used as a binary operator, e.g. `*` in `a * b`, as opposed to `*int`.
+	binary bool
+	// Preceded by whitespace in the original code.
+	spaceBefore bool
+}
+
+// A line of the code being formatted. Lines with no tokens are either
+// blank, or have only a comment.
+type fmtLine struct {
+	indent  string
+	tokens  []*fmtToken
+	comment string
+	level   int
+	// Widths of indents of the line and the lines enclosing it.
+	stack []int
+}
+
+var fmtKeywords = map[TokenType]bool{
+	TOKEN_FOR: true, TOKEN_VAR: true, TOKEN_IF: true, TOKEN_ELSE: true, TOKEN_ELIF: true,
+	TOKEN_SWITCH: true, TOKEN_CASE: true, TOKEN_DEFAULT: true, TOKEN_RETURN: true,
+	TOKEN_STRUCT: true, TOKEN_MAP: true, TOKEN_FUNC: true, TOKEN_IMPORT: true, TOKEN_AS: true,
+	TOKEN_TYPE: true, TOKEN_IN: true, TOKEN_PASS: true, TOKEN_PACKAGE: true, TOKEN_BREAK: true,
+	TOKEN_CONTINUE: true, TOKEN_FALLTHROUGH: true, TOKEN_GOTO: true, TOKEN_INTERFACE: true,
+	TOKEN_CHAN: true, TOKEN_RANGE: true, TOKEN_WHEN: true, TOKEN_IMPLEMENTS: true, TOKEN_IS: true,
+	TOKEN_GO: true, TOKEN_DEFER: true, TOKEN_SELECT: true, TOKEN_CONST: true,
+}
+
+// Operators that can be used both as unary and binary ones. The parser
+// tells which is which (see Parser.binaryOps).
+var fmtUnaryOps = map[TokenType]bool{
+	TOKEN_MINUS: true, TOKEN_PLUS: true, TOKEN_MUL: true, TOKEN_AMP: true, TOKEN_SEND: true, TOKEN_NEGATE: true,
+}
+
+var fmtAssignOps = map[TokenType]bool{
+	TOKEN_ASSIGN: true, TOKEN_PLUS_ASSIGN: true, TOKEN_MINUS_ASSIGN: true,
+	TOKEN_MUL_ASSIGN: true, TOKEN_DIV_ASSIGN: true,
+}
+
+// Reprints Have code in the canonical style: blocks are indented with tabs,
+// tokens are separated by single spaces where it helps readability, there's
+// at most one blank line in a row. Line breaks and `#` comments are kept.
+// Returns syntax errors (with positions in fset) if the code can't be parsed.
+func Format(fset *gotoken.FileSet, filename, code string) (string, []error) {
+	runes := []rune(code)
+	parser := NewParser(NewLexer(runes, fset.AddFile(filename, fset.Base(), len(code)), 0))
+	parser.binaryOps = map[int]bool{}
+	if err := parser.ParseFile(NewFile(filename, code)); err != nil {
+		return "", flattenErrors(err)
+	}
+
+	tokens := fmtTokens(runes)
+	for _, t := range tokens {
+		t.binary = parser.binaryOps[t.offset] || fmtAssignOps[t.typ] ||
+			opSet[t.typ] && !fmtUnaryOps[t.typ]
+	}
+
+	lines := fmtSplitLines(runes, tokens)
+	fmtSetLevels(lines)
+	result := fmtPrint(lines)
+
+	// Only whitespace should have changed.
+	if !fmtSameTokens(tokens, fmtTokens([]rune(result))) {
+		return "", []error{fmt.Errorf("Formatting %s changed its tokens, it's a bug in the formatter", filename)}
+	}
+	check := gotoken.NewFileSet()
+	parser = NewParser(NewLexer([]rune(result), check.AddFile(filename, check.Base(), len(result)), 0))
+	if err := parser.ParseFile(NewFile(filename, result)); err != nil {
+		return "", []error{fmt.Errorf("Formatted %s can't be parsed, it's a bug in the formatter: %s", filename, err)}
+	}
+	return result, nil
+}
+
+// Splits code into tokens, skipping indents.
+func fmtTokens(code []rune) []*fmtToken {
+	fset := gotoken.NewFileSet()
+	lex := NewLexer(code, fset.AddFile("", fset.Base(), len(string(code))), 0)
+
+	var result []*fmtToken
+	prevEnd := 0
+	for {
+		t := lex.Next()
+		switch t.Type {
+		case TOKEN_EOF:
+			return result
+		case TOKEN_INDENT:
+			continue
+		}
+		result = append(result, &fmtToken{
+			typ:         t.Type,
+			text:        string(code[t.Offset:lex.skipped]),
+			offset:      t.Offset,
+			spaceBefore: t.Offset > prevEnd,
+		})
+		prevEnd = lex.skipped
+	}
+}
+
+func fmtSameTokens(a, b []*fmtToken) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].typ != b[i].typ || a[i].text != b[i].text {
+			return false
+		}
+	}
+	return true
+}
+
+// Groups tokens in lines. Everything between tokens is whitespace or comments.
+func fmtSplitLines(code []rune, tokens []*fmtToken) []*fmtLine {
+	lines := []*fmtLine{{}}
+	prevEnd := 0
+	for i := 0; i <= len(tokens); i++ {
+		start := len(code)
+		if i < len(tokens) {
+			start = tokens[i].offset
+		}
+
+		for j, part := range strings.Split(string(code[prevEnd:start]), "\n") {
+			if j > 0 {
+				lines = append(lines, &fmtLine{})
+			}
+			line := lines[len(lines)-1]
+			if c := strings.IndexRune(part, '#'); c >= 0 {
+				line.comment = strings.TrimRightFunc(part[c:], unicode.IsSpace)
+				part = part[:c]
+			}
+			if j > 0 || i == 0 {
+				line.indent = part
+			}
+		}
+
+		if i < len(tokens) {
+			line := lines[len(lines)-1]
+			line.tokens = append(line.tokens, tokens[i])
+			prevEnd = tokens[i].offset + len([]rune(tokens[i].text))
+		}
+	}
+	return lines
+}
+
+// Computes indentation levels of lines. Indents are compared the way the parser
+// does it, so blocks stay the same, and so do relative indents of lines broken
+// inside brackets.
+func fmtSetLevels(lines []*fmtLine) {
+	stack := []int{0}
+	for _, line := range lines {
+		if len(line.tokens) == 0 {
+			continue
+		}
+		width := len(line.indent)
+		for len(stack) > 1 && stack[len(stack)-1] > width {
+			stack = stack[:len(stack)-1]
+		}
+		if stack[len(stack)-1] < width {
+			stack = append(stack, width)
+		}
+		line.level = len(stack) - 1
+		line.stack = append([]int(nil), stack...)
+	}
+
+	// Comments are indented like the code after them, unless they're less
+	// indented, e.g. when they end a block.
+	var before *fmtLine
+	for i, line := range lines {
+		if len(line.tokens) > 0 {
+			before = line
+			continue
+		}
+		var after *fmtLine
+		for _, next := range lines[i+1:] {
+			if len(next.tokens) > 0 {
+				after = next
+				break
+			}
+		}
+
+		width := len(line.indent)
+		switch {
+		case after != nil && width >= len(after.indent):
+			line.level = after.level
+		case before != nil:
+			for level, w := range before.stack {
+				if w <= width {
+					line.level = level
+				}
+			}
+		}
+	}
+}
+
+func fmtPrint(lines []*fmtLine) string {
+	buf := bytes.Buffer{}
+	var brackets []TokenType
+	blank := false
+	for _, line := range lines {
+		if len(line.tokens) == 0 && line.comment == "" {
+			// Blank lines at the beginning are dropped, and so are the ones
+			// at the end, because they're written only before other lines.
+			blank = buf.Len() > 0
+			continue
+		}
+		if blank {
+			buf.WriteString("\n")
+			blank = false
+		}
+
+		buf.WriteString(strings.Repeat("\t", line.level))
+		for i, t := range line.tokens {
+			if i > 0 {
+				buf.WriteString(fmtSpace(line.tokens, i, brackets))
+			}
+			buf.WriteString(t.text)
+
+			switch t.typ {
+			case TOKEN_LPARENTH, TOKEN_LBRACKET, TOKEN_LBRACE:
+				brackets = append(brackets, t.typ)
+			case TOKEN_RPARENTH, TOKEN_RBRACKET, TOKEN_RBRACE:
+				if len(brackets) > 0 {
+					brackets = brackets[:len(brackets)-1]
+				}
+			}
+		}
+
+		if line.comment != "" {
+			if len(line.tokens) > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(line.comment)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// Returns whitespace to be put between the i-th token of a line and the one before it.
+// The brackets argument is a stack of brackets opened so far.
+func fmtSpace(tokens []*fmtToken, i int, brackets []TokenType) string {
+	space := fmtSpaceRule(tokens, i, brackets)
+	if space == "" && !fmtCanGlue(tokens[i-1], tokens[i]) {
+		return " "
+	}
+	return space
+}
+
+func fmtSpaceRule(tokens []*fmtToken, i int, brackets []TokenType) string {
+	prev, tok := tokens[i-1], tokens[i]
+
+	switch {
+	case tok.typ == TOKEN_SEMICOLON && prev.typ == TOKEN_FOR:
+		return " "
+	case tok.typ == TOKEN_COMMA || tok.typ == TOKEN_SEMICOLON || tok.typ == TOKEN_COLON,
+		tok.typ == TOKEN_RPARENTH || tok.typ == TOKEN_RBRACKET || tok.typ == TOKEN_RBRACE,
+		tok.typ == TOKEN_INCREMENT || tok.typ == TOKEN_DECREMENT || tok.typ == TOKEN_DOT:
+		return ""
+	case prev.typ == TOKEN_LPARENTH || prev.typ == TOKEN_LBRACKET || prev.typ == TOKEN_LBRACE || prev.typ == TOKEN_DOT:
+		return ""
+	case prev.typ == TOKEN_TILDE:
+		// Underlying types in `when`, e.g. `is ~[]_`.
+		return ""
+	case prev.typ == TOKEN_COLON:
+		// No spaces in slice expressions, e.g. a[1:2].
+		if len(brackets) > 0 && brackets[len(brackets)-1] == TOKEN_LBRACKET {
+			return ""
+		}
+		return " "
+	case prev.typ == TOKEN_COMMA || prev.typ == TOKEN_SEMICOLON:
+		return " "
+	case prev.binary || tok.binary:
+		return " "
+	case tok.typ == TOKEN_SEND && prev.typ == TOKEN_CHAN:
+		// Send-only channel, chan<- T
+		return ""
+	case fmtUnaryOps[prev.typ]:
+		if prev.typ == TOKEN_SEND && i >= 2 && tokens[i-2].typ == TOKEN_CHAN {
+			return " "
+		}
+		return ""
+	case tok.typ == TOKEN_ELLIPSIS:
+		// Variadic arguments are passed with f(a...), and declared with f(a ...int).
+		if i+1 == len(tokens) || tokens[i+1].typ == TOKEN_RPARENTH || tokens[i+1].typ == TOKEN_COMMA {
+			return ""
+		}
+		return " "
+	case prev.typ == TOKEN_ELLIPSIS:
+		return ""
+	case fmtKeywords[prev.typ]:
+		if (prev.typ == TOKEN_FUNC || prev.typ == TOKEN_MAP) && (tok.typ == TOKEN_LPARENTH || tok.typ == TOKEN_LBRACKET) {
+			return ""
+		}
+		return " "
+	case fmtKeywords[tok.typ]:
+		return " "
+	case prev.typ == TOKEN_RBRACKET:
+		// Types like []int, indexes like a[1].b, generic args like f[int](1).
+		return ""
+	case tok.typ == TOKEN_LPARENTH && prev.typ == TOKEN_RPARENTH, tok.typ == TOKEN_LBRACKET:
+		// Can be a call, f()(), or results of a function, func f() (int, int).
+		// Similarly, a[1] is an index, but `var a []int` declares a slice.
+		if tok.spaceBefore {
+			return " "
+		}
+		return ""
+	case tok.typ == TOKEN_LPARENTH || tok.typ == TOKEN_LBRACE:
+		return ""
+	}
+	return " "
+}
+
+// Tells if two tokens can be written with no space in between, without
+// changing the way they're lexed (e.g. `-` and `-1` can't).
+func fmtCanGlue(a, b *fmtToken) bool {
+	tokens := fmtTokens([]rune(a.text + b.text))
+	return len(tokens) == 2 && tokens[0].typ == a.typ && tokens[1].typ == b.typ
+}
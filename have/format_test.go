@@ -0,0 +1,116 @@
+package have
+
+import (
+	"strings"
+	"testing"
+
+	gotoken "go/token"
+)
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		source, reference string
+	}{
+		{`package   main
+import "fmt"
+
+
+
+struct S :
+    x  int # member
+    func  f( a,b int )int :
+        return a*b+self.x`, `package main
+import "fmt"
+
+struct S:
+	x int # member
+	func f(a, b int) int:
+		return a * b + self.x
+`},
+		{`
+# Comments before the package clause are kept.
+package main
+func main( ch chan int ):
+    var s=S{ x:1 }
+    var xs=[ ]int{1,2,3}
+      # comment before if
+    if s.f(1,2)>=3&&true :
+        fmt.Println( xs[1:2],-s.x , <-ch )
+           # comment ending a block
+    var c chan<-int
+    var p *int=&s.x
+    xs=append(xs,xs...)
+    for var i range xs:
+            p=  &i
+
+`, `# Comments before the package clause are kept.
+package main
+func main(ch chan int):
+	var s = S{x: 1}
+	var xs = []int{1, 2, 3}
+	# comment before if
+	if s.f(1, 2) >= 3 && true:
+		fmt.Println(xs[1:2], -s.x, <-ch)
+	# comment ending a block
+	var c chan<- int
+	var p *int = &s.x
+	xs = append(xs, xs...)
+	for var i range xs:
+		p = &i
+`},
+		{`package main
+func f(x int, ys ...int) *int:
+  var a = []int{1,
+           2, 3}
+  var b = x - -1
+  var m map[string][]*int = {"a": nil}
+  var g = func(a int) int:
+    return a`, `package main
+func f(x int, ys ...int) *int:
+	var a = []int{1,
+		2, 3}
+	var b = x - -1
+	var m map[string][]*int = {"a": nil}
+	var g = func(a int) int:
+		return a
+`},
+		{`package main
+func f[T](x T) int:
+  when T
+  is ~ []_ :
+    return len( x )
+  is  ~string:
+    return 1`, `package main
+func f[T](x T) int:
+	when T
+	is ~[]_:
+		return len(x)
+	is ~string:
+		return 1
+`},
+	}
+
+	for i, c := range cases {
+		result, errs := Format(gotoken.NewFileSet(), "a.hav", c.source)
+		if len(errs) > 0 {
+			t.Errorf("Case %d: unexpected errors: %v", i, errs)
+			continue
+		}
+		if result != c.reference {
+			t.Errorf("Case %d: wrong result:\n%s\nwanted:\n%s", i, result, c.reference)
+			continue
+		}
+		again, errs := Format(gotoken.NewFileSet(), "a.hav", result)
+		if len(errs) > 0 || again != result {
+			t.Errorf("Case %d: formatting isn't idempotent:\n%s", i, again)
+		}
+	}
+}
+
+func TestFormatSyntaxError(t *testing.T) {
+	fset := gotoken.NewFileSet()
+	_, errs := Format(fset, "a.hav", "package main\nvar x = (1")
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].(*CompileError).PrettyString(fset), "a.hav:2:") {
+		t.Errorf("Expected a syntax error, got %v", errs)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	gotoken "go/token"
 )
 
 // CodeChunk can either be a slice of smaller CodeChunks
@@ -30,6 +32,20 @@ type CodeChunk struct {
 	parent *CodeChunk
 
 	indent string
+
+	// Returns //line directives for positions in Have code, nil if they
+	// aren't generated. New chunks inherit it from their parents.
+	lineDirectives func(pos gotoken.Pos) string
+	// Written before the chunk's code, at the beginning of a line.
+	lineDirective string
+
+	// Comments from Have code, written as Go comments before the chunk's code
+	// and at the end of its first line.
+	docComments     []string
+	trailingComment string
+
+	// Set in the root chunk, Go packages whose types are used by the code.
+	goPackages map[*ImportStmt]bool
 }
 
 // TODO: implement it in a io.Reader form, not keeping all results in memory
@@ -48,12 +64,27 @@ func (cc *CodeChunk) readAll(indent string) string {
 
 	buf := bytes.Buffer{}
 	for _, chk := range cc.chunks {
-		trailer := ""
+		trailer, prefix := "", ""
 		if cc.blockOfStmts {
 			trailer = "\t"
-			buf.WriteString(indent + trailer)
+			prefix = indent + trailer
 		}
-		buf.WriteString(chk.readAll(indent + trailer))
+		for _, c := range chk.docComments {
+			buf.WriteString(prefix + "//" + c + "\n")
+		}
+		// Line directives have to start at the beginning of a line, so they go before indents.
+		buf.WriteString(chk.lineDirective)
+		buf.WriteString(prefix)
+
+		code := chk.readAll(indent + trailer)
+		if chk.trailingComment != "" {
+			end := strings.IndexByte(code, '\n')
+			if end < 0 {
+				end = len(code)
+			}
+			code = code[:end] + " //" + chk.trailingComment + code[end:]
+		}
+		buf.WriteString(code)
 	}
 	return buf.String()
 }
@@ -73,11 +104,33 @@ func (cc *CodeChunk) NewStrChunk(s string) *CodeChunk {
 
 // Created a new empty chunk whose parent is the receiver.
 func (cc *CodeChunk) NewChunk() *CodeChunk {
-	ch := &CodeChunk{parent: cc, indent: cc.indent}
+	ch := &CodeChunk{parent: cc, indent: cc.indent, lineDirectives: cc.lineDirectives}
 	cc.chunks = append(cc.chunks, ch)
 	return ch
 }
 
+// Makes Go tools treat the chunk's code as coming from the given position of Have
+// code. It has to be called for chunks starting at the beginning of a line.
+func (cc *CodeChunk) setLine(pos gotoken.Pos) {
+	if cc.lineDirectives != nil && pos.IsValid() {
+		cc.lineDirective = cc.lineDirectives(pos)
+	}
+}
+
+// Carries comments of a Have statement or declaration over to the chunk.
+// Like setLine, it has to be called for chunks starting at the beginning of a line.
+func (cc *CodeChunk) setComments(c *Comments) {
+	if c == nil {
+		return
+	}
+	for _, doc := range c.Doc {
+		cc.docComments = append(cc.docComments, doc.Text)
+	}
+	if c.Trailing != nil {
+		cc.trailingComment = c.Trailing.Text
+	}
+}
+
 func (cc *CodeChunk) NewBlockChunk() *CodeChunk {
 	ch := cc.NewChunk()
 	ch.blockOfStmts = true
@@ -130,6 +183,9 @@ func (cc *CodeChunk) AddChprintf(tc *TypesContext, format string, a ...interface
 
 			i++
 		default:
+			if t, ok := v.(Type); ok {
+				cc.noteGoPackages(t)
+			}
 			if genericType, ok := v.(*GenericType); ok {
 				// We can't use GenericType.String(), it would return a valid Go type name.
 				// TODO: This could be refactored to avoid such special treatment.
@@ -143,6 +199,28 @@ func (cc *CodeChunk) AddChprintf(tc *TypesContext, format string, a ...interface
 	cc.AddString(fmt.Sprintf(parts[i], nonGenerables...))
 }
 
+// Records Go packages of the type, the generated file has to import them.
+func (cc *CodeChunk) noteGoPackages(t Type) {
+	root := cc
+	for root.parent != nil {
+		root = root.parent
+	}
+	mapSubtype(t, func(t Type) bool {
+		ct, ok := t.(*CustomType)
+		if !ok {
+			return true
+		}
+		if ct.Package != nil && ct.Package.pkg != nil && ct.Package.pkg.IsGo() {
+			if root.goPackages == nil {
+				root.goPackages = map[*ImportStmt]bool{}
+			}
+			root.goPackages[ct.Package] = true
+		}
+		// Only the name of a named type is printed.
+		return false
+	})
+}
+
 type Generable interface {
 	// Generate the full version of the output code.
 	Generate(tc *TypesContext, current *CodeChunk)
@@ -188,7 +266,7 @@ func (lit *BasicLit) Generate(tc *TypesContext, current *CodeChunk) {
 	case TOKEN_FALSE:
 		current.AddString("false")
 		return
-	case TOKEN_INT, TOKEN_STR, TOKEN_RUNE:
+	case TOKEN_INT, TOKEN_FLOAT, TOKEN_IMAG, TOKEN_STR, TOKEN_RUNE:
 		val = lit.token.Value.(string)
 	default:
 		panic("impossible")
@@ -308,6 +386,46 @@ func (dc DeclChain) Generate(tc *TypesContext, current *CodeChunk) {
 	names.AddChprintf(tc, " = ")
 }
 
+func (cs *ConstStmt) Generate(tc *TypesContext, current *CodeChunk) {
+	current = current.NewChunk()
+
+	if !cs.Block {
+		current.AddChprintf(tc, "const %C\n", cs.Specs[0])
+		return
+	}
+
+	current.AddChprintf(tc, "const (\n")
+	block := current.NewBlockChunk()
+	for _, spec := range cs.Specs {
+		block.NewChunk().AddChprintf(tc, "%C\n", spec)
+	}
+	current.AddChprintf(tc, "%C)\n", ForcedIndent)
+}
+
+func (cs *ConstSpec) Generate(tc *TypesContext, current *CodeChunk) {
+	names := make([]string, len(cs.Consts))
+	for i, c := range cs.Consts {
+		names[i] = c.name
+	}
+	current.AddString(strings.Join(names, ", "))
+
+	if cs.Implicit {
+		// Go repeats the previous line too.
+		return
+	}
+
+	if cs.Type != nil {
+		current.AddChprintf(tc, " %s", cs.Type)
+	}
+	current.AddString(" = ")
+	for i, init := range cs.Inits {
+		if i > 0 {
+			current.AddString(", ")
+		}
+		current.AddChprintf(tc, "%C", init)
+	}
+}
+
 func (vs *VarStmt) Generate(tc *TypesContext, current *CodeChunk) {
 	if vs.IsFuncStmt {
 		vs.Vars[0].Inits[0].(Generable).Generate(tc, current)
@@ -417,20 +535,31 @@ func (fc *FuncCallExpr) Generate(tc *TypesContext, current *CodeChunk) {
 	if fd := fc.fn; fd != nil && len(fd.compilerMacros) > 0 {
 		for _, cm := range fd.compilerMacros {
 			if cm.Active {
-				cm.generate(tc, current, fc.Args, fd.GenericParamVals)
+				cm.generate(tc, current, fc, fd.GenericParamVals)
 				return
 			}
 		}
 	}
 
-	current.AddChprintf(tc, "%iC(", fc.Left.(Generable))
-	for i, arg := range fc.Args {
+	current.AddChprintf(tc, "%iC(%C)", fc.Left.(Generable), &callArgs{fc.Args, fc.Spread})
+}
+
+// Comma separated list of function call arguments.
+type callArgs struct {
+	args   []Expr
+	spread bool
+}
+
+func (ca *callArgs) Generate(tc *TypesContext, current *CodeChunk) {
+	for i, arg := range ca.args {
 		current.AddChprintf(tc, "%iC", arg)
-		if i+1 < len(fc.Args) {
+		if i+1 < len(ca.args) {
 			current.AddString(", ")
 		}
 	}
-	current.AddString(")")
+	if ca.spread {
+		current.AddString("...")
+	}
 }
 
 func (fd *FuncDecl) Generate(tc *TypesContext, current *CodeChunk) {
@@ -448,9 +577,21 @@ func (fd *FuncDecl) Generate(tc *TypesContext, current *CodeChunk) {
 }
 
 func (fd *FuncDecl) InlineGenerate(tc *TypesContext, current *CodeChunk, noParenth bool) {
+	fd.generateNamed(tc, current, fd.name)
+}
+
+// Functions declared inside other functions become variables (declared before
+// a function literal is assigned, so that it can call itself).
+func (fd *FuncDecl) generateLocal(tc *TypesContext, current *CodeChunk) {
+	current.AddChprintf(tc, "var %s %s\n%C%s = ", fd.name, fd.typ, ForcedIndent, fd.name)
+	fd.generateNamed(tc, current, "")
+	current.AddChprintf(tc, "\n")
+}
+
+func (fd *FuncDecl) generateNamed(tc *TypesContext, current *CodeChunk, name string) {
 	current = current.NewChunk()
 	if fd.Receiver == nil {
-		current.AddChprintf(tc, "func %s(", fd.name)
+		current.AddChprintf(tc, "func %s(", name)
 	} else {
 		current.AddChprintf(tc, "func (self %s) %s(", fd.Receiver.Type, fd.name)
 	}
@@ -458,7 +599,11 @@ func (fd *FuncDecl) InlineGenerate(tc *TypesContext, current *CodeChunk, noParen
 	i := 0
 
 	fd.Args.eachPair(func(arg *Variable, init Expr) {
-		current.AddChprintf(tc, "%s %s", arg.name, arg.Type)
+		if fd.typ.Variadic && i+1 == fd.Args.countVars() {
+			current.AddChprintf(tc, "%s ...%s", arg.name, arg.Type.(*SliceType).Of)
+		} else {
+			current.AddChprintf(tc, "%s %s", arg.name, arg.Type)
+		}
 		if i+1 < fd.Args.countVars() {
 			current.AddString(", ")
 		}
@@ -489,10 +634,24 @@ func (fd *FuncDecl) InlineGenerate(tc *TypesContext, current *CodeChunk, noParen
 	current.AddChprintf(tc, "%C}", ForcedIndent)
 }
 
+// Statements with comments attached.
+type commentedStmt interface {
+	Comments() *Comments
+}
+
 func (bl *CodeBlock) Generate(tc *TypesContext, current *CodeChunk) {
 	block := current.NewBlockChunk()
 	for _, stmt := range bl.Statements {
-		stmt.(Generable).Generate(tc, block.NewChunk())
+		ch := block.NewChunk()
+		ch.setLine(stmt.Pos())
+		if c, ok := stmt.(commentedStmt); ok {
+			ch.setComments(c.Comments())
+		}
+		if vs, ok := stmt.(*VarStmt); ok && vs.IsFuncStmt {
+			vs.Vars[0].Inits[0].(*FuncDecl).generateLocal(tc, ch)
+			continue
+		}
+		stmt.(Generable).Generate(tc, ch)
 	}
 }
 
@@ -565,6 +724,34 @@ func (ss *SwitchStmt) Generate(tc *TypesContext, current *CodeChunk) {
 	current.AddChprintf(tc, "}\n")
 }
 
+func (ss *SelectStmt) Generate(tc *TypesContext, current *CodeChunk) {
+	current = current.NewChunk()
+
+	current.AddChprintf(tc, "select {\n")
+
+	for _, branch := range ss.Branches {
+		switch comm := branch.Comm.(type) {
+		case nil:
+			current.AddChprintf(tc, "%Cdefault:\n", ForcedIndent)
+		case *VarStmt:
+			// Go doesn't allow anything but the receive operation here,
+			// so we can't use conversions like in regular declarations.
+			vd := comm.Vars[0]
+			names := make([]string, len(vd.Vars))
+			for i, v := range vd.Vars {
+				names[i] = v.name
+			}
+			current.AddChprintf(tc, "%Ccase %s := %C:\n", ForcedIndent, strings.Join(names, ", "), vd.Inits[0])
+		default:
+			current.AddChprintf(tc, "%Ccase %iC:\n", ForcedIndent, comm)
+		}
+
+		branch.Code.Generate(tc, current)
+	}
+
+	current.AddChprintf(tc, "%C}\n", ForcedIndent)
+}
+
 func (fs *ForStmt) Generate(tc *TypesContext, current *CodeChunk) {
 	current = current.NewChunk()
 
@@ -610,9 +797,83 @@ func (fs *ForRangeStmt) Generate(tc *TypesContext, current *CodeChunk) {
 }
 
 func (f *File) Generate(tc *TypesContext, current *CodeChunk) {
-	current.AddChprintf(tc, "package %s\n\n", f.Pkg)
+	pkgClause := current.NewChunk()
+	pkgClause.setComments(f.doc)
+	pkgClause.AddChprintf(tc, "package %s\n\n", f.Pkg)
+
+	imported, restore := f.nameGoPackages()
+	defer restore()
+
 	for _, stmt := range f.statements {
-		stmt.Stmt.(Generable).Generate(tc, current)
+		ch := current.NewChunk()
+		ch.setLine(stmt.Pos())
+		if c, ok := stmt.Stmt.(commentedStmt); ok {
+			ch.setComments(c.Comments())
+		}
+		stmt.Stmt.(Generable).Generate(tc, ch)
+	}
+
+	// Types can come from Go packages that the file doesn't import.
+	root := current
+	for root.parent != nil {
+		root = root.parent
+	}
+	var missing []*ImportStmt
+	for i := range root.goPackages {
+		if !imported[i] {
+			missing = append(missing, i)
+		}
+	}
+	sort.Slice(missing, func(a, b int) bool { return missing[a].path < missing[b].path })
+	for _, i := range missing {
+		i.Generate(tc, pkgClause)
+	}
+}
+
+// Types from Go packages are printed with names of their packages, which have
+// to be the ones the file imports them as. Packages the file doesn't import get
+// names that don't collide with its imports. Returns the packages that are
+// imported, and a function restoring the original names.
+func (f *File) nameGoPackages() (imported map[*ImportStmt]bool, restore func()) {
+	imported = map[*ImportStmt]bool{}
+	if f.manager == nil {
+		return imported, func() {}
+	}
+
+	fileNames, taken := map[string]string{}, map[string]bool{}
+	for _, stmt := range f.statements {
+		if i, ok := stmt.Stmt.(*ImportStmt); ok {
+			taken[i.name] = true
+			if i.pkg != nil && i.pkg.IsGo() {
+				fileNames[i.path] = i.name
+				imported[i] = true
+			}
+		}
+	}
+
+	var stmts []*ImportStmt
+	for _, i := range f.manager.goImports {
+		stmts = append(stmts, i)
+	}
+	sort.Slice(stmts, func(a, b int) bool { return stmts[a].path < stmts[b].path })
+
+	original := make(map[*ImportStmt]string, len(stmts))
+	for _, i := range stmts {
+		original[i] = i.name
+		if name, ok := fileNames[i.path]; ok {
+			i.name = name
+			imported[i] = true
+			continue
+		}
+		for taken[i.name] {
+			i.name = "_" + i.name
+		}
+		taken[i.name] = true
+	}
+	return imported, func() {
+		for i, name := range original {
+			i.name = name
+		}
 	}
 }
 
@@ -635,6 +896,23 @@ func (bs *BranchStmt) Generate(tc *TypesContext, current *CodeChunk) {
 	}
 }
 
+func (ss *SendStmt) Generate(tc *TypesContext, current *CodeChunk) {
+	ss.InlineGenerate(tc, current, true)
+	current.AddString("\n")
+}
+
+func (ss *SendStmt) InlineGenerate(tc *TypesContext, current *CodeChunk, noParenth bool) {
+	current.AddChprintf(tc, "%C <- %C", ss.Lhs, ss.Rhs)
+}
+
+func (gs *GoStmt) Generate(tc *TypesContext, current *CodeChunk) {
+	current.AddChprintf(tc, "go %C\n", gs.Call)
+}
+
+func (ds *DeferStmt) Generate(tc *TypesContext, current *CodeChunk) {
+	current.AddChprintf(tc, "defer %C\n", ds.Call)
+}
+
 func (rs *ReturnStmt) Generate(tc *TypesContext, current *CodeChunk) {
 	current.AddChprintf(tc, "return")
 	for i, v := range rs.Values {
@@ -651,7 +929,11 @@ func (ls *LabelStmt) Generate(tc *TypesContext, current *CodeChunk) {
 }
 
 func generateStruct(tc *TypesContext, current *CodeChunk, st *StructType) {
-	current.AddChprintf(tc, "type %s struct {\n", st.Name)
+	generateStructNamed(tc, current, st, st.Name)
+}
+
+func generateStructNamed(tc *TypesContext, current *CodeChunk, st *StructType, name string) {
+	current.AddChprintf(tc, "type %s struct {\n", name)
 
 	ch := current.NewBlockChunk()
 	for _, name := range st.Keys {
@@ -669,7 +951,10 @@ func generateStruct(tc *TypesContext, current *CodeChunk, st *StructType) {
 			// Not a method, a plain member
 			continue
 		}
-		current.AddChprintf(tc, "%C\n", st.Methods[name])
+		ch := current.NewChunk()
+		ch.setLine(st.Methods[name].Pos())
+		ch.setComments(st.Methods[name].Comments())
+		ch.AddChprintf(tc, "%C\n", st.Methods[name])
 	}
 }
 
@@ -688,6 +973,14 @@ func (l instList) Less(i, j int) bool { return l[i].getGoName() < l[j].getGoName
 func (l instList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
 
 func (gf *GenericFunc) Generate(tc *TypesContext, current *CodeChunk) {
+	if gf.native.state == nativeEmitted {
+		ch := current.NewChunk()
+		ch.setLine(gf.Pos())
+		gf.Func.generateNamed(gf.native.tc, ch, gf.Func.name+gf.native.typeParams(gf.params))
+		ch.AddString("\n")
+		return
+	}
+
 	var insts instList
 	for _, inst := range tc.instantiations {
 		if inst.Generic == gf {
@@ -698,16 +991,23 @@ func (gf *GenericFunc) Generate(tc *TypesContext, current *CodeChunk) {
 	sort.Sort(insts)
 
 	for _, inst := range insts {
-		current.AddChprintf(tc, "// Generic instantiation\n")
-		if inst.Init != nil {
-			current.AddChprintf(tc, "%C\n", inst.Init)
-		} else {
-			panic("todo")
+		if inst.Init == nil {
+			// The instantiation failed, its errors have been reported.
+			continue
 		}
+		current.AddChprintf(tc, "// Generic instantiation\n")
+		ch := current.NewChunk()
+		ch.setLine(inst.Init.Pos())
+		ch.AddChprintf(tc, "%C\n", inst.Init)
 	}
 }
 
 func (gs *GenericStruct) Generate(tc *TypesContext, current *CodeChunk) {
+	if gs.native.state == nativeEmitted {
+		generateStructNamed(gs.native.tc, current, gs.struc, gs.struc.Name+gs.native.typeParams(gs.params))
+		return
+	}
+
 	var insts instList
 	for _, inst := range tc.instantiations {
 		if inst.Generic == gs {
@@ -741,11 +1041,17 @@ func removeQuotes(s string) string {
 
 var reArgs = regexp.MustCompile(`%[at]\d+`)
 
-func (cm *compilerMacro) generate(tc *TypesContext, current *CodeChunk, args []Expr, types []Type) {
+func (cm *compilerMacro) generate(tc *TypesContext, current *CodeChunk, call *FuncCallExpr, types []Type) {
 	if !cm.Active {
 		return
 	}
 
+	args := call.Args
+	variadicArg := -1
+	if call.fn.typ.Variadic {
+		variadicArg = len(call.fn.typ.Args) - 1
+	}
+
 	pattern := removeQuotes(cm.Args[0].(*BasicLit).token.Value.(string))
 	str := []byte(pattern)
 	all := reArgs.FindAllIndex(str, -1)
@@ -760,11 +1066,21 @@ func (cm *compilerMacro) generate(tc *TypesContext, current *CodeChunk, args []E
 			panic(err)
 		}
 
-		switch str[loc[0]+1] {
-		case 'a':
+		switch kind := str[loc[0]+1]; {
+		case kind == 'a' && int(num) == variadicArg:
+			// Variadic parameter expands to all the trailing arguments.
+			before, rest := pattern[:loc[0]], []Expr(nil)
+			if len(args) > variadicArg {
+				rest = args[variadicArg:]
+			} else {
+				before = strings.TrimSuffix(before, ", ")
+			}
+			pattern = before + "%C" + pattern[loc[1]:]
+			finalArgs = append(finalArgs, &callArgs{rest, call.Spread})
+		case kind == 'a':
 			pattern = pattern[:loc[0]] + "%iC" + pattern[loc[1]:]
 			finalArgs = append(finalArgs, args[num])
-		case 't':
+		case kind == 't':
 			pattern = pattern[:loc[0]] + "%s" + pattern[loc[1]:]
 			finalArgs = append(finalArgs, types[num])
 		default:
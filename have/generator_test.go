@@ -310,6 +310,38 @@ func a() (*A) {
 	return (&A{
 		x: 10,
 	})
+}`},
+		{source: `func a() (int, string):
+	return 7, "ble"
+func b():
+	a()`,
+			reference: `func a() (int, string) {
+	return 7, "ble"
+}
+func b() {
+	a()
+}`},
+	}
+	testCases(t, cases)
+}
+
+func TestGenerateLocalFuncs(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `func a() int:
+	func fact(n int) int:
+		if n < 2:
+			return 1
+		return n * fact(n - 1)
+	return fact(5)`,
+			reference: `func a() (int) {
+	var fact func(int) int
+	fact = func (n int) (int) {
+		if (n < 2) {
+			return 1
+		}
+		return (n * fact((n - 1)))
+	}
+	return fact(5)
 }`},
 	}
 	testCases(t, cases)
@@ -436,6 +468,171 @@ var l = ([]int)(apply([]int{
 	testCases(t, cases)
 }
 
+func TestGenerateGoStmt(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `
+func f(x int, c chan int):
+	c <- x
+func g(c chan int):
+	go f(1, c)
+	go (func(y int):
+		c <- y)(2)
+	go print(<-c)`,
+			reference: `func f(x int, c chan int) {
+	c <- x
+}
+func g(c chan int) {
+	go f(1, c)
+	go func (y int) {
+		c <- y
+	}(2)
+	go print((<-c))
+}`},
+		{source: `
+func f() (int, bool):
+	return 1, true
+func g():
+	go f()`,
+			reference: `func f() (int, bool) {
+	return 1, true
+}
+func g() {
+	go f()
+}`},
+	}
+	testCases(t, cases)
+}
+
+func TestGenerateDeferStmt(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `
+func f(x int):
+	defer print(x)
+	defer (func():
+		var r = recover()
+		if r != nil:
+			print(r))()
+	panic("bla")`,
+			reference: `func f(x int) {
+	defer print(x)
+	defer func () {
+		var r = (interface{})(recover())
+		if (r != nil) {
+			print(r)
+		}
+	}()
+	panic("bla")
+}`},
+	}
+	testCases(t, cases)
+}
+
+func TestGenerateSelectStmt(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `
+func f(a, b chan int, c chan<- string, quit chan bool):
+	var z int
+	for true:
+		select:
+			case var x = <-a:
+				print(x)
+			case var y, ok = <-b:
+				if ok == false:
+					break
+				print(y)
+			case z = <-a:
+				pass
+			case c <- "bla":
+				continue
+			case <-quit:
+				return
+			default:
+				pass`,
+			reference: `func f(a chan int, b chan int, c chan<- string, quit chan bool) {
+	var z = (int)(0)
+	for true {
+		select {
+		case x := (<-a):
+			print(x)
+		case y, ok := (<-b):
+			if (ok == false) {
+				break
+			}
+			print(y)
+		case z = (<-a):
+			// pass
+		case c <- "bla":
+			continue
+		case (<-quit):
+			return
+		default:
+			// pass
+		}
+	}
+}`},
+	}
+	testCases(t, cases)
+}
+
+func TestGenerateConstStmt(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `
+const:
+	A = iota
+	B
+	C
+const X, Y int8 = 1, 2
+func f():
+	const N = C * 2
+	var arr [N]int`,
+			reference: `const (
+	A = iota
+	B
+	C
+)
+const X, Y int8 = 1, 2
+func f() {
+	const N = (C * 2)
+	var arr = ([4]int)([4]int{0, 0, 0, 0})
+}`},
+		{source: `
+var x = 1.5
+var y complex128 = 2i`,
+			reference: `var x = (float64)(1.5)
+var y = (complex128)(2i)`},
+	}
+	testCases(t, cases)
+}
+
+func TestGenerateVariadic(t *testing.T) {
+	cases := []generatorTestCase{
+		{source: `
+func f(a string, xs ...int):
+	pass
+func g():
+	var s []int
+	f("a")
+	f("a", 1, 2)
+	f("a", s...)
+	s = append(s, 1, 2)
+	s = append(s, s...)
+	s = append(s)`,
+			reference: `func f(a string, xs ...int) {
+	// pass
+}
+func g() {
+	var s = ([]int)(nil)
+	f("a")
+	f("a", 1, 2)
+	f("a", s...)
+	s = append(s, 1, 2)
+	s = append(s, s...)
+	s = append(s)
+}`},
+	}
+	testCases(t, cases)
+}
+
 func TestGenerateTypeSwitchStmt(t *testing.T) {
 	cases := []generatorTestCase{
 		{source: `
@@ -478,14 +675,18 @@ func a():
 		pass
 `,
 			reference: `func a() {
-	func b() {
-		func c() {
-			func d() {
+	var b func()
+	b = func () {
+		var c func()
+		c = func () {
+			var d func()
+			d = func () {
 				// pass
 			}
 		}
 	}
-	func e() {
+	var e func()
+	e = func () {
 		// pass
 	}
 }`},
@@ -0,0 +1,257 @@
+package have
+
+import (
+	gotoken "go/token"
+	"strconv"
+	"strings"
+)
+
+// Since Go 1.18, a generic can be emitted once, as a Go generic, instead of
+// being expanded for every list of params it's used with. It's possible when
+// its code type-checks with params being opaque types, i.e. it doesn't use
+// `when` statements to tell what the params are, and the generics it uses
+// are emitted as Go generics too (or are compiler macros).
+
+type nativeState int
+
+const (
+	// The definition of the generic hasn't been checked yet.
+	nativeUnchecked nativeState = iota
+	// The definition of the generic is being checked.
+	nativeChecking
+	nativeExpanded
+	nativeEmitted
+)
+
+// Result of checking the definition of a generic, tells how its
+// instantiations are emitted.
+type nativeGeneric struct {
+	state nativeState
+	// Errors found in the definition, they're reported only once.
+	err error
+	// Types of the definition of the generic, used to generate it.
+	tc *TypesContext
+	// Go constraints of the params, in order.
+	constraints []string
+}
+
+// Tells if instantiations are named like in Go generics, e.g. `Max[int]`.
+// While the generic is being checked, it can refer to itself, and it's
+// assumed that it's going to be emitted.
+func (n *nativeGeneric) named() bool {
+	return n.state == nativeChecking || n.state == nativeEmitted
+}
+
+// Tells if a Go version (like "1.18", "go1.21.3" or "1.21rc1") supports generics.
+func goHasGenerics(version string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(version, "go"), ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(parts[1])
+	}
+	minor, err := strconv.Atoi(parts[1][:digits])
+	if err != nil {
+		return false
+	}
+	return major > 1 || major == 1 && minor >= 18
+}
+
+// Checks the definition of the generic when it's called for the first time,
+// later calls return the same errors.
+func (gf *GenericFunc) checkDefinition(tc *TypesContext) error {
+	if gf.native.state != nativeUnchecked {
+		return gf.native.err
+	}
+	if len(gf.Func.compilerMacros) > 0 || isBuiltin(gf) {
+		gf.native.state = nativeExpanded
+		return nil
+	}
+	return checkGeneric(tc, gf, gf.paramDecls, func(ntc *TypesContext) error {
+		return gf.Func.Code.CheckTypes(ntc)
+	})
+}
+
+func (gs *GenericStruct) checkDefinition(tc *TypesContext) error {
+	if gs.native.state != nativeUnchecked {
+		return gs.native.err
+	}
+
+	// Methods refer to the struct through the type of self.
+	st := gs.struc
+	st.selfType.Decl.name = st.Name
+	st.selfType.Decl.AliasedType = st
+	st.selfType.Decl.Methods = st.Methods
+	st.selfType.Name = st.Name + "[" + strings.Join(gs.params, ", ") + "]"
+
+	return checkGeneric(tc, gs, gs.paramDecls, func(ntc *TypesContext) error {
+		return (&StructStmt{Struct: st}).NegotiateTypes(ntc)
+	})
+}
+
+func isBuiltin(g Generic) bool {
+	tfile, _ := g.Location()
+	return tfile != nil && tfile.Name() == BuiltinsFileName
+}
+
+// Type-checks the definition of a generic, with its params being opaque types.
+// Only errors in `when` branches that depend on the params are left to
+// instantiations of the generic, the rest is returned. If Go generics can be
+// used, decides if the generic is emitted as one.
+func checkGeneric(tc *TypesContext, g Generic, paramDecls []*GenericParamTypeDecl,
+	check func(ntc *TypesContext) error) error {
+	info := g.nativeInfo()
+	info.state = nativeExpanded
+	if tc.nativeGenerics {
+		info.state = nativeChecking
+	}
+
+	ntc := NewTypesContext()
+	ntc.nativeGenerics, ntc.genericDef = tc.nativeGenerics, true
+
+	ok := recoverCheck(g, ntc, check, &info.err)
+	if info.state == nativeExpanded {
+		return info.err
+	}
+	if !ok || ntc.needsExpansion || !nativeDeps(g, paramDecls, ntc) {
+		info.state = nativeExpanded
+		return info.err
+	}
+
+	constraints := make([]string, len(paramDecls))
+	for i, decl := range paramDecls {
+		constraints[i] = goConstraint(decl)
+	}
+	info.state, info.tc, info.constraints = nativeEmitted, ntc, constraints
+
+	// Generics used with concrete params are generated with the rest of the package.
+	imports := g.Imports()
+	local := imports.Local()
+	for _, inst := range ntc.instantiations {
+		if !containsGenericParam(inst.Params) && inst.Generic.nativeInfo().state != nativeEmitted {
+			inst.Generic.Instantiate(local.tc, inst.Params...)
+		}
+	}
+	return nil
+}
+
+// Returns the context of types used in definitions of generics, e.g. `List[T]`
+// in `func f[T](l List[T])`. Their instantiations aren't generated.
+func (tc *TypesContext) definitionContext() *TypesContext {
+	if tc.genericDef {
+		return tc
+	}
+	if tc.definitions == nil {
+		tc.definitions = NewTypesContext()
+		tc.definitions.nativeGenerics, tc.definitions.genericDef = tc.nativeGenerics, true
+	}
+	return tc.definitions
+}
+
+// Runs check, and tells if it succeeded. Its errors are stored in err.
+// Like in PkgManager.parseAndCheck, a panic is a bug of the compiler, it's
+// reported at the definition of g.
+func recoverCheck(g Generic, ntc *TypesContext, check func(ntc *TypesContext) error, err *error) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			pos := gotoken.NoPos
+			if tfile, offset := g.Location(); tfile != nil {
+				pos = tfile.Pos(offset)
+			}
+			*err = posErrorf(pos, CodeInternal, "Internal compiler error: %v", r)
+			ok = false
+		}
+	}()
+	*err = check(ntc)
+	return *err == nil
+}
+
+// Tells if all the generics used with params of g (in its code checked in ntc,
+// and in types of its definition) can be used in a Go generic.
+func nativeDeps(g Generic, paramDecls []*GenericParamTypeDecl, ntc *TypesContext) bool {
+	imports := g.Imports()
+	defs := imports.Local().tc.definitionContext()
+
+	for _, insts := range []map[InstKey]*Instantiation{ntc.instantiations, defs.instantiations} {
+		for _, inst := range insts {
+			if !usesGenericParams(inst.Params, paramDecls) || inst.Generic == g ||
+				inst.Generic.nativeInfo().state == nativeEmitted {
+				continue
+			}
+			if gf, ok := inst.Generic.(*GenericFunc); ok && len(gf.Func.compilerMacros) > 0 {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func containsGenericParam(types []Type) bool {
+	return usesGenericParams(types, nil)
+}
+
+// Tells if types refer to the given params (or to any params, if decls is nil).
+func usesGenericParams(types []Type, decls []*GenericParamTypeDecl) bool {
+	found := false
+	mapSubtypes(types, func(t Type) bool {
+		if param, ok := t.(*GenericParamType); ok {
+			if decls == nil {
+				found = true
+			}
+			for _, decl := range decls {
+				found = found || param.decl == decl
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// Name of an instantiation of a generic emitted as a Go generic.
+func nativeName(g Generic, params []Type) string {
+	name, _ := g.Signature()
+	args := make([]string, len(params))
+	for i, p := range params {
+		if gt, ok := p.(*GenericType); ok {
+			args[i] = gt.Struct.Name
+		} else {
+			args[i] = p.String()
+		}
+	}
+	return name + "[" + strings.Join(args, ", ") + "]"
+}
+
+// Constraint of a param in Go, e.g. `any` or `interface{ comparable; fmt.Stringer }`.
+func goConstraint(decl *GenericParamTypeDecl) string {
+	var iface Type
+	comparable := decl.comparable
+	if decl.constraint != nil {
+		iface = decl.constraint.Iface
+		comparable = comparable || iface == nil
+	}
+	switch {
+	case iface != nil && comparable:
+		return "interface{ comparable; " + iface.String() + " }"
+	case iface != nil:
+		return iface.String()
+	case comparable:
+		return "comparable"
+	}
+	return "any"
+}
+
+// Params of a generic with their constraints, e.g. `[T any, K comparable]`.
+func (n *nativeGeneric) typeParams(params []string) string {
+	list := make([]string, len(params))
+	for i, p := range params {
+		list[i] = p + " " + n.constraints[i]
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
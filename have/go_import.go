@@ -0,0 +1,320 @@
+package have
+
+import (
+	"fmt"
+	goimporter "go/importer"
+	gotoken "go/token"
+	gotypes "go/types"
+)
+
+// Imports Go packages, trying each importer in turn until one succeeds.
+// By default export data is tried first, and then Go source.
+type fallbackImporter []gotypes.Importer
+
+func (fi fallbackImporter) Import(path string) (*gotypes.Package, error) {
+	var err error
+	for _, imp := range fi {
+		var pkg *gotypes.Package
+		pkg, err = imp.Import(path)
+		if err == nil {
+			return pkg, nil
+		}
+	}
+	return nil, err
+}
+
+func newGoImporter() gotypes.Importer {
+	return fallbackImporter{
+		goimporter.Default(),
+		goimporter.ForCompiler(gotoken.NewFileSet(), "source", nil),
+	}
+}
+
+// Wrap a Go package so that it can be used from Have code like any other package.
+// Its members are converted to Have objects lazily, on first use.
+func (m *PkgManager) goPackage(goPkg *gotypes.Package) *Package {
+	if pkg, ok := m.pkgs[goPkg.Path()]; ok {
+		return pkg
+	}
+
+	pkg := &Package{
+		path:    goPkg.Path(),
+		objects: make(map[string]Object),
+		manager: m,
+		tc:      NewTypesContext(),
+		Fset:    m.Fset,
+		goPkg:   goPkg,
+	}
+	m.pkgs[goPkg.Path()] = pkg
+	return pkg
+}
+
+func (m *PkgManager) loadGoPackage(path string) (*Package, error) {
+	goPkg, err := m.GoImporter.Import(path)
+	if err != nil {
+		return nil, err
+	}
+	return m.goPackage(goPkg), nil
+}
+
+// Import statement used by types coming from Go packages. Go signatures can
+// refer to packages that weren't imported by the Have file, so we can't use
+// file's ImportStmts for them. While a file is generated, their names are the
+// ones the file uses (see File.nameGoPackages).
+func (m *PkgManager) goImportStmt(goPkg *gotypes.Package) *ImportStmt {
+	if i, ok := m.goImports[goPkg]; ok {
+		return i
+	}
+	i := &ImportStmt{
+		name: goPkg.Name(),
+		path: goPkg.Path(),
+		pkg:  m.goPackage(goPkg),
+	}
+	m.goImports[goPkg] = i
+	return i
+}
+
+// Tells if the package was loaded from Go code.
+func (o *Package) IsGo() bool {
+	return o.goPkg != nil
+}
+
+// Converts an exported member of a Go package to a Have object.
+// Returns nil for members that can't be expressed in Have.
+func (o *Package) goObject(name string) Object {
+	goObj := o.goPkg.Scope().Lookup(name)
+	if goObj == nil || !goObj.Exported() {
+		return nil
+	}
+
+	m := o.manager
+
+	switch obj := goObj.(type) {
+	case *gotypes.TypeName:
+		decl, err := m.goTypeDecl(obj)
+		if err != nil {
+			return nil
+		}
+		return decl
+	case *gotypes.Const:
+		typ, err := m.goType(obj.Type())
+		if err != nil {
+			return nil
+		}
+		// Values of Go constants are already known, no need to evaluate anything.
+		basic, isBasic := obj.Type().(*gotypes.Basic)
+		untyped := isBasic && basic.Info()&gotypes.IsUntyped != 0
+		c := &Constant{name: obj.Name(), value: &constValue{Value: obj.Val(), Type: typ, Untyped: untyped}}
+		if !untyped {
+			c.Type = typ
+		}
+		return c
+	case *gotypes.Func, *gotypes.Var:
+		typ, err := m.goType(obj.Type())
+		if err != nil {
+			return nil
+		}
+		return &Variable{name: obj.Name(), Type: typ}
+	}
+	return nil
+}
+
+// Returns a TypeDecl for a Go named type. Declarations are cached, so that
+// recursive types (and types referred to from many places) work.
+func (m *PkgManager) goTypeDecl(obj *gotypes.TypeName) (*TypeDecl, error) {
+	if decl, ok := m.goDecls[obj]; ok {
+		return decl, nil
+	}
+
+	if obj.Pkg() == nil {
+		return nil, fmt.Errorf("Builtin type %s can't be imported", obj.Name())
+	}
+
+	decl := &TypeDecl{name: obj.Name(), Methods: map[string]*FuncDecl{}}
+	m.goDecls[obj] = decl
+
+	named, ok := gotypes.Unalias(obj.Type()).(*gotypes.Named)
+	if !ok || named.TypeParams().Len() > 0 {
+		delete(m.goDecls, obj)
+		return nil, fmt.Errorf("Type %s is not supported", obj.Name())
+	}
+
+	aliased, err := m.goType(named.Underlying())
+	if err != nil {
+		delete(m.goDecls, obj)
+		return nil, err
+	}
+	decl.AliasedType = aliased
+
+	// Methods declared for a value receiver are in the method set of the value,
+	// the rest only in the method set of the pointer.
+	valueSet := gotypes.NewMethodSet(named)
+	ptrSet := gotypes.NewMethodSet(gotypes.NewPointer(named))
+	for i := 0; i < ptrSet.Len(); i++ {
+		method := ptrSet.At(i).Obj().(*gotypes.Func)
+		if !method.Exported() {
+			continue
+		}
+		typ, err := m.goType(method.Type())
+		if err != nil {
+			// Just skip methods we can't express.
+			continue
+		}
+		decl.Methods[method.Name()] = &FuncDecl{
+			name:        method.Name(),
+			typ:         typ.(*FuncType),
+			PtrReceiver: valueSet.Lookup(method.Pkg(), method.Name()) == nil,
+		}
+	}
+
+	switch t := aliased.(type) {
+	case *StructType:
+		t.Name = obj.Name()
+		t.Methods = decl.Methods
+	case *IfaceType:
+		t.name = obj.Name()
+		decl.Methods = t.Methods
+	}
+
+	return decl, nil
+}
+
+func (m *PkgManager) goTypes(tuple *gotypes.Tuple) ([]Type, error) {
+	result := make([]Type, 0, tuple.Len())
+	for i := 0; i < tuple.Len(); i++ {
+		typ, err := m.goType(tuple.At(i).Type())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, typ)
+	}
+	return result, nil
+}
+
+// Converts a Go type to a Have type.
+func (m *PkgManager) goType(t gotypes.Type) (Type, error) {
+	switch t := gotypes.Unalias(t).(type) {
+	case *gotypes.Basic:
+		return goBasicType(t)
+	case *gotypes.Named:
+		obj := t.Obj()
+		if obj.Pkg() == nil {
+			// Only `error` is a named type without a package.
+			if obj.Name() == "error" {
+				return &SimpleType{ID: SIMPLE_TYPE_ERROR}, nil
+			}
+			return nil, fmt.Errorf("Type %s is not supported", obj.Name())
+		}
+		decl, err := m.goTypeDecl(obj)
+		if err != nil {
+			return nil, err
+		}
+		return &CustomType{Name: obj.Name(), Package: m.goImportStmt(obj.Pkg()), Decl: decl}, nil
+	case *gotypes.Pointer:
+		to, err := m.goType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &PointerType{To: to}, nil
+	case *gotypes.Slice:
+		of, err := m.goType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &SliceType{Of: of}, nil
+	case *gotypes.Array:
+		of, err := m.goType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &ArrayType{Size: int(t.Len()), Of: of}, nil
+	case *gotypes.Map:
+		by, err := m.goType(t.Key())
+		if err != nil {
+			return nil, err
+		}
+		of, err := m.goType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &MapType{By: by, Of: of}, nil
+	case *gotypes.Chan:
+		of, err := m.goType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		dir := CHAN_DIR_BI
+		switch t.Dir() {
+		case gotypes.SendOnly:
+			dir = CHAN_DIR_SEND
+		case gotypes.RecvOnly:
+			dir = CHAN_DIR_RECEIVE
+		}
+		return &ChanType{Of: of, Dir: dir}, nil
+	case *gotypes.Signature:
+		if t.TypeParams().Len() > 0 {
+			return nil, fmt.Errorf("Generic Go functions are not supported")
+		}
+		args, err := m.goTypes(t.Params())
+		if err != nil {
+			return nil, err
+		}
+		results, err := m.goTypes(t.Results())
+		if err != nil {
+			return nil, err
+		}
+		return &FuncType{Args: args, Results: results, Variadic: t.Variadic()}, nil
+	case *gotypes.Struct:
+		result := &StructType{Members: map[string]Type{}, Keys: []string{}, Methods: map[string]*FuncDecl{}}
+		for i := 0; i < t.NumFields(); i++ {
+			field := t.Field(i)
+			if !field.Exported() {
+				continue
+			}
+			typ, err := m.goType(field.Type())
+			if err != nil {
+				return nil, err
+			}
+			result.Members[field.Name()] = typ
+			result.Keys = append(result.Keys, field.Name())
+		}
+		return result, nil
+	case *gotypes.Interface:
+		result := &IfaceType{Keys: []string{}, Methods: map[string]*FuncDecl{}}
+		for i := 0; i < t.NumMethods(); i++ {
+			method := t.Method(i)
+			typ, err := m.goType(method.Type())
+			if err != nil {
+				return nil, err
+			}
+			result.Methods[method.Name()] = &FuncDecl{name: method.Name(), typ: typ.(*FuncType)}
+			result.Keys = append(result.Keys, method.Name())
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("Type %s is not supported", t)
+}
+
+func goBasicType(t *gotypes.Basic) (Type, error) {
+	// Untyped constants get their default types.
+	switch t.Kind() {
+	case gotypes.UntypedBool:
+		return &SimpleType{ID: SIMPLE_TYPE_BOOL}, nil
+	case gotypes.UntypedInt:
+		return &SimpleType{ID: SIMPLE_TYPE_INT}, nil
+	case gotypes.UntypedRune:
+		return &SimpleType{ID: SIMPLE_TYPE_RUNE}, nil
+	case gotypes.UntypedFloat:
+		return &SimpleType{ID: SIMPLE_TYPE_FLOAT64}, nil
+	case gotypes.UntypedComplex:
+		return &SimpleType{ID: SIMPLE_TYPE_COMPLEX128}, nil
+	case gotypes.UntypedString:
+		return &SimpleType{ID: SIMPLE_TYPE_STRING}, nil
+	}
+
+	id, ok := simpleTypeStrToID[t.Name()]
+	if !ok {
+		return nil, fmt.Errorf("Type %s is not supported", t.Name())
+	}
+	return &SimpleType{ID: id}, nil
+}
@@ -0,0 +1,263 @@
+package have
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	gotoken "go/token"
+)
+
+// Information about an identifier used in code, for tools like the language server.
+type IdentInfo struct {
+	Name string
+	// Nil for members of structs and interfaces.
+	Object Object
+	// Nil if it's not known.
+	Type Type
+	// Where the identifier is declared, NoPos if it's not known.
+	DeclPos gotoken.Pos
+
+	method bool
+}
+
+// Describes the identifier the way it's declared, e.g. `var x int`.
+func (i *IdentInfo) String() string {
+	typ := ""
+	if i.Type != nil {
+		typ = " " + i.Type.String()
+	}
+
+	switch obj := i.Object.(type) {
+	case nil:
+		if fun, ok := i.Type.(*FuncType); ok && i.method {
+			return "func " + i.Name + fun.Header()
+		}
+		return "field " + i.Name + typ
+	case *Variable:
+		if fun, ok := i.Type.(*FuncType); ok && obj.init != nil {
+			return "func " + i.Name + fun.Header()
+		}
+		return "var " + i.Name + typ
+	case *Constant:
+		return "const " + i.Name + typ
+	case *TypeDecl:
+		return "type " + i.Name + typ
+	case *ImportStmt:
+		return "package " + obj.path
+	case *GenericFunc:
+		return "func " + i.Name + "[" + strings.Join(obj.params, ", ") + "]" + obj.Func.typ.Header()
+	case *GenericStruct:
+		return "struct " + i.Name + "[" + strings.Join(obj.params, ", ") + "]"
+	case *LabelStmt:
+		return "label " + i.Name
+	}
+	return i.Name
+}
+
+// Tells if it's a method (members of structs are either fields or methods).
+func (i *IdentInfo) IsMethod() bool {
+	return i.method
+}
+
+// Returns the position of a column (counted in runes, from 1) in a line of the file
+// (counted from 1), or NoPos if there's no such line.
+func (f *File) Pos(line, column int) gotoken.Pos {
+	if f.tfile == nil || line < 1 || line > f.tfile.LineCount() {
+		return gotoken.NoPos
+	}
+	return f.tfile.LineStart(line) + gotoken.Pos(column-1)
+}
+
+// Returns the identifier (or the member name of a selector) at a position of
+// the file, or nil if there's none. It works for files that failed to compile
+// as well, as far as they were parsed.
+func (f *File) IdentAt(pos gotoken.Pos) *IdentInfo {
+	if f.parser == nil {
+		return nil
+	}
+
+	var result *IdentInfo
+	for _, ref := range f.parser.refs {
+		switch ref := ref.(type) {
+		case *Ident:
+			if ref.object != nil && ref.Pos() <= pos && pos < identEnd(ref) {
+				result = objectInfo(ref.object)
+			}
+		case *DotSelector:
+			if ref.Right.Pos() <= pos && pos < identEnd(ref.Right) {
+				result = f.memberInfo(ref)
+			}
+		}
+	}
+	return result
+}
+
+// Returns members (sorted by names) of the identifier or selector expression
+// ending at the given position, e.g. to complete code written after a dot.
+func (f *File) MembersOf(end gotoken.Pos) []*IdentInfo {
+	if f.parser == nil {
+		return nil
+	}
+
+	var left Expr
+	for _, ref := range f.parser.refs {
+		switch ref := ref.(type) {
+		case *Ident:
+			if identEnd(ref) == end && ref.object != nil {
+				left = ref
+			}
+		case *DotSelector:
+			if identEnd(ref.Right) == end {
+				left = ref
+			}
+		}
+	}
+	if left == nil {
+		return nil
+	}
+
+	if ident, ok := left.(*Ident); ok && IsPackage(ident) {
+		return pkgMembers(ident.object.(*ImportStmt).pkg)
+	}
+	typ, ok := f.typeOf(left)
+	if !ok {
+		return nil
+	}
+	members := typeMembers(typ)
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+func identEnd(ident *Ident) gotoken.Pos {
+	return ident.Pos() + gotoken.Pos(len([]rune(ident.name)))
+}
+
+// Type of an expression that's been parsed, but not necessarily checked successfully.
+func (f *File) typeOf(ex Expr) (typ Type, ok bool) {
+	typed, isTyped := ex.(TypedExpr)
+	if !isTyped {
+		return nil, false
+	}
+	if ident, isIdent := ex.(*Ident); isIdent && (ident.object == nil || ident.object.ObjectType() != OBJECT_VAR &&
+		ident.object.ObjectType() != OBJECT_CONST) {
+		return nil, false
+	}
+	typ, err := typed.Type(f.tc)
+	if err != nil || typ == nil || !typ.Known() {
+		return nil, false
+	}
+	return typ, true
+}
+
+func (f *File) memberInfo(sel *DotSelector) *IdentInfo {
+	if ident, ok := sel.Left.(*Ident); ok && IsPackage(ident) {
+		if obj := ident.object.(*ImportStmt).pkg.GetObject(sel.Right.name); obj != nil {
+			return objectInfo(obj)
+		}
+		return nil
+	}
+
+	typ, ok := f.typeOf(sel.Left)
+	if !ok {
+		return nil
+	}
+	for _, member := range typeMembers(typ) {
+		if member.Name == sel.Right.name {
+			return member
+		}
+	}
+	return nil
+}
+
+func objectInfo(obj Object) *IdentInfo {
+	info := &IdentInfo{Name: obj.Name(), Object: obj}
+
+	switch obj := obj.(type) {
+	case *Variable:
+		info.Type, info.DeclPos = obj.Type, obj.pos
+	case *Constant:
+		info.Type, info.DeclPos = obj.Type, obj.pos
+		if val, err := obj.Eval(); err == nil && info.Type == nil {
+			info.Type = val.Type
+		}
+	case *TypeDecl:
+		info.Type, info.DeclPos = obj.AliasedType, obj.Pos()
+	case Stmt:
+		info.DeclPos = obj.Pos()
+	}
+
+	if info.Type != nil && !info.Type.Known() {
+		info.Type = nil
+	}
+	return info
+}
+
+// Fields and methods of a type. Methods declared for pointers are included.
+func typeMembers(typ Type) []*IdentInfo {
+	if typ.Kind() == KIND_POINTER {
+		typ = typ.(*PointerType).To
+	}
+
+	var result []*IdentInfo
+	seen := map[string]bool{}
+	addMethod := func(method *FuncDecl) {
+		if !seen[method.name] {
+			seen[method.name] = true
+			result = append(result, &IdentInfo{Name: method.name, Type: method.typ, DeclPos: method.Pos(), method: true})
+		}
+	}
+
+	if custom, ok := typ.(*CustomType); ok && custom.Decl != nil {
+		for _, method := range custom.Decl.Methods {
+			addMethod(method)
+		}
+	}
+
+	switch root := RootType(typ).(type) {
+	case *StructType:
+		for _, name := range root.Keys {
+			if member, ok := root.Members[name]; ok && !seen[name] {
+				seen[name] = true
+				result = append(result, &IdentInfo{Name: name, Type: member})
+			} else if method, ok := root.Methods[name]; ok {
+				addMethod(method)
+			}
+		}
+	case *IfaceType:
+		for _, name := range root.Keys {
+			addMethod(root.Methods[name])
+		}
+	}
+	return result
+}
+
+// Exported objects of a package, sorted by names.
+func pkgMembers(pkg *Package) []*IdentInfo {
+	var names []string
+	if pkg.IsGo() {
+		names = pkg.goPkg.Scope().Names()
+	} else {
+		for name := range pkg.objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var result []*IdentInfo
+	for _, name := range names {
+		if !unicode.IsUpper([]rune(name)[0]) {
+			continue
+		}
+		if obj := pkg.GetObject(name); obj != nil {
+			result = append(result, objectInfo(obj))
+		}
+	}
+	return result
+}
+
+// Returns a file loaded so far (also from packages that failed to compile),
+// or nil if there's no such file.
+func (m *PkgManager) File(name string) *File {
+	return m.files[name]
+}
@@ -0,0 +1,123 @@
+package have
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentAt(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "b"
+import "strings"
+struct Point:
+	X int
+	func Len() int:
+		return self.X
+const Max = 10
+func main():
+	var p = Point{X: 1}
+	var n = p.Len() + b.Twice(p.X)
+	strings.ToUpper("x")
+	print(n + Max)`},
+		{"b", "b.hav", `package b
+func Twice(x int) int:
+	return 2 * x
+func half(x int) int:
+	return x / 2`},
+	}
+
+	manager := NewPkgManager(newFakeLocator(files...))
+	if _, errs := manager.Load("a"); len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	f := manager.File("a.hav")
+
+	testCases := []struct {
+		line, column int
+		info         string
+		declLine     int
+		declFile     string
+	}{
+		{7, 11, "var self Point", 0, ""},
+		{7, 15, "field X int", 0, ""},
+		{10, 10, "type Point struct {X int}", 4, "a.hav"},
+		{11, 10, "var p Point", 10, "a.hav"},
+		{11, 12, "func Len() int", 6, "a.hav"},
+		{11, 20, "package b", 2, "a.hav"},
+		{11, 22, "func Twice(int) int", 2, "b.hav"},
+		{12, 10, "var ToUpper func(string) string", 0, ""},
+		{13, 8, "var n int", 11, "a.hav"},
+		{13, 12, "const Max int", 8, "a.hav"},
+		{13, 4, "func print(interface{}) bool", 2, BuiltinsFileName},
+		{13, 9, "", 0, ""},
+		{11, 6, "", 0, ""}, // Declarations aren't references
+	}
+
+	for _, tc := range testCases {
+		info := f.IdentAt(f.Pos(tc.line, tc.column))
+		if info == nil {
+			if tc.info != "" {
+				t.Errorf("%d:%d: no identifier found, want %q", tc.line, tc.column, tc.info)
+			}
+			continue
+		}
+		if info.String() != tc.info {
+			t.Errorf("%d:%d: got %q, want %q", tc.line, tc.column, info, tc.info)
+		}
+		if tc.declLine == 0 {
+			continue
+		}
+		decl := manager.Fset.Position(info.DeclPos)
+		if decl.Line != tc.declLine || decl.Filename != tc.declFile {
+			t.Errorf("%d:%d: declared at %s, want %s:%d", tc.line, tc.column, decl, tc.declFile, tc.declLine)
+		}
+	}
+}
+
+func TestMembersOf(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "b"
+struct Point:
+	X int
+	Y int
+	func Len() int:
+		return self.X
+func main():
+	var p = &Point{X: 1}
+	print(p)
+	print(b.Zero)`},
+		{"b", "b.hav", `package b
+func Twice(x int) int:
+	return 2 * x
+func half(x int) int:
+	return x / 2
+var Zero = 0`},
+	}
+
+	manager := NewPkgManager(newFakeLocator(files...))
+	if _, errs := manager.Load("a"); len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	f := manager.File("a.hav")
+
+	testCases := []struct {
+		line, column int
+		members      []string
+	}{
+		{10, 9, []string{"func Len() int", "field X int", "field Y int"}},
+		{11, 9, []string{"func Twice(int) int", "var Zero int"}},
+		{10, 8, nil},
+	}
+
+	for _, tc := range testCases {
+		var members []string
+		for _, m := range f.MembersOf(f.Pos(tc.line, tc.column)) {
+			members = append(members, m.String())
+		}
+		if strings.Join(members, "; ") != strings.Join(tc.members, "; ") {
+			t.Errorf("%d:%d: got %q, want %q", tc.line, tc.column, members, tc.members)
+		}
+	}
+}
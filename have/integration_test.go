@@ -58,3 +58,62 @@ func TestGenerate(t *testing.T) {
 		}
 	}
 }
+
+func TestLineDirectives(t *testing.T) {
+	code := `package main
+func id[T](x T) T:
+	return x
+func main():
+	var x = id(1)
+	if x > 0:
+		panic("boom")
+
+		print(x)
+	print(x)`
+
+	manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"main", "lines.hav", code}))
+	pkg, errs := manager.Load("main")
+	if len(errs) > 0 {
+		t.Fatalf("Failed compilation: %s", errs[0])
+	}
+
+	output := pkg.Files[0].GenerateCodeWithLines(func(name string) string { return "src/" + name })
+	want := `package main
+
+//line src/lines.hav:2
+// Generic instantiation
+//line src/lines.hav:2
+func id_int(x int) (int) {
+//line src/lines.hav:3
+	return x
+}
+
+//line src/lines.hav:4
+func main() {
+//line src/lines.hav:5
+	var x = (int)(id_int(1))
+//line src/lines.hav:6
+	if (x > 0) {
+//line src/lines.hav:7
+		panic("boom")
+//line src/lines.hav:9
+		print(x)
+	}
+//line src/lines.hav:10
+	print(x)
+}`
+	if strings.TrimSpace(output) != want {
+		t.Fatalf("Wrong output:\n%s\nWanted:\n%s", output, want)
+	}
+
+	// Go should refer to the Have file when something goes wrong.
+	os.MkdirAll("tmp", 0744)
+	err := ioutil.WriteFile("tmp/lines.go", []byte(output), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOutput, _ := exec.Command("go", "run", "tmp/lines.go").CombinedOutput()
+	if !strings.Contains(string(runOutput), "src/lines.hav:7") {
+		t.Fatalf("Panic doesn't point at the Have file:\n%s", runOutput)
+	}
+}
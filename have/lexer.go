@@ -68,6 +68,7 @@ const (
 	TOKEN_STR                    // string literal
 	TOKEN_RUNE                   // rune literal
 	TOKEN_DOT                    // .
+	TOKEN_ELLIPSIS               // ...
 	TOKEN_LPARENTH               // (
 	TOKEN_RPARENTH               // )
 	TOKEN_LBRACKET               // [
@@ -110,6 +111,10 @@ const (
 	TOKEN_WHEN                   // the "when" keyword
 	TOKEN_IMPLEMENTS             // the "implements" keyword
 	TOKEN_IS                     // the "is" keyword
+	TOKEN_GO                     // the "go" keyword
+	TOKEN_DEFER                  // the "defer" keyword
+	TOKEN_SELECT                 // the "select" keyword
+	TOKEN_CONST                  // the "const" keyword
 	TOKEN_MUL                    // *
 	TOKEN_DIV                    // /
 	TOKEN_MUL_ASSIGN             // *=
@@ -126,6 +131,7 @@ const (
 	TOKEN_AND                    // &&
 	TOKEN_OR                     // ||
 	TOKEN_SHARP                  // #
+	TOKEN_TILDE                  // ~
 	TOKEN_UNEXP_CHAR             // For error reporting
 )
 
@@ -147,6 +153,9 @@ type Lexer struct {
 	offset int
 
 	tfile *gotoken.File
+
+	// Comments seen so far, by line numbers (there can be only one per line).
+	comments map[int]*Comment
 }
 
 func NewLexer(buf []rune, tfile *gotoken.File, offset int) *Lexer {
@@ -169,8 +178,23 @@ func (l *Lexer) skipWhiteChars() []rune {
 	return whitespace
 }
 
+// Tells if there is nothing but white characters before the token in its line.
+func (l *Lexer) startsLine(t *Token) bool {
+	for i := t.Offset - 1; i >= 0; i-- {
+		switch l.all[i] {
+		case '\n':
+			return true
+		case ' ', '\t':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (l *Lexer) skipInlineComment() []rune {
 	if !l.isEnd() && l.buf[0] == '#' {
+		start := l.skipped
 		l.skip()
 		c := 0
 		for c < len(l.buf) && l.buf[c] != '\n' {
@@ -178,11 +202,30 @@ func (l *Lexer) skipInlineComment() []rune {
 		}
 		cmt := l.buf[0:c]
 		l.skipBy(c)
+		l.addComment(start, cmt)
 		return cmt
 	}
 	return nil
 }
 
+// Remembers a comment starting at the given offset (so that the parser can
+// attach it to the code around).
+func (l *Lexer) addComment(offset int, text []rune) {
+	fullLine := true
+	for i := offset - 1; i >= 0 && l.all[i] != '\n'; i-- {
+		if !unicode.IsSpace(l.all[i]) {
+			fullLine = false
+			break
+		}
+	}
+
+	pos := l.tfile.Pos(offset + l.offset)
+	if l.comments == nil {
+		l.comments = make(map[int]*Comment)
+	}
+	l.comments[l.tfile.Line(pos)] = &Comment{Text: string(text), Pos: pos, FullLine: fullLine}
+}
+
 // Skip whitespace and comments
 func (l *Lexer) skipFluff() {
 	for {
@@ -232,7 +275,7 @@ func (l *Lexer) isEnd() bool {
 // E.g. instead of "=", "=="; rather use "==", "=".
 func (l *Lexer) checkAlt(alts ...string) (alt string, ok bool) {
 	for _, alt := range alts {
-		if string(l.buf[:len(alt)]) == alt {
+		if len(l.buf) >= len(alt) && string(l.buf[:len(alt)]) == alt {
 			l.skipBy(len(alt))
 			return alt, true
 		}
@@ -342,7 +385,9 @@ func (l *Lexer) Next() *Token {
 
 	switch {
 	case ch == '\n':
-		l.tfile.AddLine(l.curTokenPos)
+		// The new line starts right after '\n' (and the indent token
+		// is positioned at the end of the previous one).
+		l.tfile.AddLine(l.curTokenPos + l.offset + 1)
 		l.skip()
 		indent := string(l.skipWhiteChars())
 		l.skipInlineComment()
@@ -402,6 +447,14 @@ func (l *Lexer) Next() *Token {
 			return l.retNewToken(TOKEN_FALLTHROUGH, nil)
 		case "goto":
 			return l.retNewToken(TOKEN_GOTO, nil)
+		case "go":
+			return l.retNewToken(TOKEN_GO, nil)
+		case "defer":
+			return l.retNewToken(TOKEN_DEFER, nil)
+		case "select":
+			return l.retNewToken(TOKEN_SELECT, nil)
+		case "const":
+			return l.retNewToken(TOKEN_CONST, nil)
 		case "nil":
 			return l.retNewToken(TOKEN_NIL, nil)
 		case "chan":
@@ -478,7 +531,12 @@ func (l *Lexer) Next() *Token {
 	case unicode.IsNumber(ch) || ch == '"' || ch == '`' || ch == '\'':
 		gotok, lit, err := l.scanGoToken()
 		if err != nil {
-			return nil
+			// Malformed literal, e.g. an unterminated string. Make sure
+			// that something is skipped, so that the parser can carry on.
+			if lit == "" {
+				l.skip()
+			}
+			return l.newToken(TOKEN_UNEXP_CHAR, lit)
 		}
 		return l.fromGoToken(gotok, lit)
 	case ch == '(':
@@ -500,8 +558,13 @@ func (l *Lexer) Next() *Token {
 		l.skip()
 		return l.retNewToken(TOKEN_RBRACE, nil)
 	case ch == '.':
-		l.skip()
-		return l.retNewToken(TOKEN_DOT, nil)
+		alt, _ := l.checkAlt("...", ".")
+		switch alt {
+		case ".":
+			return l.retNewToken(TOKEN_DOT, nil)
+		case "...":
+			return l.retNewToken(TOKEN_ELLIPSIS, alt)
+		}
 	case ch == '#':
 		l.skipInlineComment()
 		return l.Next()
@@ -533,6 +596,9 @@ func (l *Lexer) Next() *Token {
 	case ch == '%':
 		l.skip()
 		return l.retNewToken(TOKEN_PERCENT, "%")
+	case ch == '~':
+		l.skip()
+		return l.retNewToken(TOKEN_TILDE, "~")
 	case ch == '&':
 		alt, _ := l.checkAlt("&&", "&")
 		switch alt {
@@ -550,6 +616,8 @@ func (l *Lexer) Next() *Token {
 			return l.retNewToken(TOKEN_PIPE, alt)
 		}
 	}
+	// Skip the character, so that the parser can carry on after reporting it.
+	l.skip()
 	return l.newToken(TOKEN_UNEXP_CHAR, ch)
 }
 
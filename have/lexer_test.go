@@ -122,6 +122,17 @@ func TestPlus(t *testing.T) {
 		&Token{TOKEN_EOF, 7, nil, 0}})
 }
 
+func TestDots(t *testing.T) {
+	testTokens(t, []rune("a.b s... ."), []*Token{
+		&Token{TOKEN_WORD, 0, "a", 0},
+		&Token{TOKEN_DOT, 1, nil, 0},
+		&Token{TOKEN_WORD, 2, "b", 0},
+		&Token{TOKEN_WORD, 4, "s", 0},
+		&Token{TOKEN_ELLIPSIS, 5, "...", 0},
+		&Token{TOKEN_DOT, 9, nil, 0},
+		&Token{TOKEN_EOF, 10, nil, 0}})
+}
+
 func TestComments(t *testing.T) {
 	testTokens(t, []rune("\n#bla\n \n  for"), []*Token{
 		&Token{TOKEN_INDENT, 7, "  ", 0},
@@ -1,10 +1,11 @@
 package have
 
 import (
-	"fmt"
+	"sort"
 	"strings"
 
 	gotoken "go/token"
+	gotypes "go/types"
 )
 
 type Package struct {
@@ -14,6 +15,9 @@ type Package struct {
 	manager *PkgManager
 	tc      *TypesContext
 	Fset    *gotoken.FileSet
+
+	// Non-nil for packages imported from Go code.
+	goPkg *gotypes.Package
 }
 
 func NewPackage(path string, files ...*File) *Package {
@@ -31,7 +35,12 @@ func NewPackage(path string, files ...*File) *Package {
 
 func (p *Package) addFile(f *File) {
 	f.tc = p.tc
+	f.manager = p.manager
+	f.fset = p.Fset
 	f.tfile = p.Fset.AddFile(f.Name, p.Fset.Base(), f.size)
+	if p.manager != nil {
+		p.manager.files[f.Name] = f
+	}
 	p.Files = append(p.Files, f)
 }
 
@@ -41,18 +50,51 @@ func builtinsFile(pkgName string) *File {
 	code := "package " + pkgName + `
 func print(s interface: pass) bool: return false
 func read() string: pass
-func len[T](c T) int: __compiler_macro("len(%a0)")
+func len[T](v T) int:
+	when T
+	is ~string:
+		__compiler_macro("len(%a0)")
+	is ~[]_:
+		__compiler_macro("len(%a0)")
+	is ~[_]_:
+		__compiler_macro("len(%a0)")
+	is ~*[_]_:
+		__compiler_macro("len(%a0)")
+	is ~map[_]_:
+		__compiler_macro("len(%a0)")
+	is ~chan _:
+		__compiler_macro("len(%a0)")
+	is ~<-chan _:
+		__compiler_macro("len(%a0)")
+	is ~chan<- _:
+		__compiler_macro("len(%a0)")
 func new[T]() *T: __compiler_macro("new(%t0)")
 func make[T](size int) T: __compiler_macro("make(%t0, %a0)")
-# TODO: Update append with varargs when varargs work
-func append[T](slice []T, elem T) []T: __compiler_macro("append(%a0, %a1)")
-# TODO: Refactor cap() to be a generic with 'when' stmt after pattern
-# matching is added to 'when'
-func cap(v interface: pass) int: pass
+func append[T](slice []T, elems ...T) []T: __compiler_macro("append(%a0, %a1)")
+func cap[T](v T) int:
+	when T
+	is ~[]_:
+		__compiler_macro("cap(%a0)")
+	is ~[_]_:
+		__compiler_macro("cap(%a0)")
+	is ~*[_]_:
+		__compiler_macro("cap(%a0)")
+	is ~chan _:
+		__compiler_macro("cap(%a0)")
+	is ~<-chan _:
+		__compiler_macro("cap(%a0)")
+	is ~chan<- _:
+		__compiler_macro("cap(%a0)")
 func copy[T](dst, src []T) int: __compiler_macro("copy(%a0, %a1)")
 func delete[T, K](m map[T]K, key T): __compiler_macro("delete(%a0, %a1)")
 func panic(v interface: pass): pass
-func close[T](c chan<- T): pass`
+func recover() (interface: pass): __compiler_macro("recover()")
+func close[T](c T):
+	when T
+	is ~chan _:
+		__compiler_macro("close(%a0)")
+	is ~chan<- _:
+		__compiler_macro("close(%a0)")`
 	return &File{
 		Name: BuiltinsFileName,
 		Code: code,
@@ -75,18 +117,30 @@ func newPackageWithManager(path string, manager *PkgManager) (*Package, error) {
 		tc:      NewTypesContext(),
 		Fset:    manager.Fset,
 	}
+	pkg.tc.nativeGenerics = goHasGenerics(manager.GoVersion)
 
 	for _, f := range files {
+		if f.IsTest() && path != manager.testPkg {
+			continue
+		}
 		pkg.addFile(f)
 	}
 	return pkg, nil
 }
 
+// Import path of the package.
+func (p *Package) Path() string {
+	return p.path
+}
+
+// Object declared in the package, nil if there's none with this name.
 func (p *Package) Get(name string) Object {
-	panic("todo")
+	return p.GetObject(name)
 }
 
-func topoSort(stmts []*TopLevelStmt) ([]*TopLevelStmt, error) {
+// Sorts statements in the order of their dependencies. If there's a dependency
+// loop, its statements are returned as looped, along with the errors.
+func topoSort(stmts []*TopLevelStmt) (sorted, looped []*TopLevelStmt, err error) {
 	// First, build a revered graph of statement dependencies.
 	type node struct {
 		deps, decls map[string]bool
@@ -111,18 +165,22 @@ func topoSort(stmts []*TopLevelStmt) ([]*TopLevelStmt, error) {
 
 		remains[&entry] = true
 
+		for _, decl := range decls {
+			entry.decls[decl] = true
+		}
+
 		for _, dep := range deps {
+			if entry.decls[dep] {
+				// E.g. constants of a group referring to each other.
+				continue
+			}
 			entry.deps[dep] = true
 			graph[dep] = append(graph[dep], &entry)
 		}
 
-		if len(deps) == 0 {
+		if len(entry.deps) == 0 {
 			q = append(q, &entry)
 		}
-
-		for _, decl := range decls {
-			entry.decls[decl] = true
-		}
 	}
 
 	result := make([]*TopLevelStmt, 0, len(stmts))
@@ -164,14 +222,11 @@ func topoSort(stmts []*TopLevelStmt) ([]*TopLevelStmt, error) {
 			}
 		}
 
-		looped := []string{}
 		missing := false
 	all:
 		for remain := range remains {
 			for dep := range remain.deps {
-				if _, ok := allDecls[dep]; ok {
-					looped = append(looped, dep)
-				} else {
+				if _, ok := allDecls[dep]; !ok {
 					missing = true
 					break all
 				}
@@ -179,7 +234,47 @@ func topoSort(stmts []*TopLevelStmt) ([]*TopLevelStmt, error) {
 		}
 
 		if !missing {
-			return nil, fmt.Errorf("There's a dependency loop between nodes: %#v", looped)
+			// Find a loop, starting from the first statement in the code, and report each of its links.
+			declaredBy := map[string]*node{}
+			var start *node
+			for remain := range remains {
+				for decl := range remain.decls {
+					declaredBy[decl] = remain
+				}
+				if start == nil || remain.stmt.Pos() < start.stmt.Pos() {
+					start = remain
+				}
+			}
+
+			var path []*node
+			var links []string
+			onPath := map[*node]int{}
+			for n := start; ; {
+				if i, ok := onPath[n]; ok {
+					path, links = path[i:], links[i:]
+					break
+				}
+				onPath[n] = len(path)
+				path = append(path, n)
+
+				deps := []string{}
+				for dep := range n.deps {
+					if _, ok := declaredBy[dep]; ok {
+						deps = append(deps, dep)
+					}
+				}
+				sort.Strings(deps)
+				links = append(links, deps[0])
+				n = declaredBy[deps[0]]
+			}
+
+			var errors []error
+			for i, n := range path {
+				from := links[(i+len(links)-1)%len(links)]
+				errors = append(errors, posErrorf(n.stmt.Pos(), CodeDependencyLoop, "Dependency loop: %s depends on %s", from, links[i]))
+				looped = append(looped, n.stmt)
+			}
+			return nil, looped, errorList(errors)
 		} else {
 			// When len(looped) == 0 we only have a unknown identifier error, but it will be reported
 			// during type checking (it's easier to produce meaningful messages there).
@@ -189,10 +284,50 @@ func topoSort(stmts []*TopLevelStmt) ([]*TopLevelStmt, error) {
 		}
 	}
 
-	return result, nil
+	return result, nil, nil
+}
+
+// Marks statements using declarations of the broken ones as broken too,
+// checking them would only give errors caused by the broken ones.
+func spreadBroken(stmts []*TopLevelStmt, broken map[*TopLevelStmt]bool) {
+	for changed := true; changed; {
+		changed = false
+		brokenDecls := map[string]bool{}
+		for stmt := range broken {
+			for _, decl := range stmt.Decls() {
+				brokenDecls[decl] = true
+			}
+		}
+	next:
+		for _, stmt := range stmts {
+			if broken[stmt] {
+				continue
+			}
+			for _, dep := range stmt.Deps() {
+				if brokenDecls[dep] {
+					broken[stmt] = true
+					changed = true
+					continue next
+				}
+			}
+		}
+	}
+}
+
+// Tells if any of the types contains one of the failed types.
+func usesFailed(types []Type, failed map[Type]bool) bool {
+	found := false
+	mapSubtypes(types, func(t Type) bool {
+		found = found || failed[t]
+		return !found
+	})
+	return found
 }
 
-func matchUnbounds(tc *TypesContext, imports Imports, unboundTypes map[string][]DeclaredType, unboundIdents map[string][]*Ident) (errors []error) {
+func matchUnbounds(tc *TypesContext, imports Imports, stmt *TopLevelStmt) (errors []error) {
+	unboundTypes, unboundIdents := stmt.unboundTypes, stmt.unboundIdents
+	var generics []*GenericType
+
 	for name, ts := range unboundTypes {
 		var pkg *Package
 		var baseName string
@@ -207,7 +342,9 @@ func matchUnbounds(tc *TypesContext, imports Imports, unboundTypes map[string][]
 
 		obj := pkg.GetObject(baseName)
 		if obj == nil {
-			errors = append(errors, fmt.Errorf("Unknown type %s", name))
+			for _, t := range ts {
+				errors = append(errors, posErrorf(stmt.unboundTypesPos[t], CodeUnknownType, "Unknown type %s", name))
+			}
 			continue
 		}
 
@@ -218,29 +355,61 @@ func matchUnbounds(tc *TypesContext, imports Imports, unboundTypes map[string][]
 				case *CustomType:
 					typ.Decl = decl
 				default:
-					errors = append(errors, fmt.Errorf("Not a named type: %s", typ))
+					errors = append(errors, posErrorf(stmt.unboundTypesPos[typ], CodeNotAType, "Not a named type: %s", typ))
 				}
 			}
 		case *GenericStruct:
 			for _, t := range ts {
 				switch typ := t.(type) {
 				case *GenericType:
-					obj, _, errs := decl.Instantiate(tc, typ.Params...)
-					if len(errs) > 0 {
-						panic(errs[0])
-					}
-
+					generics = append(generics, typ)
 					typ.Generic = decl
-					typ.Struct = obj.(*TypeDecl).AliasedType.(*StructType)
 				default:
-					errors = append(errors, fmt.Errorf("Not a named type: %s", typ))
+					errors = append(errors, posErrorf(stmt.unboundTypesPos[typ], CodeNotAType, "Not a named type: %s", typ))
 				}
 			}
+		default:
+			for _, t := range ts {
+				errors = append(errors, posErrorf(stmt.unboundTypesPos[t], CodeNotAType, "%s is not a type", name))
+			}
 		}
 
 		delete(unboundTypes, name)
 	}
 
+	// Generics are instantiated only when all the types they might use as params are bound.
+	if len(errors) == 0 {
+		// Types nested in params come after the types using them, and are instantiated first.
+		sort.SliceStable(generics, func(i, j int) bool {
+			return stmt.unboundTypesPos[generics[i]] > stmt.unboundTypesPos[generics[j]]
+		})
+		failed := map[Type]bool{}
+		for _, typ := range generics {
+			if usesFailed(typ.Params, failed) {
+				// Errors of the nested types are enough.
+				failed[typ] = true
+				continue
+			}
+			if !tc.genericDef && containsGenericParam(typ.Params) {
+				// A type used in the definition of a generic. Errors are reported by
+				// instantiations of the generic, where params are concrete.
+				obj, _, errs := typ.Generic.Instantiate(tc.definitionContext(), typ.Params...)
+				if len(errs) == 0 {
+					typ.Struct = obj.(*TypeDecl).AliasedType.(*StructType)
+				}
+				continue
+			}
+			obj, _, errs := typ.Generic.Instantiate(tc, typ.Params...)
+			if len(errs) > 0 {
+				pos := stmt.unboundTypesPos[typ]
+				errors = append(errors, placeErrorsAt(pos, traceErrors(typ.Generic, typ.Params, pos, errs))...)
+				failed[typ] = true
+				continue
+			}
+			typ.Struct = obj.(*TypeDecl).AliasedType.(*StructType)
+		}
+	}
+
 	for name, ids := range unboundIdents {
 		// Even when an object is not found, we don't report an error yet.
 		// Running type checker can change the situation - some idents can have
@@ -262,7 +431,7 @@ func (o *Package) ParseAndCheck() []error {
 	for _, f := range o.Files {
 		errors = append(errors, f.Parse()...)
 		if pkgName != "" && pkgName != f.Pkg {
-			errors = append(errors, fmt.Errorf("Different packages in one dir: %s and %s", pkgName, f.Pkg))
+			errors = append(errors, posErrorf(f.pkgPos, CodePackageClause, "Different packages in one dir: %s and %s", pkgName, f.Pkg))
 		}
 		pkgName = f.Pkg
 	}
@@ -271,8 +440,29 @@ func (o *Package) ParseAndCheck() []error {
 		return errors
 	}
 
+	// Types declared in other files, or later in the file, aren't known when
+	// patterns are parsed, so files that used their names are parsed again.
+	pkgTypes := map[string]bool{}
+	for _, f := range o.Files {
+		for name, obj := range f.objects {
+			switch obj.(type) {
+			case *TypeDecl, *GenericStruct:
+				pkgTypes[name] = true
+			}
+		}
+	}
+	for _, f := range o.Files {
+		if f.capturesAny(pkgTypes) {
+			errors = append(errors, f.parse(pkgTypes)...)
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+
 	builtins := builtinsFile(pkgName)
 	o.addFile(builtins)
+	o.tc.builtins = builtins.tfile
 	errors = append(errors, builtins.Parse()...)
 
 	if len(errors) > 0 {
@@ -284,14 +474,18 @@ func (o *Package) ParseAndCheck() []error {
 	for _, f := range o.Files {
 		for _, importStmt := range f.parser.imports {
 			importPaths[importStmt.path] = true
+			o.tc.checking = importStmt.Pos()
+			o.manager.importing = append(o.manager.importing, importStmt)
 			pkg, errs := o.manager.Load(importStmt.path)
+			o.manager.importing = o.manager.importing[:len(o.manager.importing)-1]
 			if len(errs) > 0 {
-				errors = append(errors, errs...)
+				errors = append(errors, placeErrors(importStmt, errs)...)
 				continue
 			}
 
 			importStmt.pkg = pkg
 		}
+		o.tc.checking = gotoken.NoPos
 		f.parser.imports[LocalPkg] = &ImportStmt{
 			name: LocalPkg,
 			path: "",
@@ -303,44 +497,120 @@ func (o *Package) ParseAndCheck() []error {
 		return errors
 	}
 
+	// Statements with errors found before type checking aren't checked, and
+	// neither are the statements using what they declare.
+	broken := map[*TopLevelStmt]bool{}
+	var redeclared []*TopLevelStmt
+
+	declared := map[string]gotoken.Pos{}
 	for _, f := range o.Files {
+		declPos := map[string]gotoken.Pos{}
+		declStmt := map[string]*TopLevelStmt{}
+		for _, stmt := range f.statements {
+			for _, name := range stmt.Decls() {
+				declPos[name] = stmt.Pos()
+				declStmt[name] = stmt
+			}
+		}
+
 		for name, obj := range f.objects {
 			if _, ok := o.objects[name]; ok {
-				errors = append(errors, fmt.Errorf("Redeclared %s in the same package", name))
+				errors = append(errors, posErrorf(declPos[name], CodeRedeclared,
+					"Redeclared %s in the same package, previous declaration at %s",
+					name, o.Fset.Position(declared[name])))
+				// Uses of the name refer to the previous declaration, they're fine.
+				redeclared = append(redeclared, declStmt[name])
 				continue
 			}
 			o.objects[name] = obj
+			declared[name] = declPos[name]
 		}
 	}
 
-	for _, f := range o.Files {
-		for _, stmt := range f.statements {
-			stmt.loadDeps()
-			errors = append(errors, matchUnbounds(o.tc, f.parser.imports, stmt.unboundTypes, stmt.unboundIdents)...)
+	// Definitions of generics go first, they're checked when they're used for
+	// the first time (see nativeGeneric).
+	for _, generics := range []bool{true, false} {
+		for _, f := range o.Files {
+			for _, stmt := range f.statements {
+				if _, ok := stmt.Stmt.(Generic); ok != generics {
+					continue
+				}
+				stmt.loadDeps()
+				o.tc.track(stmt.Pos())
+				errs := matchUnbounds(o.tc, f.parser.imports, stmt)
+				if len(errs) > 0 {
+					errors = append(errors, errs...)
+					broken[stmt] = true
+				}
+			}
 		}
 	}
 
-	if len(errors) > 0 {
-		return errors
+	// Only now all the constants used in array sizes are bound.
+	for _, f := range o.Files {
+		for _, stmt := range f.statements {
+			o.tc.track(stmt.Pos())
+			errs := resolveArraySizes(stmt.unresolvedArrays)
+			if len(errs) > 0 {
+				errors = append(errors, errs...)
+				broken[stmt] = true
+			}
+		}
 	}
+	o.tc.checking = gotoken.NoPos
 
 	allStmts := []*TopLevelStmt{}
 	for _, f := range o.Files {
 		allStmts = append(allStmts, f.statements...)
 	}
 
-	sorted, err := topoSort(allStmts)
-	if err != nil {
-		return []error{err}
+	var sorted []*TopLevelStmt
+	for {
+		spreadBroken(allStmts, broken)
+		var unbroken []*TopLevelStmt
+		for _, stmt := range allStmts {
+			if !broken[stmt] {
+				unbroken = append(unbroken, stmt)
+			}
+		}
+		var looped []*TopLevelStmt
+		var err error
+		sorted, looped, err = topoSort(unbroken)
+		if err == nil {
+			break
+		}
+		errors = append(errors, flattenErrors(err)...)
+		for _, stmt := range looped {
+			broken[stmt] = true
+		}
+	}
+
+	for _, stmt := range redeclared {
+		broken[stmt] = true
+	}
+	for _, stmt := range allStmts {
+		if broken[stmt] {
+			o.tc.failVars(stmt.Stmt)
+		}
+	}
+
+	for _, stmt := range sorted {
+		if !broken[stmt] {
+			errors = append(errors, flattenErrors(o.tc.negotiateStmt(stmt.Stmt))...)
+		}
 	}
 
-	for _, f := range sorted {
-		typedStmt := f.Stmt.(ExprToProcess)
-		if err := typedStmt.NegotiateTypes(o.tc); err != nil {
-			return []error{err}
+	for _, f := range o.Files {
+		if f.IsTest() {
+			errors = append(errors, f.checkTestFuncs()...)
 		}
 	}
 
+	// Statements were checked in the order of dependencies, report errors in the order of code.
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errorPos(errors[i]) < errorPos(errors[j])
+	})
+
 	if len(errors) > 0 {
 		return errors
 	}
@@ -349,12 +619,19 @@ func (o *Package) ParseAndCheck() []error {
 }
 
 func (o *Package) GetObject(name string) Object {
-	return o.objects[name]
+	obj, ok := o.objects[name]
+	if !ok && o.IsGo() {
+		obj = o.goObject(name)
+		if obj != nil {
+			o.objects[name] = obj
+		}
+	}
+	return obj
 }
 
 func (o *Package) GetType(name string) *TypeDecl {
-	obj, ok := o.objects[name]
-	if !ok || obj.ObjectType() != OBJECT_TYPE {
+	obj := o.GetObject(name)
+	if obj == nil || obj.ObjectType() != OBJECT_TYPE {
 		return nil
 	}
 	return obj.(*TypeDecl)
@@ -369,21 +646,100 @@ type PkgManager struct {
 	greyStack []string
 	locator   PkgLocator
 
+	// Import statements of the packages in greyStack, used to report cycles.
+	importing []*ImportStmt
+
+	// Used for packages that the locator can't find any Have files for.
+	GoImporter gotypes.Importer
+	// Caches of objects converted from Go packages.
+	goDecls   map[*gotypes.TypeName]*TypeDecl
+	goImports map[*gotypes.Package]*ImportStmt
+	// All the files loaded so far, by names.
+	files map[string]*File
+	// Path of the package whose test files are loaded.
+	testPkg string
+
+	// Version of Go that the code is generated for (e.g. "1.18"). Since Go 1.18,
+	// generics are emitted as Go generics when possible, instead of being
+	// expanded for each list of params. Empty for the oldest versions.
+	GoVersion string
+
 	Fset *gotoken.FileSet
 }
 
 func NewPkgManager(locator PkgLocator) *PkgManager {
 	return &PkgManager{
-		pkgs:      make(map[string]*Package),
-		greyNodes: make(map[string]bool),
-		locator:   locator,
-		Fset:      gotoken.NewFileSet(),
+		pkgs:       make(map[string]*Package),
+		greyNodes:  make(map[string]bool),
+		locator:    locator,
+		GoImporter: newGoImporter(),
+		goDecls:    make(map[*gotypes.TypeName]*TypeDecl),
+		goImports:  make(map[*gotypes.Package]*ImportStmt),
+		files:      make(map[string]*File),
+		Fset:       gotoken.NewFileSet(),
+	}
+}
+
+// Reports each import in a cycle ending with `path`.
+func (m *PkgManager) importCycleErrors(path string) []error {
+	start := 0
+	for m.greyStack[start] != path {
+		start++
+	}
+	cycle := strings.Join(append(m.greyStack[start:], path), " -> ")
+
+	var errors []error
+	for i := start; i < len(m.greyStack); i++ {
+		next := path
+		if i+1 < len(m.greyStack) {
+			next = m.greyStack[i+1]
+		}
+		var pos gotoken.Pos
+		if i < len(m.importing) {
+			pos = m.importing[i].Pos()
+		}
+		errors = append(errors, posErrorf(pos, CodeImport, "Import cycle (%s): %s imports %s", cycle, m.greyStack[i], next))
+	}
+	return errors
+}
+
+// Returns code of a loaded file, or an empty string if there's no such file.
+// Useful for quoting code in error messages, see CompileError.Report.
+func (m *PkgManager) Source(filename string) string {
+	if f, ok := m.files[filename]; ok {
+		return f.Code
+	}
+	return ""
+}
+
+// Loads a package together with its _test.hav files (test files of
+// the packages it imports are skipped, like in Go). It has to be the first
+// time the package is loaded by the manager.
+func (m *PkgManager) LoadWithTests(path string) (*Package, []error) {
+	m.testPkg = path
+	return m.Load(path)
+}
+
+// Returns Have packages loaded so far (with no Go ones), sorted by paths.
+func (m *PkgManager) Packages() []*Package {
+	var paths []string
+	for path, pkg := range m.pkgs {
+		if !pkg.IsGo() {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	pkgs := make([]*Package, 0, len(paths))
+	for _, path := range paths {
+		pkgs = append(pkgs, m.pkgs[path])
 	}
+	return pkgs
 }
 
 func (m *PkgManager) Load(path string) (*Package, []error) {
 	if cycle := m.greyNodes[path]; cycle {
-		return nil, []error{fmt.Errorf("Import cycle: %s", strings.Join(append(m.greyStack, path), ", "))}
+		return nil, m.importCycleErrors(path)
 	}
 
 	if pkg, ok := m.pkgs[path]; ok {
@@ -398,10 +754,18 @@ func (m *PkgManager) Load(path string) (*Package, []error) {
 	}()
 
 	pkg, err := newPackageWithManager(path, m)
-	if err != nil {
+	if err != nil || len(pkg.Files) == 0 {
+		// No Have code there, maybe it's a Go package.
+		goPkg, goErr := m.loadGoPackage(path)
+		if goErr == nil {
+			return goPkg, nil
+		}
+		if err == nil {
+			err = unplacedErrorf(CodeImport, "Package %s not found: %s", path, goErr)
+		}
 		return nil, []error{err}
 	}
-	errs := pkg.ParseAndCheck()
+	errs := m.parseAndCheck(pkg)
 	if len(errs) > 0 {
 		return nil, errs
 	}
@@ -409,6 +773,17 @@ func (m *PkgManager) Load(path string) (*Package, []error) {
 	return pkg, nil
 }
 
+// Bugs in the compiler shouldn't crash it with a stack trace, they're reported
+// at the innermost statement that was being checked when they happened.
+func (m *PkgManager) parseAndCheck(pkg *Package) (errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			errs = []error{posErrorf(pkg.tc.checking, CodeInternal, "Internal compiler error: %v", r)}
+		}
+	}()
+	return pkg.ParseAndCheck()
+}
+
 type Instantiation struct {
 	FullName string
 	Params   []Type
@@ -423,11 +798,16 @@ type Instantiation struct {
 }
 
 func (r *Instantiation) getGoName() string {
+	if r.goName == "" && r.Generic.nativeInfo().named() {
+		r.goName = nativeName(r.Generic, r.Params)
+	}
 	if r.goName == "" {
 		r.goName = string(NewInstKey(r.Generic, r.Params))
 		r.goName = strings.Replace(r.goName, "[", "_", -1)
 		r.goName = strings.Replace(r.goName, "]", "_", -1)
 		r.goName = strings.Replace(r.goName, "*", "PTR_", -1)
+		r.goName = strings.Replace(r.goName, "<-", "DIR_", -1)
+		r.goName = strings.Replace(r.goName, " ", "_", -1)
 		r.goName = strings.TrimRight(r.goName, "_")
 	}
 	return r.goName
@@ -445,8 +825,8 @@ func (r *Instantiation) ParseAndCheck() []error {
 	_, paramsList := r.Generic.Signature()
 	genericParams := make(map[string]Type, len(paramsList))
 	if len(paramsList) != len(r.Params) {
-		// TODO: Add location info to the error
-		return []error{fmt.Errorf("Wrong number of generic args: %d, not %d",
+		// Callers know where the generic is used, they attach the position.
+		return []error{unplacedErrorf(CodeWrongArgumentCount, "Wrong number of generic args: %d, not %d",
 			len(r.Params), len(paramsList))}
 	}
 
@@ -455,24 +835,25 @@ func (r *Instantiation) ParseAndCheck() []error {
 		genericParams[name] = val
 	}
 
+	if err := checkConstraints(r.Generic.paramDeclList(), r.Params); err != nil {
+		return []error{err}
+	}
+
 	r.parser.genericParams = genericParams
 	r.parser.generic = r.Generic
 
 	stmts, err := r.parser.Parse()
 	if err != nil {
-		return []error{err}
+		return flattenErrors(err)
 	}
 	if len(stmts) != 1 {
-		panic(fmt.Sprintf("Internal error: parsing a generic instantiation returned %d statements", len(stmts)))
+		return []error{unplacedErrorf(CodeInternal, "Internal error: parsing a generic instantiation returned %d statements",
+			len(stmts))}
 	}
 
 	tlStmt := stmts[0]
 
-	errors := matchUnbounds(r.tc, r.parser.imports, tlStmt.unboundTypes, tlStmt.unboundIdents)
-	if len(errors) > 0 {
-		return errors
-	}
-
+	// The object is set before binding types, so that the generic can refer to itself.
 	// TODO: Refactor this ugliness
 	switch s := tlStmt.Stmt.(type) {
 	case *VarStmt:
@@ -488,12 +869,28 @@ func (r *Instantiation) ParseAndCheck() []error {
 		s.Decl.AliasedType.(*StructType).selfType.Name = r.getGoName()
 		s.Decl.AliasedType.(*StructType).GenericParamVals = r.Params
 	default:
-		panic("Internal error")
+		return []error{posErrorf(tlStmt.Pos(), CodeInternal, "Internal error: unexpected instantiation of a generic")}
 	}
 
-	err = tlStmt.Stmt.(ExprToProcess).NegotiateTypes(r.tc)
-	if err != nil {
-		return []error{err}
+	outerPos := r.tc.checking
+	r.tc.track(tlStmt.Pos())
+	errors := matchUnbounds(r.tc, r.parser.imports, tlStmt)
+	errors = append(errors, resolveArraySizes(tlStmt.unresolvedArrays)...)
+	// Not deferred, like in negotiateStmt.
+	r.tc.checking = outerPos
+	if len(errors) > 0 {
+		return errors
 	}
-	return nil
+
+	errors = flattenErrors(r.tc.negotiateStmt(tlStmt.Stmt))
+	if fn, ok := r.Init.(*FuncDecl); ok && len(errors) == 0 && len(fn.compilerMacros) > 0 && !fn.macroActive() {
+		// None of the `when` branches with macros is chosen for these params.
+		name, _ := r.Generic.Signature()
+		params := make([]string, len(r.Params))
+		for i, param := range r.Params {
+			params[i] = param.String()
+		}
+		return []error{unplacedErrorf(CodeInvalidArgument, "Invalid argument for %s: %s", name, strings.Join(params, ", "))}
+	}
+	return errors
 }
@@ -3,7 +3,9 @@ package have
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
 	"testing"
 
@@ -82,7 +84,7 @@ func main() {
 		foo int
 	}
 
-	var x = (A)(A{
+	var x = (A)(A{ // We're not sure if 'foo' is an ident until typechecker
 		foo: 7,
 	})
 }`,
@@ -235,7 +237,9 @@ func TestCompilePackageGenericStruct(t *testing.T) {
 struct bla[T]:
 	t T
 	func meh(a T) T:
-		return a + self.t
+		if a == self.t:
+			return a
+		return self.t
 func main():
 	var x bla[int], y bla[string]
 	x.meh(7)
@@ -249,7 +253,10 @@ type bla_int struct {
 }
 
 func (self bla_int) meh(a int) (int) {
-	return (a + self.t)
+	if (a == self.t) {
+		return a
+	}
+	return self.t
 }
 
 // Generic instantiation
@@ -258,7 +265,10 @@ type bla_string struct {
 }
 
 func (self bla_string) meh(a string) (string) {
-	return (a + self.t)
+	if (a == self.t) {
+		return a
+	}
+	return self.t
 }
 
 func main() {
@@ -271,6 +281,148 @@ func main() {
 	testPkg(t, false, files)
 }
 
+func TestCompilePackageGoGenerics(t *testing.T) {
+	code := `package main
+struct Set[T]:
+	m map[T]bool
+	func Has(x T) bool:
+		return self.m[x]
+func Index[T](s []T, x T) int:
+	for var i, v range s:
+		if v == x:
+			return i
+	return -1
+func Fill[T](n int, x T) []T:
+	var s = make[[]T](n)
+	s[0] = x
+	return s
+func Show[T](x T):
+	when T
+	is int:
+		print("int")
+	default:
+		print(x)
+interface Namer:
+	func Name() string
+struct P:
+	n string
+	func Name() string:
+		return self.n
+func Names[T implements Namer](xs []T) []string:
+	var out []string
+	for var _, x range xs:
+		out = append(out, x.Name())
+	return out
+func main():
+	var s Set[string]
+	s.Has("a")
+	Index([]int{1, 2}, 2)
+	Fill(1, "a")
+	Show(1)
+	Names([]P{P{n: "a"}})`
+
+	want := `package main
+
+type Set[T comparable] struct {
+	m map[T]bool
+}
+
+func (self Set[T]) Has(x T) (bool) {
+	return self.m[x]
+}
+
+func Index[T comparable](s []T, x T) (int) {
+	for i, v := range s {
+		i, v := i, v // Added by compiler
+		if (v == x) {
+			return i
+		}
+	}
+	return (-1)
+}
+func Fill[T any](n int, x T) ([]T) {
+	var s = ([]T)(make([]T, n))
+	s[0] = x
+	return s
+}
+// Generic instantiation
+func Show_int(x int) {
+	{
+		print("int")
+	}
+}
+
+type Namer interface{Name() string}
+type P struct {
+	n string
+}
+
+func (self P) Name() (string) {
+	return self.n
+}
+
+func Names[T Namer](xs []T) ([]string) {
+	var out = ([]string)(nil)
+	for _, x := range xs {
+		x := x // Added by compiler
+		out = append(out, x.Name())
+	}
+	return out
+}
+func main() {
+	var s = (Set[string])(struct {m map[string]bool}{})
+	s.Has("a")
+	Index[int]([]int{
+		1,
+		2,
+	}, 2)
+	Fill[string](1, "a")
+	Show_int(1)
+	Names[P]([]P{
+		P{
+			n: "a",
+		},
+	})
+}`
+
+	manager := NewPkgManager(newFakeLocator(fakeLocatorFile{"main", "main.hav", code}))
+	manager.GoVersion = "1.18"
+	pkg, errs := manager.Load("main")
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	output := pkg.Files[0].GenerateCode()
+	if strings.TrimSpace(output) != want {
+		t.Fatalf("Wrong output, wanted:\n%s\nGot:\n%s", want, output)
+	}
+
+	// Go accepts the generics, e.g. their constraints allow what their code does.
+	os.MkdirAll("tmp", 0744)
+	if err := ioutil.WriteFile("tmp/generics.go", []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if runOutput, err := exec.Command("go", "run", "tmp/generics.go").CombinedOutput(); err != nil {
+		t.Fatalf("Generated code doesn't work: %s\n%s", err, runOutput)
+	}
+}
+
+func TestGoHasGenerics(t *testing.T) {
+	cases := map[string]bool{
+		"":         false,
+		"1.16":     false,
+		"1.18":     true,
+		"go1.21.3": true,
+		"1.22rc1":  true,
+		"2.0":      true,
+		"1":        false,
+	}
+	for version, want := range cases {
+		if got := goHasGenerics(version); got != want {
+			t.Errorf("goHasGenerics(%q): got %v, want %v", version, got, want)
+		}
+	}
+}
+
 type testStmt struct {
 	name  string
 	decls []string
@@ -437,7 +589,7 @@ func TestStmtsSort(t *testing.T) {
 			input = append(input, tls)
 		}
 
-		l, err := topoSort(input)
+		l, _, err := topoSort(input)
 		if c.shouldFail {
 			if err == nil {
 				t.Fail()
@@ -655,9 +807,271 @@ var aaa = (float32)((123 + b.bbb))`,
 	testPkgImport(t, files, outputCode, true)
 }
 
+func TestPkgImport_Go(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "strings"
+var aaa = strings.ToUpper("abc")
+var bbb strings.Builder
+func f(r *strings.Reader) int:
+	return r.Len()
+func g():
+	bbb.Grow(len(aaa))
+	var x = strings.Repeat(bbb.String(), 2)
+	var y = f(strings.NewReader(x))`},
+	}
+
+	outputCode := map[string]string{
+		"a.hav": `package a
+
+import strings "strings"
+var aaa = (string)(strings.ToUpper("abc"))
+var bbb = (strings.Builder)(strings.Builder{})
+func f(r *strings.Reader) (int) {
+	return r.Len()
+}
+func g() {
+	bbb.Grow(len(aaa))
+	var x = (string)(strings.Repeat(bbb.String(), 2))
+	var y = (int)(f(strings.NewReader(x)))
+}`,
+	}
+
+	testPkgImport(t, files, outputCode, false)
+}
+
+func TestPkgImport_GoUnknownMember(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "strings"
+var aaa = strings.NoSuchFunc("abc")`},
+	}
+
+	testPkgImport(t, files, nil, true)
+}
+
+func TestPkgImport_GoInterfaces(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "io"
+import "strings"
+var r io.Reader = strings.NewReader("abc")`},
+	}
+
+	outputCode := map[string]string{
+		"a.hav": `package a
+
+import io "io"
+import strings "strings"
+var r = (io.Reader)(strings.NewReader("abc"))`,
+	}
+
+	testPkgImport(t, files, outputCode, false)
+}
+
+func TestPkgImport_GoAlias(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "strings" as str
+import "net/http"
+import "bufio" as io
+var r = str.NewReader("abc")
+func f(resp *http.Response):
+	var b = resp.Body
+	var w = io.NewReader(b)`},
+	}
+
+	// Types from Go packages use names of the file's imports, missing imports are added.
+	outputCode := map[string]string{
+		"a.hav": `package a
+
+import _io "io"
+import str "strings"
+import http "net/http"
+import io "bufio"
+var r = (*str.Reader)(str.NewReader("abc"))
+func f(resp *http.Response) {
+	var b = (_io.ReadCloser)(resp.Body)
+	var w = (*io.Reader)(io.NewReader(b))
+}`,
+	}
+
+	testPkgImport(t, files, outputCode, false)
+}
+
+func TestPkgImport_GoConstants(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "math"
+import "time"
+var f float64 = math.Pi
+var m int8 = math.MaxInt8
+var d = time.Second
+const N = math.MaxInt8 - 124
+var a [N]int`},
+	}
+
+	outputCode := map[string]string{
+		"a.hav": `package a
+
+import math "math"
+import time "time"
+var f = (float64)(math.Pi)
+var m = (int8)(math.MaxInt8)
+var d = (time.Duration)(time.Second)
+const N = (math.MaxInt8 - 124)
+var a = ([3]int)([3]int{0, 0, 0})`,
+	}
+
+	testPkgImport(t, files, outputCode, false)
+}
+
+func TestPkgImport_GoVariadic(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "fmt"
+var args []interface:
+	pass
+var x = fmt.Sprintf("%s %d", "a", 2)
+func f() string:
+	args = append(args, "a", 2)
+	return fmt.Sprintf("%s %d", args...)
+var z = fmt.Sprint()`},
+	}
+
+	outputCode := map[string]string{
+		"a.hav": `package a
+
+import fmt "fmt"
+var args = ([]interface{})(nil)
+var x = (string)(fmt.Sprintf("%s %d", "a", 2))
+func f() (string) {
+	args = append(args, "a", 2)
+	return fmt.Sprintf("%s %d", args...)
+}
+var z = (string)(fmt.Sprint())`,
+	}
+
+	testPkgImport(t, files, outputCode, false)
+}
+
+func TestPkgImport_GoConstantOverflow(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "math"
+var m int8 = math.MaxInt16`},
+	}
+
+	testPkgImport(t, files, nil, true)
+}
+
 var justCase = flag.Int("case", -1, "Run only selected test case")
 
 func TestMain(m *testing.M) {
 	flag.Parse()
 	os.Exit(m.Run())
 }
+
+func TestLoadWithTests(t *testing.T) {
+	files := []fakeLocatorFile{
+		{"a", "a.hav", `package a
+import "b"
+func Double(x int) int:
+	return b.Twice(x)`},
+		{"a", "a_test.hav", `package a
+import "testing"
+func TestDouble(t *testing.T):
+	if Double(2) != 4:
+		t.Errorf("Wrong result")`},
+		{"b", "b.hav", `package b
+func Twice(x int) int:
+	return 2 * x`},
+		{"b", "b_test.hav", `package b
+func TestBroken():
+	pass`},
+	}
+
+	pkg, errs := NewPkgManager(newFakeLocator(files...)).Load("a")
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(pkg.Files) != 2 || pkg.GetObject("TestDouble") != nil {
+		t.Errorf("Test files shouldn't be loaded")
+	}
+
+	// Test files of imported packages are skipped.
+	pkg, errs = NewPkgManager(newFakeLocator(files...)).LoadWithTests("a")
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(pkg.Files) != 3 || pkg.GetObject("TestDouble") == nil {
+		t.Errorf("Test files should be loaded")
+	}
+
+	manager := NewPkgManager(newFakeLocator(files...))
+	_, errs = manager.LoadWithTests("b")
+	if len(errs) != 1 || errs[0].(*CompileError).PrettyString(manager.Fset) !=
+		"b_test.hav:2:1: Test function TestBroken should have signature func(t *testing.T)" {
+		t.Errorf("Wrong errors: %v", errs)
+	}
+}
+
+func TestCompilePackage_Comments(t *testing.T) {
+	files := []struct {
+		name, file, gocode string
+	}{
+		{
+			"comments.hav",
+			`# Package main is an example.
+package main
+
+# Point is a point.
+struct Point:
+	x int
+
+	# Len returns something.
+	func Len() int:
+		return 1 # Not quite.
+
+# Doer does things.
+interface Doer:
+	func Do()
+
+type Num int # Just a number.
+
+# Zero is zero.
+var Zero = 0
+
+# main does nothing.
+func main():
+	# Nothing here.
+	var p = Point{}
+	p.Len()`,
+			`// Package main is an example.
+package main
+
+// Point is a point.
+type Point struct {
+	x int
+}
+
+// Len returns something.
+func (self Point) Len() (int) {
+	return 1 // Not quite.
+}
+
+// Doer does things.
+type Doer interface{Do()}
+type Num int // Just a number.
+// Zero is zero.
+var Zero = (int)(0)
+// main does nothing.
+func main() {
+	// Nothing here.
+	var p = (Point)(Point{})
+	p.Len()
+}`,
+		},
+	}
+	testPkg(t, false, files)
+}
@@ -3,6 +3,7 @@ package have
 import (
 	"errors"
 	"fmt"
+	gotoken "go/token"
 	"strconv"
 	"strings"
 )
@@ -15,21 +16,51 @@ type Parser struct {
 	branchTreesStack BranchTreesStack
 	funcStack        []*FuncDecl
 
+	// Consumed most recently, nil if it was put back.
+	lastToken *Token
+	// Number of function literals being parsed, see expectStmtEnd.
+	funcLits int
+
 	// TODO: Remove after implementing unboundVars
 	ignoreUnknowns bool
 	unboundTypes   map[string][]DeclaredType
 	unboundIdents  map[string][]*Ident
-	topLevelDecls  map[string]Object
+	// Where the unbound types are used, for error messages.
+	unboundTypesPos map[DeclaredType]gotoken.Pos
+	topLevelDecls   map[string]Object
+	// Arrays with sizes that have to be computed after binding identifiers.
+	unresolvedArrays []*ArrayType
 
 	imports Imports
 
 	// genericParams and generic normally are nils, unless we're parsing a generic instantiation
 	genericParams map[string]Type
 	generic       Generic
+	// Params of the generic declared most recently.
+	genericDecls []*GenericParamTypeDecl
+	// Non-nil while parsing a pattern of a `when` branch, collects the types
+	// it captures (see typeFromWord).
+	pattern *[]*GenericParamTypeDecl
+	// Types captured by patterns in the current top-level statement.
+	captured []*GenericParamTypeDecl
+	// Names of types declared at the top level of the package, if known. Such
+	// names used in patterns refer to the types, instead of capturing types.
+	pkgTypes map[string]bool
 
 	dontLookup bool
 
+	// True when parsing values of constants, which can refer to `iota`.
+	parsingConst bool
+
 	prevLbl *LabelStmt // Just declared labal is stored here temporarily
+
+	// Offsets of tokens used as binary operators (as opposed to unary ones,
+	// e.g. `*` can be both). Collected only if the map isn't nil, see Format.
+	binaryOps map[int]bool
+
+	// Identifiers and member selectors in the order of parsing, used to find
+	// what's at a given position (see File.IdentAt).
+	refs []Expr
 }
 
 type Imports map[string]*ImportStmt
@@ -43,11 +74,12 @@ func (i *Imports) Local() *Package {
 
 func (p *Parser) nextToken() *Token {
 	if len(p.tokensBuf) > 0 {
-		result := p.tokensBuf[0]
+		p.lastToken = p.tokensBuf[0]
 		p.tokensBuf = p.tokensBuf[1:]
-		return result
+		return p.lastToken
 	}
-	return p.lex.Next()
+	p.lastToken = p.lex.Next()
+	return p.lastToken
 }
 
 // See the next token without changing the parser state.
@@ -68,6 +100,7 @@ func NewParserWithoutBuiltins(lex *Lexer) *Parser {
 		branchTreesStack: []*BranchStmtsTree{NewBranchStmtsTree()},
 		unboundTypes:     make(map[string][]DeclaredType),
 		unboundIdents:    make(map[string][]*Ident),
+		unboundTypesPos:  make(map[DeclaredType]gotoken.Pos),
 		topLevelDecls:    make(map[string]Object),
 		imports:          make(map[string]*ImportStmt),
 	}
@@ -78,6 +111,9 @@ func (p *Parser) putBack(tok *Token) {
 	if tok == nil {
 		panic(fmt.Errorf("NIL tok %s", tok.Type))
 	}
+	if tok == p.lastToken {
+		p.lastToken = nil
+	}
 	p.tokensBuf = append([]*Token{tok}, p.tokensBuf...)
 }
 
@@ -131,7 +167,7 @@ func (p *Parser) expectNewIndent() (*Token, error) {
 	//indent := p.expect(TOKEN_INDENT)
 	indent := p.nextToken()
 	if indent.Type != TOKEN_INDENT {
-		return nil, CompileErrorf(indent, "New indent expected, got %#v", indent)
+		return nil, CompileErrorf(indent, CodeSyntax, "New indent expected, got %#v", indent)
 	}
 
 	prevIndent := ""
@@ -141,7 +177,7 @@ func (p *Parser) expectNewIndent() (*Token, error) {
 	newIndent := indent.Value.(string)
 
 	if !strings.HasPrefix(newIndent, prevIndent) || len(newIndent) == len(prevIndent) {
-		return nil, CompileErrorf(indent, "Code block is not indented")
+		return nil, CompileErrorf(indent, CodeSyntax, "Code block is not indented")
 	}
 
 	p.indentStack = append(p.indentStack, newIndent)
@@ -155,7 +191,7 @@ func (p *Parser) isIndentEnd() (end bool, err error) {
 	token := p.nextToken()
 	defer p.putBack(token)
 	if token.Type != TOKEN_INDENT {
-		return false, CompileErrorf(token, "Indent expected")
+		return false, CompileErrorf(token, CodeSyntax, "Indent expected")
 	}
 
 	ident := token.Value.(string)
@@ -165,7 +201,7 @@ func (p *Parser) isIndentEnd() (end bool, err error) {
 	}
 	if curIdent != ident {
 		if len(ident) >= len(curIdent) {
-			return false, CompileErrorf(token, "Unexpected indent")
+			return false, CompileErrorf(token, CodeSyntax, "Unexpected indent")
 		}
 		return true, nil
 	}
@@ -260,6 +296,63 @@ func (p *Parser) checkForBranch(branchTokens ...TokenType) (ok bool, token *Toke
 	return false, nil
 }
 
+// Tokens that continue a statement on the same indent level as the statement
+// itself, e.g. branches of `if` and `switch`.
+var stmtBranchTokens = map[TokenType]bool{
+	TOKEN_ELSE:    true,
+	TOKEN_ELIF:    true,
+	TOKEN_CASE:    true,
+	TOKEN_DEFAULT: true,
+	TOKEN_IS:      true,
+}
+
+// Used after a syntax error to skip the rest of a broken statement, so that
+// parsing can carry on with the next statement on the current indent level.
+// `indents` and `scopes` are sizes of the indents and identifiers stacks
+// at this level, nested scopes opened by the broken statement are dropped.
+func (p *Parser) skipBrokenStmt(indents, scopes int) {
+	p.indentStack = p.indentStack[:indents]
+	*p.identStack = (*p.identStack)[:scopes]
+	p.parsingConst = false
+	p.prevLbl = nil
+
+	indent := ""
+	if indents > 0 {
+		indent = p.indentStack[indents-1]
+	}
+	if t := p.lastToken; t != nil && t.Type == TOKEN_INDENT {
+		// The error was found at the end of a line, the indent can start
+		// the next statement.
+		p.putBack(t)
+	}
+	for {
+		t := p.nextToken()
+		if t.Type == TOKEN_EOF {
+			p.putBack(t)
+			return
+		}
+		if t.Type != TOKEN_INDENT || len(t.Value.(string)) > len(indent) {
+			continue
+		}
+		// Branches of the broken statement are skipped as well.
+		if next := p.peek(); t.Value.(string) == indent && stmtBranchTokens[next.Type] {
+			continue
+		}
+		p.putBack(t)
+		return
+	}
+}
+
+// Statements end with their lines (or blocks). Only code blocks of function
+// literals can be ended by other tokens, like `)` in `f(func(): pass)`.
+func (p *Parser) expectStmtEnd() error {
+	t := p.peek()
+	if t.Type != TOKEN_INDENT && t.Type != TOKEN_EOF && p.funcLits == 0 && !p.lex.startsLine(t) {
+		return CompileErrorf(t, CodeSyntax, "Unexpected token after a statement: %s", t.Type)
+	}
+	return nil
+}
+
 // Forces end of the current indent, can be used to end it
 // in the middle of a line.
 func (p *Parser) forceIndentEnd() {
@@ -305,7 +398,7 @@ func (p *Parser) parseCodeBlock() (*CodeBlock, error) {
 		}
 
 		if stmt == nil {
-			return nil, CompileErrorf(t, "Expected a statement in a block")
+			return nil, CompileErrorf(t, CodeSyntax, "Expected a statement in a block")
 		}
 
 		result := &CodeBlock{Labels: map[string]*LabelStmt{}, Statements: []Stmt{stmt}}
@@ -326,19 +419,30 @@ func (p *Parser) parseCodeBlock() (*CodeBlock, error) {
 	p.branchTreesStack.pushNew()
 	defer p.branchTreesStack.pop()
 
+	// Statements with errors are skipped, so that all errors in the block are reported.
+	var errs []error
+	indents, scopes := len(p.indentStack), len(*p.identStack)
+
 	for t := p.nextToken(); t.Type != TOKEN_EOF; t = p.nextToken() {
 		p.putBack(t) // So that we can use handleIndentEnd
 		end, err := p.handleIndentEnd()
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			p.skipBrokenStmt(indents, scopes)
+			continue
 		}
 		if end {
 			break
 		}
 
 		stmt, err := p.parseStmt()
+		if err == nil && stmt != nil {
+			err = p.expectStmtEnd()
+		}
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			p.skipBrokenStmt(indents, scopes)
+			continue
 		}
 
 		if stmt == nil {
@@ -348,13 +452,17 @@ func (p *Parser) parseCodeBlock() (*CodeBlock, error) {
 
 		if lbl, ok := stmt.(*LabelStmt); ok {
 			if err := result.AddLabel(lbl); err != nil {
-				return nil, err
+				errs = append(errs, err)
 			}
 		}
 
 		result.Statements = append(result.Statements, stmt)
 	}
 
+	if len(errs) > 0 {
+		return nil, errorList(errs)
+	}
+
 	p.branchTreesStack.top().MatchGotoLabels(result.Labels)
 
 	return result, nil
@@ -416,7 +524,7 @@ func (p *Parser) parse3ClauseForStmt() (*ForStmt, error) {
 
 	// Consume first semicolon
 	if t, ok := p.expect(TOKEN_SEMICOLON); !ok {
-		return nil, CompileErrorf(t, "Expected semicolon")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected semicolon")
 	}
 
 	if p.peek().Type != TOKEN_SEMICOLON {
@@ -428,7 +536,7 @@ func (p *Parser) parse3ClauseForStmt() (*ForStmt, error) {
 
 	// Consume second semicolon
 	if t, ok := p.expect(TOKEN_SEMICOLON); !ok {
-		return nil, CompileErrorf(t, "Expected semicolon")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected semicolon")
 	}
 
 	if p.peek().Type != TOKEN_COLON {
@@ -440,7 +548,7 @@ func (p *Parser) parse3ClauseForStmt() (*ForStmt, error) {
 
 	// Consume the colon
 	if t, ok := p.expect(TOKEN_COLON); !ok {
-		return nil, CompileErrorf(t, "Expected `:` at the end of `for` statement")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `:` at the end of `for` statement")
 	}
 
 	result.Code, err = p.parseCodeBlock()
@@ -462,7 +570,7 @@ func (p *Parser) parseWhileLikeFor() (*ForStmt, error) {
 
 	// Consume the colon
 	if t, ok := p.expect(TOKEN_COLON); !ok {
-		return nil, CompileErrorf(t, "Expected `:` at the end of `for` statement")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `:` at the end of `for` statement")
 	}
 
 	result.Code, err = p.parseCodeBlock()
@@ -494,7 +602,7 @@ func (p *Parser) parseRangeForStmt() (*ForRangeStmt, error) {
 				p.putBack(t)
 				break loop
 			case TOKEN_WORD:
-				v := &Variable{name: t.Value.(string)}
+				v := &Variable{name: t.Value.(string), pos: t.Pos}
 				p.identStack.addObject(v)
 				result.ScopedVars.Vars = append(result.ScopedVars.Vars, v)
 
@@ -503,10 +611,10 @@ func (p *Parser) parseRangeForStmt() (*ForRangeStmt, error) {
 					p.nextToken()
 				case TOKEN_RANGE:
 				default:
-					return nil, CompileErrorf(p.peek(), "Unexpected token, rangle loop vars types must be inferred")
+					return nil, CompileErrorf(p.peek(), CodeSyntax, "Unexpected token, rangle loop vars types must be inferred")
 				}
 			default:
-				return nil, CompileErrorf(t, "Unexpected token on range loop vars list")
+				return nil, CompileErrorf(t, CodeSyntax, "Unexpected token on range loop vars list")
 			}
 		}
 	} else {
@@ -518,7 +626,7 @@ func (p *Parser) parseRangeForStmt() (*ForRangeStmt, error) {
 	}
 
 	if t, ok := p.expect(TOKEN_RANGE); !ok {
-		return nil, CompileErrorf(t, "Expected `range`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `range`")
 	}
 
 	result.Series, err = p.parseExpr()
@@ -528,7 +636,7 @@ func (p *Parser) parseRangeForStmt() (*ForRangeStmt, error) {
 
 	// Consume the colon
 	if t, ok := p.expect(TOKEN_COLON); !ok {
-		return nil, CompileErrorf(t, "Expected `:` at the end of `for` statement")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `:` at the end of `for` statement")
 	}
 
 	result.Code, err = p.parseCodeBlock()
@@ -542,7 +650,7 @@ func (p *Parser) parseRangeForStmt() (*ForRangeStmt, error) {
 func (p *Parser) parseForStmt(lbl *LabelStmt) (stmt Stmt, err error) {
 	ident, ok := p.expect(TOKEN_FOR)
 	if !ok {
-		return nil, CompileErrorf(ident, "Impossible happened")
+		return nil, CompileErrorf(ident, CodeInternal, "Impossible happened")
 	}
 
 	// We push another BranchStmtsTree so that code like below fails:
@@ -583,7 +691,7 @@ func (p *Parser) parseForStmt(lbl *LabelStmt) (stmt Stmt, err error) {
 func (p *Parser) parseColonWithCodeBlock() (*CodeBlock, error) {
 	colon, ok := p.expect(TOKEN_COLON)
 	if !ok {
-		return nil, CompileErrorf(colon, "Expected `:` at the end of `if` condition")
+		return nil, CompileErrorf(colon, CodeSyntax, "Expected `:` at the end of `if` condition")
 	}
 
 	return p.parseCodeBlock()
@@ -592,7 +700,7 @@ func (p *Parser) parseColonWithCodeBlock() (*CodeBlock, error) {
 func (p *Parser) parseIf() (*IfStmt, error) {
 	ident, ok := p.expect(TOKEN_IF)
 	if !ok {
-		return nil, CompileErrorf(ident, "Impossible happened")
+		return nil, CompileErrorf(ident, CodeInternal, "Impossible happened")
 	}
 
 	scopedVar := p.scanForSemicolon()
@@ -613,7 +721,7 @@ func (p *Parser) parseIf() (*IfStmt, error) {
 
 		scolon, ok := p.expect(TOKEN_SEMICOLON)
 		if !ok {
-			return nil, CompileErrorf(scolon, "`;` expected")
+			return nil, CompileErrorf(scolon, CodeSyntax, "`;` expected")
 		}
 	}
 
@@ -621,7 +729,7 @@ func (p *Parser) parseIf() (*IfStmt, error) {
 		t := p.peek()
 		condition, err = p.parseExpr()
 		if err != nil {
-			return nil, nil, CompileErrorf(t, "Couldn't parse the condition expression: %s", err)
+			return nil, nil, CompileErrorf(t, CodeSyntax, "Couldn't parse the condition expression: %s", err)
 		}
 
 		block, err = p.parseColonWithCodeBlock()
@@ -690,7 +798,7 @@ loop:
 func (p *Parser) parseSwitchStmt() (*SwitchStmt, error) {
 	ident, ok := p.expect(TOKEN_SWITCH)
 	if !ok {
-		return nil, CompileErrorf(ident, "Impossible happened")
+		return nil, CompileErrorf(ident, CodeInternal, "Impossible happened")
 	}
 
 	scopedVar := p.scanForToken(TOKEN_SEMICOLON, []TokenType{TOKEN_CASE, TOKEN_DEFAULT})
@@ -712,7 +820,7 @@ func (p *Parser) parseSwitchStmt() (*SwitchStmt, error) {
 
 		scolon, ok := p.expect(TOKEN_SEMICOLON)
 		if !ok {
-			return nil, CompileErrorf(scolon, "`;` expected")
+			return nil, CompileErrorf(scolon, CodeSyntax, "`;` expected")
 		}
 	}
 
@@ -729,8 +837,11 @@ func (p *Parser) parseSwitchStmt() (*SwitchStmt, error) {
 		t := p.peek()
 		varStmt, err = p.parseVarStmt(true)
 		p.identStack.popScope()
+		if err != nil {
+			return nil, err
+		}
 		if len(varStmt.Vars) != 1 || len(varStmt.Vars[0].Vars) != 1 {
-			return nil, CompileErrorf(t, "Invalid variable declaration in switch header")
+			return nil, CompileErrorf(t, CodeSyntax, "Invalid variable declaration in switch header")
 		}
 		typeSwitchVar = varStmt.Vars[0].Vars[0]
 		mainStmt = varStmt
@@ -801,6 +912,117 @@ loop:
 	}, nil
 }
 
+// Tells if the expression is a (possibly parenthesized) receive operation.
+func isRecvExpr(ex Expr) bool {
+	op, ok := ex.(*UnaryOp)
+	return ok && op.op.Type == TOKEN_SEND
+}
+
+// Parses the communication clause of a select's `case`.
+func (p *Parser) parseSelectComm() (Stmt, error) {
+	t := p.peek()
+
+	if t.Type == TOKEN_VAR {
+		vs, err := p.parseVarStmt(true)
+		if err != nil {
+			return nil, err
+		}
+		if len(vs.Vars) != 1 || len(vs.Vars[0].Inits) != 1 || len(vs.Vars[0].Vars) > 2 ||
+			!isRecvExpr(vs.Vars[0].Inits[0]) {
+			return nil, CompileErrorf(t, CodeSyntax, "Invalid variable declaration in select case, expected `var x = <-ch`")
+		}
+		for _, v := range vs.Vars[0].Vars {
+			if v.Type.Known() {
+				return nil, CompileErrorf(t, CodeSyntax, "Variables declared in select cases can't have explicit types")
+			}
+		}
+		return vs, nil
+	}
+
+	s, err := p.parseSimpleStmt(false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s := s.(type) {
+	case *SendStmt:
+		return s, nil
+	case *ExprStmt:
+		if isRecvExpr(s.Expression) {
+			return s, nil
+		}
+	case *AssignStmt:
+		if s.Token.Type == TOKEN_ASSIGN && len(s.Lhs) <= 2 && len(s.Rhs) == 1 && isRecvExpr(s.Rhs[0]) {
+			return s, nil
+		}
+	}
+	return nil, CompileErrorf(t, CodeSyntax, "Select case must be a send or receive operation")
+}
+
+func (p *Parser) parseSelectStmt(lbl *LabelStmt) (*SelectStmt, error) {
+	ident, ok := p.expect(TOKEN_SELECT)
+	if !ok {
+		return nil, CompileErrorf(ident, CodeInternal, "Impossible happened")
+	}
+
+	if t, ok := p.expect(TOKEN_COLON); !ok {
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `:` after `select`")
+	}
+
+	// Same as in for statements, so that breaks from outside don't get matched.
+	p.branchTreesStack.pushNew()
+	defer p.branchTreesStack.pop()
+
+	indent, err := p.expectNewIndent()
+	if err != nil {
+		return nil, err
+	}
+	p.putBack(indent)
+
+	result := &SelectStmt{stmt: stmt{expr: expr{ident.Pos}}}
+
+	for p.peek().Type != TOKEN_EOF {
+		end, err := p.handleIndentEnd()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			break
+		}
+
+		t := p.nextToken()
+		branch := &SelectBranch{stmt: stmt{expr: expr{t.Pos}}}
+
+		// Scope for variables declared in the case clause.
+		p.identStack.pushScope()
+
+		switch t.Type {
+		case TOKEN_CASE:
+			branch.Comm, err = p.parseSelectComm()
+		case TOKEN_DEFAULT:
+		default:
+			err = CompileErrorf(t, CodeSyntax, "Expected `case` or `default` in select")
+		}
+
+		if err == nil {
+			branch.Code, err = p.parseColonWithCodeBlock()
+		}
+		p.identStack.popScope()
+		if err != nil {
+			return nil, err
+		}
+
+		result.Branches = append(result.Branches, branch)
+	}
+
+	p.branchTreesStack.top().MatchBranchableStmt(result, "", TOKEN_BREAK)
+	if lbl != nil {
+		p.branchTreesStack.top().MatchBranchableStmt(result, lbl.Name(), TOKEN_BREAK)
+	}
+
+	return result, nil
+}
+
 /*
 func (p *Parser) loadBuiltinFuncs() {
 	for _, code := range builtinFuncs {
@@ -819,11 +1041,11 @@ func (p *Parser) loadBuiltinFuncs() {
 func (p *Parser) parseFuncStmt() (Stmt, error) {
 	ident, ok := p.expect(TOKEN_FUNC)
 	if !ok {
-		return nil, CompileErrorf(ident, "Impossible happened")
+		return nil, CompileErrorf(ident, CodeInternal, "Impossible happened")
 	}
 
 	if p.peek().Type == TOKEN_MUL {
-		return nil, CompileErrorf(p.peek(), "Declared a non-method function as having a pointer receiver")
+		return nil, CompileErrorf(p.peek(), CodeMisplaced, "Declared a non-method function as having a pointer receiver")
 	}
 
 	p.putBack(ident)
@@ -858,7 +1080,7 @@ func (p *Parser) parseVarStmt(varKeyword bool) (*VarStmt, error) {
 	firstTok := p.nextToken()
 	if varKeyword {
 		if firstTok.Type != TOKEN_VAR {
-			return nil, CompileErrorf(firstTok, "Impossible happened")
+			return nil, CompileErrorf(firstTok, CodeInternal, "Impossible happened")
 		}
 	} else {
 		// We've just consumed part of the declaration, put it back.
@@ -879,6 +1101,122 @@ func (p *Parser) parseVarStmt(varKeyword bool) (*VarStmt, error) {
 	return stmt, nil
 }
 
+// Parses single-line constant declarations:
+//
+//	const A, B int = 1, 2
+//
+// as well as blocks:
+//
+//	const:
+//	    A = iota
+//	    B
+func (p *Parser) parseConstStmt() (*ConstStmt, error) {
+	firstTok, ok := p.expect(TOKEN_CONST)
+	if !ok {
+		return nil, CompileErrorf(firstTok, CodeInternal, "Impossible happened")
+	}
+
+	result := &ConstStmt{stmt: stmt{expr: expr{firstTok.Pos}}}
+
+	if p.peek().Type != TOKEN_COLON {
+		spec, err := p.parseConstSpec(nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		result.Specs = append(result.Specs, spec)
+		return result, nil
+	}
+
+	p.nextToken()
+	result.Block = true
+
+	indent, err := p.expectNewIndent()
+	if err != nil {
+		return nil, err
+	}
+	p.putBack(indent)
+
+	var prev *ConstSpec
+	for iota := 0; p.peek().Type != TOKEN_EOF; iota++ {
+		end, err := p.handleIndentEnd()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			break
+		}
+
+		spec, err := p.parseConstSpec(prev, iota)
+		if err != nil {
+			return nil, err
+		}
+		result.Specs = append(result.Specs, spec)
+		prev = spec
+	}
+	return result, nil
+}
+
+// Parses a single line of a constant declaration. When the type and values
+// are omitted, they're copied from the previous line (prev).
+func (p *Parser) parseConstSpec(prev *ConstSpec, iota int) (*ConstSpec, error) {
+	spec := &ConstSpec{}
+	start := p.peek()
+
+	for {
+		t, ok := p.expect(TOKEN_WORD)
+		if !ok {
+			return nil, CompileErrorf(t, CodeSyntax, "Expected constant name")
+		}
+		spec.Consts = append(spec.Consts, &Constant{name: t.Value.(string), iota: iota, pos: t.Pos})
+
+		if p.peek().Type != TOKEN_COMMA {
+			break
+		}
+		p.nextToken()
+	}
+
+	switch p.peek().Type {
+	case TOKEN_INDENT, TOKEN_EOF, TOKEN_SEMICOLON:
+		if prev == nil {
+			return nil, CompileErrorf(start, CodeAssignmentMismatch, "Missing value in constant declaration")
+		}
+		spec.Type, spec.Inits, spec.Implicit = prev.Type, prev.Inits, true
+	default:
+		if p.peek().Type != TOKEN_ASSIGN {
+			typ, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			spec.Type = typ
+		}
+
+		if t, ok := p.expect(TOKEN_ASSIGN); !ok {
+			return nil, CompileErrorf(t, CodeAssignmentMismatch, "Missing value in constant declaration")
+		}
+
+		p.parsingConst = true
+		inits, err := p.parseExprList()
+		p.parsingConst = false
+		if err != nil {
+			return nil, err
+		}
+		spec.Inits = inits
+	}
+
+	if len(spec.Inits) < len(spec.Consts) {
+		return nil, CompileErrorf(start, CodeAssignmentMismatch, "Missing value in constant declaration")
+	} else if len(spec.Inits) > len(spec.Consts) {
+		return nil, CompileErrorf(start, CodeAssignmentMismatch, "Too many values in constant declaration")
+	}
+
+	for i, c := range spec.Consts {
+		c.Type = spec.Type
+		c.init = spec.Inits[i]
+		p.identStack.addObject(c)
+	}
+	return spec, nil
+}
+
 func (p *Parser) parseVarDecl() ([]*VarDecl, error) {
 	unknownType := &UnknownType{}
 	var varDecls = []*VarDecl{}
@@ -900,11 +1238,11 @@ groupsLoop:
 			token := p.nextToken()
 			switch token.Type {
 			case TOKEN_WORD:
-				decl.name = token.Value.(string)
+				decl.name, decl.pos = token.Value.(string), token.Pos
 			case TOKEN_ASSIGN:
 				break loop
 			default:
-				return nil, CompileErrorf(token, "Unexpected token %s\n", token.Type)
+				return nil, CompileErrorf(token, CodeSyntax, "Unexpected token %s\n", token.Type)
 			}
 
 			vars = append(vars, decl)
@@ -932,13 +1270,13 @@ groupsLoop:
 				t = p.peek()
 				break loop
 			default:
-				return nil, CompileErrorf(token, "Unexpected token %s", token.Type)
+				return nil, CompileErrorf(token, CodeSyntax, "Unexpected token %s", token.Type)
 			}
 		}
 
 		// Right side of "="
 		if len(vars) == 0 {
-			return nil, CompileErrorf(t, "No vars declared on the left side of \"=\"")
+			return nil, CompileErrorf(t, CodeSyntax, "No vars declared on the left side of \"=\"")
 		}
 
 		switch t := p.nextToken(); t.Type {
@@ -956,7 +1294,7 @@ groupsLoop:
 			varDecls = append(varDecls, &VarDecl{Vars: vars})
 			break groupsLoop
 		default:
-			return nil, CompileErrorf(t, "Unexpected token after new vars list: %s", t.Type)
+			return nil, CompileErrorf(t, CodeSyntax, "Unexpected token after new vars list: %s", t.Type)
 		}
 
 		var inits []Expr
@@ -972,13 +1310,13 @@ groupsLoop:
 			if len(inits) == len(vars) {
 				// Cool, it really was a list of initializers in parentheses.
 				if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-					return nil, CompileErrorf(t, "Expected `)`")
+					return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 				}
 			} else if len(inits) == 1 {
 				// Whoops, someone just put an expression in parentheses and we
 				// treated it like a tuple. We need to fix this.
 				if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-					return nil, CompileErrorf(t, "Expected `)`")
+					return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 				}
 				if t := p.nextToken(); t.Type == TOKEN_COMMA {
 					restInits, err := p.parseArgs(0)
@@ -990,7 +1328,7 @@ groupsLoop:
 					p.putBack(t)
 				}
 			} else {
-				return nil, CompileErrorf(t, "Couldn't parse the list of initializers")
+				return nil, CompileErrorf(t, CodeSyntax, "Couldn't parse the list of initializers")
 			}
 		} else {
 			p.putBack(t)
@@ -1010,7 +1348,7 @@ groupsLoop:
 				v.init = inits[0]
 			}
 		} else {
-			return nil, CompileErrorf(t, "Different number of new vars and initializers\n")
+			return nil, CompileErrorf(t, CodeAssignmentMismatch, "Different number of new vars and initializers\n")
 		}
 
 		varDecls[len(varDecls)-1].Inits = inits
@@ -1026,7 +1364,7 @@ groupsLoop:
 func (p *Parser) parseCompoundLit() (*CompoundLit, error) {
 	startTok, ok := p.expect(TOKEN_LBRACE)
 	if !ok {
-		return nil, CompileErrorf(startTok, "Compound literal has to start with `{`")
+		return nil, CompileErrorf(startTok, CodeSyntax, "Compound literal has to start with `{`")
 	}
 
 	p.skipWhiteSpace()
@@ -1064,23 +1402,23 @@ func (p *Parser) parseCompoundLit() (*CompoundLit, error) {
 			switch t := p.nextToken(); t.Type {
 			case TOKEN_COLON:
 				if kind == COMPOUND_LISTLIKE {
-					return nil, CompileErrorf(t, "Mixture of value and key:value expressions in a literal")
+					return nil, CompileErrorf(t, CodeInvalidLiteral, "Mixture of value and key:value expressions in a literal")
 				}
 				kind = COMPOUND_MAPLIKE
 			case TOKEN_COMMA:
 				if kind == COMPOUND_MAPLIKE {
-					return nil, CompileErrorf(t, "Mixture of value and key:value expressions in a literal")
+					return nil, CompileErrorf(t, CodeInvalidLiteral, "Mixture of value and key:value expressions in a literal")
 				}
 				kind = COMPOUND_LISTLIKE
 			case TOKEN_RBRACE:
 				if kind == COMPOUND_MAPLIKE {
-					return nil, CompileErrorf(t, "Unexpected end of a map-like compound literal")
+					return nil, CompileErrorf(t, CodeSyntax, "Unexpected end of a map-like compound literal")
 				} else if kind == COMPOUND_UNKNOWN {
 					kind = COMPOUND_LISTLIKE
 				}
 				return &CompoundLit{expr{startTok.Pos}, nil, &UnknownType{}, kind, elems, startTok.Pos}, nil
 			default:
-				return nil, CompileErrorf(t, "Unexpected token in a compound literal")
+				return nil, CompileErrorf(t, CodeSyntax, "Unexpected token in a compound literal")
 			}
 		} else {
 			switch t := p.nextToken(); t.Type {
@@ -1088,11 +1426,11 @@ func (p *Parser) parseCompoundLit() (*CompoundLit, error) {
 			case TOKEN_RBRACE:
 				return &CompoundLit{expr{startTok.Pos}, nil, &UnknownType{}, kind, elems, startTok.Pos}, nil
 			default:
-				return nil, CompileErrorf(t, "Unexpected token in a compound literal")
+				return nil, CompileErrorf(t, CodeSyntax, "Unexpected token in a compound literal")
 			}
 		}
 	}
-	return nil, CompileErrorf(startTok, "Impossible happened")
+	return nil, CompileErrorf(startTok, CodeInternal, "Impossible happened")
 }
 
 func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (*StructType, error) {
@@ -1108,14 +1446,14 @@ func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (
 
 		tokens, ok := p.expectSeries(TOKEN_STRUCT, TOKEN_WORD)
 		if !ok {
-			return nil, CompileErrorf(tokens[0], "Couldn't parse struct header")
+			return nil, CompileErrorf(tokens[0], CodeSyntax, "Couldn't parse struct header")
 		}
 		name = tokens[1].Value.(string)
 
 		switch t := p.peek(); t.Type {
 		case TOKEN_LBRACKET:
 			if !genericPossible {
-				return nil, CompileErrorf(t, "Generic types can only be declared top-level")
+				return nil, CompileErrorf(t, CodeMisplaced, "Generic types can only be declared top-level")
 			}
 			// Scope for generic params
 			p.identStack.pushScope()
@@ -1126,16 +1464,16 @@ func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (
 			}
 
 			if t, ok := p.expect(TOKEN_COLON); !ok {
-				return nil, CompileErrorf(t, "Expected `:` after `]`")
+				return nil, CompileErrorf(t, CodeSyntax, "Expected `:` after `]`")
 			}
 		case TOKEN_COLON:
 			p.nextToken()
 		default:
-			return nil, CompileErrorf(t, "Couldn't parse struct header")
+			return nil, CompileErrorf(t, CodeSyntax, "Couldn't parse struct header")
 		}
 	} else {
 		if tokens, ok := p.expectSeries(TOKEN_STRUCT, TOKEN_COLON); !ok {
-			return nil, CompileErrorf(tokens[0], "Couldn't parse struct declaration")
+			return nil, CompileErrorf(tokens[0], CodeSyntax, "Couldn't parse struct declaration")
 		}
 	}
 
@@ -1159,7 +1497,7 @@ func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (
 			result.Keys = append(result.Keys, name)
 		case TOKEN_FUNC:
 			if receiverTypeDecl == nil {
-				err = CompileErrorf(token, "Cannot declare methods in inline struct declarations")
+				err = CompileErrorf(token, CodeMisplaced, "Cannot declare methods in inline struct declarations")
 				return nil
 			}
 
@@ -1179,6 +1517,7 @@ func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (
 				return nil
 			}
 			fun.Receiver, fun.PtrReceiver = receiver, ptrReceiver
+			fun.comments = p.commentsAt(fun.Pos())
 			result.Methods[fun.name] = fun
 			result.Keys = append(result.Keys, fun.name)
 			p.identStack.popScope()
@@ -1196,7 +1535,7 @@ func (p *Parser) parseStruct(receiverTypeDecl *TypeDecl, genericPossible bool) (
 			return nil, err
 		}
 		if token != nil {
-			return nil, CompileErrorf(token, "Use `pass` for empty interface")
+			return nil, CompileErrorf(token, CodeSyntax, "Use `pass` for empty interface")
 		}
 		return result, nil
 	}
@@ -1239,12 +1578,12 @@ func (p *Parser) parseInterface(named bool) (*IfaceType, error) {
 
 		tokens, ok := p.expectSeries(TOKEN_INTERFACE, TOKEN_WORD, TOKEN_COLON)
 		if !ok {
-			return nil, CompileErrorf(tokens[0], "Couldn't parse struct header")
+			return nil, CompileErrorf(tokens[0], CodeSyntax, "Couldn't parse struct header")
 		}
 		name = tokens[1].Value.(string)
 	} else {
 		if tokens, ok := p.expectSeries(TOKEN_INTERFACE, TOKEN_COLON); !ok {
-			return nil, CompileErrorf(tokens[0], "Couldn't parse struct declaration")
+			return nil, CompileErrorf(tokens[0], CodeSyntax, "Couldn't parse struct declaration")
 		}
 	}
 
@@ -1286,7 +1625,7 @@ func (p *Parser) parseInterface(named bool) (*IfaceType, error) {
 			return nil, err
 		}
 		if token != nil {
-			return nil, CompileErrorf(token, "Use `pass` for empty interface")
+			return nil, CompileErrorf(token, CodeSyntax, "Use `pass` for empty interface")
 		}
 		return result, nil
 	}
@@ -1329,12 +1668,12 @@ func (p *Parser) parseChanType() (*ChanType, error) {
 	}
 
 	if t, ok := p.expect(TOKEN_CHAN); !ok {
-		return nil, CompileErrorf(t, "Expected `chan` after `<-`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `chan` after `<-`")
 	}
 
 	if p.peek().Type == TOKEN_SEND {
 		if dir != CHAN_DIR_BI {
-			return nil, CompileErrorf(p.peek(), "Invalid channel declaration")
+			return nil, CompileErrorf(p.peek(), CodeSyntax, "Invalid channel declaration")
 		}
 
 		dir = CHAN_DIR_SEND
@@ -1363,7 +1702,17 @@ func (p *Parser) parsingGenericInstantiation() bool {
 	return p.genericParams != nil
 }
 
-func (p *Parser) typeFromWord(name string) Type {
+// Stores a type that will be bound to its declaration after parsing all files.
+func (p *Parser) addUnboundType(name string, typ DeclaredType, pos gotoken.Pos) {
+	p.unboundTypes[name] = append(p.unboundTypes[name], typ)
+	p.unboundTypesPos[typ] = pos
+}
+
+func (p *Parser) typeFromWord(name string, pos gotoken.Pos) Type {
+	if p.pattern != nil && p.capturedByPattern(name) {
+		return p.capture(name, pos)
+	}
+
 	if p.parsingGenericInstantiation() {
 		// Substitute a generic param occurence with a concrete type.
 		if typ, ok := p.genericParams[name]; ok {
@@ -1376,7 +1725,7 @@ func (p *Parser) typeFromWord(name string) Type {
 		switch {
 		case obj == nil:
 			r := &CustomType{Name: name}
-			p.unboundTypes[name] = append(p.unboundTypes[name], r)
+			p.addUnboundType(name, r, pos)
 			return r
 		case obj.ObjectType() == OBJECT_TYPE:
 			decl := obj.(*TypeDecl)
@@ -1386,7 +1735,7 @@ func (p *Parser) typeFromWord(name string) Type {
 				return &CustomType{Name: name, Decl: decl}
 			}
 		case obj.ObjectType() == OBJECT_GENERIC_TYPE:
-			return &GenericParamType{Name: obj.Name()}
+			return &GenericParamType{Name: obj.Name(), decl: obj.(*GenericParamTypeDecl)}
 		default:
 			panic("niemożliwe")
 		}
@@ -1401,7 +1750,7 @@ func (p *Parser) typeFromWord(name string) Type {
 
 func (p *Parser) parseGenericParamTypes() ([]Type, error) {
 	if t, ok := p.expect(TOKEN_LBRACKET); !ok {
-		return nil, CompileErrorf(t, "Expected `[`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `[`")
 	}
 
 	var result []Type
@@ -1418,7 +1767,7 @@ func (p *Parser) parseGenericParamTypes() ([]Type, error) {
 		case TOKEN_RBRACKET:
 			return result, nil
 		default:
-			return nil, CompileErrorf(t, "Unexpected token")
+			return nil, CompileErrorf(t, CodeSyntax, "Unexpected token")
 		}
 	}
 }
@@ -1443,23 +1792,27 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 		return &PointerType{ptrTo}, nil
 	case TOKEN_MAP:
 		if t, ok := p.expect(TOKEN_LBRACKET); !ok {
-			return nil, CompileErrorf(t, "Expected `[` after `map`")
+			return nil, CompileErrorf(t, CodeSyntax, "Expected `[` after `map`")
 		}
 
 		t := p.peek()
 		by, err := p.parseType()
 		if err != nil {
-			return nil, CompileErrorf(t, "Failed parsing map index type: %s", err)
+			return nil, CompileErrorf(t, CodeSyntax, "Failed parsing map index type: %s", err)
 		}
 
 		if t, ok := p.expect(TOKEN_RBRACKET); !ok {
-			return nil, CompileErrorf(t, "Expected `]` after map's index type")
+			return nil, CompileErrorf(t, CodeSyntax, "Expected `]` after map's index type")
 		}
 
 		t = p.peek()
 		of, err := p.parseType()
 		if err != nil {
-			return nil, CompileErrorf(t, "Failed parsing map value type: %s", err)
+			return nil, CompileErrorf(t, CodeSyntax, "Failed parsing map value type: %s", err)
+		}
+
+		if param, ok := by.(*GenericParamType); ok && param.decl != nil {
+			param.decl.comparable = true
 		}
 
 		return &MapType{by, of}, nil
@@ -1473,13 +1826,16 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 			}
 			return &SliceType{sliceOf}, nil
 		case TOKEN_INT:
-			if t, ok := p.expect(TOKEN_RBRACKET); !ok {
-				return nil, CompileErrorf(t, "Expected ']'")
+			if p.peek().Type != TOKEN_RBRACKET {
+				// Not a simple literal, e.g. [2*N]int
+				p.putBack(next)
+				return p.parseArrayWithSizeExpr()
 			}
+			p.nextToken()
 
 			size, err := strconv.ParseInt(next.Value.(string), 10, 64)
 			if err != nil {
-				return nil, CompileErrorf(next, "Couldn't parse array size")
+				return nil, CompileErrorf(next, CodeSyntax, "Couldn't parse array size")
 			}
 
 			arrayOf, err := p.parseType()
@@ -1488,8 +1844,21 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 			}
 
 			return &ArrayType{Of: arrayOf, Size: int(size)}, nil
+		case TOKEN_WORD, TOKEN_LPARENTH, TOKEN_MINUS, TOKEN_PLUS:
+			if p.pattern != nil && next.Type == TOKEN_WORD && next.Value.(string) == Blank &&
+				p.peek().Type == TOKEN_RBRACKET {
+				// Array of any size in a pattern.
+				p.nextToken()
+				arrayOf, err := p.parseType()
+				if err != nil {
+					return nil, err
+				}
+				return &ArrayType{Of: arrayOf, Size: -1}, nil
+			}
+			p.putBack(next)
+			return p.parseArrayWithSizeExpr()
 		default:
-			return nil, CompileErrorf(next, "Invalid type name, expected slice or array")
+			return nil, CompileErrorf(next, CodeSyntax, "Invalid type name, expected slice or array")
 
 			// TODO:
 			// case TOKEN_THREEDOTS
@@ -1502,13 +1871,13 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 			p.nextToken()
 			membNameTok := p.nextToken()
 			if membNameTok.Type != TOKEN_WORD {
-				return nil, CompileErrorf(membNameTok, "Package member name expected after `.`")
+				return nil, CompileErrorf(membNameTok, CodeSyntax, "Package member name expected after `.`")
 			}
 			membName := membNameTok.Value.(string)
 
 			pkg, ok := p.imports[name]
 			if !ok {
-				return nil, CompileErrorf(token, "Package `%s` not imported", name)
+				return nil, CompileErrorf(token, CodeImport, "Package `%s` not imported", name)
 			}
 
 			fullName := name + "." + membName
@@ -1523,7 +1892,7 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 			} else {
 				typ = &CustomType{Name: membName, Package: pkg}
 			}
-			p.unboundTypes[fullName] = append(p.unboundTypes[fullName], typ)
+			p.addUnboundType(fullName, typ, token.Pos)
 			return typ, nil
 		} else {
 			if p.peek().Type == TOKEN_LBRACKET {
@@ -1533,10 +1902,10 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 					return nil, err
 				}
 				typ := &GenericType{Name: name, Params: params}
-				p.unboundTypes[name] = append(p.unboundTypes[name], typ)
+				p.addUnboundType(name, typ, token.Pos)
 				return typ, nil
 			} else {
-				return p.typeFromWord(name), nil
+				return p.typeFromWord(name, token.Pos), nil
 			}
 		}
 	case TOKEN_STRUCT:
@@ -1556,8 +1925,69 @@ func (p *Parser) attemptTypeParse(justTry bool) (Type, error) {
 			p.putBack(token)
 			return nil, doesntLookLikeTypeErr
 		}
-		return nil, CompileErrorf(token, "Expected type name, got %s", token.Type)
+		return nil, CompileErrorf(token, CodeSyntax, "Expected type name, got %s", token.Type)
+	}
+}
+
+// Tells if a name used in a pattern of a `when` branch captures a type.
+// Names of builtin types, params of the generic and types declared in the
+// package or in the code don't.
+func (p *Parser) capturedByPattern(name string) bool {
+	if name == Blank {
+		return true
+	}
+	if _, ok := GetBuiltinType(name); ok {
+		return false
+	}
+	if _, ok := p.genericParams[name]; ok {
+		return false
+	}
+	if p.pkgTypes[name] {
+		return false
+	}
+	if local, ok := p.imports[LocalPkg]; ok && local.pkg != nil {
+		// Instantiations are parsed when the package is bound.
+		switch local.pkg.GetObject(name).(type) {
+		case *TypeDecl, *GenericStruct:
+			return false
+		}
+	}
+	return p.identStack.findTypeDecl(name) == nil
+}
+
+func (p *Parser) capture(name string, pos gotoken.Pos) Type {
+	for _, decl := range *p.pattern {
+		if decl.name == name {
+			return &GenericParamType{Name: name, decl: decl}
+		}
+	}
+	decl := &GenericParamTypeDecl{stmt: stmt{expr: expr{pos}}, name: name, captured: true}
+	if name != Blank {
+		// Every `_` is a different type.
+		*p.pattern = append(*p.pattern, decl)
 	}
+	return &GenericParamType{Name: name, decl: decl}
+}
+
+// Parses an array type with size given by a constant expression. Its value
+// is computed after identifiers are bound, see resolveArraySizes.
+func (p *Parser) parseArrayWithSizeExpr() (*ArrayType, error) {
+	sizeExpr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.expect(TOKEN_RBRACKET); !ok {
+		return nil, CompileErrorf(t, CodeSyntax, "Expected ']'")
+	}
+
+	arrayOf, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+
+	arr := &ArrayType{Of: arrayOf, SizeExpr: sizeExpr}
+	p.unresolvedArrays = append(p.unresolvedArrays, arr)
+	return arr, nil
 }
 
 func (p *Parser) parseTypeExpr() (*TypeExpr, error) {
@@ -1584,6 +2014,8 @@ func (p *Parser) parseFuncTypeOrLit() (Expr, error) {
 	}
 
 	if p.peek().Type == TOKEN_COLON {
+		p.funcLits++
+		defer func() { p.funcLits-- }()
 		return p.parseFuncBody(fd)
 	} else {
 		return &TypeExpr{expr{loc}, fd.typ}, nil
@@ -1598,6 +2030,7 @@ func (p *Parser) wordToExpr(word *Token) PrimaryExpr {
 	name := word.Value.(string)
 	ident := &Ident{expr: expr{word.Pos}, name: name}
 	var result PrimaryExpr = ident
+	p.refs = append(p.refs, ident)
 
 	if p.parsingGenericInstantiation() && p.genericParams[name] != nil {
 		typ, ok := p.genericParams[name]
@@ -1606,7 +2039,9 @@ func (p *Parser) wordToExpr(word *Token) PrimaryExpr {
 		}
 		result = &TypeExpr{expr: expr{word.Pos}, typ: typ}
 	} else if !p.dontLookup {
-		if v := p.identStack.findObject(name); v == nil && !p.ignoreUnknowns {
+		if v := p.identStack.findObject(name); v == nil && name == "iota" && p.parsingConst {
+			ident.object = iotaConst
+		} else if v == nil && !p.ignoreUnknowns {
 			if pkg := p.imports[name]; pkg == nil {
 				p.unboundIdents[name] = append(p.unboundIdents[name], ident)
 			} else {
@@ -1637,7 +2072,7 @@ func (p *Parser) parsePrimaryExpr() (PrimaryExpr, error) {
 			return nil, err
 		}
 		if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-			return nil, CompileErrorf(t, "Expected closing `)`")
+			return nil, CompileErrorf(t, CodeSyntax, "Expected closing `)`")
 		}
 	case TOKEN_WORD:
 		left = p.wordToExpr(token)
@@ -1646,7 +2081,7 @@ func (p *Parser) parsePrimaryExpr() (PrimaryExpr, error) {
 	case TOKEN_INT, TOKEN_FLOAT, TOKEN_IMAG, TOKEN_TRUE, TOKEN_FALSE, TOKEN_RUNE:
 		return &BasicLit{expr{token.Pos}, token}, nil
 	case TOKEN_NIL:
-		return &NilExpr{}, nil
+		return &NilExpr{expr{token.Pos}}, nil
 	case TOKEN_FUNC:
 		p.putBack(token)
 		left, err = p.parseFuncTypeOrLit()
@@ -1668,7 +2103,7 @@ func (p *Parser) parsePrimaryExpr() (PrimaryExpr, error) {
 			return nil, err
 		}
 	default:
-		return nil, CompileErrorf(token, "Unexpected token (expected a primary expression): %s", token.Type)
+		return nil, CompileErrorf(token, CodeSyntax, "Unexpected token (expected a primary expression): %s", token.Type)
 	}
 
 loop:
@@ -1689,23 +2124,29 @@ loop:
 					}
 				}
 				if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-					return nil, CompileErrorf(t, "Expected `)`")
+					return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 				}
 				return &TypeAssertion{expr{token.Pos}, te == nil, left, te}, nil
 			case TOKEN_WORD:
 				left = &DotSelector{expr{token.Pos}, left, &Ident{expr{t.Pos}, t.Value.(string), nil, false}}
+				p.refs = append(p.refs, left)
 			default:
-				return nil, CompileErrorf(t, "Unexpected token after `.`")
+				return nil, CompileErrorf(t, CodeSyntax, "Unexpected token after `.`")
 			}
 		case TOKEN_LPARENTH:
 			args, err := p.parseArgs(0)
 			if err != nil {
 				return nil, err
 			}
+			spread := false
+			if p.peek().Type == TOKEN_ELLIPSIS {
+				p.nextToken()
+				spread = true
+			}
 			if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-				return nil, CompileErrorf(t, "Expected `)`")
+				return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 			}
-			left = &FuncCallExpr{expr{token.Pos}, left, args, nil}
+			left = &FuncCallExpr{expr: expr{token.Pos}, Left: left, Args: args, Spread: spread}
 		case TOKEN_LBRACKET:
 			var index []Expr
 			exp, err := p.parseExpr()
@@ -1740,7 +2181,7 @@ loop:
 			}
 
 			if t, ok := p.expect(TOKEN_RBRACKET); !ok {
-				return nil, CompileErrorf(t, "Expected `]`")
+				return nil, CompileErrorf(t, CodeSyntax, "Expected `]`")
 			}
 			left = &ArrayExpr{expr{token.Pos}, left, index, nil}
 		case TOKEN_LBRACE:
@@ -1778,7 +2219,7 @@ func (p *Parser) parseMaybeUnaryExpr() (Expr, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &UnaryOp{op: token, Right: primaryExpr}, nil
+		return &UnaryOp{expr: expr{token.Pos}, op: token, Right: primaryExpr}, nil
 	} else {
 		p.putBack(token)
 		return p.parsePrimaryExpr()
@@ -1790,7 +2231,7 @@ var hierarchy [][]TokenType = [][]TokenType{
 	{TOKEN_PLUS, TOKEN_MINUS, TOKEN_PIPE},
 	{TOKEN_SHL, TOKEN_SHR},
 	{TOKEN_LT, TOKEN_GT, TOKEN_EQ_GT, TOKEN_EQ_LT},
-	{TOKEN_EQUALS},
+	{TOKEN_EQUALS, TOKEN_NEQUALS},
 	{TOKEN_OR, TOKEN_AND}}
 
 var opSet map[TokenType]bool = make(map[TokenType]bool)
@@ -1820,6 +2261,9 @@ func (p *Parser) parseExpr() (Expr, error) {
 
 	reduce := func() {
 		op := opStack[len(opStack)-1]
+		if p.binaryOps != nil {
+			p.binaryOps[op.Offset] = true
+		}
 		reduced := &BinaryOp{
 			expr:  expr{op.Pos},
 			Left:  exprStack[len(exprStack)-2],
@@ -1863,7 +2307,7 @@ func (p *Parser) parseArgs(max int) ([]Expr, error) {
 	for {
 		token := p.nextToken()
 		switch token.Type {
-		case TOKEN_EOF, TOKEN_RPARENTH, TOKEN_INDENT, TOKEN_SEMICOLON:
+		case TOKEN_EOF, TOKEN_RPARENTH, TOKEN_INDENT, TOKEN_SEMICOLON, TOKEN_COLON, TOKEN_ELLIPSIS:
 			p.putBack(token)
 			return result, nil
 		case TOKEN_COMMA:
@@ -1890,9 +2334,26 @@ func (p *Parser) makeUnnamedVars(types []Type) []*Variable {
 	return result
 }
 
-func (p *Parser) parseArgsDecl() (DeclChain, error) {
+// Parses type of a function parameter, which can be variadic (e.g. `...int`).
+// Types of variadic parameters are slices.
+func (p *Parser) parseParamType() (typ Type, variadic bool, err error) {
+	if p.peek().Type != TOKEN_ELLIPSIS {
+		typ, err = p.parseType()
+		return typ, false, err
+	}
+	p.nextToken()
+	of, err := p.parseType()
+	if err != nil {
+		return nil, false, err
+	}
+	return &SliceType{of}, true, nil
+}
+
+// Parses a list of parameters (or results) of a function. If variadic is true,
+// the last parameter is variadic.
+func (p *Parser) parseArgsDecl() (decls DeclChain, variadic bool, err error) {
 	if p.peek().Type == TOKEN_RPARENTH {
-		return nil, nil
+		return nil, false, nil
 	}
 
 	var result []*Variable
@@ -1917,13 +2378,23 @@ loop:
 				continue loop
 			}
 		case named:
-			names = append(names, p.nextToken())
+			name := p.nextToken()
+			if name.Type != TOKEN_WORD {
+				return nil, false, CompileErrorf(name, CodeSyntax, "Expected a parameter name")
+			}
+			names = append(names, name)
 		case anon:
-			t, err := p.parseType()
+			t, isVariadic, err := p.parseParamType()
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 			types = append(types, t)
+			if isVariadic {
+				if err := p.checkVariadicLast(); err != nil {
+					return nil, false, err
+				}
+				variadic = true
+			}
 		}
 
 		switch t := p.peek(); t.Type {
@@ -1931,7 +2402,7 @@ loop:
 			switch state {
 			case undecided, anon:
 				for _, name := range names {
-					result = append(result, &Variable{Type: p.typeFromWord(name.Value.(string))})
+					result = append(result, &Variable{Type: p.typeFromWord(name.Value.(string), name.Pos)})
 				}
 				for _, typ := range types {
 					result = append(result, &Variable{Type: typ})
@@ -1939,7 +2410,7 @@ loop:
 				names = nil
 				break loop
 			case named:
-				return nil, CompileErrorf(t, "Last parameter needs a type")
+				return nil, false, CompileErrorf(t, CodeSyntax, "Last parameter needs a type")
 			}
 		case TOKEN_COMMA:
 			p.nextToken()
@@ -1947,17 +2418,26 @@ loop:
 		default:
 			switch state {
 			case anon:
-				CompileErrorf(t, "Invalid arguments declaration: comma missing or a typo in argument name")
+				return nil, false, CompileErrorf(t, CodeSyntax, "Invalid arguments declaration: comma missing or a typo in argument name")
 			case undecided:
 				state = named
 				fallthrough
 			case named:
-				t, err := p.parseType()
+				t, isVariadic, err := p.parseParamType()
 				if err != nil {
-					return nil, err
+					return nil, false, err
+				}
+				if isVariadic {
+					if len(names) > 1 {
+						return nil, false, CompileErrorf(names[0], CodeInvalidVariadic, "Only the last parameter can be variadic")
+					}
+					if err := p.checkVariadicLast(); err != nil {
+						return nil, false, err
+					}
+					variadic = true
 				}
 				for _, name := range names {
-					result = append(result, &Variable{name: name.Value.(string), Type: t})
+					result = append(result, &Variable{name: name.Value.(string), Type: t, pos: name.Pos})
 				}
 				names = nil
 			}
@@ -1968,12 +2448,22 @@ loop:
 			case TOKEN_COMMA:
 				p.nextToken()
 			default:
-				return nil, CompileErrorf(p.peek(), "Unexpected token: %s", p.peek().Type)
+				return nil, false, CompileErrorf(p.peek(), CodeSyntax, "Unexpected token: %s", p.peek().Type)
 			}
 		}
 	}
 
-	return []*VarDecl{&VarDecl{Vars: result}}, nil
+	return []*VarDecl{&VarDecl{Vars: result}}, variadic, nil
+}
+
+// Called after parsing a variadic parameter, makes sure that it's the last one.
+func (p *Parser) checkVariadicLast() error {
+	switch t := p.peek(); t.Type {
+	case TOKEN_RPARENTH, TOKEN_COLON, TOKEN_INDENT:
+		return nil
+	default:
+		return CompileErrorf(t, CodeInvalidVariadic, "Only the last parameter can be variadic")
+	}
 }
 
 func typesFromVars(vd DeclChain) []Type {
@@ -1989,29 +2479,40 @@ func typesFromVars(vd DeclChain) []Type {
 func (p *Parser) parseGenericParams() ([]string, error) {
 	t, ok := p.expect(TOKEN_LBRACKET)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected `[`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `[`")
 	}
 	genericTypes := []string{}
+	if !p.parsingGenericInstantiation() {
+		p.genericDecls = nil
+	}
 
 loop:
 	for {
 		typeName, ok := p.expect(TOKEN_WORD)
 		if !ok {
-			return nil, CompileErrorf(typeName, "Expected generic type name")
+			return nil, CompileErrorf(typeName, CodeSyntax, "Expected generic type name")
 		}
 
 		name := typeName.Value.(string)
 
+		constraint, err := p.parseGenericConstraint()
+		if err != nil {
+			return nil, err
+		}
+
 		if !p.parsingGenericInstantiation() {
 			// When parsing a generic instantiation, ignore the params.
 			// We're just re-parsing the code, substituting generic params occurences
 			// with concrete types as we go.
 			genericTypes = append(genericTypes, name)
 
-			p.identStack.addObject(&GenericParamTypeDecl{
-				stmt: stmt{expr: expr{typeName.Pos}},
-				name: name},
-			)
+			decl := &GenericParamTypeDecl{
+				stmt:       stmt{expr: expr{typeName.Pos}},
+				name:       name,
+				constraint: constraint,
+			}
+			p.genericDecls = append(p.genericDecls, decl)
+			p.identStack.addObject(decl)
 		}
 
 		switch t := p.nextToken(); t.Type {
@@ -2019,20 +2520,42 @@ loop:
 		case TOKEN_RBRACKET:
 			break loop
 		default:
-			return nil, CompileErrorf(t, "Unexpected token %s", t)
+			return nil, CompileErrorf(t, CodeSyntax, "Unexpected token %s", t)
 		}
 	}
 
 	return genericTypes, nil
 }
 
+// Parses an optional constraint of a generic param, like `implements Stringer`
+// or `is comparable`.
+func (p *Parser) parseGenericConstraint() (*GenericConstraint, error) {
+	switch p.peek().Type {
+	case TOKEN_IMPLEMENTS:
+		p.nextToken()
+		iface, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		return &GenericConstraint{Iface: iface}, nil
+	case TOKEN_IS:
+		p.nextToken()
+		t := p.nextToken()
+		if t.Type != TOKEN_WORD || t.Value.(string) != "comparable" {
+			return nil, CompileErrorf(t, CodeSyntax, "Expected `comparable`")
+		}
+		return &GenericConstraint{}, nil
+	}
+	return nil, nil
+}
+
 // Parses function header (declaration without the body).
 // Returns a partially complete FuncDecl, that can be later filled with
 // function's body, etc.
 func (p *Parser) parseFuncHeader(genericPossible bool) (*FuncDecl, error) {
 	startTok, ok := p.expect(TOKEN_FUNC)
 	if !ok {
-		return nil, CompileErrorf(startTok, "Function declaration needs to start with 'func' keyword")
+		return nil, CompileErrorf(startTok, CodeSyntax, "Function declaration needs to start with 'func' keyword")
 	}
 
 	if p.peek().Type == TOKEN_MUL {
@@ -2051,7 +2574,7 @@ func (p *Parser) parseFuncHeader(genericPossible bool) (*FuncDecl, error) {
 
 		if p.peek().Type == TOKEN_LBRACKET {
 			if !genericPossible {
-				return nil, CompileErrorf(p.peek(), "Unexpected generic function")
+				return nil, CompileErrorf(p.peek(), CodeSyntax, "Unexpected generic function")
 			}
 			genericTypes, err = p.parseGenericParams()
 			if err != nil {
@@ -2062,20 +2585,20 @@ func (p *Parser) parseFuncHeader(genericPossible bool) (*FuncDecl, error) {
 		// anonymous function
 		p.putBack(t)
 	default:
-		return nil, CompileErrorf(t, "Unexpected token after `func`: %s", t.Type)
+		return nil, CompileErrorf(t, CodeSyntax, "Unexpected token after `func`: %s", t.Type)
 	}
 
 	if t, ok := p.expect(TOKEN_LPARENTH); !ok {
-		return nil, CompileErrorf(t, "Expected `(`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `(`")
 	}
 
-	args, err := p.parseArgsDecl()
+	args, variadic, err := p.parseArgsDecl()
 	if err != nil {
 		return nil, err
 	}
 
 	if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-		return nil, CompileErrorf(t, "Expected `)`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 	}
 
 	results := DeclChain(nil)
@@ -2083,13 +2606,17 @@ func (p *Parser) parseFuncHeader(genericPossible bool) (*FuncDecl, error) {
 	if p.peek().Type == TOKEN_LPARENTH {
 		p.nextToken()
 
-		results, err = p.parseArgsDecl()
+		var variadicResult bool
+		results, variadicResult, err = p.parseArgsDecl()
 		if err != nil {
 			return nil, err
 		}
+		if variadicResult {
+			return nil, CompileErrorf(startTok, CodeInvalidVariadic, "Function results can't be variadic")
+		}
 
 		if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-			return nil, CompileErrorf(t, "Expected `)`")
+			return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 		}
 	} else {
 		typ, err := p.attemptTypeParse(true)
@@ -2109,8 +2636,9 @@ func (p *Parser) parseFuncHeader(genericPossible bool) (*FuncDecl, error) {
 		Args:    args,
 		Results: results,
 		typ: &FuncType{
-			Args:    typesFromVars(args),
-			Results: typesFromVars(results),
+			Args:     typesFromVars(args),
+			Results:  typesFromVars(results),
+			Variadic: variadic,
 		},
 		GenericParams: genericTypes,
 	}, nil
@@ -2129,15 +2657,16 @@ func (p *Parser) parseFunc(genericPossible bool) (*FuncDecl, Object, error) {
 
 	if len(fd.GenericParams) > 0 {
 		gf = &GenericFunc{stmt: stmt{expr: fd.expr},
-			params:  fd.GenericParams,
-			Func:    fd,
-			imports: p.imports,
-			tfile:   p.lex.tfile,
-			offset:  p.lex.offset,
+			params:     fd.GenericParams,
+			paramDecls: p.genericDecls,
+			Func:       fd,
+			imports:    p.imports,
+			tfile:      p.lex.tfile,
+			offset:     p.lex.offset + start.Offset,
 		}
 		obj = gf
 	} else {
-		obj = &Variable{name: fd.name, Type: fd.typ, init: fd}
+		obj = &Variable{name: fd.name, Type: fd.typ, init: fd, pos: fd.Pos()}
 	}
 
 	if fd.Receiver == nil {
@@ -2164,7 +2693,7 @@ func (p *Parser) parseFunc(genericPossible bool) (*FuncDecl, Object, error) {
 func (p *Parser) parseFuncBody(fd *FuncDecl) (*FuncDecl, error) {
 	t, ok := p.expect(TOKEN_COLON)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected `:`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `:`")
 	}
 
 	p.identStack.pushScope()
@@ -2190,7 +2719,7 @@ func (p *Parser) parseFuncBody(fd *FuncDecl) (*FuncDecl, error) {
 	}
 
 	if p.branchTreesStack.top().CountBranchStmts() > 0 {
-		return nil, CompileErrorf(t, "Unmatched branch statements in block: %#v", p.branchTreesStack.top())
+		return nil, CompileErrorf(t, CodeInternal, "Unmatched branch statements in block: %#v", p.branchTreesStack.top())
 	}
 
 	fd.Code = block
@@ -2201,12 +2730,12 @@ func (p *Parser) parseFuncBody(fd *FuncDecl) (*FuncDecl, error) {
 func (p *Parser) parseTypeDecl() (*TypeDecl, error) {
 	startTok, ok := p.expect(TOKEN_TYPE)
 	if !ok {
-		return nil, CompileErrorf(startTok, "Type declaration needs to start with 'type' keyword")
+		return nil, CompileErrorf(startTok, CodeSyntax, "Type declaration needs to start with 'type' keyword")
 	}
 
 	name, ok := p.expect(TOKEN_WORD)
 	if !ok {
-		return nil, CompileErrorf(startTok, "Type name expected")
+		return nil, CompileErrorf(startTok, CodeSyntax, "Type name expected")
 	}
 
 	realType, err := p.parseType()
@@ -2243,11 +2772,11 @@ func (p *Parser) parseBranchStmt() (*BranchStmt, error) {
 func (p *Parser) parseReturnStmt() (*ReturnStmt, error) {
 	tok, ok := p.expect(TOKEN_RETURN)
 	if !ok {
-		return nil, CompileErrorf(tok, "Expected `return` keyword")
+		return nil, CompileErrorf(tok, CodeSyntax, "Expected `return` keyword")
 	}
 
 	if len(p.funcStack) == 0 {
-		return nil, CompileErrorf(tok, "Return statement used outside a function")
+		return nil, CompileErrorf(tok, CodeMisplaced, "Return statement used outside a function")
 	}
 
 	s := &ReturnStmt{stmt: stmt{expr: expr{tok.Pos}}, Func: p.funcStack[len(p.funcStack)-1]}
@@ -2266,14 +2795,60 @@ func (p *Parser) parseReturnStmt() (*ReturnStmt, error) {
 	}
 }
 
+func (p *Parser) parseGoStmt() (*GoStmt, error) {
+	tok, ok := p.expect(TOKEN_GO)
+	if !ok {
+		return nil, CompileErrorf(tok, CodeSyntax, "Expected `go`")
+	}
+
+	if len(p.funcStack) == 0 {
+		return nil, CompileErrorf(tok, CodeMisplaced, "Go statement used outside a function")
+	}
+
+	ex, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	call, ok := ex.(*FuncCallExpr)
+	if !ok {
+		return nil, CompileErrorf(tok, CodeSyntax, "Expression in go must be function call")
+	}
+
+	return &GoStmt{stmt: stmt{expr: expr{tok.Pos}}, Call: call}, nil
+}
+
+func (p *Parser) parseDeferStmt() (*DeferStmt, error) {
+	tok, ok := p.expect(TOKEN_DEFER)
+	if !ok {
+		return nil, CompileErrorf(tok, CodeSyntax, "Expected `defer`")
+	}
+
+	if len(p.funcStack) == 0 {
+		return nil, CompileErrorf(tok, CodeMisplaced, "Defer statement used outside a function")
+	}
+
+	ex, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	call, ok := ex.(*FuncCallExpr)
+	if !ok {
+		return nil, CompileErrorf(tok, CodeSyntax, "Expression in defer must be function call")
+	}
+
+	return &DeferStmt{stmt: stmt{expr: expr{tok.Pos}}, Call: call}, nil
+}
+
 func (p *Parser) parseCompilerMacro() (*compilerMacro, error) {
 	tok := p.nextToken()
 	if tok.Type != TOKEN_WORD || tok.Value.(string) != "__compiler_macro" {
-		return nil, CompileErrorf(tok, "Expected __compiler_macro")
+		return nil, CompileErrorf(tok, CodeSyntax, "Expected __compiler_macro")
 	}
 
 	if t, ok := p.expect(TOKEN_LPARENTH); !ok {
-		return nil, CompileErrorf(t, "Expected `(`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `(`")
 	}
 
 	args, err := p.parseArgs(0)
@@ -2282,13 +2857,13 @@ func (p *Parser) parseCompilerMacro() (*compilerMacro, error) {
 	}
 
 	if t, ok := p.expect(TOKEN_RPARENTH); !ok {
-		return nil, CompileErrorf(t, "Expected `)`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `)`")
 	}
 
 	result := &compilerMacro{stmt: stmt{expr: expr{tok.Pos}}, Args: args}
 
 	if len(p.funcStack) == 0 {
-		return nil, CompileErrorf(tok, "__compiler_macro used outside a function")
+		return nil, CompileErrorf(tok, CodeMisplaced, "__compiler_macro used outside a function")
 	}
 
 	fun := p.funcStack[len(p.funcStack)-1]
@@ -2336,11 +2911,11 @@ func (p *Parser) parseInitOrAssign() (Stmt, error) {
 
 	assign, ok := s.(*AssignStmt)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected assignment")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected assignment")
 	}
 
 	if assign.Token.Type != TOKEN_ASSIGN {
-		return nil, CompileErrorf(assign.Token, "Only `=` assignment allowed")
+		return nil, CompileErrorf(assign.Token, CodeSyntax, "Only `=` assignment allowed")
 	}
 
 	return s, nil
@@ -2367,10 +2942,13 @@ func (p *Parser) parseSimpleStmt(labelPossible bool) (SimpleStmt, error) {
 	switch firstTok.Type {
 	case TOKEN_SEND:
 		if len(lhs) > 1 {
-			return nil, CompileErrorf(firstTok, "More than one expression on the left side of the send expression")
+			return nil, CompileErrorf(firstTok, CodeSyntax, "More than one expression on the left side of the send expression")
 		}
 
 		p.nextToken()
+		if p.binaryOps != nil {
+			p.binaryOps[firstTok.Offset] = true
+		}
 		rhs, err := p.parseExpr()
 		if err != nil {
 			return nil, err
@@ -2379,7 +2957,7 @@ func (p *Parser) parseSimpleStmt(labelPossible bool) (SimpleStmt, error) {
 		return &SendStmt{stmt{expr: expr{firstTok.Pos}}, lhs[0], rhs}, nil
 	case TOKEN_PLUS_ASSIGN, TOKEN_MINUS_ASSIGN: // TODO: add other ops
 		if len(lhs) > 1 {
-			return nil, CompileErrorf(firstTok, "More than one expression on the left side of assignment")
+			return nil, CompileErrorf(firstTok, CodeSyntax, "More than one expression on the left side of assignment")
 		}
 		fallthrough
 	case TOKEN_ASSIGN:
@@ -2389,13 +2967,14 @@ func (p *Parser) parseSimpleStmt(labelPossible bool) (SimpleStmt, error) {
 			return nil, err
 		}
 		if len(lhs) != len(rhs) && len(rhs) != 1 {
-			return nil, CompileErrorf(t, "Different number of values in assignment (%d and %d)", len(lhs), len(rhs))
+			return nil, CompileErrorf(t, CodeAssignmentMismatch, "Different number of values in assignment (%d and %d)",
+				len(lhs), len(rhs))
 		}
 		return &AssignStmt{stmt{expr: expr{firstTok.Pos}}, lhs, rhs, firstTok}, nil
 	}
 
 	if len(lhs) > 1 {
-		return nil, CompileErrorf(firstTok, "Unexpected list of expressions")
+		return nil, CompileErrorf(firstTok, CodeSyntax, "Unexpected list of expressions")
 	}
 
 	if len(lhs) == 0 {
@@ -2405,7 +2984,7 @@ func (p *Parser) parseSimpleStmt(labelPossible bool) (SimpleStmt, error) {
 	switch p.peek().Type {
 	// TODO: parse sending to channels, increment/decrement statements, maybe short var declarations, etc
 	default:
-		return &ExprStmt{stmt{expr: expr{firstTok.Pos}}, lhs[0]}, nil
+		return &ExprStmt{stmt{expr: expr{lhs[0].Pos()}}, lhs[0]}, nil
 	}
 }
 
@@ -2423,12 +3002,14 @@ func (p *Parser) parseStructStmt() (Stmt, error) {
 
 	if len(structDecl.GenericParams) > 0 {
 		gs := &GenericStruct{
-			params:  structDecl.GenericParams,
-			struc:   structDecl,
-			code:    p.lex.Slice(firstTok, p.peek()),
-			imports: p.imports,
-			tfile:   p.lex.tfile,
-			offset:  p.lex.offset,
+			stmt:       stmt{expr: expr{firstTok.Pos}},
+			params:     structDecl.GenericParams,
+			paramDecls: p.genericDecls,
+			struc:      structDecl,
+			code:       p.lex.Slice(firstTok, p.peek()),
+			imports:    p.imports,
+			tfile:      p.lex.tfile,
+			offset:     p.lex.offset + firstTok.Offset,
 		}
 		p.identStack.addObject(gs)
 		return gs, nil
@@ -2467,12 +3048,12 @@ func (p *Parser) parseIfaceStmt() (*IfaceStmt, error) {
 func (p *Parser) parseImportStmt() (*ImportStmt, error) {
 	t, ok := p.expect(TOKEN_IMPORT)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected `import`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `import`")
 	}
 
 	t, ok = p.expect(TOKEN_STR)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected package path")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected package path")
 	}
 
 	path := t.Value.(string)
@@ -2484,18 +3065,20 @@ func (p *Parser) parseImportStmt() (*ImportStmt, error) {
 		p.nextToken()
 		word, ok := p.expect(TOKEN_WORD)
 		if !ok {
-			return nil, CompileErrorf(word, "Expected imported package name")
+			return nil, CompileErrorf(word, CodeSyntax, "Expected imported package name")
 		}
 		name = word.Value.(string)
 	}
 
 	result := &ImportStmt{
+		// Errors about the import are reported at the path.
+		stmt: stmt{expr: expr{t.Pos}},
 		name: name,
 		path: path,
 	}
 
 	if _, ok := p.imports[name]; ok {
-		return nil, CompileErrorf(t, "Package named `%s` imported more than once", name)
+		return nil, CompileErrorf(t, CodeImport, "Package named `%s` imported more than once", name)
 	}
 
 	p.imports[name] = result
@@ -2506,7 +3089,7 @@ func (p *Parser) parseImportStmt() (*ImportStmt, error) {
 func (p *Parser) parseWhenStmt() (*WhenStmt, error) {
 	t, ok := p.expect(TOKEN_WHEN)
 	if !ok {
-		return nil, CompileErrorf(t, "Expected `when`")
+		return nil, CompileErrorf(t, CodeSyntax, "Expected `when`")
 	}
 
 	var args []Type
@@ -2529,6 +3112,7 @@ func (p *Parser) parseWhenStmt() (*WhenStmt, error) {
 	var parseOneBranch = func() (*WhenBranch, error) {
 		branch := &WhenBranch{stmt: stmt{expr: expr{p.peek().Pos}}}
 		var lastKindToken *Token
+		var captured []*GenericParamTypeDecl
 
 	inLoop:
 		for {
@@ -2545,14 +3129,30 @@ func (p *Parser) parseWhenStmt() (*WhenStmt, error) {
 				continue inLoop
 			}
 
+			tilde := p.peek()
+			underlying := lastKindToken != nil && lastKindToken.Type == TOKEN_IS && tilde.Type == TOKEN_TILDE
+			if underlying {
+				p.nextToken()
+			}
+			if lastKindToken != nil && lastKindToken.Type == TOKEN_IS && p.peek().Type != TOKEN_WORD {
+				// Types like `[]_` are patterns, but not plain names.
+				p.pattern = &captured
+			}
 			typ, err := p.parseType()
+			p.pattern = nil
 			if err != nil {
 				return nil, err
 			}
+			if k := typ.Kind(); underlying && !p.parsingGenericInstantiation() &&
+				(k == KIND_CUSTOM || k == KIND_GENERIC_INST) {
+				// Such types never are underlying types of other ones.
+				return nil, CompileErrorf(tilde, CodeInvalidPattern, "Type %s isn't an underlying type, it can't be used with ~", typ)
+			}
 
 			branch.Predicates = append(branch.Predicates, &WhenPredicate{
-				Kind:   TokenToWhenPred(lastKindToken),
-				Target: typ,
+				Kind:       TokenToWhenPred(lastKindToken),
+				Target:     typ,
+				Underlying: underlying,
 			})
 
 			switch p.peek().Type {
@@ -2561,12 +3161,12 @@ func (p *Parser) parseWhenStmt() (*WhenStmt, error) {
 			case TOKEN_COLON:
 				break inLoop
 			default:
-				return nil, CompileErrorf(p.peek(), "Unexpected token %s", p.peek().Type)
+				return nil, CompileErrorf(p.peek(), CodeSyntax, "Unexpected token %s", p.peek().Type)
 			}
 		}
 
 		var err error
-		branch.Code, err = p.parseColonWithCodeBlock()
+		branch.Code, err = p.parseBranchCode(args, branch, captured)
 		if err != nil {
 			return nil, err
 		}
@@ -2606,7 +3206,101 @@ func (p *Parser) parseWhenStmt() (*WhenStmt, error) {
 	return result, nil
 }
 
+// Parses the code of a `when` branch, where the types captured by its patterns
+// can be used.
+func (p *Parser) parseBranchCode(args []Type, branch *WhenBranch,
+	captured []*GenericParamTypeDecl) (*CodeBlock, error) {
+	if len(captured) == 0 {
+		return p.parseColonWithCodeBlock()
+	}
+	p.captured = append(p.captured, captured...)
+
+	if types, ok := p.matchCaptures(args, branch); ok {
+		// Captured types are substituted, just like params of the generic.
+		outer := p.genericParams
+		p.genericParams = make(map[string]Type, len(outer)+len(captured))
+		for name, typ := range outer {
+			p.genericParams[name] = typ
+		}
+		for _, decl := range captured {
+			p.genericParams[decl.name] = types[decl]
+		}
+		defer func() { p.genericParams = outer }()
+		return p.parseColonWithCodeBlock()
+	}
+
+	branch.Captures = captured
+	p.identStack.pushScope()
+	defer p.identStack.popScope()
+	for _, decl := range captured {
+		p.identStack.addObject(decl)
+	}
+	return p.parseColonWithCodeBlock()
+}
+
+// When an instantiation of a generic is parsed, args of `when` are usually
+// known, so types captured by patterns of a branch can be found right away.
+func (p *Parser) matchCaptures(args []Type, branch *WhenBranch) (map[*GenericParamTypeDecl]Type, bool) {
+	if !p.parsingGenericInstantiation() {
+		return nil, false
+	}
+	types := map[*GenericParamTypeDecl]Type{}
+	for i, pred := range branch.Predicates {
+		if pred.Kind != WHEN_KIND_IS || i >= len(args) {
+			continue
+		}
+		if match, sure := matchPredicate(pred, args[i], types); !match || !sure {
+			return nil, false
+		}
+	}
+	return types, true
+}
+
+// Nodes that comments can be attached to.
+type commented interface {
+	setComments(c *Comments)
+}
+
+// Returns comments attached to a node starting at the given position (nil if
+// there are none): the full-line ones right above it, and the one at the end
+// of its first line.
+func (p *Parser) commentsAt(pos gotoken.Pos) *Comments {
+	tfile := p.lex.tfile
+	line, column := tfile.Line(pos), tfile.Position(pos).Column
+
+	result := &Comments{}
+	if c, ok := p.lex.comments[line]; ok && !c.FullLine {
+		result.Trailing = c
+	}
+	for l := line - 1; ; l-- {
+		c, ok := p.lex.comments[l]
+		if !ok || !c.FullLine || tfile.Position(c.Pos).Column != column {
+			break
+		}
+		result.Doc = append([]*Comment{c}, result.Doc...)
+	}
+
+	if result.Trailing == nil && len(result.Doc) == 0 {
+		return nil
+	}
+	return result
+}
+
+// Parses a statement, and attaches comments to it.
 func (p *Parser) parseStmt() (Stmt, error) {
+	for t := p.peek(); t.Type == TOKEN_INDENT && t.Value.(string) == ""; t = p.peek() {
+		p.nextToken()
+	}
+	start := p.peek()
+
+	stmt, err := p.parseBareStmt()
+	if c, ok := stmt.(commented); ok && err == nil {
+		c.setComments(p.commentsAt(start.Pos))
+	}
+	return stmt, err
+}
+
+func (p *Parser) parseBareStmt() (Stmt, error) {
 	lbl := p.prevLbl
 	p.prevLbl = nil
 	for {
@@ -2615,6 +3309,9 @@ func (p *Parser) parseStmt() (Stmt, error) {
 		case TOKEN_VAR:
 			p.putBack(token)
 			return p.parseVarStmt(true)
+		case TOKEN_CONST:
+			p.putBack(token)
+			return p.parseConstStmt()
 		case TOKEN_IF:
 			p.putBack(token)
 			return p.parseIf()
@@ -2624,6 +3321,9 @@ func (p *Parser) parseStmt() (Stmt, error) {
 		case TOKEN_FOR:
 			p.putBack(token)
 			return p.parseForStmt(lbl)
+		case TOKEN_SELECT:
+			p.putBack(token)
+			return p.parseSelectStmt(lbl)
 		case TOKEN_FUNC:
 			p.putBack(token)
 			return p.parseFuncStmt()
@@ -2632,7 +3332,7 @@ func (p *Parser) parseStmt() (Stmt, error) {
 			return p.parseTypeDecl()
 		case TOKEN_INDENT:
 			if token.Value.(string) != "" {
-				return nil, CompileErrorf(token, "Unexpected indent, '%s'", token.Value.(string))
+				return nil, CompileErrorf(token, CodeSyntax, "Unexpected indent, '%s'", token.Value.(string))
 			}
 		case TOKEN_PASS:
 			return &PassStmt{stmt{expr: expr{token.Pos}}}, nil
@@ -2642,6 +3342,12 @@ func (p *Parser) parseStmt() (Stmt, error) {
 		case TOKEN_RETURN:
 			p.putBack(token)
 			return p.parseReturnStmt()
+		case TOKEN_GO:
+			p.putBack(token)
+			return p.parseGoStmt()
+		case TOKEN_DEFER:
+			p.putBack(token)
+			return p.parseDeferStmt()
 		case TOKEN_EOF:
 			return nil, nil
 		case TOKEN_STRUCT:
@@ -2670,24 +3376,25 @@ func (p *Parser) parseStmt() (Stmt, error) {
 }
 
 func (p *Parser) ParseFile(f *File) error {
-	if t, ok := p.expect(TOKEN_PACKAGE); !ok {
-		return CompileErrorf(t, "Expected keyword `package` at the beginning of a file")
+	// Blank lines and comments can come before the package clause.
+	p.skipWhiteSpace()
+	pkgTok, ok := p.expect(TOKEN_PACKAGE)
+	if !ok {
+		return CompileErrorf(pkgTok, CodeSyntax, "Expected keyword `package` at the beginning of a file")
 	}
 
 	pkg := ""
 	if t, ok := p.expect(TOKEN_WORD); !ok {
-		return CompileErrorf(t, "Expected package name after the `package` keyword")
+		return CompileErrorf(t, CodeSyntax, "Expected package name after the `package` keyword")
 	} else {
 		pkg = t.Value.(string)
+		f.pkgPos = t.Pos
+		f.doc = p.commentsAt(pkgTok.Pos)
 	}
 
 	stmts, err := p.Parse()
-	if err != nil {
-		return err
-	}
-
 	f.Pkg, f.statements = pkg, stmts
-	return nil
+	return err
 }
 
 func (p *Parser) reapNewDecls() error {
@@ -2721,27 +3428,43 @@ func (p *Parser) parseUnindentedBlock() ([]Stmt, error) {
 	return result, nil
 }
 
+// Parses all the top-level statements. Statements with syntax errors are
+// skipped, and the rest is returned even when there are errors (which are
+// returned as an ErrorList if there's more than one).
 func (p *Parser) Parse() ([]*TopLevelStmt, error) {
 	var result = []*TopLevelStmt{}
+	var errs []error
 	for t := p.nextToken(); t.Type != TOKEN_EOF; t = p.nextToken() {
 		p.putBack(t)
 		stmt, err := p.parseStmt()
-		if err != nil {
-			return nil, err
+		if err == nil && stmt != nil {
+			err = p.expectStmtEnd()
 		}
-		if stmt == nil {
+		if err != nil {
+			errs = append(errs, err)
+			p.skipBrokenStmt(0, 0)
+			// Forget whatever the broken statement declared.
+			p.identStack.pushScope()
+		} else if stmt == nil {
 			// EOF
 			break
+		} else {
+			result = append(result, &TopLevelStmt{
+				Stmt:             stmt,
+				unboundTypes:     p.unboundTypes,
+				unboundIdents:    p.unboundIdents,
+				unboundTypesPos:  p.unboundTypesPos,
+				unresolvedArrays: p.unresolvedArrays,
+				captured:         p.captured,
+			})
+			p.reapNewDecls()
 		}
-		result = append(result, &TopLevelStmt{
-			Stmt:          stmt,
-			unboundTypes:  p.unboundTypes,
-			unboundIdents: p.unboundIdents,
-		})
-		p.reapNewDecls()
 		// Reset unbound types/idents before next statement
 		p.unboundTypes = make(map[string][]DeclaredType)
 		p.unboundIdents = make(map[string][]*Ident)
+		p.unboundTypesPos = make(map[DeclaredType]gotoken.Pos)
+		p.unresolvedArrays = nil
+		p.captured = nil
 	}
-	return result, nil
+	return result, errorList(errs)
 }
@@ -810,6 +810,125 @@ func x():
 	validityTest(t, cases)
 }
 
+func TestSelectStmt(t *testing.T) {
+	cases := []validityTestCase{
+		{`
+func x(c chan int):
+	select:
+		case var v = <-c:
+			pass
+		case var v, ok = <-c:
+			pass
+		case c <- 1:
+			pass
+		case <-c:
+			pass
+		default:
+			pass`, true},
+		{`
+func x(c chan int):
+	select:
+		case <-c:
+			break`, true},
+		{`
+func x(c chan int):
+	select:
+		case <-c:
+			continue`, false},
+		{`
+func x(c chan int):
+	for x = 0; x < 10; x += 1:
+		select:
+			case <-c:
+				continue`, true},
+		{`
+func x(c chan int):
+	lol:
+	select:
+		case <-c:
+			break lol`, true},
+		{`
+func x(c chan int):
+	select:
+		case var v = <-c:
+			pass
+	v`, false},
+		{`
+func x(c chan int):
+	select:
+		case c:
+			pass`, false},
+		{`
+func x(c chan int):
+	select:
+		case var v int = <-c:
+			pass`, false},
+		{`
+func x(c chan int):
+	select:
+		pass`, false},
+		{`
+func x(c chan int):
+	select
+		case <-c:
+			pass`, false},
+	}
+	validityTest(t, cases)
+}
+
+func TestConstStmt(t *testing.T) {
+	cases := []validityTestCase{
+		{`const A = 1`, true},
+		{`const A, B int = 1, 2`, true},
+		{`
+const:
+	A = iota
+	B
+	C`, true},
+		{`
+const:
+	A, B = iota, 2 * iota
+	C, D`, true},
+		{`
+func f():
+	const A = 1
+	var x = A`, true},
+		{`const A`, false},
+		{`const A int`, false},
+		{`const A, B = 1`, false},
+		{`const A = 1, 2`, false},
+		{`
+const:
+	A`, false},
+		{`var x = iota`, false},
+	}
+	validityTest(t, cases)
+}
+
+func TestParseVariadic(t *testing.T) {
+	cases := []validityTestCase{
+		{`func f(xs ...int):
+	pass`, true},
+		{`func f(a string, xs ...int):
+	pass`, true},
+		{`func f(...int):
+	pass`, true},
+		{`var f func(int, ...string)`, true},
+		{`func f(xs ...int):
+	f(1, 2, 3)
+	f(xs...)`, true},
+		{`func f(xs ...int, a string):
+	pass`, false},
+		{`func f(a, xs ...int):
+	pass`, false},
+		{`func f() (...int):
+	pass`, false},
+		{`func f(xs ...int):
+	f(xs..., 1)`, false},
+	}
+	validityTest(t, cases)
+}
+
 func TestParseGenericFunc(t *testing.T) {
 	cases := []validityTestCase{
 		{`func a[T]() int: # OK
@@ -920,6 +1039,7 @@ func TestVarDecl(t *testing.T) {
 				Vars: []*Variable{
 					&Variable{
 						name: "x",
+						pos:  5,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 					},
 				},
@@ -933,6 +1053,7 @@ func TestVarDecl(t *testing.T) {
 				Vars: DeclChain{&VarDecl{Vars: []*Variable{
 					&Variable{
 						name: "x",
+						pos:  5,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 						init: &BinaryOp{
 							expr: expr{pos: 15},
@@ -974,6 +1095,7 @@ func TestVarDecl(t *testing.T) {
 				Vars: DeclChain{&VarDecl{Vars: []*Variable{
 					&Variable{
 						name: "x",
+						pos:  5,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 						init: &BasicLit{
 							expr:  expr{pos: 15},
@@ -982,6 +1104,7 @@ func TestVarDecl(t *testing.T) {
 					},
 					&Variable{
 						name: "y",
+						pos:  7,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 						init: &BasicLit{
 							expr:  expr{pos: 18},
@@ -1012,6 +1135,7 @@ func TestVarDecl(t *testing.T) {
 						Vars: []*Variable{
 							&Variable{
 								name: "x",
+								pos:  5,
 								Type: &SimpleType{ID: SIMPLE_TYPE_INT},
 								init: &BasicLit{
 									expr: expr{pos: 16},
@@ -1025,6 +1149,7 @@ func TestVarDecl(t *testing.T) {
 							},
 							&Variable{
 								name: "y",
+								pos:  7,
 								Type: &SimpleType{ID: SIMPLE_TYPE_INT},
 								init: &BasicLit{
 									expr: expr{pos: 19},
@@ -1062,6 +1187,7 @@ func TestVarDecl(t *testing.T) {
 						Vars: []*Variable{
 							&Variable{
 								name: "z",
+								pos:  23,
 								Type: &UnknownType{},
 								init: &BasicLit{
 									expr: expr{pos: 27},
@@ -1097,6 +1223,7 @@ func TestVarDecl(t *testing.T) {
 				Vars: DeclChain{&VarDecl{Vars: []*Variable{
 					&Variable{
 						name: "x",
+						pos:  5,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 						init: &BasicLit{
 							expr: expr{pos: 16},
@@ -1110,6 +1237,7 @@ func TestVarDecl(t *testing.T) {
 					},
 					&Variable{
 						name: "y",
+						pos:  7,
 						Type: &SimpleType{ID: simpleTypeStrToID["int"]},
 						init: &BasicLit{
 							expr: expr{pos: 20},
@@ -1156,6 +1284,7 @@ func TestVarDecl(t *testing.T) {
 						Vars: []*Variable{
 							&Variable{
 								name: "x",
+								pos:  5,
 								Type: &SimpleType{ID: SIMPLE_TYPE_INT},
 							},
 						},
@@ -1165,6 +1294,7 @@ func TestVarDecl(t *testing.T) {
 						Vars: []*Variable{
 							&Variable{
 								name: "y",
+								pos:  12,
 								Type: &UnknownType{},
 								init: &BasicLit{
 									expr: expr{pos: 16},
@@ -1209,3 +1339,35 @@ func TestVarDecl(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRecovery(t *testing.T) {
+	parser := newTestParser(`
+var a = )
+func f():
+	var b = 1
+	if b > 0:
+		var c = ]
+	elif b < 0:
+		pass
+	var d = 2
+var e = 3
+~
+var g = 4`)
+	stmts, err := parser.Parse()
+
+	errs := flattenErrors(err)
+	if len(errs) != 3 {
+		fmt.Printf("Expected 3 errors, got %d: %s\n", len(errs), err)
+		t.Fail()
+	}
+
+	// Broken statements are skipped, but the rest is still available.
+	var names []string
+	for _, stmt := range stmts {
+		names = append(names, stmt.Decls()...)
+	}
+	if !reflect.DeepEqual(names, []string{"e", "g"}) {
+		fmt.Printf("Expected declarations of e and g, got %v\n", names)
+		t.Fail()
+	}
+}
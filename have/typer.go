@@ -2,10 +2,11 @@
 package have
 
 import (
-	"fmt"
 	"strings"
 )
 
+import gotoken "go/token"
+
 // Generic instantiation key.
 type InstKey string
 
@@ -26,6 +27,34 @@ type TypesContext struct {
 	goNames map[Expr]string
 	// Stores instantiations of generics.
 	instantiations map[InstKey]*Instantiation
+	// Variables whose declarations failed to typecheck. Errors caused by using them
+	// aren't reported, as they all have the same root cause.
+	failedVars map[*Variable]bool
+	// Set when a failed variable is used.
+	usedFailed bool
+	// Position of the innermost statement being processed, used to report
+	// internal errors. Statements of builtins aren't tracked (see track).
+	checking gotoken.Pos
+	// File with the builtins of the package.
+	builtins *gotoken.File
+	// Set if generics can be emitted as Go generics, see nativeGeneric.
+	nativeGenerics bool
+	// Set when checking the definition of a generic, whose params are opaque types.
+	genericDef bool
+	// Set when the statement being checked uses values or types that depend on
+	// opaque params, or uses unknown identifiers (which is an error for any params).
+	usedParams, usedUnknown bool
+	// Set when the checked definition of a generic can't be emitted as a Go generic,
+	// because it uses `when` on its params, or has errors that depend on them.
+	needsExpansion bool
+	// Set while types are applied to operands of an untyped constant expression,
+	// which are checked with the whole expression.
+	constOperands bool
+	// Set when checking a branch of `when` that is chosen only for some params.
+	// Errors that depend on opaque params are left to instantiations there.
+	inParamBranch bool
+	// See definitionContext.
+	definitions *TypesContext
 }
 
 func (tc *TypesContext) SetType(e Expr, typ Type) { tc.types[e] = typ }
@@ -37,6 +66,96 @@ func NewTypesContext() *TypesContext {
 		types:          map[Expr]Type{},
 		goNames:        map[Expr]string{},
 		instantiations: map[InstKey]*Instantiation{},
+		failedVars:     map[*Variable]bool{},
+	}
+}
+
+// Added to errors in definitions of generics that are caused by their params
+// being opaque.
+const opaqueParamsHint = " (code for specific types of params has to be in `when` branches)"
+
+// Negotiates types of a statement. Returns its errors, unless they are caused
+// by an earlier error (i.e. the statement uses a variable whose declaration
+// failed), or depend on opaque params of a generic whose definition is checked
+// and the statement is in a `when` branch that might not be chosen for them.
+// Variables declared by a failed statement are marked as failed too.
+func (tc *TypesContext) negotiateStmt(stmt Stmt) error {
+	outer, outerPos := tc.usedFailed, tc.checking
+	outerParams, outerUnknown := tc.usedParams, tc.usedUnknown
+	tc.usedFailed = false
+	tc.track(stmt.Pos())
+	tc.usedParams, tc.usedUnknown = false, false
+	err := stmt.(ExprToProcess).NegotiateTypes(tc)
+	cascade, dependent := tc.usedFailed, tc.usedParams && !tc.usedUnknown
+	// Not deferred, so that after a panic the innermost statement is known.
+	tc.usedFailed, tc.checking = outer, outerPos
+	tc.usedParams, tc.usedUnknown = outerParams, outerUnknown
+
+	if err == nil {
+		return nil
+	}
+
+	tc.failVars(stmt)
+
+	if cascade {
+		return nil
+	}
+	if dependent && tc.inParamBranch {
+		// Checked by instantiations of the generic, where params are concrete.
+		tc.needsExpansion = true
+		return nil
+	}
+	if dependent && tc.genericDef {
+		// Code written for some params only, it has to be moved to a `when` branch.
+		for _, e := range flattenErrors(err) {
+			if ce, ok := e.(*CompileError); ok && !strings.HasSuffix(ce.Message, opaqueParamsHint) {
+				ce.Message += opaqueParamsHint
+			}
+		}
+	}
+	return err
+}
+
+// Marks variables declared by a failed statement, errors of their uses would
+// only be consequences of the failure.
+func (tc *TypesContext) failVars(stmt Stmt) {
+	if vs, ok := stmt.(*VarStmt); ok {
+		for _, decl := range vs.Vars {
+			for _, v := range decl.Vars {
+				tc.failedVars[v] = true
+				if v.Type == nil {
+					v.Type = &UnknownType{}
+				}
+			}
+		}
+	}
+}
+
+// Notes the position of the statement being processed. Positions in builtins
+// don't tell users much, errors there are reported at code that uses them.
+func (tc *TypesContext) track(pos gotoken.Pos) {
+	if !pos.IsValid() {
+		return
+	}
+	if b := tc.builtins; b != nil && pos >= gotoken.Pos(b.Base()) && pos <= gotoken.Pos(b.Base()+b.Size()) {
+		return
+	}
+	tc.checking = pos
+}
+
+func (tc *TypesContext) checkFailed(obj Object) {
+	if v, ok := obj.(*Variable); ok {
+		if tc.failedVars[v] {
+			tc.usedFailed = true
+		}
+		tc.checkParams(v.Type)
+	}
+}
+
+// Notes if a type used by the statement being checked depends on opaque params.
+func (tc *TypesContext) checkParams(t Type) {
+	if tc.genericDef && t != nil && containsGenericParam([]Type{t}) {
+		tc.usedParams = true
 	}
 }
 
@@ -153,6 +272,12 @@ func Implements(iface, value Type) bool {
 			return false
 		}
 		valueMethods = gen.Struct.Methods
+	case KIND_GENERIC_PARAM:
+		// Methods of opaque params come from their constraints.
+		valueMethods = map[string]*FuncDecl{}
+		if iface := paramConstraintIface(value); iface != nil {
+			valueMethods = RootType(iface).(*IfaceType).Methods
+		}
 	default:
 		// Other types can't have methods, but they still can satsifty
 		// the empty interface.
@@ -186,9 +311,31 @@ func Implements(iface, value Type) bool {
 	return true
 }
 
+// Returns the interface that values of an opaque generic param implement
+// because of its constraint, or nil.
+func paramConstraintIface(t Type) Type {
+	param, ok := t.(*GenericParamType)
+	if !ok || param.decl == nil || param.decl.constraint == nil {
+		return nil
+	}
+	if iface := param.decl.constraint.Iface; iface != nil && IsInterface(iface) {
+		return iface
+	}
+	return nil
+}
+
+// Operators other than comparisons (see AreComparable) can't be used with
+// values of opaque params, like in Go generics with no type sets.
+func checkParamOperator(ex Expr, op *Token, typ Type) error {
+	if RootType(typ).Kind() == KIND_GENERIC_PARAM {
+		return ExprErrorf(ex, CodeInvalidOperator, "Operator %s can't be used with values of %s", op.Value, typ)
+	}
+	return nil
+}
+
 func IsPackage(e TypedExpr) bool {
 	ident, isIdent := e.(*Ident)
-	return isIdent && ident.object.ObjectType() == OBJECT_PACKAGE
+	return isIdent && ident.object != nil && ident.object.ObjectType() == OBJECT_PACKAGE
 }
 
 func IsBlank(e TypedExpr) bool {
@@ -215,6 +362,23 @@ func funcUnderneath(expr Expr) *FuncDecl {
 	return nil
 }
 
+func (cs *ConstStmt) NegotiateTypes(tc *TypesContext) error {
+	for _, spec := range cs.Specs {
+		if spec.Type != nil && RootType(spec.Type).Kind() != KIND_SIMPLE {
+			return ExprErrorf(cs, CodeInvalidConstantType, "Invalid constant type %s", spec.Type)
+		}
+		for _, c := range spec.Consts {
+			if _, err := c.Eval(); err != nil {
+				if isUnplaced(err) {
+					return exprError(cs, err)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (vs *VarStmt) NegotiateTypes(tc *TypesContext) error {
 	for _, v := range vs.Vars {
 		err := v.NegotiateTypes(tc)
@@ -233,47 +397,200 @@ func (bs *BranchStmt) NegotiateTypes(tc *TypesContext) error { return nil }
 
 func (ls *LabelStmt) NegotiateTypes(tc *TypesContext) error { return nil }
 
-func (ls *GenericFunc) NegotiateTypes(tc *TypesContext) error { return nil }
+// Definitions of generics are checked even if they aren't used, so that their
+// errors are reported without instantiations.
+func (ls *GenericFunc) NegotiateTypes(tc *TypesContext) error {
+	if err := checkConstraintDecls(ls.paramDecls); err != nil {
+		return err
+	}
+	return ls.checkDefinition(tc)
+}
+
+func (ls *GenericStruct) NegotiateTypes(tc *TypesContext) error {
+	if err := checkConstraintDecls(ls.paramDecls); err != nil {
+		return err
+	}
+	return ls.checkDefinition(tc)
+}
 
-func (ls *GenericStruct) NegotiateTypes(tc *TypesContext) error { return nil }
+func checkConstraintDecls(decls []*GenericParamTypeDecl) error {
+	for _, decl := range decls {
+		if c := decl.constraint; c != nil && c.Iface != nil && !IsInterface(c.Iface) {
+			return ExprErrorf(decl, CodeInvalidTypeAssertion, "Not an interface: %s", c.Iface)
+		}
+	}
+	return nil
+}
+
+// Checks if types used as params of a generic satisfy constraints of the params.
+func checkConstraints(decls []*GenericParamTypeDecl, params []Type) error {
+	for i, decl := range decls {
+		if i < len(params) && decl.constraint != nil && !decl.constraint.satisfiedBy(params[i]) {
+			return unplacedErrorf(CodeUnsatisfiedConstraint, "%s doesn't satisfy the constraint `%s %s`",
+				params[i], decl.name, decl.constraint)
+		}
+	}
+	return nil
+}
+
+func (c *GenericConstraint) satisfiedBy(t Type) bool {
+	if c.Iface != nil {
+		return IsInterface(c.Iface) && Implements(c.Iface, t)
+	}
+	if param, ok := t.(*GenericParamType); ok {
+		// Go generics need the param to be declared comparable.
+		if param.decl != nil {
+			param.decl.comparable = true
+		}
+		return true
+	}
+	return isRootTypeComparable(RootType(t))
+}
 
 func (ws *WhenStmt) NegotiateTypes(tc *TypesContext) error {
+	// In definitions of generics, predicates about opaque params might be true,
+	// so all the branches that might be chosen are checked.
+	var errs []error
+	// Set after a branch that might be chosen, the following ones might be not.
+	conditional := false
 	for _, branch := range ws.Branches {
-		fail := false
+		fail, maybe := false, false
 	loop:
 		for i, pred := range branch.Predicates {
+			match, sure := true, true
 			switch pred.Kind {
 			case WHEN_KIND_IS:
-				if !IsIdentincal(pred.Target, ws.Args[i]) {
-					fail = true
-					break loop
-				}
+				match, sure = matchPredicate(pred, ws.Args[i], map[*GenericParamTypeDecl]Type{})
 			case WHEN_KIND_IMPLEMENTS:
 				_, ok := RootType(pred.Target).(*IfaceType)
 				if !ok {
-					return ExprErrorf(branch, "Not an interface: %s", pred.Target)
+					return ExprErrorf(branch, CodeInvalidTypeAssertion, "Not an interface: %s", pred.Target)
 				}
 
-				if !Implements(pred.Target, ws.Args[i]) {
-					fail = true
-					break loop
-				}
+				match, sure = Implements(pred.Target, ws.Args[i]), !containsGenericParam(ws.Args[i:i+1])
 			case WHEN_KIND_DEFAULT:
 			}
+
+			if !sure {
+				maybe = true
+			} else if !match {
+				fail = true
+				break loop
+			}
 		}
 
-		branch.True = !fail
+		if fail {
+			continue
+		}
+		if maybe || len(branch.Captures) > 0 {
+			if !tc.genericDef {
+				return ExprErrorf(branch, CodeInvalidPattern, "Types can be captured only from params of generics")
+			}
+			// Branches are chosen for each instantiation.
+			tc.needsExpansion = true
+		}
 
+		branch.True = !maybe
+		outer := tc.inParamBranch
+		tc.inParamBranch = outer || maybe || conditional || len(branch.Captures) > 0
+		errs = append(errs, branch.Code.CheckTypes(tc))
+		tc.inParamBranch = outer
 		if branch.True {
-			return branch.Code.CheckTypes(tc)
+			break
+		}
+		conditional = true
+	}
+	return errorList(errs)
+}
+
+// Matches a type against the target of `is`, see matchPattern. With `is ~`
+// the underlying type is matched, e.g. for types declared as `type L []int`.
+func matchPredicate(pred *WhenPredicate, t Type, captured map[*GenericParamTypeDecl]Type) (match, sure bool) {
+	if pred.Underlying {
+		root, ok := boundRootType(t)
+		if !ok {
+			return false, false
+		}
+		t = root
+	}
+	return matchPattern(pred.Target, t, captured)
+}
+
+// Matches a type against the target of `is`, which can be a pattern (see
+// WhenPredicate). Types matched by captures are stored in captured. The result
+// isn't sure if it depends on opaque params (or types that aren't bound yet,
+// when it's used by the parser).
+func matchPattern(pattern, t Type, captured map[*GenericParamTypeDecl]Type) (match, sure bool) {
+	if param, ok := pattern.(*GenericParamType); ok && param.decl != nil && param.decl.captured {
+		if prev, ok := captured[param.decl]; ok {
+			return matchPattern(prev, t, captured)
+		}
+		captured[param.decl] = t
+		return true, true
+	}
+	if IsIdentincal(pattern, t) {
+		return true, true
+	}
+
+	if t.Kind() == KIND_GENERIC_PARAM || pattern.Kind() == KIND_GENERIC_PARAM {
+		return false, false
+	}
+
+	// Named types aren't identical to any pattern, see matchPredicate.
+	switch pattern := pattern.(type) {
+	case *SliceType:
+		if slice, ok := t.(*SliceType); ok {
+			return matchPattern(pattern.Of, slice.Of, captured)
+		}
+	case *ArrayType:
+		if array, ok := t.(*ArrayType); ok && (pattern.Size < 0 || pattern.Size == array.Size) {
+			return matchPattern(pattern.Of, array.Of, captured)
+		}
+	case *PointerType:
+		if ptr, ok := t.(*PointerType); ok {
+			return matchPattern(pattern.To, ptr.To, captured)
+		}
+	case *ChanType:
+		if ch, ok := t.(*ChanType); ok && pattern.Dir == ch.Dir {
+			return matchPattern(pattern.Of, ch.Of, captured)
+		}
+	case *MapType:
+		if m, ok := t.(*MapType); ok {
+			byMatch, bySure := matchPattern(pattern.By, m.By, captured)
+			ofMatch, ofSure := matchPattern(pattern.Of, m.Of, captured)
+			return byMatch && ofMatch, bySure && ofSure || bySure && !byMatch || ofSure && !ofMatch
+		}
+	default:
+		// Types of different kinds can't become identical.
+		return false, !containsGenericParam([]Type{t}) || t.Kind() != pattern.Kind()
+	}
+	return false, true
+}
+
+// Like RootType, but tells if the type is bound to its declaration, which
+// might not be the case while parsing.
+func boundRootType(t Type) (Type, bool) {
+	for {
+		switch typ := t.(type) {
+		case *CustomType:
+			if typ.Decl == nil || typ.Decl.AliasedType == nil {
+				return nil, false
+			}
+			t = typ.Decl.AliasedType
+		case *GenericType:
+			if typ.Struct == nil {
+				return nil, false
+			}
+			return typ.Struct, true
+		default:
+			return t, true
 		}
 	}
-	return nil
 }
 
 func (rs *ReturnStmt) NegotiateTypes(tc *TypesContext) error {
 	if rs.Func.Results.countVars() != len(rs.Values) {
-		return ExprErrorf(rs, "Different number of return values")
+		return ExprErrorf(rs, CodeWrongResultCount, "Different number of return values")
 	}
 
 	i, err := 0, error(nil)
@@ -301,27 +618,72 @@ func (ls *SendStmt) NegotiateTypes(tc *TypesContext) error {
 
 	lroot := RootType(ltyp)
 	if lroot.Kind() != KIND_CHAN {
-		return ExprErrorf(ls.Lhs, "Not a chan used for sending")
+		return ExprErrorf(ls.Lhs, CodeInvalidChannelOperation, "Not a chan used for sending")
 	}
 
 	channel := lroot.(*ChanType)
 	if channel.Dir == CHAN_DIR_RECEIVE {
-		return ExprErrorf(ls.Lhs, "Channel is receive-only")
+		return ExprErrorf(ls.Lhs, CodeInvalidChannelOperation, "Channel is receive-only")
 	}
 	if !IsAssignable(channel.Of, rtyp) {
-		return ExprErrorf(ls.Rhs, "Send value has to be assignable to channel's base type")
+		return ExprErrorf(ls.Rhs, CodeNotAssignable, "Send value has to be assignable to channel's base type")
 	}
 
 	return nil
 }
 
+// Type checks a function call whose results are discarded,
+// like the ones in `go` and `defer` statements.
+func negotiateCallStmt(tc *TypesContext, call *FuncCallExpr) error {
+	castType, err := ExprToTypeName(tc, call.Left)
+	if err != nil {
+		return err
+	}
+	if castType != nil {
+		return ExprErrorf(call, CodeUnusedExpression, "Type conversion can't be used as a statement")
+	}
+
+	// Function literals called in place have to have their bodies checked too.
+	if lit, ok := call.Left.(*FuncDecl); ok {
+		if err := lit.Code.CheckTypes(tc); err != nil {
+			return err
+		}
+	}
+
+	typ, err := call.Type(tc)
+	if err != nil {
+		return err
+	}
+	if !typ.Known() {
+		if call.IsNullResult(tc) {
+			return nil
+		}
+		return ExprErrorf(call, CodeCantInfer, "Couldn't infer types")
+	}
+	if typ.Kind() == KIND_TUPLE {
+		// Arguments have been checked by Type(), results are discarded.
+		tc.SetType(call, typ)
+		return nil
+	}
+	return call.ApplyType(tc, typ)
+}
+
+func (gs *GoStmt) NegotiateTypes(tc *TypesContext) error {
+	return negotiateCallStmt(tc, gs.Call)
+}
+
+func (ds *DeferStmt) NegotiateTypes(tc *TypesContext) error {
+	return negotiateCallStmt(tc, ds.Call)
+}
+
 func (ss *StructStmt) NegotiateTypes(tc *TypesContext) error {
+	var errs []error
 	for _, m := range ss.Struct.Methods {
 		if err := m.Code.CheckTypes(tc); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errorList(errs)
 }
 
 func (is *IfaceStmt) NegotiateTypes(tc *TypesContext) error {
@@ -331,6 +693,7 @@ func (is *IfaceStmt) NegotiateTypes(tc *TypesContext) error {
 // This will overwrite the type pointer by varType.
 func NegotiateExprType(tc *TypesContext, varType *Type, value TypedExpr) error {
 	*varType = nonilTyp(*varType)
+	tc.checkParams(*varType)
 
 	valueTyp, err := value.Type(tc)
 	if err != nil {
@@ -345,7 +708,7 @@ func NegotiateExprType(tc *TypesContext, varType *Type, value TypedExpr) error {
 		// it would be "int" and "[]int").
 		ok, guessedType := value.GuessType(tc)
 		if !ok || !guessedType.Known() {
-			return ExprErrorf(value, "Too little information to infer types")
+			return ExprErrorf(value, CodeCantInfer, "Too little information to infer types")
 		}
 
 		typ = guessedType
@@ -369,7 +732,7 @@ func NegotiateExprType(tc *TypesContext, varType *Type, value TypedExpr) error {
 			ok, guessedType := value.GuessType(tc)
 			if ok {
 				if !IsAssignable(typ, guessedType) {
-					return ExprErrorf(value, "Types %s and %s are not assignable", typ, guessedType)
+					return ExprErrorf(value, CodeNotAssignable, "Types %s and %s are not assignable", typ, guessedType)
 				}
 				return value.ApplyType(tc, guessedType)
 			}
@@ -377,7 +740,7 @@ func NegotiateExprType(tc *TypesContext, varType *Type, value TypedExpr) error {
 		return value.ApplyType(tc, typ)
 	} else {
 		if !IsAssignable(typ, valueTyp) {
-			return ExprErrorf(value, "Types %s and %s are not assignable", typ, valueTyp)
+			return ExprErrorf(value, CodeNotAssignable, "Types %s and %s are not assignable", typ, valueTyp)
 		}
 		// Run value.ApplyType with value's own type - seems unnecessary,
 		// but ApplyType might do some extra checks as side effects.
@@ -394,7 +757,7 @@ func CheckCondition(tc *TypesContext, expr TypedExpr) error {
 	}
 
 	if !IsBoolAssignable(boolTyp) {
-		return ExprErrorf(expr, "Error while negotiating types")
+		return ExprErrorf(expr, CodeInternal, "Error while negotiating types")
 	}
 	return nil
 }
@@ -409,32 +772,33 @@ func negotiateScopedVar(tc *TypesContext, scopedVar Stmt) error {
 	// ok
 	case *AssignStmt:
 		if scoped.Token.Type != TOKEN_ASSIGN {
-			return CompileErrorf(scoped.Token, "Only `=` assignment allowed in scoped declarations")
+			return CompileErrorf(scoped.Token, CodeMisplaced, "Only `=` assignment allowed in scoped declarations")
 		}
 	default:
-		return ExprErrorf(scopedVar, "Not a var declaration or assignment")
+		return ExprErrorf(scopedVar, CodeMisplaced, "Not a var declaration or assignment")
 	}
 
 	return scopedVar.(ExprToProcess).NegotiateTypes(tc)
 }
 
 func (is *IfStmt) NegotiateTypes(tc *TypesContext) error {
+	var errs []error
 	for _, b := range is.Branches {
 		if err := negotiateScopedVar(tc, b.ScopedVar); err != nil {
-			return err
+			return errorList(append(errs, err))
 		}
 
 		if b.Condition != nil {
 			if err := CheckCondition(tc, b.Condition.(TypedExpr)); err != nil {
-				return err
+				return errorList(append(errs, err))
 			}
 		}
 
 		if err := b.Code.CheckTypes(tc); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errorList(errs)
 }
 
 func (ss *SwitchStmt) NegotiateTypes(tc *TypesContext) error {
@@ -454,10 +818,10 @@ func (ss *SwitchStmt) NegotiateTypes(tc *TypesContext) error {
 			var ok bool
 			assertion, ok = init.(*TypeAssertion)
 			if !ok {
-				return ExprErrorf(ss.Value, "Variable not initialized with type assertion")
+				return ExprErrorf(ss.Value, CodeInvalidTypeAssertion, "Variable not initialized with type assertion")
 			}
 			if !assertion.ForSwitch {
-				return ExprErrorf(ss.Value, "Type switch should use v.(type)")
+				return ExprErrorf(ss.Value, CodeInvalidSwitch, "Type switch should use v.(type)")
 			}
 		case *ExprStmt:
 			var ok bool
@@ -483,7 +847,7 @@ func (ss *SwitchStmt) NegotiateTypes(tc *TypesContext) error {
 		var ok bool
 		ok, valType = valExpr.GuessType(tc)
 		if !ok {
-			return ExprErrorf(valExpr, "Couldn't determine type of switch expression")
+			return ExprErrorf(valExpr, CodeCantInfer, "Couldn't determine type of switch expression")
 		}
 	}
 	err = valExpr.ApplyType(tc, valType)
@@ -491,19 +855,20 @@ func (ss *SwitchStmt) NegotiateTypes(tc *TypesContext) error {
 		return err
 	}
 
+	var errs []error
 	wasDefault := false
 	for i, b := range ss.Branches {
 		if len(b.Values) > 0 {
 			if typeSwitch {
 				if len(b.Values) != 1 {
-					return ExprErrorf(b.Values[0], "More than 1 value in a branch of type switch")
+					return errorList(append(errs, ExprErrorf(b.Values[0], CodeInvalidSwitch, "More than 1 value in a branch of type switch")))
 				}
 				typ, err := ExprToTypeName(tc, b.Values[0])
 				if err != nil {
-					return err
+					return errorList(append(errs, err))
 				}
 				if typ == nil {
-					return ExprErrorf(b.Values[0], "Not a type name in type switch")
+					return errorList(append(errs, ExprErrorf(b.Values[0], CodeNotAType, "Not a type name in type switch")))
 				}
 
 				if b.TypeSwitchVar != nil {
@@ -511,38 +876,64 @@ func (ss *SwitchStmt) NegotiateTypes(tc *TypesContext) error {
 				}
 
 				if err := CheckTypeAssert(tc, assertion.Left.(TypedExpr), typ); err != nil {
-					return err
+					return errorList(append(errs, err))
 				}
 			} else {
 				if ss.Value == nil && len(b.Values) > 1 {
-					return ExprErrorf(b.Values[0], "List of values in freeform switch")
+					return errorList(append(errs, ExprErrorf(b.Values[0], CodeInvalidSwitch, "List of values in freeform switch")))
 				}
 
 				for _, val := range b.Values {
 					err := NegotiateExprType(tc, &valType, val.(TypedExpr))
 					if err != nil {
-						return ExprErrorf(b.Values[0], "Error with switch clause: %s", i+1, err)
+						return errorList(append(errs, ExprErrorf(b.Values[0], CodeInvalidSwitch, "Error with switch clause %d: %s", i+1, err)))
 					}
 
-					if !AreComparable(tc, valExpr, val.(TypedExpr)) {
-						return ExprErrorf(b.Values[0], "Error with switch clause, values are not comparable")
+					comparable, err := AreComparable(tc, valExpr, val.(TypedExpr))
+					if err != nil {
+						return errorList(append(errs, err))
+					}
+					if !comparable {
+						return errorList(append(errs, ExprErrorf(b.Values[0], CodeNotComparable,
+							"Error with switch clause, values are not comparable")))
 					}
 				}
 			}
 		} else {
 			if wasDefault {
-				return ExprErrorf(b, "Error - more than one `default` clause")
+				return errorList(append(errs, ExprErrorf(b, CodeInvalidSwitch, "Error - more than one `default` clause")))
 			}
 			wasDefault = true
 		}
 
-		err := b.Code.CheckTypes(tc)
-		if err != nil {
-			return err
+		if err := b.Code.CheckTypes(tc); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errorList(errs)
+}
+
+func (ss *SelectStmt) NegotiateTypes(tc *TypesContext) error {
+	var errs []error
+	wasDefault := false
+	for _, b := range ss.Branches {
+		if b.Comm != nil {
+			if err := b.Comm.(ExprToProcess).NegotiateTypes(tc); err != nil {
+				return errorList(append(errs, err))
+			}
+		} else {
+			if wasDefault {
+				return errorList(append(errs, ExprErrorf(b, CodeInvalidSwitch, "Error - more than one `default` clause")))
+			}
+			wasDefault = true
+		}
+
+		if err := b.Code.CheckTypes(tc); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errorList(errs)
 }
 
 func (p *PassStmt) NegotiateTypes(tc *TypesContext) error {
@@ -569,11 +960,11 @@ func iteratorType(containerType Type) (*TupleType, error) {
 	case KIND_CHAN:
 		chanType := ct.(*ChanType)
 		if chanType.Dir == CHAN_DIR_SEND {
-			return nil, fmt.Errorf("Can't read from %s (%s)", containerType, ct)
+			return nil, unplacedErrorf(CodeInvalidChannelOperation, "Can't read from %s (%s)", containerType, ct)
 		}
 		return &TupleType{[]Type{chanType.Of}}, nil
 	default:
-		return nil, fmt.Errorf("Type %s is not iterable", containerType)
+		return nil, unplacedErrorf(CodeNotIterable, "Type %s is not iterable", containerType)
 	}
 }
 
@@ -587,7 +978,7 @@ func (fs *ForRangeStmt) NegotiateTypes(tc *TypesContext) error {
 		var ok bool
 		ok, seriesTyp = fs.Series.(TypedExpr).GuessType(tc)
 		if !ok || !seriesTyp.Known() {
-			return ExprErrorf(fs.Series, "Couldn't determine the type")
+			return ExprErrorf(fs.Series, CodeCantInfer, "Couldn't determine the type")
 		}
 	}
 
@@ -598,12 +989,12 @@ func (fs *ForRangeStmt) NegotiateTypes(tc *TypesContext) error {
 
 	iterType, err := iteratorType(seriesTyp)
 	if err != nil {
-		return ExprErrorf(fs.Series, err.Error())
+		return exprError(fs.Series, err)
 	}
 
 	if fs.ScopedVars != nil {
 		if len(iterType.Members) < len(fs.ScopedVars.Vars) {
-			return ExprErrorf(fs.Series, "Wrong number of iterator vars, max %d", len(iterType.Members))
+			return ExprErrorf(fs.Series, CodeAssignmentMismatch, "Wrong number of iterator vars, max %d", len(iterType.Members))
 		}
 
 		// All vars are new, just assign them their types.
@@ -612,7 +1003,7 @@ func (fs *ForRangeStmt) NegotiateTypes(tc *TypesContext) error {
 		}
 	} else if fs.OutsideVars != nil {
 		if len(iterType.Members) < len(fs.OutsideVars) {
-			return ExprErrorf(fs.OutsideVars[0], "Wrong number of iterator vars, max %d", len(iterType.Members))
+			return ExprErrorf(fs.OutsideVars[0], CodeAssignmentMismatch, "Wrong number of iterator vars, max %d", len(iterType.Members))
 		}
 
 		// TODO: Check if fs.OutsideVars are addressable
@@ -626,7 +1017,7 @@ func (fs *ForRangeStmt) NegotiateTypes(tc *TypesContext) error {
 			}
 
 			if !IsAssignable(varType, iterType.Members[i]) {
-				return ExprErrorf(v, "Can't use %s for iteration, it's not assignable to %s",
+				return ExprErrorf(v, CodeNotAssignable, "Can't use %s for iteration, it's not assignable to %s",
 					varType, iterType.Members[i])
 			}
 		}
@@ -689,7 +1080,7 @@ func NegotiateTupleUnpackAssign(tc *TypesContext, onlyFuncCalls bool, lhsTypes [
 			return err
 		}
 		if rhsType.Kind() != KIND_TUPLE {
-			return ExprErrorf(rhs, "Too few values on the right side (function call returns only 1 result)")
+			return ExprErrorf(rhs, CodeAssignmentMismatch, "Too few values on the right side (function call returns only 1 result)")
 		}
 		tuple = rhsType.(*TupleType)
 	default:
@@ -697,7 +1088,7 @@ func NegotiateTupleUnpackAssign(tc *TypesContext, onlyFuncCalls bool, lhsTypes [
 		// boolean is returned only if two variables are in the lhs expression.
 		if onlyFuncCalls {
 			// Tuples cannot be stored explicitly at the moment.
-			return ExprErrorf(rhs, "Too few values")
+			return ExprErrorf(rhs, CodeAssignmentMismatch, "Too few values")
 		}
 
 		leftTyp, err := rhs.Type(tc)
@@ -711,7 +1102,7 @@ func NegotiateTupleUnpackAssign(tc *TypesContext, onlyFuncCalls bool, lhsTypes [
 		}
 
 		if !ok || !leftTyp.Known() {
-			return ExprErrorf(rhs, "Couldn't determine type of the right side of the assignment")
+			return ExprErrorf(rhs, CodeCantInfer, "Couldn't determine type of the right side of the assignment")
 		}
 
 		tuple = &TupleType{Members: []Type{
@@ -724,20 +1115,25 @@ func NegotiateTupleUnpackAssign(tc *TypesContext, onlyFuncCalls bool, lhsTypes [
 		}
 	}
 
+	if len(lhsTypes) != len(tuple.Members) {
+		return ExprErrorf(rhs, CodeAssignmentMismatch, "Assignment mismatch: %d variables but %d values",
+			len(lhsTypes), len(tuple.Members))
+	}
+
 	for i, t := range lhsTypes {
 		typ := firstKnown(*t, tuple.Members[i])
 		if typ == nil {
-			return ExprErrorf(rhs, "Too little information to infer types")
+			return ExprErrorf(rhs, CodeCantInfer, "Too little information to infer types")
 		}
 
 		if !tuple.Members[i].Known() {
-			return ExprErrorf(rhs, "Unknown type in a tuple")
+			return ExprErrorf(rhs, CodeUnknownType, "Unknown type in a tuple")
 		}
 
 		if (*t).Kind() == KIND_UNKNOWN {
 			*t = typ
 		} else if !IsAssignable(*t, tuple.Members[i]) {
-			return ExprErrorf(rhs, "Types %s and %s aren't assignable", *t, tuple.Members[i])
+			return ExprErrorf(rhs, CodeNotAssignable, "Types %s and %s aren't assignable", *t, tuple.Members[i])
 		}
 	}
 	return nil
@@ -766,7 +1162,7 @@ func (as *AssignStmt) NegotiateTypes(tc *TypesContext) error {
 
 			return NegotiateTupleUnpackAssign(tc, false, types, as.Rhs[0].(TypedExpr))
 		} else {
-			return ExprErrorf(as, "Different number of items on the left and right hand side")
+			return ExprErrorf(as, CodeAssignmentMismatch, "Different number of items on the left and right hand side")
 		}
 	}
 
@@ -788,6 +1184,11 @@ func (as *AssignStmt) NegotiateTypes(tc *TypesContext) error {
 		if err != nil {
 			return err
 		}
+		if as.Token.Type != TOKEN_ASSIGN {
+			if err := checkParamOperator(as, as.Token, leftType); err != nil {
+				return err
+			}
+		}
 
 		// TODO: check addressability, "_" for ==, and if type is numeric for +=, -=,...
 	}
@@ -847,7 +1248,7 @@ func (es *ExprStmt) NegotiateTypes(tc *TypesContext) error {
 		if ok && fc.IsNullResult(tc) {
 			return nil
 		}
-		return ExprErrorf(es, "Couldn't infer types")
+		return ExprErrorf(es, CodeCantInfer, "Couldn't infer types")
 	}
 
 	return es.Expression.(TypedExpr).ApplyType(tc, typ)
@@ -914,19 +1315,27 @@ func ExprToTypeName(tc *TypesContext, e Expr) (t Type, err error) {
 		return &PointerType{To: subType}, nil
 	case *Ident:
 		if e.object == nil {
-			return nil, ExprErrorf(e, "Unknown identifier: %s", e.name)
+			tc.usedUnknown = true
+			return nil, ExprErrorf(e, CodeUnknownIdentifier, "Unknown identifier: %s", e.name)
 		}
 		if e.object.ObjectType() == OBJECT_TYPE {
 			return e.object.(*TypeDecl).Type(), nil
 		}
+		if decl, ok := e.object.(*GenericParamTypeDecl); ok {
+			typ := &GenericParamType{Name: decl.name, decl: decl}
+			tc.checkParams(typ)
+			return typ, nil
+		}
 	case *DotSelector:
 		if IsPackage(e.Left.(TypedExpr)) {
 			importStmt := e.Left.(*Ident).object.(*ImportStmt)
+			if importStmt.pkg.GetObject(e.Right.name) == nil {
+				return nil, ExprErrorf(e, CodeNoMember, "No member %s in package %s", e.Right.name, importStmt.path)
+			}
 			decl := importStmt.pkg.GetType(e.Right.name)
 			if decl != nil {
 				return &CustomType{Decl: decl, Name: decl.name, Package: importStmt}, nil
 			}
-			return nil, ExprErrorf(e, "No member %s in package %s", e.Right.name, importStmt.path)
 		}
 	}
 	// No error found, but the expression is not a type.
@@ -938,7 +1347,7 @@ func ExprToGeneric(e Expr) (t Generic, err error) {
 	switch e := e.(type) {
 	case *Ident:
 		if e.object == nil {
-			return nil, ExprErrorf(e, "Unknown identifier: %s", e.name)
+			return nil, ExprErrorf(e, CodeUnknownIdentifier, "Unknown identifier: %s", e.name)
 		}
 		if e.object.ObjectType() == OBJECT_GENERIC {
 			return e.object.(Generic), nil
@@ -968,7 +1377,7 @@ func (ex *FuncCallExpr) inferGeneric(tc *TypesContext) (*Variable, string, error
 	_, params := generic.Signature()
 	genericFn, isFn := generic.(*GenericFunc)
 	if !isFn {
-		return nil, "", ExprErrorf(ex.Left, "Expression is not a function")
+		return nil, "", ExprErrorf(ex.Left, CodeNotAFunction, "Expression is not a function")
 	}
 
 	var argTypes []Type
@@ -976,19 +1385,28 @@ func (ex *FuncCallExpr) inferGeneric(tc *TypesContext) (*Variable, string, error
 		argTypes = append(argTypes, v.Type)
 	})
 
-	gnParams, err := deduceGenericParams(tc, params, argTypes, ex.Args)
+	if genericFn.Func.typ.Variadic && !ex.Spread && len(ex.Args) >= len(argTypes)-1 {
+		// Each trailing argument is an element of the variadic slice.
+		variadic := argTypes[len(argTypes)-1].(*SliceType).Of
+		argTypes = argTypes[:len(argTypes)-1]
+		for len(argTypes) < len(ex.Args) {
+			argTypes = append(argTypes, variadic)
+		}
+	}
+
+	gnParams, err := deduceGenericParams(tc, params, genericFn.paramDecls, argTypes, ex.Args)
 	if err != nil {
-		return nil, "", ExprErrorf(ex, err.Error())
+		// Errors of nested instantiations are already placed.
+		return nil, "", errorList(placeErrors(ex, flattenErrors(err)))
 	}
 
 	obj, goName, errors := generic.Instantiate(tc, gnParams...)
 	if len(errors) > 0 {
-		// TODO: return all errors
-		return nil, "", errors[0]
+		return nil, "", errorList(placeErrors(ex, traceErrors(generic, gnParams, ex.Pos(), errors)))
 	}
 
 	if obj.ObjectType() != OBJECT_VAR {
-		return nil, "", ExprErrorf(ex, "Result of a generic is not a value")
+		return nil, "", ExprErrorf(ex, CodeNotAValue, "Result of a generic is not a value")
 	}
 
 	return obj.(*Variable), goName, nil
@@ -1018,6 +1436,13 @@ func (ex *FuncCallExpr) getCalleeType(tc *TypesContext) (Type, error) {
 
 // Type check function arguments.
 func (ex *FuncCallExpr) checkArgs(tc *TypesContext, asFunc *FuncType) error {
+	if ex.Spread && !asFunc.Variadic {
+		return ExprErrorf(ex, CodeInvalidVariadic, "Can't use `...` with a non-variadic function")
+	}
+	if asFunc.Variadic && !ex.Spread {
+		return ex.checkVariadicArgs(tc, asFunc)
+	}
+
 	if len(asFunc.Args) != len(ex.Args) {
 		if len(ex.Args) == 1 {
 			types := make([]*Type, len(asFunc.Args))
@@ -1028,7 +1453,7 @@ func (ex *FuncCallExpr) checkArgs(tc *TypesContext, asFunc *FuncType) error {
 
 			return NegotiateTupleUnpackAssign(tc, true, types, ex.Args[0].(TypedExpr))
 		}
-		return ExprErrorf(ex, "Wrong number of arguments: %d instead of %d", len(ex.Args), len(asFunc.Args))
+		return ExprErrorf(ex, CodeWrongArgumentCount, "Wrong number of arguments: %d instead of %d", len(ex.Args), len(asFunc.Args))
 	} else {
 		for i, arg := range asFunc.Args {
 			if err := NegotiateExprType(tc, &arg, ex.Args[i].(TypedExpr)); err != nil {
@@ -1039,6 +1464,27 @@ func (ex *FuncCallExpr) checkArgs(tc *TypesContext, asFunc *FuncType) error {
 	return nil
 }
 
+// Type check arguments of a variadic function, called without spreading
+// a slice - the trailing arguments become elements of the variadic slice.
+func (ex *FuncCallExpr) checkVariadicArgs(tc *TypesContext, asFunc *FuncType) error {
+	fixed := len(asFunc.Args) - 1
+	if len(ex.Args) < fixed {
+		return ExprErrorf(ex, CodeWrongArgumentCount, "Wrong number of arguments: %d instead of at least %d", len(ex.Args), fixed)
+	}
+
+	elemType := asFunc.Args[fixed].(*SliceType).Of
+	for i, arg := range ex.Args {
+		typ := elemType
+		if i < fixed {
+			typ = asFunc.Args[i]
+		}
+		if err := NegotiateExprType(tc, &typ, arg.(TypedExpr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ex *FuncCallExpr) Type(tc *TypesContext) (Type, error) {
 	if tc.IsTypeSet(ex) {
 		return tc.GetType(ex), nil
@@ -1052,7 +1498,13 @@ func (ex *FuncCallExpr) Type(tc *TypesContext) (Type, error) {
 
 	if castType != nil {
 		if len(ex.Args) != 1 {
-			return nil, ExprErrorf(ex, "Type casts take only 1 argument")
+			return nil, ExprErrorf(ex, CodeWrongArgumentCount, "Type casts take only 1 argument")
+		}
+		if ex.Spread {
+			return nil, ExprErrorf(ex, CodeInvalidConversion, "Can't use `...` in a type conversion")
+		}
+		if _, err := ex.Args[0].(TypedExpr).Type(tc); err != nil {
+			return nil, err
 		}
 		if IsConvertable(tc, ex.Args[0].(TypedExpr), castType) {
 			return castType, nil
@@ -1094,16 +1546,19 @@ func (ex *FuncCallExpr) ApplyType(tc *TypesContext, typ Type) error {
 
 	if castType != nil {
 		if len(ex.Args) != 1 {
-			return ExprErrorf(ex, "Type conversion takes exactly one argument")
+			return ExprErrorf(ex, CodeWrongArgumentCount, "Type conversion takes exactly one argument")
 		}
 		// Just try applying, ignore error - even if it fails if might still be convertible.
 		ex.Args[0].(TypedExpr).ApplyType(tc, castType)
+		if _, err := ex.Args[0].(TypedExpr).Type(tc); err != nil {
+			return err
+		}
 		if !IsConvertable(tc, ex.Args[0].(TypedExpr), castType) {
 			typ, _ := ex.Args[0].(TypedExpr).Type(tc)
-			return ExprErrorf(ex, "Impossible conversion from %s to %s", typ, castType)
+			return ExprErrorf(ex, CodeInvalidConversion, "Impossible conversion from %s to %s", typ, castType)
 		}
 		if !IsAssignable(typ, castType) {
-			return ExprErrorf(ex, "Cannot assign `%s` to `%s`", castType, typ)
+			return ExprErrorf(ex, CodeUnassignable, "Cannot assign `%s` to `%s`", castType, typ)
 		}
 		tc.SetType(ex, typ)
 		return nil
@@ -1113,23 +1568,32 @@ func (ex *FuncCallExpr) ApplyType(tc *TypesContext, typ Type) error {
 			return err
 		}
 		if calleeType.Kind() != KIND_FUNC {
-			return ExprErrorf(ex, "Only functions can be called, not %s", calleeType)
-		}
-
-		if typ.Kind() == KIND_TUPLE {
-			panic("todo")
+			return ExprErrorf(ex, CodeNotAFunction, "Only functions can be called, not %s", calleeType)
 		}
 
 		asFunc := calleeType.(*FuncType)
-		switch {
-		case len(asFunc.Results) == 0:
-			return ExprErrorf(ex, "Function `%s` doesn't return anything", asFunc)
-		case len(asFunc.Results) == 1:
-			if !IsAssignable(asFunc.Results[0], typ) {
-				return ExprErrorf(ex, "Can't assign `%s` to `%s`", asFunc.Results[0], typ)
+
+		if tuple, ok := typ.(*TupleType); ok {
+			// E.g. statements calling functions with many results.
+			if len(tuple.Members) != len(asFunc.Results) {
+				return ExprErrorf(ex, CodeWrongResultCount, "Function returns %d values, not %d", len(asFunc.Results), len(tuple.Members))
+			}
+			for i, result := range asFunc.Results {
+				if !IsAssignable(tuple.Members[i], result) {
+					return ExprErrorf(ex, CodeUnassignable, "Can't assign `%s` to `%s`", result, tuple.Members[i])
+				}
+			}
+		} else {
+			switch {
+			case len(asFunc.Results) == 0:
+				return ExprErrorf(ex, CodeWrongResultCount, "Function `%s` doesn't return anything", asFunc)
+			case len(asFunc.Results) == 1:
+				if !IsAssignable(asFunc.Results[0], typ) {
+					return ExprErrorf(ex, CodeUnassignable, "Can't assign `%s` to `%s`", asFunc.Results[0], typ)
+				}
+			default:
+				return ExprErrorf(ex, CodeWrongResultCount, "Function `%s` returns more than one result", asFunc)
 			}
-		default:
-			return ExprErrorf(ex, "Function `%s` returns more than one result", asFunc)
 		}
 
 		err = ex.checkArgs(tc, asFunc)
@@ -1176,7 +1640,7 @@ func (ex *FuncDecl) Type(tc *TypesContext) (Type, error) {
 }
 func (ex *FuncDecl) ApplyType(tc *TypesContext, typ Type) error {
 	if !IsAssignable(typ, ex.typ) {
-		return ExprErrorf(ex, "Cannot assign `%s` to `%s`", ex.typ, typ)
+		return ExprErrorf(ex, CodeUnassignable, "Cannot assign `%s` to `%s`", ex.typ, typ)
 	}
 	return ex.Code.CheckTypes(tc)
 }
@@ -1184,27 +1648,29 @@ func (ex *FuncDecl) GuessType(tc *TypesContext) (ok bool, typ Type) {
 	return false, nil
 }
 
+// Checks all the statements, even if some of them fail.
 func (cb *CodeBlock) CheckTypes(tc *TypesContext) error {
+	var errs []error
 	for _, stmt := range cb.Statements {
-		typedStmt := stmt.(ExprToProcess)
-		if err := typedStmt.NegotiateTypes(tc); err != nil {
-			return err
+		if err := tc.negotiateStmt(stmt); err != nil {
+			errs = append(errs, err)
+			continue
 		}
 
 		if es, ok := stmt.(*ExprStmt); ok {
 			_, ok := es.Expression.(*FuncCallExpr)
 			if !ok {
-				return ExprErrorf(es, "Expression evaluated but not used")
+				errs = append(errs, ExprErrorf(es, CodeUnusedExpression, "Expression evaluated but not used"))
 			}
 		}
 	}
-	return nil
+	return errorList(errs)
 }
 
 func (ex *TypeExpr) Type(tc *TypesContext) (Type, error) { return ex.typ, nil }
 func (ex *TypeExpr) ApplyType(tc *TypesContext, typ Type) error {
 	if ex.typ.String() != typ.String() {
-		return ExprErrorf(ex, "Different types, %s and %s", ex.typ.String(), typ.String())
+		return ExprErrorf(ex, CodeMismatchedTypes, "Different types, %s and %s", ex.typ.String(), typ.String())
 	}
 	return nil
 }
@@ -1221,17 +1687,18 @@ func (ex *TypeAssertion) Type(tc *TypesContext) (Type, error) {
 }
 func (ex *TypeAssertion) ApplyType(tc *TypesContext, typ Type) error {
 	if ex.ForSwitch {
-		return ExprErrorf(ex, "This is only allowed in switch statements")
+		return ExprErrorf(ex, CodeInvalidSwitch, "This is only allowed in switch statements")
 	}
 
 	if typ.Kind() == KIND_TUPLE {
 		tuple := typ.(*TupleType)
 		if len(tuple.Members) != 2 {
-			ExprErrorf(ex, "Wrong number of elements on left of type assertion (max. 2)")
+			ExprErrorf(ex, CodeAssignmentMismatch, "Wrong number of elements on left of type assertion (max. 2)")
 		}
 
 		if !IsBoolAssignable(tuple.Members[1]) {
-			ExprErrorf(ex, "Second value returned from type assertion is bool, bools aren't assignable to %s", tuple.Members[1])
+			ExprErrorf(ex, CodeNotAssignable, "Second value returned from type assertion is bool, bools aren't assignable to %s",
+				tuple.Members[1])
 		}
 
 		tc.SetType(ex, typ)
@@ -1239,7 +1706,7 @@ func (ex *TypeAssertion) ApplyType(tc *TypesContext, typ Type) error {
 	}
 
 	if ex.Right.typ.String() != typ.String() {
-		return ExprErrorf(ex, "Different types: %s and %s", typ, ex.Right.typ)
+		return ExprErrorf(ex, CodeMismatchedTypes, "Different types: %s and %s", typ, ex.Right.typ)
 	}
 
 	te := ex.Left.(TypedExpr)
@@ -1276,35 +1743,35 @@ func CheckTypeAssert(tc *TypesContext, src TypedExpr, target Type) error {
 	}
 
 	if !IsInterface(srcType) {
-		return ExprErrorf(src, "Invalid type assertion, non-interface `%s` used as a source", srcType)
+		return ExprErrorf(src, CodeInvalidTypeAssertion, "Invalid type assertion, non-interface `%s` used as a source", srcType)
 	}
 
 	if !IsInterface(target) {
 		if !Implements(srcType, target) {
-			return ExprErrorf(src, "Impossible type assertion: `%s` doesn't implement `%s`",
+			return ExprErrorf(src, CodeInvalidTypeAssertion, "Impossible type assertion: `%s` doesn't implement `%s`",
 				target, srcType)
 		}
 	}
 	return nil
 }
 
-func (ex *DotSelector) typeFromPkg() (Type, error) {
+func (ex *DotSelector) typeFromPkg(tc *TypesContext) (Type, error) {
 	importStmt := ex.Left.(*Ident).object.(*ImportStmt)
 
 	member := importStmt.pkg.GetObject(ex.Right.name)
 	if member == nil {
-		return nil, ExprErrorf(ex.Right, "Package %s doesn't have member %s", importStmt.name, ex.Right.name)
+		return nil, ExprErrorf(ex.Right, CodeNoMember, "Package %s doesn't have member %s", importStmt.name, ex.Right.name)
 	}
-	typ, err := typeOfObject(member, importStmt.name)
+	typ, err := typeOfObject(tc, ex, member, importStmt.name)
 	if err != nil {
-		return typ, ExprErrorf(ex, err.Error())
+		return typ, exprError(ex, err)
 	}
 	return typ, err
 }
 
 func (ex *DotSelector) Type(tc *TypesContext) (Type, error) {
 	if IsPackage(ex.Left.(TypedExpr)) {
-		return ex.typeFromPkg()
+		return ex.typeFromPkg(tc)
 	}
 
 	leftType, err := ex.Left.(TypedExpr).Type(tc)
@@ -1317,6 +1784,17 @@ func (ex *DotSelector) Type(tc *TypesContext) (Type, error) {
 		leftType = asPtr.To
 	}
 
+	if custom, ok := leftType.(*CustomType); ok && custom.Decl != nil {
+		// Methods of named types that aren't structs (or come from Go packages).
+		if method, ok := custom.Decl.Methods[ex.Right.name]; ok {
+			return method.Type(tc)
+		}
+	}
+
+	if iface := paramConstraintIface(leftType); iface != nil {
+		leftType = iface
+	}
+
 	leftType = RootType(leftType)
 
 	switch leftType.Kind() {
@@ -1326,7 +1804,7 @@ func (ex *DotSelector) Type(tc *TypesContext) (Type, error) {
 		if !ok {
 			method, ok := asStruct.Methods[ex.Right.name]
 			if !ok {
-				return nil, ExprErrorf(ex.Right, "No such member: %s", ex.Right.name)
+				return nil, ExprErrorf(ex.Right, CodeNoMember, "No such member: %s", ex.Right.name)
 			}
 
 			member, err = method.Type(tc)
@@ -1339,30 +1817,28 @@ func (ex *DotSelector) Type(tc *TypesContext) (Type, error) {
 		asIface := leftType.(*IfaceType)
 		method, ok := asIface.Methods[ex.Right.name]
 		if !ok {
-			return nil, ExprErrorf(ex.Right, "No such member: %s", ex.Right.name)
+			return nil, ExprErrorf(ex.Right, CodeNoMember, "No such member: %s", ex.Right.name)
 		}
 
 		return method.Type(tc)
-	case KIND_UNKNOWN:
-		panic("todo")
 	default:
 		if leftType.Known() {
-			return nil, ExprErrorf(ex.Left, "Dot selector used for type %s", leftType)
+			return nil, ExprErrorf(ex.Left, CodeNoMember, "Dot selector used for type %s", leftType)
 		}
 		return &UnknownType{}, nil
 	}
 }
 
-func (ex *DotSelector) applyTypeForPkgMemb(typ Type) error {
+func (ex *DotSelector) applyTypeForPkgMemb(tc *TypesContext, typ Type) error {
 	importStmt := ex.Left.(*Ident).object.(*ImportStmt)
 
-	member, ok := importStmt.pkg.objects[ex.Right.name]
-	if !ok {
-		return ExprErrorf(ex.Right, "Package %s doesn't have member %s", importStmt.name, ex.Right.name)
+	member := importStmt.pkg.GetObject(ex.Right.name)
+	if member == nil {
+		return ExprErrorf(ex.Right, CodeNoMember, "Package %s doesn't have member %s", importStmt.name, ex.Right.name)
 	}
-	err := applyTypeToObject(member, importStmt.name, typ)
+	err := applyTypeToObject(tc, ex, member, importStmt.name, typ)
 	if err != nil {
-		return ExprErrorf(ex, err.Error())
+		return exprError(ex, err)
 	}
 	return nil
 }
@@ -1370,7 +1846,7 @@ func (ex *DotSelector) applyTypeForPkgMemb(typ Type) error {
 func (ex *DotSelector) ApplyType(tc *TypesContext, typ Type) error {
 	ident, isIdent := ex.Left.(*Ident)
 	if isIdent && ident.object.ObjectType() == OBJECT_PACKAGE {
-		return ex.applyTypeForPkgMemb(typ)
+		return ex.applyTypeForPkgMemb(tc, typ)
 	}
 
 	exType, err := ex.Type(tc)
@@ -1379,12 +1855,15 @@ func (ex *DotSelector) ApplyType(tc *TypesContext, typ Type) error {
 	}
 	if exType.String() != typ.String() {
 		t, _ := ex.Left.(TypedExpr).Type(tc)
-		return ExprErrorf(ex.Right, "Type %s has no member named %s", t, ex.Right.name)
+		return ExprErrorf(ex.Right, CodeNoMember, "Type %s has no member named %s", t, ex.Right.name)
 	}
 	return nil
 }
 
 func (ex *DotSelector) GuessType(tc *TypesContext) (ok bool, typ Type) {
+	if ident, ok := ex.Left.(*Ident); ok && ident.object != nil && IsPackage(ident) {
+		return guessTypeOfObject(ident.object.(*ImportStmt).pkg.GetObject(ex.Right.name))
+	}
 	return false, nil
 }
 
@@ -1439,18 +1918,17 @@ func (ex *ArrayExpr) Type(tc *TypesContext) (Type, error) {
 				return nil, err
 			}
 			if typ == nil {
-				return nil, ExprErrorf(arg, "Generic parameter #%d is not a type", i)
+				return nil, ExprErrorf(arg, CodeNotAType, "Generic parameter #%d is not a type", i)
 			}
 			types = append(types, typ)
 		}
 		obj, goName, errors := generic.Instantiate(tc, types...)
 		if len(errors) > 0 {
-			// TODO: return all errors
-			return nil, errors[0]
+			return nil, errorList(placeErrors(ex, traceErrors(generic, types, ex.Pos(), errors)))
 		}
 
 		if obj.ObjectType() != OBJECT_VAR {
-			return nil, ExprErrorf(ex, "Result of a generic is not a value")
+			return nil, ExprErrorf(ex, CodeNotAValue, "Result of a generic is not a value")
 		}
 
 		t := obj.(*Variable).Type
@@ -1466,7 +1944,7 @@ func (ex *ArrayExpr) Type(tc *TypesContext) (Type, error) {
 	}
 
 	if len(ex.Index) != 1 {
-		return nil, ExprErrorf(ex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
+		return nil, ExprErrorf(ex, CodeInvalidIndex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
 	}
 
 	leftType, err := ex.Left.(TypedExpr).Type(tc)
@@ -1486,7 +1964,7 @@ func (ex *ArrayExpr) Type(tc *TypesContext) (Type, error) {
 
 func (ex *ArrayExpr) applyTypeSliceExpr(tc *TypesContext, typ Type) error {
 	if len(ex.Index) != 1 {
-		return ExprErrorf(ex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
+		return ExprErrorf(ex, CodeInvalidIndex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
 	}
 
 	sliceExpr := ex.Index[0].(*SliceExpr)
@@ -1498,12 +1976,12 @@ func (ex *ArrayExpr) applyTypeSliceExpr(tc *TypesContext, typ Type) error {
 	ok, keyType, valueType := ex.baseTypesOfContainer(leftType)
 
 	if !ok {
-		return ExprErrorf(ex, "Couldn't infer cotainer type")
+		return ExprErrorf(ex, CodeCantInfer, "Couldn't infer cotainer type")
 	}
 
 	if !IsTypeInt(keyType) {
 		t, _ := ex.leftExprType(tc)
-		return ExprErrorf(ex, "Type %s doesn't support slice expressions", t)
+		return ExprErrorf(ex, CodeInvalidIndex, "Type %s doesn't support slice expressions", t)
 	}
 
 	err = firstErr(
@@ -1521,7 +1999,7 @@ func (ex *ArrayExpr) applyTypeSliceExpr(tc *TypesContext, typ Type) error {
 	resultType := &SliceType{Of: valueType}
 
 	if !IsAssignable(typ, resultType) {
-		return ExprErrorf(ex, "Types %s and %s are not assignable", resultType, typ)
+		return ExprErrorf(ex, CodeNotAssignable, "Types %s and %s are not assignable", resultType, typ)
 	}
 
 	return nil
@@ -1548,7 +2026,7 @@ func (ex *ArrayExpr) ApplyType(tc *TypesContext, typ Type) error {
 		t := tc.GetType(ex)
 
 		if !IsIdentincal(t, typ) {
-			return ExprErrorf(ex, "Array expression has type %s, not %s", t, typ)
+			return ExprErrorf(ex, CodeInvalidIndex, "Array expression has type %s, not %s", t, typ)
 		}
 		return nil
 	}
@@ -1559,7 +2037,7 @@ func (ex *ArrayExpr) ApplyType(tc *TypesContext, typ Type) error {
 	}
 
 	if !lt.Known() {
-		return ExprErrorf(ex, "Coudln't infer container's type")
+		return ExprErrorf(ex, CodeCantInfer, "Coudln't infer container's type")
 	}
 
 	if err := ex.Left.(TypedExpr).ApplyType(tc, lt); err != nil {
@@ -1568,11 +2046,11 @@ func (ex *ArrayExpr) ApplyType(tc *TypesContext, typ Type) error {
 
 	ok, keyTyp, valueTyp := ex.baseTypesOfContainer(lt)
 	if !ok {
-		return ExprErrorf(ex, "Coudln't infer container's type")
+		return ExprErrorf(ex, CodeCantInfer, "Coudln't infer container's type")
 	}
 
 	if len(ex.Index) != 1 {
-		return ExprErrorf(ex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
+		return ExprErrorf(ex, CodeInvalidIndex, "Index operator takes exactly 1 argument, not %d", len(ex.Index))
 	}
 
 	if _, ok := ex.Index[0].(*SliceExpr); ok {
@@ -1589,11 +2067,11 @@ func (ex *ArrayExpr) ApplyType(tc *TypesContext, typ Type) error {
 	if typ.Kind() == KIND_TUPLE {
 		tuple := typ.(*TupleType)
 		if len(tuple.Members) != 2 || !IsBoolAssignable(tuple.Members[1]) {
-			return ExprErrorf(ex, "Second value is bool")
+			return ExprErrorf(ex, CodeNotAssignable, "Second value is bool")
 		}
 
 		if RootType(lt).Kind() != KIND_MAP {
-			return ExprErrorf(ex, "Only map index expressions can return extra bool value")
+			return ExprErrorf(ex, CodeAssignmentMismatch, "Only map index expressions can return extra bool value")
 		}
 
 		// Unwrap the tuple
@@ -1601,7 +2079,7 @@ func (ex *ArrayExpr) ApplyType(tc *TypesContext, typ Type) error {
 	}
 
 	if !IsAssignable(vt, valueTyp) {
-		return ExprErrorf(ex, "Type %s cannot be assigned to %s", valueTyp, typ)
+		return ExprErrorf(ex, CodeNotAssignable, "Type %s cannot be assigned to %s", valueTyp, typ)
 	}
 
 	tc.SetType(ex, typ)
@@ -1644,7 +2122,7 @@ func (ex *CompoundLit) Type(tc *TypesContext) (Type, error) {
 		return nil, err
 	}
 	if typ == nil {
-		return nil, ExprErrorf(ex, "Non-type on the left of complex literal")
+		return nil, ExprErrorf(ex, CodeNotAType, "Non-type on the left of complex literal")
 	}
 
 	ex.typ = typ
@@ -1695,7 +2173,7 @@ func (ex *CompoundLit) ApplyType(tc *TypesContext, typ Type) error {
 			apply = true
 		case COMPOUND_LISTLIKE:
 			if len(ex.elems) != len(asStruct.Members) {
-				return ExprErrorf(ex, "Type has %d members, but literal has just %d",
+				return ExprErrorf(ex, CodeInvalidLiteral, "Type has %d members, but literal has just %d",
 					len(asStruct.Members), len(ex.elems))
 			}
 
@@ -1712,13 +2190,13 @@ func (ex *CompoundLit) ApplyType(tc *TypesContext, typ Type) error {
 
 				ident, ok := elName.(*Ident)
 				if !ok {
-					return ExprErrorf(elName, "Expected a member name")
+					return ExprErrorf(elName, CodeInvalidLiteral, "Expected a member name")
 				}
 				ident.memberName = true
 				name := ident.name
 				memb, ok := asStruct.Members[name]
 				if !ok {
-					return ExprErrorf(elName, "No member named %s", name)
+					return ExprErrorf(elName, CodeNoMember, "No member named %s", name)
 				}
 				if err := elType.(TypedExpr).ApplyType(tc, memb); err != nil {
 					return err
@@ -1752,7 +2230,7 @@ func (ex *CompoundLit) ApplyType(tc *TypesContext, typ Type) error {
 		ex.typ = typ
 		return nil
 	}
-	return ExprErrorf(ex, "Can't use a compound literal to initialize type %s", typ.String())
+	return ExprErrorf(ex, CodeInvalidLiteral, "Can't use a compound literal to initialize type %s", typ.String())
 }
 
 func (ex *CompoundLit) GuessType(tc *TypesContext) (ok bool, typ Type) {
@@ -1851,21 +2329,20 @@ func isRootTypeComparable(t Type) bool {
 }
 
 // Implements the definition of comparable operands from the Go spec.
-// Panic if e1's or e2's methods return errors - their types need to be negotiated earlier.
-func AreComparable(tc *TypesContext, e1, e2 TypedExpr) bool {
-	t1, err := e1.Type(tc)
-	if err != nil || t1.Kind() == KIND_UNKNOWN {
-		panic(fmt.Errorf("Not type-negotiated expression: %s", err))
+// Types of e1 and e2 need to be negotiated earlier, errors are returned otherwise.
+func AreComparable(tc *TypesContext, e1, e2 TypedExpr) (bool, error) {
+	t1, err := negotiatedType(tc, e1)
+	if err != nil {
+		return false, err
 	}
-
-	t2, err := e2.Type(tc)
-	if err != nil || t2.Kind() == KIND_UNKNOWN {
-		panic(fmt.Errorf("Not type-negotiated expression: %s", err))
+	t2, err := negotiatedType(tc, e2)
+	if err != nil {
+		return false, err
 	}
 
 	// Initial requirement from the Go spec.
 	if !IsAssignable(t1, t2) && !IsAssignable(t2, t1) {
-		return false
+		return false, nil
 	}
 
 	rootT1, rootT2 := RootType(t1), RootType(t2)
@@ -1875,18 +2352,35 @@ func AreComparable(tc *TypesContext, e1, e2 TypedExpr) bool {
 
 	switch {
 	case isE2Nil && (rootT1.Kind() == KIND_MAP || rootT1.Kind() == KIND_SLICE || rootT1.Kind() == KIND_FUNC):
-		return true
+		return true, nil
 	case isE1Nil && (rootT2.Kind() == KIND_MAP || rootT2.Kind() == KIND_SLICE || rootT2.Kind() == KIND_FUNC):
-		return true
+		return true, nil
+	case rootT1.Kind() == KIND_GENERIC_PARAM && rootT1.String() == rootT2.String():
+		if decl := rootT1.(*GenericParamType).decl; decl != nil {
+			decl.comparable = true
+		}
+		return true, nil
 	case rootT1.String() == rootT2.String():
-		return isRootTypeComparable(rootT1)
+		return isRootTypeComparable(rootT1), nil
 	case IsInterface(t1):
-		return Implements(t1, t2)
+		return Implements(t1, t2), nil
 	case IsInterface(t2):
-		return Implements(t2, t1)
+		return Implements(t2, t1), nil
 	}
 
-	return false
+	return false, nil
+}
+
+// Returns the type of an expression whose type has been negotiated already.
+func negotiatedType(tc *TypesContext, e TypedExpr) (Type, error) {
+	t, err := e.Type(tc)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind() == KIND_UNKNOWN {
+		return nil, ExprErrorf(e, CodeCantInfer, "Too little information to infer types")
+	}
+	return t, nil
 }
 
 // Implements the definition of ordered operands from the Go spec.
@@ -1914,7 +2408,7 @@ func (ex *BinaryOp) applyTypeForComparisonOp(tc *TypesContext, typ Type) error {
 	leftExpr, rightExpr := ex.Left.(TypedExpr), ex.Right.(TypedExpr)
 
 	if !IsBoolAssignable(typ) {
-		return ExprErrorf(ex, "Comparison operators return bools, not %s", typ)
+		return ExprErrorf(ex, CodeNotAssignable, "Comparison operators return bools, not %s", typ)
 	}
 
 	t1, err := leftExpr.Type(tc)
@@ -1947,7 +2441,7 @@ func (ex *BinaryOp) applyTypeForComparisonOp(tc *TypesContext, typ Type) error {
 		err = leftExpr.ApplyType(tc, t2)
 		t1 = t2
 	case !t1.Known() && !t2.Known():
-		err = ExprErrorf(ex, "Couldn't infer types of left and right operands")
+		err = ExprErrorf(ex, CodeCantInfer, "Couldn't infer types of left and right operands")
 	}
 
 	if err != nil {
@@ -1961,11 +2455,15 @@ func (ex *BinaryOp) applyTypeForComparisonOp(tc *TypesContext, typ Type) error {
 
 	if ex.op.IsOrderOp() {
 		if !AreOrdered(t1, t2) {
-			return ExprErrorf(ex, "Operands of types %s and %s can't be ordered", t1, t2)
+			return ExprErrorf(ex, CodeNotComparable, "Operands of types %s and %s can't be ordered", t1, t2)
 		}
 	} else {
-		if !AreComparable(tc, leftExpr, rightExpr) {
-			return ExprErrorf(ex, "Types %s and %s aren't comparable", t1, t2)
+		comparable, err := AreComparable(tc, leftExpr, rightExpr)
+		if err != nil {
+			return err
+		}
+		if !comparable {
+			return ExprErrorf(ex, CodeNotComparable, "Types %s and %s aren't comparable", t1, t2)
 		}
 	}
 
@@ -1983,15 +2481,14 @@ func (ex *BinaryOp) ApplyType(tc *TypesContext, typ Type) error {
 
 	if ex.op.IsLogicalOp() {
 		if !IsBoolAssignable(typ) {
-			return ExprErrorf(ex, "Logical operators return bools, not %s", typ)
+			return ExprErrorf(ex, CodeNotAssignable, "Logical operators return bools, not %s", typ)
 		}
 	}
 
-	leftExpr, rightExpr := ex.Left.(TypedExpr), ex.Right.(TypedExpr)
-	if err := leftExpr.ApplyType(tc, typ); err != nil {
+	if err := tc.applyOperatorType(ex, typ, ex.Left.(TypedExpr), ex.Right.(TypedExpr)); err != nil {
 		return err
 	}
-	return rightExpr.ApplyType(tc, typ)
+	return checkParamOperator(ex, ex.op, typ)
 }
 
 func (ex *BinaryOp) GuessType(tc *TypesContext) (ok bool, typ Type) {
@@ -2047,7 +2544,7 @@ func (ex *UnaryOp) Type(tc *TypesContext) (Type, error) {
 		}
 		return rootTyp.(*ChanType).Of, nil
 	default:
-		panic("todo")
+		return nil, ExprErrorf(ex, CodeInvalidOperator, "Operator %s can't be used as a unary operator", ex.op.Value)
 	}
 }
 
@@ -2058,13 +2555,16 @@ func (ex *UnaryOp) ApplyType(tc *TypesContext, typ Type) error {
 
 	switch right := ex.Right.(TypedExpr); ex.op.Type {
 	case TOKEN_PLUS, TOKEN_MINUS, TOKEN_SHR, TOKEN_SHL:
-		return right.ApplyType(tc, typ)
+		if err := tc.applyOperatorType(ex, typ, right); err != nil {
+			return err
+		}
+		return checkParamOperator(ex, ex.op, typ)
 	case TOKEN_MUL:
 		return right.ApplyType(tc, &PointerType{To: typ})
 	case TOKEN_AMP:
 		typ = UnderlyingType(typ)
 		if typ.Kind() != KIND_POINTER {
-			return ExprErrorf(ex, "Not a pointer type")
+			return ExprErrorf(ex, CodeNotAPointer, "Not a pointer type")
 		}
 		to := typ.(*PointerType).To
 		return right.ApplyType(tc, to)
@@ -2075,20 +2575,21 @@ func (ex *UnaryOp) ApplyType(tc *TypesContext, typ Type) error {
 		}
 		rootTyp := RootType(rightType)
 		if rootTyp.Kind() != KIND_CHAN {
-			return ExprErrorf(ex, "Type %s is not a channel", rightType)
+			return ExprErrorf(ex, CodeInvalidChannelOperation, "Type %s is not a channel", rightType)
 		}
 		if rootTyp.(*ChanType).Dir == CHAN_DIR_SEND {
-			return ExprErrorf(ex, "Type %s is a send-only channel", rightType)
+			return ExprErrorf(ex, CodeInvalidChannelOperation, "Type %s is a send-only channel", rightType)
 		}
 
 		if typ.Kind() == KIND_TUPLE {
 			tuple := typ.(*TupleType)
 			if len(tuple.Members) != 2 {
-				ExprErrorf(ex, "Wrong number of elements on channel receive (max. 2)")
+				return ExprErrorf(ex, CodeAssignmentMismatch, "Wrong number of elements on channel receive (max. 2)")
 			}
 
 			if !IsBoolAssignable(tuple.Members[1]) {
-				ExprErrorf(ex, "Second value returned from chan receive is bool, and bools aren't assignable to %s", tuple.Members[1])
+				return ExprErrorf(ex, CodeNotAssignable, "Second value returned from chan receive is bool, and bools aren't assignable to %s",
+					tuple.Members[1])
 			}
 
 			tc.SetType(ex, typ)
@@ -2096,11 +2597,11 @@ func (ex *UnaryOp) ApplyType(tc *TypesContext, typ Type) error {
 		}
 
 		if !IsAssignable(rootTyp.(*ChanType).Of, typ) {
-			return ExprErrorf(ex, "Types %s and %s are not assignable", rootTyp.(*ChanType).Of, typ)
+			return ExprErrorf(ex, CodeNotAssignable, "Types %s and %s are not assignable", rootTyp.(*ChanType).Of, typ)
 		}
 		return nil
 	default:
-		panic("todo")
+		return ExprErrorf(ex, CodeInvalidOperator, "Operator %s can't be used as a unary operator", ex.op.Value)
 	}
 }
 
@@ -2130,50 +2631,104 @@ func (ex *UnaryOp) GuessType(tc *TypesContext) (ok bool, typ Type) {
 		}
 		return true, &ChanType{Of: typ}
 	default:
-		panic("todo")
+		return false, nil
 	}
 }
 
 // Helper function for expressions with common Type() implementations.
-func typeOfObject(obj Object, name string) (Type, error) {
+// The ex argument is the expression refering to the object.
+func typeOfObject(tc *TypesContext, ex Expr, obj Object, name string) (Type, error) {
+	tc.checkFailed(obj)
+	if c, ok := obj.(*Constant); ok {
+		val, err := c.Eval()
+		if err != nil {
+			return nil, err
+		}
+		if val.Untyped {
+			// Just like literals, untyped constants get types from their context.
+			return tc.GetType(ex), nil
+		}
+		return val.Type, nil
+	}
 	if obj != nil && obj.ObjectType() == OBJECT_VAR {
-		return obj.(*Variable).Type, nil
+		return nonilTyp(obj.(*Variable).Type), nil
 	}
-	return nil, fmt.Errorf("Unknown identifier: %s", name)
+	tc.usedUnknown = true
+	return nil, unplacedErrorf(CodeUnknownIdentifier, "Unknown identifier: %s", name)
 }
 
-func applyTypeToObject(obj Object, name string, typ Type) error {
+func applyTypeToObject(tc *TypesContext, ex Expr, obj Object, name string, typ Type) error {
+	tc.checkFailed(obj)
 	if obj == nil {
-		return fmt.Errorf("Unknown identifier: %s", name)
+		tc.usedUnknown = true
+		return unplacedErrorf(CodeUnknownIdentifier, "Unknown identifier: %s", name)
+	}
+
+	if c, ok := obj.(*Constant); ok {
+		val, err := c.Eval()
+		if err != nil {
+			return err
+		}
+		if !val.Untyped {
+			if !IsAssignable(typ, val.Type) {
+				return unplacedErrorf(CodeInvalidConstant, "Constant %s is of type %s, can't use it as %s", name, val.Type, typ)
+			}
+			return nil
+		}
+		if IsInterface(typ) {
+			// Untyped constants stored in interfaces get their default types.
+			typ = val.Type
+		}
+		if tc.constOperands {
+			// Checked with the whole constant expression.
+			tc.SetType(ex, typ)
+			return nil
+		}
+		if err := constFits(ex, val, typ); err != nil {
+			return err
+		}
+		tc.SetType(ex, typ)
+		return nil
 	}
 
 	if obj.ObjectType() != OBJECT_VAR {
-		return fmt.Errorf("Identifier %s is not a variable", name)
+		return unplacedErrorf(CodeUnassignable, "Identifier %s is not a variable", name)
 	}
 
 	if !IsAssignable(typ, obj.(*Variable).Type) {
-		return fmt.Errorf("Identifier %s is of type %s, can't assign type %s to it", name, obj.(*Variable).Type, typ)
+		return unplacedErrorf(CodeNotAssignable, "Identifier %s is of type %s, can't assign type %s to it",
+			name, obj.(*Variable).Type, typ)
 	}
 	return nil
 }
 
 func (ex *Ident) Type(tc *TypesContext) (Type, error) {
-	typ, err := typeOfObject(ex.object, ex.name)
+	typ, err := typeOfObject(tc, ex, ex.object, ex.name)
 	if err != nil {
-		return typ, ExprErrorf(ex, err.Error())
+		return typ, exprError(ex, err)
 	}
 	return typ, nil
 }
 
 func (ex *Ident) ApplyType(tc *TypesContext, typ Type) error {
-	err := applyTypeToObject(ex.object, ex.name, typ)
+	err := applyTypeToObject(tc, ex, ex.object, ex.name, typ)
 	if err != nil {
-		return ExprErrorf(ex, err.Error())
+		return exprError(ex, err)
 	}
 	return nil
 }
 
 func (ex *Ident) GuessType(tc *TypesContext) (ok bool, typ Type) {
+	return guessTypeOfObject(ex.object)
+}
+
+// Untyped constants can be guessed to be of their default types.
+func guessTypeOfObject(obj Object) (ok bool, typ Type) {
+	if c, isConst := obj.(*Constant); isConst {
+		if val, err := c.Eval(); err == nil && val.Untyped {
+			return true, val.Type
+		}
+	}
 	return false, nil
 }
 
@@ -2191,7 +2746,7 @@ func (ex *NilExpr) ApplyType(tc *TypesContext, typ Type) error {
 		tc.SetType(ex, typ)
 		return nil
 	}
-	return ExprErrorf(ex, "Type %s can't be set to nil", typ)
+	return ExprErrorf(ex, CodeInvalidNil, "Type %s can't be set to nil", typ)
 }
 
 func (ex *NilExpr) GuessType(tc *TypesContext) (ok bool, typ Type) {
@@ -2206,7 +2761,12 @@ func (ex *BasicLit) ApplyType(tc *TypesContext, typ Type) error {
 	actualType := RootType(typ)
 
 	if actualType.Kind() != KIND_SIMPLE {
-		return ExprErrorf(ex, "Can't use this literal for type %s", typ)
+		return ExprErrorf(ex, CodeInvalidLiteral, "Can't use this literal for type %s", typ)
+	}
+	if tc.constOperands {
+		// Checked with the whole constant expression, e.g. 2.5 * 2 is an int.
+		tc.SetType(ex, typ)
+		return nil
 	}
 
 	switch {
@@ -2224,10 +2784,13 @@ func (ex *BasicLit) ApplyType(tc *TypesContext, typ Type) error {
 	case (ex.token.Type == TOKEN_TRUE || ex.token.Type == TOKEN_FALSE) &&
 		actualType.(*SimpleType).ID == SIMPLE_TYPE_BOOL:
 
+		if err := tc.checkConstExpr(ex, typ); err != nil {
+			return err
+		}
 		tc.SetType(ex, typ)
 		return nil
 	}
-	return ExprErrorf(ex, "Can't use this literal for type %s", typ)
+	return ExprErrorf(ex, CodeInvalidLiteral, "Can't use this literal for type %s", typ)
 }
 
 func (ex *BasicLit) GuessType(tc *TypesContext) (ok bool, typ Type) {
@@ -2258,10 +2821,11 @@ func firstKnown(types ...Type) Type {
 	return nil
 }
 
-func deduceGenericParams(tc *TypesContext, params []string, decls []Type, uses []Expr) ([]Type, error) {
+func deduceGenericParams(tc *TypesContext, params []string, paramDecls []*GenericParamTypeDecl,
+	decls []Type, uses []Expr) ([]Type, error) {
 	if len(decls) != len(uses) {
 		// TODO: tuple passing
-		return nil, fmt.Errorf("Invalid number of arguments: %d instead of %d", len(uses), len(decls))
+		return nil, unplacedErrorf(CodeWrongArgumentCount, "Invalid number of arguments: %d instead of %d", len(uses), len(decls))
 	}
 
 	// Requirements for each param inferred from uses. If all goes well, each param
@@ -2301,7 +2865,7 @@ func deduceGenericParams(tc *TypesContext, params []string, decls []Type, uses [
 				var ok bool
 				ok, use = uses[i].(TypedExpr).GuessType(tc)
 				if !ok {
-					return nil, fmt.Errorf("Argument #%d has unknown type", i)
+					return nil, unplacedErrorf(CodeCantInfer, "Argument #%d has unknown type", i)
 				}
 			}
 
@@ -2316,12 +2880,23 @@ func deduceGenericParams(tc *TypesContext, params []string, decls []Type, uses [
 					return false
 				}
 
+				if j >= len(declSubts) {
+					// Same kinds, but different shapes, e.g. functions with different numbers of args.
+					err = unplacedErrorf(CodeCantInfer, "Generic function and the parameter have incomptible types (%s and %s)", decl, use)
+					return false
+				}
 				declSubt := declSubts[j]
 				if declSubt.Kind() == KIND_GENERIC_PARAM {
 					name := declSubt.(*GenericParamType).Name
 					if req, ok := reqs[name]; ok {
-						if req.String() != t.String() {
-							err = fmt.Errorf("%s can't be both %s and %s", name, req, t)
+						switch {
+						case req.String() == t.String():
+						case IsInterface(req) && IsAssignable(req, t):
+							// E.g. append(s, "a"), where s is []interface{}
+						case IsInterface(t) && IsAssignable(t, req):
+							reqs[name] = t
+						default:
+							err = unplacedErrorf(CodeCantInfer, "%s can't be both %s and %s", name, req, t)
 							return false
 							// ERROR, contradictory requirements
 						}
@@ -2331,7 +2906,7 @@ func deduceGenericParams(tc *TypesContext, params []string, decls []Type, uses [
 					j++
 					return false
 				} else if declSubt.Kind() != t.Kind() {
-					err = fmt.Errorf("Generic function and the parameter have incomptible types (%s and %s)", declSubt, t)
+					err = unplacedErrorf(CodeCantInfer, "Generic function and the parameter have incomptible types (%s and %s)", declSubt, t)
 					return false
 				}
 
@@ -2347,12 +2922,15 @@ func deduceGenericParams(tc *TypesContext, params []string, decls []Type, uses [
 
 	// Check if all is known. If not, we'll need to another round with GuessTypes.
 	if len(reqs) != len(params) {
-		return nil, fmt.Errorf("Not all parameters were guessed")
+		return nil, unplacedErrorf(CodeCantInfer, "Not all parameters were guessed")
 	}
 
 	result := make([]Type, 0, len(params))
 	for _, p := range params {
 		result = append(result, reqs[p])
 	}
+	if err := checkConstraints(paramDecls, result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
@@ -1395,6 +1395,16 @@ var c = a < b`,
 
 func TestTypesComparability(t *testing.T) {
 	testVarTypes(t, []typeTestCase{
+		{`var a, b int
+var c = a != b`,
+			true,
+			"bool",
+		},
+		{`var a *int
+var c = a != nil`,
+			true,
+			"bool",
+		},
 		{`var a, b bool
 var c = a == b`,
 			true,
@@ -1716,42 +1726,54 @@ var x = a[float32]()`,
 		},
 		{`
 func a[T]() T:
-	return 1
+	when T
+	is float32:
+		return 1
 var x = a[float32]()`,
 			true,
 			"float32",
 		},
 		{`
 func a[T](x T) T:
-	return 1 + x
+	when T
+	is float32:
+		return 1 + x
 var x = a[float32](4)`,
 			true,
 			"float32",
 		},
 		{`
 func a[T](x T) T: # Trying to add string literal "aaa" to float32
-	return "aaa" + x
+	when T
+	is float32:
+		return "aaa" + x
 var x = a[float32](4)`,
 			false,
 			"",
 		},
 		{`
 func a[T, K](x T, y K) T:
-	return x + y
+	when K
+	is T:
+		return x + y
 var x = a[float32, float32](4, 5)`,
 			true,
 			"float32",
 		},
 		{`
 func a[T, K](x T, y K) T:
-	return x + y # Error, can't add float32 and string
+	when T
+	is float32:
+		return x + y # Error, can't add float32 and string
 var x = a[float32, string](4, "s")`,
 			false,
 			"",
 		},
 		{`
 func a[T](x T) T: # a[T] used in a[T]
-	return x + a[T](10)
+	when T
+	is float32:
+		return x + a[T](10)
 var x = a[float32](4)`,
 			true,
 			"float32",
@@ -1785,7 +1807,9 @@ func TestTypesGenericTypes(t *testing.T) {
 		{`
 struct A[T]:
 	func x() T:
-		return 1
+		when T
+		is int:
+			return 1
 var a A[int]
 var x = a.x()`,
 			true,
@@ -1794,7 +1818,9 @@ var x = a.x()`,
 		{`
 struct A[T]:
 	func x() T:
-		return "a"
+		when T
+		is string:
+			return "a"
 struct B[T]:
 	func y() T:
 		var a A[T]
@@ -1807,7 +1833,9 @@ var x = b.y()`,
 		{`
 struct A[T]:
 	func x() T:
-		return "a"
+		when T
+		is string:
+			return "a"
 struct B[T]:
 	func y(a A[T]) T:
 		return a.x()
@@ -1819,7 +1847,9 @@ var x = b.y(a)`,
 		{`
 struct A[T]:
 	func x() T:
-		return 11.2
+		when T
+		is float32:
+			return 11.2
 func x[T](a A[T]) T:
 	return a.x()
 var a A[float32]
@@ -1830,7 +1860,9 @@ var x = x(a)`,
 		{`
 struct A[T]:
 	func x() T:
-		return 11
+		when T
+		is float32:
+			return 11
 interface I:
 	func x() float32
 var a A[float32]
@@ -1842,7 +1874,9 @@ var x = i`,
 		{`
 struct A[T]:
 	func x() T:
-		return 11
+		when T
+		is int:
+			return 11
 interface I:
 	func x() float32
 var a A[int]
@@ -2263,6 +2297,325 @@ var placeholder int = 0`,
 	})
 }
 
+func TestTypesGoStmt(t *testing.T) {
+	testVarTypes(t, []typeTestCase{
+		{`
+func f(x int):
+    pass
+func g():
+    go f(1)
+var placeholder int = 0`,
+			true,
+			"int",
+		},
+		{`
+func f(x int):
+    pass
+func g():
+    go f("bla")
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+func f(x int) (int, bool):
+    return x, true
+func g():
+    go f(1)
+var placeholder int = 0`,
+			true,
+			"int",
+		},
+		{`
+func g():
+    go (func(x int):
+        pass)(5)
+var placeholder int = 0`,
+			true,
+			"int",
+		},
+		{`
+func g():
+    go (func():
+        var x int = "bla")()
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+func g():
+    go int(5)
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+func g():
+    var x = 5
+    go x
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+func f(x int):
+    pass
+go f(1)
+var placeholder int = 0`,
+			false,
+			"",
+		},
+	})
+}
+
+func TestTypesDeferStmt(t *testing.T) {
+	testVarTypes(t, []typeTestCase{
+		{`
+func f(x int):
+    defer print(x)
+var placeholder int = 0`,
+			true,
+			"int",
+		},
+		{`
+func f(x int):
+    defer print(x, x)
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+func f():
+    defer (func():
+        var x int = "bla")()
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+defer print(1)
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`var r = recover()`,
+			true,
+			"interface{}",
+		},
+	})
+}
+
+func TestTypesSelectStmt(t *testing.T) {
+	testVarTypes(t, []typeTestCase{
+		{`
+var c chan string
+var x string
+var ok bool
+select:
+	case x = <-c:
+		pass
+	case x, ok = <-c:
+		pass
+	case c <- "a":
+		pass
+var placeholder = x`,
+			true,
+			"string",
+		},
+		{`
+var c chan string
+var x int
+select:
+	case x = <-c:
+		pass
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+var c chan string
+select:
+	case c <- 1:
+		pass
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+var c <-chan string
+select:
+	case c <- "a":
+		pass
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+var c chan string
+select:
+	case var v, ok = <-c:
+		var x string = v
+		var y bool = ok
+var placeholder int = 0`,
+			true,
+			"int",
+		},
+		{`
+var c chan string
+select:
+	case <-c:
+		var x int = "a"
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+select:
+	default:
+		pass
+	default:
+		pass
+var placeholder int = 0`,
+			false,
+			"",
+		},
+	})
+}
+
+func TestTypesConstants(t *testing.T) {
+	testVarTypes(t, []typeTestCase{
+		{`
+const:
+	A = iota
+	B
+	C
+var x [C]int = [C]int{1, 2}`, true, "[2]int"},
+		{`
+const N = 2 * 3 - 1
+var y [N + 1]string
+var x = y`, true, "[6]string"},
+		{`
+const:
+	B = A * 2
+	A = 3
+var x [B]int
+var y = x`, true, "[6]int"},
+		{`
+const A = 1 << 10
+var x int16 = A`, true, "int16"},
+		{`
+const A = 1 << 10
+var x int8 = A`, false, ""},
+		{`
+const A = 1.5
+var x = A`, true, "float64"},
+		{`
+const A = 1.5
+var x int = A`, false, ""},
+		{`
+const A = 1
+var x float32 = A / 2.0`, true, "float32"},
+		{`
+const A int8 = 1
+var x int = A`, false, ""},
+		{`
+const A uint8 = 1
+var x = A`, true, "uint8"},
+		{`const A int8 = 300
+var x = 1`, false, ""},
+		{`var x int8 = 300`, false, ""},
+		{`var x int8 = 100 + 100`, false, ""},
+		// Only values of untyped constant expressions have to fit, not their operands.
+		{`var x int8 = 300 / 100`, true, "int8"},
+		{`
+const A = 300
+var x int8 = A / 100`, true, "int8"},
+		{`
+const A = 1 << 100
+var x = A >> 98`, true, "int"},
+		{`var x int = 2.5 * 2`, true, "int"},
+		{`var x int8 = 1000 / 5`, false, ""},
+		{`
+const A int16 = 300
+var x int8 = A / 100`, false, ""},
+		{`var x uint = -1`, false, ""},
+		{`var x int = 1 / 0`, false, ""},
+		{`
+const A = B
+const B = A
+var x = 1`, false, ""},
+		{`
+var y = 1
+const A = y
+var x = 1`, false, ""},
+		{`
+var n = 3
+var x [n]int`, false, ""},
+		{`
+const N = -1
+var x [N]int`, false, ""},
+		{`
+const A = "abc" + "def"
+var x = A`, true, "string"},
+	})
+}
+
+func TestTypesVariadic(t *testing.T) {
+	testVarTypes(t, []typeTestCase{
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var x = f("a", 1, 2, 3)`, true, "int"},
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var x = f("a")`, true, "int"},
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var s = []int{1, 2}
+var x = f("a", s...)`, true, "int"},
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var x = f()`, false, ""},
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var x = f("a", 1, "b")`, false, ""},
+		{`
+func f(a string, xs ...int) int:
+	return len(xs)
+var s = []string{"b"}
+var x = f("a", s...)`, false, ""},
+		{`
+func f(a string, xs []int) int:
+	return len(xs)
+var s = []int{1}
+var x = f("a", s...)`, false, ""},
+		{`
+func f(xs ...int) int:
+	return 0
+var g func(...int) int = f`, true, "func(...int) int"},
+		{`
+func f(xs ...int) int:
+	return 0
+var g func([]int) int = f`, false, ""},
+		{`
+var s []int
+var x = append(s, 1, 2, 3)`, true, "[]int"},
+		{`
+var s []int
+var x = append(s)`, true, "[]int"},
+		{`
+var s []int
+var x = append(s, s...)`, true, "[]int"},
+		{`
+var s []int
+var x = append(s, 1, "a")`, false, ""},
+	})
+}
+
 func TestTypesWhenStmt(t *testing.T) {
 	testVarTypes(t, []typeTestCase{
 		{`
@@ -2309,11 +2662,11 @@ var placeholder int = 0`,
 func f[T]():
 	when T
 	is int:
-		var x int = "test" # "test" can't be int, but this branch isn't typechecked
+		var x int = "test" # Fail, wrong for any T, branches that might be chosen are checked with f
 f[string]()
 var placeholder int = 0`,
-			true,
-			"int",
+			false,
+			"",
 		},
 		{`
 func f[T, K]():
@@ -2325,6 +2678,166 @@ var placeholder int = 0`,
 			true,
 			"int",
 		},
+		{`
+func first[T](x T) int:
+	when T
+	is []E:
+		var e E = x[0]
+		return 0
+	is map[K]_:
+		var keys []K
+		return len(keys)
+	is *P:
+		var p P = *x
+		return 1
+	default:
+		return 2
+var n int
+var a = first([]string{"a"}) + first(map[int]bool{}) + first(&n) + first(1)`,
+			true,
+			"int",
+		},
+		{`
+func f[T](x T) T:
+	when T
+	is []E:
+		var e E = x[0]
+		var s string = e # Fail, E is int
+	return x
+var a = f([]int{1})`,
+			false,
+			"",
+		},
+		{`
+func f[T](x T) int:
+	when T
+	is [_]int:
+		return x[0]
+	is chan _:
+		return cap(x)
+	default:
+		return 0
+var c chan bool
+var a [3]int
+var placeholder = f(a) + f(c) + f("abc")`,
+			true,
+			"int",
+		},
+		{`
+func f[T](x T) int:
+	when T
+	is []Point: # Types of the package aren't captured, even if declared later
+		return x[0].x
+	is *Point:
+		return x.x
+	default:
+		return 0
+struct Point:
+	x int
+var placeholder = f([]Point{}) + f(&Point{}) + f([]int{})`,
+			true,
+			"int",
+		},
+		{`
+func f[T](x T) int:
+	when T
+	is []Point:
+		return 1
+	default:
+		var s string = x # Fail, []int isn't []Point
+		return 0
+struct Point:
+	x int
+var placeholder = f([]int{})`,
+			false,
+			"",
+		},
+		{`
+func f[T](x T) int:
+	when T
+	is map[K]K:
+		var k K
+		return 0
+	default:
+		return 1
+var a = f(map[int]int{}) + f(map[int]string{})`,
+			true,
+			"int",
+		},
+		{`
+var x []int
+func f():
+	when []int
+	is []E: # Fail, types can be captured only from params of generics
+		pass
+var placeholder int = 0`,
+			false,
+			"",
+		},
+		{`
+var arr [2]int
+var placeholder = len([]int{}) + cap(arr) + len(&arr) + len("abc") + len(map[int]int{})`,
+			true,
+			"int",
+		},
+		{`
+var placeholder = len(1) # Fail, invalid argument for len`,
+			false,
+			"",
+		},
+		{`
+type Name string
+type Names []Name
+type Queue chan int
+func f(n Name, ns Names, q Queue) int:
+	close(q)
+	return len(n) + len(ns) + cap(ns) + len(q) + cap(q)
+var n Name, ns Names, q Queue
+var placeholder = f(n, ns, q)`,
+			true,
+			"int",
+		},
+		{`
+type Ints []int
+func f[T](x T) int:
+	when T
+	is []int:
+		return 1
+	is ~[]E:
+		var e E = x[0]
+		return 2
+	default:
+		return 3
+var placeholder = f(Ints{1}) + f([]int{1}) + f("a")`,
+			true,
+			"int",
+		},
+		{`
+type Ints []int
+func f[T](x T) int:
+	when T
+	is []E:
+		var e E = x[0]
+		return 1
+	default:
+		var s string = x # Fail, Ints isn't identical to []E
+		return 0
+var placeholder = f(Ints{1})`,
+			false,
+			"",
+		},
+		{`
+type Name string
+func f[T](x T) int:
+	when T
+	is ~Name: # Fail, Name isn't an underlying type
+		return 1
+	default:
+		return 0
+var placeholder int = 0`,
+			false,
+			"",
+		},
 	})
 }
 